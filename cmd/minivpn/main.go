@@ -10,8 +10,8 @@ import (
 	"github.com/apex/log"
 	"github.com/pborman/getopt/v2"
 
-	"github.com/ooni/minivpn/extras/ping"
-	"github.com/ooni/minivpn/vpn"
+	"openVPN/extras/ping"
+	"openVPN/vpn"
 )
 
 var (
@@ -52,6 +52,13 @@ func RunPinger(opt *vpn.Options, target string, count uint32) error {
 		return err
 	}
 	pinger.PrintStats()
+	if opt.Shaping != nil {
+		opt.Log.Infof("shaping: %s", tunnel.ShapingStats())
+	}
+	if opt.WriteLimiter != nil || opt.ReadLimiter != nil {
+		write, read := tunnel.RateLimiterStats()
+		opt.Log.Infof("shaper: write %s, read %s", write, read)
+	}
 
 	return nil
 }
@@ -62,6 +69,7 @@ func main() {
 	optTarget := getopt.StringLong("target", 't', "8.8.8.8", "Target for ICMP Ping")
 	optCount := getopt.Uint32Long("count", 'n', uint32(3), "Stop after sending these many ECHO_REQUEST packets")
 	optVerbosity := getopt.Uint16Long("verbosity", 'v', uint16(4), "Verbosity level (1 to 5, 1 is lowest)")
+	optAllowPT := getopt.ListLong("allow-pt", 0, "Pluggable transport binaries that proxy-pt can run (comma separated)")
 
 	helpFlag := getopt.Bool('h', "Display help")
 
@@ -98,11 +106,19 @@ func main() {
 	logger := &log.Logger{Level: verbosityLevel, Handler: &logHandler{Writer: os.Stderr}}
 	logger.Debugf("config file: %s", *optConfig)
 
-	opts, err := vpn.NewOptionsFromFilePath(*optConfig)
+	parser := &vpn.ConfigParser{PTBinaries: *optAllowPT}
+	opts, diagnostics, err := parser.ParseFile(*optConfig)
 	if err != nil {
 		fmt.Println("fatal: " + err.Error())
 		os.Exit(1)
 	}
+	for _, d := range diagnostics {
+		if d.Severity == vpn.SeverityInfo {
+			logger.Debugf("config: %s", d)
+		} else {
+			logger.Warnf("config: %s", d)
+		}
+	}
 	opts.Log = logger
 
 	switch args[0] {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
@@ -9,7 +10,7 @@ import (
 	"syscall"
 
 	socks5 "github.com/armon/go-socks5"
-	"github.com/ooni/minivpn/vpn"
+	"openVPN/vpn"
 )
 
 const (
@@ -17,10 +18,10 @@ const (
 	socksIP   = "127.0.0.1"
 )
 
-// ListenAndServeSocks configures a vpn dialer, and configures and runs a
-// socks5 server to use dialer.DialContext. The vpn dialer will initialize the tunnel
-// upon receiving the first proxied request, and will reuse the same session
-// for all further requests.
+// ListenAndServeSocks starts a vpn client, and configures and runs a
+// socks5 server to use the tunnel dialer's DialContext. All the proxied
+// requests reuse the same session. The client dials the remote as configured
+// in the options (e.g., through an obfs4 bridge).
 func ListenAndServeSocks(opts *vpn.Options) {
 	port := os.Getenv("LPORT")
 	if port == "" {
@@ -30,10 +31,11 @@ func ListenAndServeSocks(opts *vpn.Options) {
 	if ip == "" {
 		ip = socksIP
 	}
-	dialer, err := vpn.StartNewTunDialerFromOptions(opts, &net.Dialer{})
-	if err != nil {
+	client := vpn.NewClientFromOptions(opts)
+	if err := client.Start(context.Background()); err != nil {
 		panic(err)
 	}
+	dialer := vpn.NewTunDialer(client)
 	conf := &socks5.Config{
 		Dial: dialer.DialContext,
 	}
@@ -23,8 +23,8 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/m-lab/ndt7-client-go"
 	"github.com/m-lab/ndt7-client-go/spec"
-	"github.com/ooni/minivpn/extras/ndt7/emitter"
-	"github.com/ooni/minivpn/vpn"
+	"openVPN/extras/ndt7/emitter"
+	"openVPN/vpn"
 )
 
 const (
@@ -131,4 +131,7 @@ func RunMeasurement(d vpn.TunDialer, ndt7Server string, mode string, direct bool
 	case "upload":
 		r.runUpload(ctx)
 	}
+	if !direct {
+		log.Printf("shaping: %s", d.ShapingStats())
+	}
 }
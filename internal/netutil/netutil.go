@@ -0,0 +1,34 @@
+// Package netutil contains helpers for the connections used by the
+// transports in this module.
+package netutil
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// WatchContext applies the deadline of the passed context to conn, and
+// interrupts any blocking I/O on conn when the context is done. The caller
+// must call the returned function once it is done with the handshake; it
+// stops watching and clears the deadline.
+func WatchContext(ctx context.Context, conn net.Conn) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+		conn.SetDeadline(time.Time{})
+	}
+}
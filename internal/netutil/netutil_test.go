@@ -0,0 +1,44 @@
+package netutil
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWatchContext(t *testing.T) {
+	t.Run("cancel interrupts a blocking read", func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		stop := WatchContext(ctx, c1)
+		defer stop()
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+		}()
+		_, err := c1.Read(make([]byte, 1))
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("Read(): want %v, got %v", os.ErrDeadlineExceeded, err)
+		}
+	})
+
+	t.Run("stop clears the deadline", func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+		stop := WatchContext(ctx, c1)
+		stop()
+		time.Sleep(5 * time.Millisecond)
+		go c2.Write([]byte{1})
+		if _, err := c1.Read(make([]byte, 1)); err != nil {
+			t.Errorf("Read(): unexpected error %v", err)
+		}
+	})
+}
@@ -5,22 +5,29 @@ import (
 	"log"
 	"net"
 	"net/url"
+	"strings"
 )
 
 // Node is a proxy node, that can be used to construct a proxy chain.
 type Node struct {
-	Addr     string     // ag: I'm guessing this is used like ip:port
-	Host     string     // ... but then this is redundant
-	Protocol string     // obfs4 in this case
-	url      *url.URL   // url
-	Values   url.Values // contains the cert and iat-mode parameters
+	Addr        string     // ag: I'm guessing this is used like ip:port
+	Host        string     // ... but then this is redundant
+	Protocol    string     // obfs4 in this case
+	Fingerprint string     // the bridge fingerprint, if given in a bridge line
+	url         *url.URL   // url
+	Values      url.Values // contains the cert and iat-mode parameters
 	//Transport string     // this only makes sense if/when we do use different transporters for obfs4. for the time being this can be removed, or perhaps denoted as "raw"
 }
 
-// NewNodeNewNodeFromURI returns a configured proxy node. It accepts a string with all the parameters
+// NewNodeFromURI returns a configured proxy node. It accepts a string with all the parameters
 // needed to establish a connection to the obfs4 proxy, in the form:
 // obfs4://<ip>:<port>?cert=<deadbeef>&iat-mode=<int>
+// It also accepts a Tor bridge line, with or without the leading "Bridge":
+// obfs4 <ip>:<port> [<fingerprint>] cert=<deadbeef> iat-mode=<int>
 func NewNodeFromURI(uri string) (Node, error) {
+	if isBridgeLine(uri) {
+		return newNodeFromBridgeLine(uri)
+	}
 	u, err := url.Parse(uri)
 	if err != nil {
 		return Node{}, err
@@ -41,3 +48,49 @@ func NewNodeFromURI(uri string) (Node, error) {
 		Values:   u.Query(),
 	}, nil
 }
+
+// isBridgeLine returns true if the passed string looks like a bridge line
+// rather than an uri.
+func isBridgeLine(s string) bool {
+	fields := strings.Fields(s)
+	if len(fields) > 0 && fields[0] == "Bridge" {
+		fields = fields[1:]
+	}
+	return len(fields) > 1 && fields[0] == "obfs4"
+}
+
+// newNodeFromBridgeLine parses a Tor bridge line. The cert is taken verbatim,
+// so unlike in the uri form it does not need to be urlencoded.
+func newNodeFromBridgeLine(line string) (Node, error) {
+	fields := strings.Fields(line)
+	if fields[0] == "Bridge" {
+		fields = fields[1:]
+	}
+	host, port, err := net.SplitHostPort(fields[1])
+	if err != nil {
+		return Node{}, fmt.Errorf("bad bridge address: %w", err)
+	}
+	node := Node{
+		Protocol: fields[0],
+		Addr:     net.JoinHostPort(host, port),
+		Host:     host,
+		Values:   url.Values{},
+	}
+	for _, f := range fields[2:] {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok {
+			if node.Fingerprint != "" || len(node.Values) != 0 {
+				return Node{}, fmt.Errorf("unexpected bridge line argument: %s", f)
+			}
+			node.Fingerprint = f
+			continue
+		}
+		node.Values.Set(k, v)
+	}
+	if node.Values.Get("cert") == "" {
+		return Node{}, fmt.Errorf("bridge line without cert")
+	}
+	node.url = &url.URL{Scheme: node.Protocol, Host: node.Addr, RawQuery: node.Values.Encode()}
+	log.Printf("Using %s proxy at %s:%s", node.Protocol, host, port)
+	return node, nil
+}
@@ -0,0 +1,76 @@
+package obfs4
+
+import (
+	"testing"
+)
+
+func TestNewNodeFromURI(t *testing.T) {
+	tests := []struct {
+		name    string
+		uri     string
+		want    Node
+		wantErr bool
+	}{
+		{
+			name: "obfs4 uri",
+			uri:  "obfs4://1.2.3.4:443?cert=a%2Bb&iat-mode=0",
+			want: Node{Protocol: "obfs4", Addr: "1.2.3.4:443", Host: "1.2.3.4"},
+		},
+		{
+			name: "bridge line",
+			uri:  "obfs4 1.2.3.4:443 0123456789ABCDEF0123456789ABCDEF01234567 cert=a+b iat-mode=0",
+			want: Node{
+				Protocol:    "obfs4",
+				Addr:        "1.2.3.4:443",
+				Host:        "1.2.3.4",
+				Fingerprint: "0123456789ABCDEF0123456789ABCDEF01234567",
+			},
+		},
+		{
+			name: "torrc bridge line without fingerprint",
+			uri:  "Bridge obfs4 [::1]:443 cert=a+b iat-mode=0",
+			want: Node{Protocol: "obfs4", Addr: "[::1]:443", Host: "::1"},
+		},
+		{
+			name:    "other schemes fail",
+			uri:     "socks5://1.2.3.4:443",
+			wantErr: true,
+		},
+		{
+			name:    "bridge line without cert fails",
+			uri:     "obfs4 1.2.3.4:443 iat-mode=0",
+			wantErr: true,
+		},
+		{
+			name:    "bridge line with bad address fails",
+			uri:     "obfs4 1.2.3.4 cert=a+b iat-mode=0",
+			wantErr: true,
+		},
+		{
+			name:    "bridge line with stray argument fails",
+			uri:     "obfs4 1.2.3.4:443 cert=a+b foo",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewNodeFromURI(tt.uri)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewNodeFromURI() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.Protocol != tt.want.Protocol || got.Addr != tt.want.Addr ||
+				got.Host != tt.want.Host || got.Fingerprint != tt.want.Fingerprint {
+				t.Errorf("NewNodeFromURI() = %+v, want %+v", got, tt.want)
+			}
+			if cert := got.Values.Get("cert"); cert != "a+b" {
+				t.Errorf("NewNodeFromURI(): cert = %v, want a+b", cert)
+			}
+			if mode := got.Values.Get("iat-mode"); mode != "0" {
+				t.Errorf("NewNodeFromURI(): iat-mode = %v, want 0", mode)
+			}
+		})
+	}
+}
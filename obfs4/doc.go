@@ -2,5 +2,8 @@
 // proxy (that is configured to redirect traffic to a OpenVPN gateway belonging
 // to the gateway pool for a given provider). The raw vpn connection can be
 // then composed through the obfs4 pluggable transport.
+//
+// The package also implements the server side (Listen and Server), so that a
+// bridge in front of an OpenVPN gateway can be run without obfs4proxy.
 
 package obfs4
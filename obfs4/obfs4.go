@@ -12,7 +12,6 @@ package obfs4
 
 import (
 	"context"
-	"fmt"
 	"log"
 	"net"
 
@@ -21,39 +20,43 @@ import (
 	"gitlab.com/yawning/obfs4.git/transports/base"
 	"gitlab.com/yawning/obfs4.git/transports/obfs4"
 	"golang.org/x/net/proxy"
+
+	"openVPN/internal/netutil"
 )
 
 // The server certificate given to the client is in the following format:
 // obfs4://server_ip:443?cert=4UbQjIfjJEQHPOs8vs5sagrSXx1gfrDCGdVh2hpIPSKH0nklv1e4f29r7jb91VIrq4q5Jw&iat-mode=0'
 // be sure to urlencode the certificate you obtain from obfs4proxy or other software.
+// Alternatively, a Tor bridge line can be used (see NewNodeFromURI).
+
+// Dialer dials an obfs4 node. Each Dialer keeps its own client factory and
+// parsed arguments, so that several dialers for the same node can coexist.
+type Dialer struct {
+	// UnderlyingDialer is used to connect to the obfs4 node. If nil,
+	// proxy.Direct is used.
+	UnderlyingDialer proxy.ContextDialer
 
-type obfs4Context struct {
+	node  Node
 	cf    base.ClientFactory
 	cargs interface{} // type obfs4ClientArgs
+	err   error       // set when the client could not be initialized
 }
 
-var obfs4Map = make(map[string]obfs4Context)
-
-type Dialer struct {
-	node Node
-}
-
+// NewDialer returns a Dialer for the given node. If the node arguments
+// cannot be parsed, the error is returned by DialContext; use
+// NewDialerFromNode to get it right away.
 func NewDialer(node Node) *Dialer {
-	return &Dialer{node}
-}
-
-func (d *Dialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
-	// TODO(ainghazal): honor ctx
-	dialFn := dialer(d.node.Addr)
-	return dialFn(network, address)
-}
-
-// Obfs4ClientInit initializes the obfs4 client
-func Obfs4ClientInit(node Node) error {
-	if _, ok := obfs4Map[node.Addr]; ok {
-		return fmt.Errorf("obfs4 context already initialized")
+	d, err := NewDialerFromNode(node)
+	if err != nil {
+		return &Dialer{node: node, err: err}
 	}
+	return d
+}
 
+// NewDialerFromNode initializes the obfs4 client for the given node, and
+// returns a Dialer. It returns an error if the node arguments cannot be
+// parsed.
+func NewDialerFromNode(node Node) (*Dialer, error) {
 	t := new(obfs4.Transport)
 
 	stateDir := node.Values.Get("state-dir")
@@ -69,31 +72,67 @@ func Obfs4ClientInit(node Node) error {
 	cf, err := t.ClientFactory(stateDir)
 	if err != nil {
 		log.Println("obfs4: error on clientFactory")
-		return err
+		return nil, err
 	}
 
 	cargs, err := cf.ParseArgs(&ptArgs)
 	if err != nil {
 		log.Println("error on parseArgs:", err.Error())
-		return err
+		return nil, err
 	}
+	return &Dialer{node: node, cf: cf, cargs: cargs}, nil
+}
 
-	obfs4Map[node.Addr] = obfs4Context{cf: cf, cargs: cargs}
-	return nil
+// Obfs4ClientInit checks that the obfs4 client can be initialized for the
+// given node.
+//
+// Deprecated: NewDialerFromNode initializes the client and returns any
+// error; there is no shared state to set up anymore.
+func Obfs4ClientInit(node Node) error {
+	_, err := NewDialerFromNode(node)
+	return err
 }
 
-type DialFunc func(string, string) (net.Conn, error)
+// DialContext connects to the obfs4 node and performs the obfs4 handshake.
+// The node is expected to forward the connection to its final destination, so
+// the passed address is ignored. The handshake is interrupted if the context
+// is done, and it honours the context deadline.
+func (d *Dialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	underlying := d.UnderlyingDialer
+	if underlying == nil {
+		underlying = proxy.Direct
+	}
 
-func dialer(nodeAddr string) DialFunc {
-	oc := obfs4Map[nodeAddr]
 	// From the documentation of the ClientFactory interface:
 	// https://github.com/Yawning/obfs4/blob/master/transports/base/base.go#L42
 	// Dial creates an outbound net.Conn, and does whatever is required
 	// (eg: handshaking) to get the connection to the point where it is
 	// ready to relay data.
 	// Dial(network, address string, dialFn DialFunc, args interface{}) (net.Conn, error)
-	dialFn := proxy.Direct.Dial
-	return func(network, address string) (net.Conn, error) {
-		return oc.cf.Dial(network, nodeAddr, dialFn, oc.cargs)
+	//
+	// The obfs4 conn does not support deadlines, so we keep a reference to
+	// the raw conn to interrupt the handshake.
+	var stop func()
+	dialFn := func(network, address string) (net.Conn, error) {
+		conn, err := underlying.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		stop = netutil.WatchContext(ctx, conn)
+		return conn, nil
+	}
+	conn, err := d.cf.Dial(network, d.node.Addr, dialFn, d.cargs)
+	if stop != nil {
+		stop()
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
 	}
+	return conn, nil
 }
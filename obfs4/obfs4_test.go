@@ -0,0 +1,126 @@
+package obfs4
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// testingNode returns a node with a syntactically valid cert.
+func testingNode(t *testing.T, addr string) Node {
+	cert := base64.RawStdEncoding.EncodeToString(make([]byte, 52))
+	node, err := NewNodeFromURI("obfs4 " + addr + " cert=" + cert + " iat-mode=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+func TestNewDialerFromNode(t *testing.T) {
+	node := testingNode(t, "127.0.0.1:443")
+	if _, err := NewDialerFromNode(node); err != nil {
+		t.Fatalf("NewDialerFromNode() error = %v", err)
+	}
+	// a second dialer for the same node is fine
+	if _, err := NewDialerFromNode(node); err != nil {
+		t.Fatalf("NewDialerFromNode() error = %v", err)
+	}
+
+	node.Values.Set("cert", "foo")
+	if _, err := NewDialerFromNode(node); err == nil {
+		t.Errorf("NewDialerFromNode(): expected error with bad cert")
+	}
+}
+
+func TestNewDialer(t *testing.T) {
+	if d := NewDialer(testingNode(t, "127.0.0.1:443")); d == nil || d.err != nil {
+		t.Fatalf("NewDialer() = %+v", d)
+	}
+
+	node := testingNode(t, "127.0.0.1:443")
+	node.Values.Set("cert", "foo")
+	d := NewDialer(node)
+	if d == nil {
+		t.Fatal("NewDialer(): expected a dialer with bad cert")
+	}
+	if _, err := d.DialContext(context.Background(), "tcp", "ignored:1194"); err == nil {
+		t.Errorf("DialContext(): expected error with bad cert")
+	}
+}
+
+func TestObfs4ClientInit(t *testing.T) {
+	node := testingNode(t, "127.0.0.1:443")
+	// unlike the old package map, initializing twice is fine
+	for i := 0; i < 2; i++ {
+		if err := Obfs4ClientInit(node); err != nil {
+			t.Fatalf("Obfs4ClientInit() error = %v", err)
+		}
+	}
+	node.Values.Set("cert", "foo")
+	if err := Obfs4ClientInit(node); err == nil {
+		t.Errorf("Obfs4ClientInit(): expected error with bad cert")
+	}
+}
+
+type mockContextDialer struct {
+	called  bool
+	address string
+}
+
+func (d *mockContextDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.called = true
+	d.address = address
+	return nil, errors.New("mocked error")
+}
+
+func TestDialer_DialContext(t *testing.T) {
+	t.Run("uses the underlying dialer to reach the node", func(t *testing.T) {
+		d, err := NewDialerFromNode(testingNode(t, "127.0.0.1:443"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		underlying := &mockContextDialer{}
+		d.UnderlyingDialer = underlying
+		if _, err := d.DialContext(context.Background(), "tcp", "10.0.0.1:1194"); err == nil {
+			t.Errorf("DialContext(): expected error")
+		}
+		if !underlying.called || underlying.address != "127.0.0.1:443" {
+			t.Errorf("DialContext(): underlying dialer not called for the node: %+v", underlying)
+		}
+	})
+
+	t.Run("handshake honours the context deadline", func(t *testing.T) {
+		// a node that accepts connections but never answers
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		go func() {
+			for {
+				c, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer c.Close()
+			}
+		}()
+		d, err := NewDialerFromNode(testingNode(t, ln.Addr().String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err = d.DialContext(ctx, "tcp", "")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("DialContext(): want %v, got %v", context.DeadlineExceeded, err)
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Errorf("DialContext(): took too long")
+		}
+	})
+}
@@ -0,0 +1,213 @@
+package obfs4
+
+//
+// obfs4 server side, to run self-hosted bridges in front of an OpenVPN
+// gateway.
+//
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	pt "git.torproject.org/pluggable-transports/goptlib.git"
+
+	"gitlab.com/yawning/obfs4.git/transports/base"
+	"gitlab.com/yawning/obfs4.git/transports/obfs4"
+	"golang.org/x/net/proxy"
+)
+
+// Listener is a net.Listener that accepts obfs4 connections. The obfs4
+// handshake is done in the background, so that a slow or bogus client does
+// not block Accept; connections that fail the handshake are dropped.
+type Listener struct {
+	net.Listener
+
+	sf    base.ServerFactory
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+
+	// acceptErr is set, and failed closed, when the inner listener fails.
+	acceptErr error
+	failed    chan struct{}
+}
+
+// Listen announces on the local network address, and returns a Listener for
+// obfs4 connections. The bridge identity (node id, keys and drbg seed) is
+// read from the obfs4_state.json file in stateDir, and generated there if the
+// file does not exist yet. The directory must exist. Reusing a stateDir keeps
+// the same bridge cert across restarts.
+func Listen(network, address, stateDir string) (*Listener, error) {
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	l, err := NewListener(ln, stateDir)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// NewListener returns a Listener that performs the obfs4 handshake on the
+// connections accepted by inner. See Listen for the meaning of stateDir.
+func NewListener(inner net.Listener, stateDir string) (*Listener, error) {
+	t := new(obfs4.Transport)
+	sf, err := t.ServerFactory(stateDir, &pt.Args{})
+	if err != nil {
+		return nil, fmt.Errorf("obfs4: cannot init server: %w", err)
+	}
+	l := &Listener{
+		Listener: inner,
+		sf:       sf,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+		failed:   make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l, nil
+}
+
+// acceptLoop accepts connections from the inner listener, and starts a
+// handshake for each of them.
+func (l *Listener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.acceptErr = err
+			close(l.failed)
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+// handshake performs the server side of the obfs4 handshake, and hands the
+// conn to Accept.
+func (l *Listener) handshake(conn net.Conn) {
+	oc, err := l.sf.WrapConn(conn)
+	if err != nil {
+		// WrapConn closes the conn after a random delay.
+		log.Printf("obfs4: handshake with %s failed: %s", conn.RemoteAddr(), err)
+		return
+	}
+	select {
+	case l.conns <- oc:
+	case <-l.done:
+		oc.Close()
+	}
+}
+
+// Accept waits for and returns the next obfs4 connection, once the handshake
+// is done.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-l.failed:
+		return nil, l.acceptErr
+	}
+}
+
+// Close stops listening. Connections already returned by Accept are not
+// closed.
+func (l *Listener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// Cert returns the bridge cert that clients need to connect.
+func (l *Listener) Cert() string {
+	cert, _ := l.sf.Args().Get("cert")
+	return cert
+}
+
+// BridgeLine returns the bridge line that clients can use to connect to this
+// bridge at addr, for instance as the argument of proxy-obfs4. If addr is
+// empty, the listener address is used.
+func (l *Listener) BridgeLine(addr string) string {
+	if addr == "" {
+		addr = l.Addr().String()
+	}
+	iatMode, _ := l.sf.Args().Get("iat-mode")
+	return fmt.Sprintf("obfs4 %s cert=%s iat-mode=%s", addr, l.Cert(), iatMode)
+}
+
+// Node returns a Node to connect to this bridge at the listener address.
+func (l *Listener) Node() (Node, error) {
+	return NewNodeFromURI(l.BridgeLine(""))
+}
+
+// Server forwards the connections accepted on an obfs4 Listener to an
+// OpenVPN endpoint. Since obfs4 is a stream transport, the endpoint must be
+// an OpenVPN server using proto tcp.
+type Server struct {
+	// Forward is the host:port of the OpenVPN endpoint.
+	Forward string
+	// Dialer is used to connect to Forward. If nil, proxy.Direct is used.
+	Dialer proxy.ContextDialer
+}
+
+// Serve accepts connections on the listener and forwards each of them to the
+// OpenVPN endpoint. It returns when the listener fails; after the listener is
+// closed, the returned error is net.ErrClosed.
+func (s *Server) Serve(l net.Listener) error {
+	if s.Forward == "" {
+		return errors.New("obfs4: no address to forward to")
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.forward(conn)
+	}
+}
+
+// ListenAndServe listens on the local network address with Listen, and calls
+// Serve. It blocks until the listener fails.
+func (s *Server) ListenAndServe(network, address, stateDir string) error {
+	l, err := Listen(network, address, stateDir)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	log.Printf("obfs4: bridge line: %s", l.BridgeLine(""))
+	return s.Serve(l)
+}
+
+// forward connects to the endpoint and copies data in both directions until
+// either side is done.
+func (s *Server) forward(conn net.Conn) {
+	defer conn.Close()
+	dialer := s.Dialer
+	if dialer == nil {
+		dialer = proxy.Direct
+	}
+	upstream, err := dialer.DialContext(context.Background(), "tcp", s.Forward)
+	if err != nil {
+		log.Printf("obfs4: cannot reach %s: %s", s.Forward, err)
+		return
+	}
+	defer upstream.Close()
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+var _ net.Listener = &Listener{} // Ensure that we implement net.Listener
@@ -0,0 +1,126 @@
+package obfs4
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func startEchoServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestListen_stateIsKept(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Listen("tcp", "127.0.0.1:0", dir)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	cert := l.Cert()
+	l.Close()
+	if cert == "" {
+		t.Fatal("Cert(): empty cert")
+	}
+
+	l, err = Listen("tcp", "127.0.0.1:0", dir)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer l.Close()
+	if l.Cert() != cert {
+		t.Errorf("Cert(): got %v, want %v", l.Cert(), cert)
+	}
+	if _, err := l.Node(); err != nil {
+		t.Errorf("Node() error = %v", err)
+	}
+}
+
+func TestListener_Close(t *testing.T) {
+	l, err := Listen("tcp", "127.0.0.1:0", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept(): want %v, got %v", net.ErrClosed, err)
+	}
+}
+
+func TestServer_loopback(t *testing.T) {
+	echo := startEchoServer(t)
+	l, err := Listen("tcp", "127.0.0.1:0", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	srv := &Server{Forward: echo}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+
+	node, err := l.Node()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDialerFromNode(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := d.DialContext(ctx, "tcp", "ignored:1194")
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	defer conn.Close()
+	if conn.LocalAddr().Network() != "tcp" {
+		t.Errorf("LocalAddr(): network = %v, want tcp", conn.LocalAddr().Network())
+	}
+
+	msg := []byte("alles ist green")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(got) != string(msg) {
+		t.Errorf("echo: got %q, want %q", got, msg)
+	}
+
+	l.Close()
+	if err := <-served; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Serve(): want %v, got %v", net.ErrClosed, err)
+	}
+}
+
+func TestServer_Serve_noForward(t *testing.T) {
+	l, err := Listen("tcp", "127.0.0.1:0", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := (&Server{}).Serve(l); err == nil {
+		t.Errorf("Serve(): expected error without Forward")
+	}
+}
@@ -0,0 +1,105 @@
+package vpn
+
+//
+// Binding of the outer (TCP/UDP) socket to a local address, port or interface.
+//
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+var (
+	// ErrBindNotSupported is returned when the requested socket options
+	// cannot be set on the current platform.
+	ErrBindNotSupported = errors.New("socket option not supported on this platform")
+)
+
+// BindDialer is a DialerContext that binds the outer socket before
+// connecting to the remote. It can bind to a local address and port, and on
+// Linux also to a network interface (SO_BINDTODEVICE) and set a socket mark
+// (SO_MARK). The zero value behaves like a bare net.Dialer.
+type BindDialer struct {
+	// LocalAddr is the local IP address (or hostname) to bind to.
+	LocalAddr string
+	// LocalPort is the local port to bind to.
+	LocalPort string
+	// Interface is the name of the network interface to bind to.
+	Interface string
+	// Mark is the firewall mark to set on the socket, if not zero.
+	Mark int
+}
+
+// NewBindDialerFromOptions returns a BindDialer configured from the
+// local, lport, nobind, bind-dev and mark options.
+func NewBindDialerFromOptions(o *Options) *BindDialer {
+	d := &BindDialer{
+		Interface: o.BindDev,
+		Mark:      o.Mark,
+	}
+	if !o.NoBind {
+		d.LocalAddr = o.Local
+		d.LocalPort = o.LPort
+	}
+	return d
+}
+
+// needsBind returns true if the options ask for anything other than the
+// default dialer.
+func (o *Options) needsBind() bool {
+	if !o.NoBind && (o.Local != "" || o.LPort != "") {
+		return true
+	}
+	return o.BindDev != "" || o.Mark != 0
+}
+
+// DialContext binds the socket as configured and connects to the address on
+// the named network.
+func (d *BindDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	if d.LocalAddr != "" || d.LocalPort != "" {
+		laddr, err := d.resolveLocalAddr(network)
+		if err != nil {
+			return nil, err
+		}
+		dialer.LocalAddr = laddr
+	}
+	if d.Interface != "" || d.Mark != 0 {
+		dialer.Control = d.control
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// resolveLocalAddr returns the local net.Addr matching the passed network.
+func (d *BindDialer) resolveLocalAddr(network string) (net.Addr, error) {
+	port := d.LocalPort
+	if port == "" {
+		port = "0"
+	}
+	hostport := net.JoinHostPort(d.LocalAddr, port)
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return net.ResolveTCPAddr(network, hostport)
+	case "udp", "udp4", "udp6":
+		return net.ResolveUDPAddr(network, hostport)
+	default:
+		return nil, fmt.Errorf("%w: cannot bind network %s", errBadInput, network)
+	}
+}
+
+// control is passed to net.Dialer to set the socket options before connect.
+func (d *BindDialer) control(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = setSocketOptions(fd, d.Interface, d.Mark)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+var _ DialerContext = &BindDialer{} // Ensure that we implement DialerContext
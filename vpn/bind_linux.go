@@ -0,0 +1,24 @@
+//go:build linux
+
+package vpn
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// setSocketOptions binds the socket to the given interface and sets the
+// given mark, if they are not empty.
+func setSocketOptions(fd uintptr, iface string, mark int) error {
+	if iface != "" {
+		if err := syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface); err != nil {
+			return fmt.Errorf("cannot bind to device %s: %w", iface, err)
+		}
+	}
+	if mark != 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark); err != nil {
+			return fmt.Errorf("cannot set mark %d: %w", mark, err)
+		}
+	}
+	return nil
+}
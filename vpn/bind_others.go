@@ -0,0 +1,16 @@
+//go:build !linux
+
+package vpn
+
+import "fmt"
+
+// setSocketOptions fails if any of the Linux-only socket options is requested.
+func setSocketOptions(fd uintptr, iface string, mark int) error {
+	if iface != "" {
+		return fmt.Errorf("%w: bind-dev", ErrBindNotSupported)
+	}
+	if mark != 0 {
+		return fmt.Errorf("%w: mark", ErrBindNotSupported)
+	}
+	return nil
+}
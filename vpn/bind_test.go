@@ -0,0 +1,62 @@
+package vpn
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestBindDialer_DialContext(t *testing.T) {
+	t.Run("tcp binds to the local address", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		go func() {
+			c, err := ln.Accept()
+			if err == nil {
+				c.Close()
+			}
+		}()
+
+		d := &BindDialer{LocalAddr: "127.0.0.1"}
+		conn, err := d.DialContext(context.Background(), "tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("DialContext() error = %v", err)
+		}
+		defer conn.Close()
+		if ip := conn.LocalAddr().(*net.TCPAddr).IP.String(); ip != "127.0.0.1" {
+			t.Errorf("DialContext(): local ip = %v, want 127.0.0.1", ip)
+		}
+	})
+
+	t.Run("udp binds to the local port", func(t *testing.T) {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := strconv.Itoa(pc.LocalAddr().(*net.UDPAddr).Port)
+		// free the port so that we can bind to it
+		pc.Close()
+
+		d := &BindDialer{LocalAddr: "127.0.0.1", LocalPort: port}
+		conn, err := d.DialContext(context.Background(), "udp", "127.0.0.1:1194")
+		if err != nil {
+			t.Fatalf("DialContext() error = %v", err)
+		}
+		defer conn.Close()
+		if got := strconv.Itoa(conn.LocalAddr().(*net.UDPAddr).Port); got != port {
+			t.Errorf("DialContext(): local port = %v, want %v", got, port)
+		}
+	})
+
+	t.Run("unknown network fails", func(t *testing.T) {
+		d := &BindDialer{LocalAddr: "127.0.0.1"}
+		_, err := d.DialContext(context.Background(), "unix", "/tmp/foo")
+		if err == nil {
+			t.Errorf("DialContext(): expected error")
+		}
+	})
+}
@@ -34,6 +34,18 @@ type tunnelInfo struct {
 	ip     string
 	gw     string
 	peerID int
+	// hasPeerID is set when the server pushed a peer-id.
+	hasPeerID bool
+	// netmask is the netmask of ip, when the server pushes one (topology
+	// subnet, or tap), and routeGw is the pushed route-gateway.
+	netmask string
+	routeGw string
+	// ip6 is the pushed IPv6 address, in prefix form, and gw6 the IPv6
+	// gateway.
+	ip6 string
+	gw6 string
+	// info is the public view of the tunnel configuration.
+	info *TunnelInfo
 }
 
 // vpnClient is a net.Conn that uses the VPN tunnel. It is a net.Conn with an
@@ -81,6 +93,17 @@ type Client struct {
 	// for testing.
 	muxerFactoryFn muxFactory
 
+	// shaper applies the shaping policy in Opts, if any, and coverDone
+	// stops the cover traffic.
+	shaper    *shaper
+	coverDone chan struct{}
+
+	// hopper is the outer conn when port hopping is enabled.
+	hopper *hoppingConn
+
+	// mtuTestDone stops the mtu-test.
+	mtuTestDone chan struct{}
+
 	startOnce sync.Once
 	startErr  error
 }
@@ -96,10 +119,51 @@ func NewClientFromOptions(opt *Options) *Client {
 	return &Client{
 		Opts:    opt,
 		tunInfo: &tunnelInfo{},
-		Dialer:  &net.Dialer{},
+		Dialer:  newDialerFromOptions(opt),
 	}
 }
 
+// newDialerFromOptions returns the default DialerContext for a Client
+// configured with the passed options. The returned dialer binds the outer
+// socket if requested, and goes through any configured proxy. An obfs4 bridge,
+// a websocket relay or an outer TLS session, if any, goes through that proxy. A pluggable
+// transport, if any, is given the proxy and dials on its own.
+func newDialerFromOptions(o *Options) DialerContext {
+	if o.ProxyPT != "" {
+		return NewPTDialerFromOptions(o)
+	}
+	var dialer DialerContext = &net.Dialer{}
+	if o.needsBind() {
+		dialer = NewBindDialerFromOptions(o)
+	}
+	switch {
+	case o.SOCKSProxy != "":
+		dialer = &SOCKS5Dialer{
+			Addr:     o.SOCKSProxy,
+			Username: o.SOCKSProxyUser,
+			Password: o.SOCKSProxyPass,
+			Dialer:   dialer,
+		}
+	case o.HTTPProxy != "":
+		dialer = &HTTPProxyDialer{
+			Addr:       o.HTTPProxy,
+			Username:   o.HTTPProxyUser,
+			Password:   o.HTTPProxyPass,
+			AuthMethod: o.HTTPProxyAuth,
+			Dialer:     dialer,
+		}
+	}
+	switch {
+	case o.ProxyOBFS4 != "":
+		dialer = newOBFS4Dialer(o.ProxyOBFS4, dialer)
+	case o.ProxyWebSocket != "":
+		dialer = NewWebSocketDialerFromOptions(o, dialer)
+	case o.ProxyTLS:
+		dialer = NewTLSDialerFromOptions(o, dialer)
+	}
+	return dialer
+}
+
 //
 // observability
 //
@@ -150,13 +214,52 @@ func (c *Client) start(ctx context.Context) error {
 
 	c.conn = conn
 	c.mux = mux
+
+	if c.hopper != nil {
+		c.startHopping(mux)
+	}
+	if c.shaper != nil && c.shaper.policy.CoverInterval > 0 {
+		if w, ok := mux.(pingWriter); ok {
+			c.coverDone = make(chan struct{})
+			go c.shaper.sendCover(w, c.coverDone)
+		}
+	}
+	if c.Opts != nil && c.Opts.MTUTest {
+		if om, ok := mux.(occMuxer); ok {
+			_, linkMTU, _ := c.Opts.devMTUs()
+			c.mtuTestDone = make(chan struct{})
+			go om.occState().runMTUTest(linkMTU, c.mtuTestDone)
+		}
+	}
 	return nil
 }
 
-// muxerFactory returns the default muxer Factory, or any other one that has
-// been injected into the `muxerFactoryFn` private field in Client for testing.
+// startHopping starts port hopping, if the server assigned us a peer-id.
+// Without one, data packets are sent as P_DATA_V1, and the server would not
+// follow us to a new address, so the hopping is disabled.
+func (c *Client) startHopping(mux vpnMuxer) {
+	if !c.tunInfo.hasPeerID {
+		logger.Warn("port-hop: disabled, the server did not push a peer-id")
+		return
+	}
+	if w, ok := mux.(pingWriter); ok {
+		c.hopper.setOnHop(func() {
+			if err := w.writePing(); err != nil {
+				logger.Warnf("port-hop: cannot send ping: %s", err)
+			}
+		})
+	}
+	c.hopper.start()
+}
+
+// muxerFactory returns the default muxer Factory (the static key one, if the
+// options configure a secret), or any other one that has been injected into
+// the `muxerFactoryFn` private field in Client for testing.
 func (c *Client) muxerFactory() muxFactory {
 	muxFactory := newMuxerFromOptions
+	if c.Opts != nil && c.Opts.staticKeyMode() {
+		muxFactory = newStaticKeyMuxerFromOptions
+	}
 	if c.muxerFactoryFn == nil {
 		return muxFactory
 	}
@@ -181,6 +284,22 @@ func (c *Client) dial(ctx context.Context) (net.Conn, error) {
 		return nil, fmt.Errorf("%w: unknown proto %d", errBadInput, c.Opts.Proto)
 
 	}
+	if c.Opts.PortHopInterval > 0 {
+		if c.Opts.Proto != UDPMode {
+			return nil, fmt.Errorf("%w: %s", errBadInput, "port-hop needs proto udp")
+		}
+		if c.Opts.LPort != "" && !c.Opts.NoBind {
+			return nil, fmt.Errorf("%w: %s", errBadInput, "port-hop cannot be used with lport")
+		}
+	}
+	_, _, tunMTU := c.Opts.devMTUs()
+	if err := c.Opts.Shaping.checkMTU(tunMTU); err != nil {
+		return nil, err
+	}
+
+	if c.Dialer == nil {
+		c.Dialer = newDialerFromOptions(c.Opts)
+	}
 
 	select {
 	case <-ctx.Done():
@@ -194,13 +313,37 @@ func (c *Client) dial(ctx context.Context) (net.Conn, error) {
 		if err != nil {
 			return nil, fmt.Errorf("%w: %s", ErrDialError, err)
 		}
+		if c.Opts.PortHopInterval > 0 {
+			c.hopper = newHoppingConnFromOptions(c.Opts, c.Dialer, conn)
+			conn = c.hopper
+		}
+		if s := newScramblerFromOptions(c.Opts); s != nil {
+			sconn, err := newScrambleConn(conn, s)
+			if err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("%w: %s", ErrDialError, err)
+			}
+			conn = sconn
+		}
+		c.shaper = newShaperFromOptions(c.Opts)
+		if c.shaper != nil && c.shaper.policy.MaxJitter > 0 {
+			conn = &shapedConn{Conn: conn, s: c.shaper}
+		}
 		return conn, nil
 	}
 }
 
-// Write sends bytes into the tunnel.
+// Write sends bytes into the tunnel. If the shaping policy has size buckets,
+// the packet is padded before it is encrypted; the returned count is still
+// the one of the passed bytes.
 func (c *Client) Write(b []byte) (int, error) {
-	return c.mux.Write(b)
+	if c.shaper == nil {
+		return c.mux.Write(b)
+	}
+	if _, err := c.mux.Write(c.shaper.pad(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
 }
 
 // Read reads bytes from the tunnel.
@@ -212,14 +355,56 @@ func (c *Client) Read(b []byte) (int, error) {
 	return c.mux.Read(b)
 }
 
-// Close closes the tunnel connection.
+// Close closes the tunnel connection, stops the cover traffic and the
+// mtu-test, and stops any pluggable transport the Dialer started. With
+// explicit-exit-notify, it first tells the remote that we exit.
 func (c *Client) Close() error {
+	if c.coverDone != nil {
+		close(c.coverDone)
+		c.coverDone = nil
+	}
+	if c.mtuTestDone != nil {
+		close(c.mtuTestDone)
+		c.mtuTestDone = nil
+	}
+	if c.Opts != nil && c.Opts.ExplicitExitNotify > 0 && c.Opts.Proto != TCPMode {
+		if om, ok := c.mux.(occMuxer); ok {
+			om.occState().sendExit(c.Opts.ExplicitExitNotify)
+		}
+	}
+	if pt, ok := c.Dialer.(*PTDialer); ok {
+		pt.Close()
+	}
 	if c.conn != nil {
 		return c.conn.Close()
 	}
 	return nil
 }
 
+// MTUTestResult returns the result of the mtu-test, and false if it did not
+// complete (yet).
+func (c *Client) MTUTestResult() (MTUTestResult, bool) {
+	if om, ok := c.mux.(occMuxer); ok && om.occState() != nil {
+		return om.occState().mtuTestResult()
+	}
+	return MTUTestResult{}, false
+}
+
+// ShapingStats returns what the shaping policy did so far. It returns the
+// zero value if there is no policy.
+func (c *Client) ShapingStats() ShapingStats {
+	return c.shaper.stats()
+}
+
+// RateLimiterStats returns the stats of the rate limiters for outgoing and
+// incoming data packets. The zero value is returned for a missing limiter.
+func (c *Client) RateLimiterStats() (write, read RateLimiterStats) {
+	if c.Opts == nil {
+		return
+	}
+	return c.Opts.WriteLimiter.Stats(), c.Opts.ReadLimiter.Stats()
+}
+
 // LocalAddr returns the local address on the tunnel virtual device, if known.
 // In case the Addr is not known, a zero-value net.Addr will be returned.
 func (c *Client) LocalAddr() net.Addr {
@@ -232,6 +417,16 @@ func (c *Client) LocalAddr() net.Addr {
 	return addr
 }
 
+// TunnelInfo returns the tunnel configuration that the server pushed, or
+// the one given with ifconfig in static key mode. It returns the zero value
+// before the tunnel is started.
+func (c *Client) TunnelInfo() TunnelInfo {
+	if c.tunInfo == nil || c.tunInfo.info == nil {
+		return TunnelInfo{}
+	}
+	return *c.tunInfo.info
+}
+
 // RemoteAddr returns the address of the tun interface of the tunnel gateway,
 // if known. In case the Addr is not known, a zero-value net.Addr will be returned.
 func (c *Client) RemoteAddr() net.Addr {
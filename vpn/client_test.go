@@ -37,6 +37,89 @@ func TestNewClientFromOptions(t *testing.T) {
 	})
 }
 
+func Test_newDialerFromOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts *Options
+		want DialerContext
+	}{
+		{
+			name: "no bind options returns a net.Dialer",
+			opts: &Options{},
+			want: &net.Dialer{},
+		},
+		{
+			name: "nobind ignores local and lport",
+			opts: &Options{Local: "127.0.0.1", LPort: "1194", NoBind: true},
+			want: &net.Dialer{},
+		},
+		{
+			name: "local and lport return a BindDialer",
+			opts: &Options{Local: "127.0.0.1", LPort: "1194"},
+			want: &BindDialer{LocalAddr: "127.0.0.1", LocalPort: "1194"},
+		},
+		{
+			name: "nobind keeps bind-dev and mark",
+			opts: &Options{Local: "127.0.0.1", NoBind: true, BindDev: "eth0", Mark: 1},
+			want: &BindDialer{Interface: "eth0", Mark: 1},
+		},
+		{
+			name: "http-proxy wraps the bind dialer",
+			opts: &Options{LPort: "1194", HTTPProxy: "10.0.0.1:3128", HTTPProxyUser: "u", HTTPProxyPass: "p", HTTPProxyAuth: "basic"},
+			want: &HTTPProxyDialer{
+				Addr: "10.0.0.1:3128", Username: "u", Password: "p", AuthMethod: "basic",
+				Dialer: &BindDialer{LocalPort: "1194"},
+			},
+		},
+		{
+			name: "socks-proxy wraps the default dialer",
+			opts: &Options{SOCKSProxy: "127.0.0.1:1080"},
+			want: &SOCKS5Dialer{Addr: "127.0.0.1:1080", Dialer: &net.Dialer{}},
+		},
+		{
+			name: "proxy-pt is given the socks-proxy",
+			opts: &Options{
+				ProxyPT: "stub", ProxyPTCmd: []string{"stub-client"}, ProxyPTArgs: []string{"k=v"},
+				SOCKSProxy: "127.0.0.1:1080", SOCKSProxyUser: "u", SOCKSProxyPass: "p",
+			},
+			want: &PTDialer{
+				Name: "stub", Command: []string{"stub-client"}, Args: []string{"k=v"},
+				Proxy: "socks5://u:p@127.0.0.1:1080",
+			},
+		},
+		{
+			name: "proxy-websocket wraps the http-proxy",
+			opts: &Options{
+				HTTPProxy: "10.0.0.1:3128", ProxyWebSocket: "wss://relay.example.com/vpn",
+				ProxyWebSocketHost: "cdn.example.com", ProxyWebSocketFingerprint: "chrome",
+			},
+			want: &WebSocketDialer{
+				URL: "wss://relay.example.com/vpn", Host: "cdn.example.com", Fingerprint: "chrome",
+				Dialer: &HTTPProxyDialer{Addr: "10.0.0.1:3128", Dialer: &net.Dialer{}},
+			},
+		},
+		{
+			name: "proxy-tls wraps the default dialer",
+			opts: &Options{
+				ProxyTLS: true, ProxyTLSServerName: "stunnel.example.com", ProxyTLSFingerprint: "chrome",
+				ProxyTLSALPN: []string{"http/1.1"}, ProxyTLSPins: []string{"sha256//pin"},
+			},
+			want: &TLSDialer{
+				ServerName: "stunnel.example.com", Fingerprint: "chrome",
+				ALPN: []string{"http/1.1"}, Pins: []string{"sha256//pin"},
+				Dialer: &net.Dialer{},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newDialerFromOptions(tt.opts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("newDialerFromOptions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 type mockMuxerForClient struct {
 	muxer
 	writeCalled bool
@@ -163,6 +246,27 @@ func TestClient_Close(t *testing.T) {
 	}
 }
 
+func TestClient_dialScramble(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	c := NewClientFromOptions(&Options{
+		Remote: host, Port: port, Proto: TCPMode,
+		ScrambleMethod: scrambleObfuscate, ScrambleMask: "s3cr3t",
+	})
+	conn, err := c.dial(context.Background())
+	if err != nil {
+		t.Fatalf("Client.dial() error = %v", err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*scrambleConn); !ok {
+		t.Errorf("Client.dial(): expected a scrambleConn, got %T", conn)
+	}
+}
+
 type badDialer struct{}
 
 func (bd *badDialer) DialContext(context.Context, string, string) (net.Conn, error) {
@@ -0,0 +1,529 @@
+package vpn
+
+//
+// The grammar of the config files, as in the reference implementation: how a
+// line is split in tokens, the inline files, and the <connection> blocks.
+//
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// connectionDirectives are the directives that a <connection> block can
+// contain, among the ones that we support.
+var connectionDirectives = []string{
+	"remote", "port", "rport", "proto", "local", "lport", "bind", "nobind",
+	"http-proxy", "socks-proxy", "explicit-exit-notify",
+}
+
+// Connection is a <connection> block of the config file: a remote, with the
+// options that only apply when connecting to it. The options returned by the
+// parser use the first one; WithConnection returns the options for another.
+type Connection struct {
+	Remote string
+	Port   string
+	Proto  int
+
+	// apply parses the directives of the block on top of some options.
+	apply func(*Options) error
+}
+
+// WithConnection returns a copy of the options that uses the i-th
+// <connection> block of the config file. The settings of the block, and the
+// ones that it does not set, are the same as if the block came first.
+func (o *Options) WithConnection(i int) (*Options, error) {
+	if i < 0 || i >= len(o.Connections) {
+		return nil, fmt.Errorf("%w: no connection %d", errBadInput, i)
+	}
+	c := *o
+	if err := o.Connections[i].apply(&c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// configDirective is a directive of the config file: the option name, its
+// arguments, and the line it comes from, starting at 1.
+type configDirective struct {
+	lineno int
+	key    string
+	args   []string
+}
+
+// ConfigParser parses config files. The zero value is lenient, reads from
+// the disk, and only allows the files below the directory of the config file.
+type ConfigParser struct {
+	// Mode tells how to treat the directives that minivpn does not
+	// support.
+	Mode ParseMode
+
+	// FS, if not nil, holds the config files and the files that they
+	// refer to, instead of the disk. The files that a config file refers
+	// to are read when parsing, and stored in the options as if they were
+	// inline.
+	FS fs.FS
+
+	// Paths tells which files a config file can refer to.
+	Paths PathPolicy
+
+	// PTBinaries are the pluggable transport binaries that a proxy-pt
+	// directive can run. A config file cannot start any program by
+	// default: a proxy-pt directive for another binary fails in strict
+	// mode, and is dropped with a security diagnostic in lenient mode.
+	PTBinaries []string
+}
+
+// ParseFile parses the config file at name, on disk or in FS. It returns the
+// options, and the diagnostics about what minivpn ignores in the file. In
+// strict mode, a directive that would get a warning or error diagnostic fails
+// the parsing.
+func (cp *ConfigParser) ParseFile(name string) (*Options, []Diagnostic, error) {
+	var (
+		f   io.ReadCloser
+		dir string
+		err error
+	)
+	if cp.FS == nil {
+		f, err = os.Open(name) //#nosec G304
+		dir, _ = filepath.Split(name)
+	} else {
+		f, err = cp.FS.Open(name)
+		dir = path.Dir(name)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	return cp.Parse(f, dir)
+}
+
+// Parse parses a config file that it reads from r, as ParseFile. The files
+// that it refers to with a relative path are in dir, on disk or in FS.
+func (cp *ConfigParser) Parse(r io.Reader, dir string) (*Options, []Diagnostic, error) {
+	lines, err := readLines(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cp.parseLines(lines, &configFiles{dir: dir, fsys: cp.FS, policy: cp.Paths})
+}
+
+// getOptionsFromLines tries to parse all the lines coming from a config file
+// and raises validation errors if the values do not conform to the expected
+// format. What minivpn ignores is logged.
+func getOptionsFromLines(lines []string, dir string) (*Options, error) {
+	opt, diagnostics, err := (&ConfigParser{}).parseLines(lines, newConfigFiles(dir))
+	if err != nil {
+		return nil, err
+	}
+	logDiagnostics(diagnostics)
+	return opt, nil
+}
+
+// parseLines parses the lines of a config file, that refers to other files
+// with files. The config file supports inline files, as in <ca>...</ca>, and
+// <connection> blocks.
+func (cp *ConfigParser) parseLines(lines []string, files *configFiles) (*Options, []Diagnostic, error) {
+	opt := &Options{}
+	var (
+		blocks      [][]configDirective
+		diagnostics []Diagnostic
+	)
+
+	// diagnose records the diagnostic for a directive, if any, and
+	// returns an error if strict mode does not accept it.
+	diagnose := func(key string, lineno int, supported bool) error {
+		d := diagnoseDirective(key, lineno, supported)
+		if d == nil {
+			return nil
+		}
+		if cp.Mode == ParseStrict && d.Severity != SeverityInfo {
+			return fmt.Errorf("%w: %s", errBadCfg, d)
+		}
+		diagnostics = append(diagnostics, *d)
+		return nil
+	}
+
+	for i := 0; i < len(lines); i++ {
+		l, lineno := lines[i], i+1
+		if i == 0 {
+			l = strings.TrimPrefix(l, "\ufeff")
+		}
+
+		// inline files and blocks span until their closing tag.
+		if tag, closing, ok := inlineTag(l); ok {
+			if closing {
+				return nil, nil, fmt.Errorf("%w: line %d: </%s> was not opened", errBadCfg, lineno, tag)
+			}
+			end := i + 1
+			for end < len(lines) && !isClosingTag(lines[end], tag) {
+				end++
+			}
+			if end == len(lines) {
+				return nil, nil, fmt.Errorf("%w: line %d: <%s> not closed", errBadInput, lineno, tag)
+			}
+			body := lines[i+1 : end]
+			i = end
+			if tag == "connection" {
+				b, err := getConnectionDirectives(body, lineno+1, diagnose)
+				if err != nil {
+					return nil, nil, err
+				}
+				blocks = append(blocks, b)
+				continue
+			}
+			supported := hasElement(tag, inlineTags)
+			if err := diagnose(tag, lineno, supported); err != nil {
+				return nil, nil, err
+			}
+			if !supported {
+				continue
+			}
+			if err := parseInlineTag(opt, tag, body); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		d, err := getDirectiveFromLine(l, lineno)
+		if err != nil {
+			return nil, nil, err
+		}
+		if d == nil {
+			continue
+		}
+		supported := isSupportedDirective(d.key)
+		if err := diagnose(d.key, lineno, supported); err != nil {
+			return nil, nil, err
+		}
+		if !supported {
+			continue
+		}
+		if d.key == "proxy-pt" && !cp.allowsPT(d.args) {
+			diag := Diagnostic{
+				Line:      lineno,
+				Directive: d.key,
+				Severity:  SeverityError,
+				Reason:    "the transport binary is not allowed, see ConfigParser.PTBinaries",
+				Security:  true,
+			}
+			if cp.Mode == ParseStrict {
+				return nil, nil, fmt.Errorf("%w: %s", errBadCfg, diag)
+			}
+			diagnostics = append(diagnostics, diag)
+			continue
+		}
+		if diag := diagnoseArgs(d); diag != nil {
+			if cp.Mode == ParseStrict {
+				return nil, nil, fmt.Errorf("%w: %s", errBadCfg, diag)
+			}
+			diagnostics = append(diagnostics, *diag)
+			continue
+		}
+		if err := parseOption(opt, files, d.key, d.args, d.lineno); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// the blocks start from the options as they were before any block
+	// was applied.
+	base := *opt
+	for _, b := range blocks {
+		opt.Connections = append(opt.Connections, newConnection(b, files, &base))
+	}
+	for i := range opt.Connections {
+		c, err := opt.WithConnection(i)
+		if err != nil {
+			return nil, nil, err
+		}
+		opt.Connections[i].Remote, opt.Connections[i].Port, opt.Connections[i].Proto = c.Remote, c.Port, c.Proto
+	}
+	if len(opt.Connections) > 0 {
+		if err := opt.Connections[0].apply(opt); err != nil {
+			return nil, nil, err
+		}
+	}
+	if opt.Remote != "" && opt.Port == "" {
+		opt.Port = opt.defaultPort()
+	}
+	_, _, tunMTU := opt.devMTUs()
+	if err := opt.Shaping.checkMTU(tunMTU); err != nil {
+		return nil, nil, err
+	}
+	return opt, diagnostics, nil
+}
+
+// allowsPT returns true if the arguments of a proxy-pt directive name a
+// binary in PTBinaries. Malformed directives are left to the option parser.
+func (cp *ConfigParser) allowsPT(args []string) bool {
+	if len(args) < 2 {
+		return true
+	}
+	for _, b := range cp.PTBinaries {
+		if filepath.Clean(b) == filepath.Clean(args[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSupportedDirective returns true if the parser knows the directive.
+func isSupportedDirective(key string) bool {
+	_, ok := pMap[key]
+	_, okDir := pMapDir[key]
+	return ok || okDir
+}
+
+// getDirectiveFromLine tokenizes a line of the config file, and returns nil
+// for blank lines and comments. A leading "--" in the option name is
+// dropped, so that command line options can be used too.
+func getDirectiveFromLine(l string, lineno int) (*configDirective, error) {
+	tokens, err := splitConfigLine(l)
+	if err != nil {
+		return nil, fmt.Errorf("%w: line %d: %s", errBadCfg, lineno, err)
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	return &configDirective{
+		lineno: lineno,
+		key:    strings.TrimPrefix(tokens[0], "--"),
+		args:   tokens[1:],
+	}, nil
+}
+
+// getConnectionDirectives parses the lines of a <connection> block, that
+// starts at line first. The block must have exactly one remote. The
+// directives that we do not know are passed to diagnose, and dropped.
+func getConnectionDirectives(lines []string, first int, diagnose func(string, int, bool) error) ([]configDirective, error) {
+	var (
+		out     []configDirective
+		remotes int
+	)
+	for i, l := range lines {
+		d, err := getDirectiveFromLine(l, first+i)
+		if err != nil {
+			return nil, err
+		}
+		if d == nil {
+			continue
+		}
+		if !isSupportedDirective(d.key) {
+			if err := diagnose(d.key, d.lineno, false); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !hasElement(d.key, connectionDirectives) {
+			return nil, fmt.Errorf("%w: line %d: %s cannot be used in a <connection> block", errBadCfg, d.lineno, d.key)
+		}
+		if err := diagnose(d.key, d.lineno, true); err != nil {
+			return nil, err
+		}
+		if d.key == "remote" {
+			remotes++
+		}
+		out = append(out, *d)
+	}
+	if remotes != 1 {
+		return nil, fmt.Errorf("%w: line %d: a <connection> block needs one remote", errBadCfg, first-1)
+	}
+	return out, nil
+}
+
+// newConnection returns the Connection for the directives of a block, that
+// refer to files with files. The block is applied on top of the transport
+// options of base.
+func newConnection(directives []configDirective, files *configFiles, base *Options) Connection {
+	proxy := false
+	for _, d := range directives {
+		if d.key == "http-proxy" || d.key == "socks-proxy" {
+			proxy = true
+		}
+	}
+	return Connection{
+		apply: func(o *Options) error {
+			resetConnection(o, base)
+			if proxy {
+				// the proxy of the block replaces the global one,
+				// whatever its kind.
+				o.HTTPProxy, o.HTTPProxyUser, o.HTTPProxyPass, o.HTTPProxyAuth = "", "", "", ""
+				o.SOCKSProxy, o.SOCKSProxyUser, o.SOCKSProxyPass = "", "", ""
+			}
+			// a remote without a port takes the one of the port
+			// directive, not the one of the global remote.
+			o.Port = ""
+			for _, d := range directives {
+				if err := parseOption(o, files, d.key, d.args, d.lineno); err != nil {
+					return err
+				}
+			}
+			if o.Port == "" {
+				o.Port = o.defaultPort()
+			}
+			return nil
+		},
+	}
+}
+
+// resetConnection sets the options that a <connection> block can override
+// to their values in base.
+func resetConnection(o, base *Options) {
+	o.Remote, o.Port, o.port, o.Proto = base.Remote, base.Port, base.port, base.Proto
+	o.Local, o.LPort, o.NoBind = base.Local, base.LPort, base.NoBind
+	o.HTTPProxy, o.HTTPProxyUser, o.HTTPProxyPass, o.HTTPProxyAuth = base.HTTPProxy, base.HTTPProxyUser, base.HTTPProxyPass, base.HTTPProxyAuth
+	o.SOCKSProxy, o.SOCKSProxyUser, o.SOCKSProxyPass = base.SOCKSProxy, base.SOCKSProxyUser, base.SOCKSProxyPass
+	o.ExplicitExitNotify = base.ExplicitExitNotify
+}
+
+// splitConfigLine splits a line of a config file in tokens, following the
+// grammar of the reference implementation:
+//
+// - tokens are separated by whitespace, and a token that starts with # or ;
+// starts a comment;
+//
+// - a token that starts with a double quote runs until the closing double
+// quote, and a token that starts with a single quote until the closing
+// single quote;
+//
+// - out of single quotes, a backslash escapes a backslash, a double quote or
+// a whitespace.
+func splitConfigLine(line string) ([]string, error) {
+	const (
+		stInitial = iota
+		stUnquoted
+		stQuoted
+		stSingleQuoted
+	)
+	var (
+		out       []string
+		token     strings.Builder
+		state     = stInitial
+		backslash bool
+	)
+	for _, c := range line {
+		if !backslash && c == '\\' && state != stSingleQuoted {
+			backslash = true
+			continue
+		}
+		if backslash && c != '\\' && c != '"' && !unicode.IsSpace(c) {
+			return nil, fmt.Errorf("bad backslash usage: use \\\\ for a backslash, as in c:\\\\openvpn\\\\ta.key")
+		}
+		escaped := backslash
+		backslash = false
+		switch state {
+		case stInitial:
+			switch {
+			case !escaped && unicode.IsSpace(c):
+			case !escaped && (c == '#' || c == ';'):
+				return out, nil
+			case !escaped && c == '"':
+				state = stQuoted
+			case !escaped && c == '\'':
+				state = stSingleQuoted
+			default:
+				token.WriteRune(c)
+				state = stUnquoted
+			}
+			continue
+		case stUnquoted:
+			if escaped || !unicode.IsSpace(c) {
+				token.WriteRune(c)
+				continue
+			}
+		case stQuoted:
+			if escaped || c != '"' {
+				token.WriteRune(c)
+				continue
+			}
+		case stSingleQuoted:
+			if c != '\'' {
+				token.WriteRune(c)
+				continue
+			}
+		}
+		out = append(out, token.String())
+		token.Reset()
+		state = stInitial
+	}
+	switch {
+	case backslash:
+		return nil, fmt.Errorf("trailing backslash")
+	case state == stQuoted:
+		return nil, fmt.Errorf("no closing quotation (\")")
+	case state == stSingleQuoted:
+		return nil, fmt.Errorf("no closing quotation (')")
+	case state == stUnquoted:
+		out = append(out, token.String())
+	}
+	return out, nil
+}
+
+// inlineTags are the inline files that we support.
+var inlineTags = []string{"ca", "cert", "extra-certs", "key", "tls-auth", "tls-crypt", "secret", "auth-user-pass"}
+
+// inlineTag returns the name of the inline file or block that a line opens,
+// as in <ca>, or closes, as in </ca>. ok is false for other lines.
+func inlineTag(l string) (tag string, closing bool, ok bool) {
+	l = strings.TrimSpace(l)
+	if len(l) < 3 || l[0] != '<' || l[len(l)-1] != '>' {
+		return "", false, false
+	}
+	tag = l[1 : len(l)-1]
+	if strings.HasPrefix(tag, "/") {
+		tag, closing = tag[1:], true
+	}
+	if tag == "" || strings.ContainsAny(tag, "<>/ \t") {
+		return "", false, false
+	}
+	return tag, closing, true
+}
+
+// isClosingTag returns true if the line closes the given tag.
+func isClosingTag(l, tag string) bool {
+	t, closing, ok := inlineTag(l)
+	return ok && closing && t == tag
+}
+
+// parseInlineTag stores the content of an inline file.
+func parseInlineTag(o *Options, tag string, lines []string) error {
+	var b []byte
+	for _, l := range lines {
+		b = append(b, strings.TrimSpace(l)...)
+		b = append(b, '\n')
+	}
+	if len(b) == 0 {
+		return fmt.Errorf("%w: empty inline tag: %s", errBadInput, tag)
+	}
+	switch tag {
+	case "ca":
+		o.Ca = b
+	case "cert":
+		o.Cert = b
+	case "extra-certs":
+		o.ExtraCerts = b
+	case "key":
+		o.Key = b
+	case "tls-auth":
+		o.Ta = b
+	case "tls-crypt":
+		o.TLSCrypt = b
+	case "secret":
+		o.Secret = b
+	case "auth-user-pass":
+		creds, err := parseCredentials(lines)
+		if err != nil {
+			return err
+		}
+		o.Username, o.Password = creds[0], creds[1]
+	default:
+		return fmt.Errorf("%w: unknown tag: %s", errBadInput, tag)
+	}
+	return nil
+}
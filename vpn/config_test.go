@@ -0,0 +1,303 @@
+package vpn
+
+import (
+	"errors"
+	"os"
+	fp "path/filepath"
+	"reflect"
+	"testing"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+func Test_splitConfigLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    []string
+		wantErr bool
+	}{
+		{"empty", "", nil, false},
+		{"blank", " \t ", nil, false},
+		{"simple", "remote example.com 1194", []string{"remote", "example.com", "1194"}, false},
+		{"tabs and spaces", "\tremote  example.com\t 1194 ", []string{"remote", "example.com", "1194"}, false},
+		{"comment", "# remote example.com", nil, false},
+		{"indented comment", "   ; remote example.com", nil, false},
+		{"trailing comment", "cipher AES-256-GCM # the default", []string{"cipher", "AES-256-GCM"}, false},
+		{"comment char in a token", "setenv UV_X a#b;c", []string{"setenv", "UV_X", "a#b;c"}, false},
+		{"double quotes", `setenv IV_GUI_VER "my client 1.2"`, []string{"setenv", "IV_GUI_VER", "my client 1.2"}, false},
+		{"escapes in double quotes", `setenv UV_X "a \"b\" c\\d"`, []string{"setenv", "UV_X", `a "b" c\d`}, false},
+		{"escapes out of quotes", `auth-user-pass my\ file c:\\ovpn`, []string{"auth-user-pass", "my file", `c:\ovpn`}, false},
+		{"single quotes", `setenv UV_X 'a \ "b"'`, []string{"setenv", "UV_X", `a \ "b"`}, false},
+		{"empty quotes", `setenv UV_X ""`, []string{"setenv", "UV_X", ""}, false},
+		{"quote in a token", `setenv UV_X a"b`, []string{"setenv", "UV_X", `a"b`}, false},
+		{"no closing double quote", `setenv UV_X "a`, nil, true},
+		{"no closing single quote", `setenv UV_X 'a`, nil, true},
+		{"bad backslash", `ca c:\ovpn\ca.crt`, nil, true},
+		{"trailing backslash", `ca ca.crt\`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := splitConfigLine(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("splitConfigLine() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitConfigLine() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_inlineTag(t *testing.T) {
+	tests := []struct {
+		line    string
+		tag     string
+		closing bool
+		ok      bool
+	}{
+		{"<ca>", "ca", false, true},
+		{" </tls-crypt> ", "tls-crypt", true, true},
+		{"<connection>", "connection", false, true},
+		{"<>", "", false, false},
+		{"</>", "", false, false},
+		{"<a b>", "", false, false},
+		{"remote <host>", "", false, false},
+	}
+	for _, tt := range tests {
+		tag, closing, ok := inlineTag(tt.line)
+		if tag != tt.tag || closing != tt.closing || ok != tt.ok {
+			t.Errorf("inlineTag(%q) = %q, %v, %v, want %q, %v, %v", tt.line, tag, closing, ok, tt.tag, tt.closing, tt.ok)
+		}
+	}
+}
+
+func TestGetOptionsFromLinesGrammar(t *testing.T) {
+	d := t.TempDir()
+	writeDummyCertFiles(d)
+	l := []string{
+		"\ufeffclient",
+		"--dev tun",
+		"  # an indented comment",
+		"; another comment",
+		"remote vpn.example.com",
+		"port 443",
+		"proto udp4",
+		`ca "ca.crt"   # the ca`,
+		"cert cert.pem",
+		"key key.pem",
+		"key-direction 1",
+		"<tls-auth>",
+		"#",
+		"# 2048 bit OpenVPN static key",
+		"-----BEGIN OpenVPN Static key V1-----",
+		"00112233",
+		"-----END OpenVPN Static key V1-----",
+		"</tls-auth>",
+		"<tls-crypt>",
+		"tls-crypt-key",
+		"</tls-crypt>",
+		"<extra-certs>",
+		"extra-cert",
+		"</extra-certs>",
+		"<auth-user-pass>",
+		"user",
+		"pass word",
+		"</auth-user-pass>",
+		"<dh>",
+		"remote ignored.example.com 1",
+		"</dh>",
+		`setenv IV_GUI_VER "my client 1.2"`,
+	}
+	o, err := getOptionsFromLines(l, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Remote != "vpn.example.com" || o.Port != "443" || o.Proto != UDPMode {
+		t.Errorf("remote = %s:%s (%d), want vpn.example.com:443 (udp)", o.Remote, o.Port, o.Proto)
+	}
+	if o.CaPath != fp.Join(d, "ca.crt") || o.KeyDirection != "1" {
+		t.Errorf("ca = %s, key-direction = %s", o.CaPath, o.KeyDirection)
+	}
+	if string(o.TLSCrypt) != "tls-crypt-key\n" || string(o.ExtraCerts) != "extra-cert\n" {
+		t.Errorf("tls-crypt = %q, extra-certs = %q", o.TLSCrypt, o.ExtraCerts)
+	}
+	if len(o.Ta) == 0 {
+		t.Error("tls-auth: no inline key")
+	}
+	if o.Username != "user" || o.Password != "pass word" {
+		t.Errorf("auth-user-pass = %q, %q", o.Username, o.Password)
+	}
+	if o.SetEnv["IV_GUI_VER"] != "my client 1.2" {
+		t.Errorf("setenv = %q", o.SetEnv)
+	}
+
+	o, err = getOptionsFromLines([]string{"remote vpn.example.com", "proto tcp-client"}, d)
+	if err != nil || o.Port != "1194" || o.Proto != TCPMode {
+		t.Errorf("default port: got %v, %+v", err, o)
+	}
+	o, err = getOptionsFromLines([]string{"port 1195", "remote vpn.example.com 443 tcp"}, d)
+	if err != nil || o.Port != "443" || o.Proto != TCPMode {
+		t.Errorf("remote with port and proto: got %v, %+v", err, o)
+	}
+}
+
+func TestGetOptionsFromLinesConnections(t *testing.T) {
+	d := t.TempDir()
+	l := []string{
+		"proto udp",
+		"port 1195",
+		"<connection>",
+		"remote first.example.com",
+		"</connection>",
+		"",
+		"<connection>",
+		"  remote second.example.com 443",
+		"  proto tcp # fallback",
+		"</connection>",
+		"cipher AES-256-GCM",
+	}
+	o, err := getOptionsFromLines(l, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Connection{
+		{Remote: "first.example.com", Port: "1195", Proto: UDPMode},
+		{Remote: "second.example.com", Port: "443", Proto: TCPMode},
+	}
+	if len(o.Connections) != len(want) {
+		t.Fatalf("got %d connections, want %d", len(o.Connections), len(want))
+	}
+	for i, c := range o.Connections {
+		if c.Remote != want[i].Remote || c.Port != want[i].Port || c.Proto != want[i].Proto {
+			t.Errorf("connection %d = %+v, want %+v", i, c, want[i])
+		}
+	}
+	if o.Remote != "first.example.com" || o.Port != "1195" || o.Proto != UDPMode {
+		t.Errorf("options use %s:%s (%d), want the first connection", o.Remote, o.Port, o.Proto)
+	}
+	second, err := o.WithConnection(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Remote != "second.example.com" || second.Port != "443" || second.Proto != TCPMode || second.Cipher != "AES-256-GCM" {
+		t.Errorf("WithConnection(1) = %+v", second)
+	}
+	if o.Proto != UDPMode {
+		t.Error("WithConnection() changed the options")
+	}
+	if _, err := o.WithConnection(2); !errors.Is(err, errBadInput) {
+		t.Errorf("WithConnection(2): want %v, got %v", errBadInput, err)
+	}
+}
+
+func TestOptions_WithConnectionDoesNotLeak(t *testing.T) {
+	l := []string{
+		"proto udp",
+		"http-proxy global.example.com 3128",
+		"<connection>",
+		"remote first.example.com 443",
+		"proto tcp",
+		"local 10.0.0.2",
+		"explicit-exit-notify 2",
+		"</connection>",
+		"<connection>",
+		"remote second.example.com 1194",
+		"socks-proxy 127.0.0.1 9050",
+		"</connection>",
+		"<connection>",
+		"remote third.example.com 1194",
+		"</connection>",
+	}
+	o, err := getOptionsFromLines(l, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Proto != TCPMode || o.Local != "10.0.0.2" || o.HTTPProxy != "global.example.com:3128" {
+		t.Errorf("options = %+v, want the first connection", o)
+	}
+
+	second, err := o.WithConnection(1)
+	if err != nil {
+		t.Fatalf("WithConnection(1): %v", err)
+	}
+	if second.Remote != "second.example.com" || second.Proto != UDPMode || second.Local != "" || second.ExplicitExitNotify != 0 {
+		t.Errorf("WithConnection(1) = %+v, leaks the first connection", second)
+	}
+	if second.SOCKSProxy != "127.0.0.1:9050" || second.HTTPProxy != "" {
+		t.Errorf("WithConnection(1): socks-proxy = %q, http-proxy = %q", second.SOCKSProxy, second.HTTPProxy)
+	}
+
+	third, err := o.WithConnection(2)
+	if err != nil {
+		t.Fatalf("WithConnection(2): %v", err)
+	}
+	if third.HTTPProxy != "global.example.com:3128" || third.SOCKSProxy != "" || third.Proto != UDPMode {
+		t.Errorf("WithConnection(2) = %+v, want the global options", third)
+	}
+}
+
+func TestGetOptionsFromLinesBadGrammar(t *testing.T) {
+	tests := []struct {
+		name    string
+		lines   []string
+		wantErr error
+	}{
+		{"unclosed quote", []string{`setenv UV_X "a`}, errBadCfg},
+		{"bad backslash", []string{`ca c:\ca.crt`}, errBadCfg},
+		{"unclosed tag", []string{"<ca>", "ca_string"}, errBadInput},
+		{"closing tag without opening", []string{"</ca>"}, errBadCfg},
+		{"empty inline file", []string{"<ca>", "</ca>"}, errBadInput},
+		{"bad credentials", []string{"<auth-user-pass>", "user", "</auth-user-pass>"}, errBadCfg},
+		{"connection without remote", []string{"<connection>", "proto tcp", "</connection>"}, errBadCfg},
+		{"connection with two remotes", []string{"<connection>", "remote a 1", "remote b 1", "</connection>"}, errBadCfg},
+		{"connection with a global option", []string{"<connection>", "remote a 1", "cipher AES-256-GCM", "</connection>"}, errBadCfg},
+		{"bad port", []string{"remote a 1194", "port http"}, errBadCfg},
+		{"bad remote port", []string{"remote a http"}, errBadCfg},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := getOptionsFromLines(tt.lines, t.TempDir()); !errors.Is(err, tt.wantErr) {
+				t.Errorf("getOptionsFromLines(): want %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func Test_parseKeyFiles(t *testing.T) {
+	d := t.TempDir()
+	for _, f := range []string{"ta.key", "tc.key", "extra.pem"} {
+		os.WriteFile(fp.Join(d, f), []byte("dummy"), 0600)
+	}
+	o, err := getOptionsFromLines([]string{"tls-auth ta.key 1", "tls-crypt tc.key", "extra-certs extra.pem"}, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.TaPath != fp.Join(d, "ta.key") || o.KeyDirection != "1" || o.TLSCryptPath != fp.Join(d, "tc.key") || o.ExtraCertsPath != fp.Join(d, "extra.pem") {
+		t.Errorf("getOptionsFromLines() = %+v", o)
+	}
+	bad := [][]string{
+		{"tls-auth ta.key 2"},
+		{"tls-crypt ../tc.key"},
+		{"extra-certs missing.pem"},
+	}
+	for _, l := range bad {
+		if _, err := getOptionsFromLines(l, d); !errors.Is(err, errBadCfg) {
+			t.Errorf("getOptionsFromLines(%q): want %v, got %v", l, errBadCfg, err)
+		}
+	}
+}
+
+func Test_appendExtraCerts(t *testing.T) {
+	cert := &tls.Certificate{Certificate: [][]byte{[]byte("leaf")}}
+	if err := appendExtraCerts(cert, append(append(append([]byte(nil), pemTestingCa...), '\n'), pemTestingCertificate...)); err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.Certificate) != 3 {
+		t.Errorf("appendExtraCerts(): got %d certificates, want 3", len(cert.Certificate))
+	}
+	bad := []byte("-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n")
+	if err := appendExtraCerts(cert, bad); !errors.Is(err, ErrBadKeypair) {
+		t.Errorf("appendExtraCerts(): want %v, got %v", ErrBadKeypair, err)
+	}
+}
@@ -0,0 +1,129 @@
+package vpn
+
+//
+// The files that a config file refers to (ca, cert, key...). They are read
+// from the disk, or from a fs.FS, and the PathPolicy tells which ones a config
+// file can refer to.
+//
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// PathPolicy tells which files a config file can refer to.
+type PathPolicy int
+
+const (
+	// PathsBelowConfig only allows the files below the directory of the
+	// config file. It is the default, so that a config file cannot make
+	// us read any file.
+	PathsBelowConfig PathPolicy = iota
+
+	// PathsAnywhere allows any file. Relative paths still start from the
+	// directory of the config file.
+	PathsAnywhere
+
+	// PathsInlineOnly does not allow any file: the config file must
+	// inline them.
+	PathsInlineOnly
+)
+
+// configFiles resolves the files that a config file refers to.
+type configFiles struct {
+	// dir is the directory of the config file, where relative paths
+	// start from.
+	dir string
+	// fsys holds the files, or the disk is used if it is nil. In fsys,
+	// paths are slash-separated, and absolute paths start from its root.
+	fsys   fs.FS
+	policy PathPolicy
+}
+
+// newConfigFiles returns the configFiles for a config file on disk, in dir,
+// with the default policy.
+func newConfigFiles(dir string) *configFiles {
+	return &configFiles{dir: dir}
+}
+
+// resolve returns the path of the file that the option name refers to, on
+// disk or in fsys, after checking that the policy allows it and that it is a
+// regular file.
+func (f *configFiles) resolve(name, file string) (string, error) {
+	if f.policy == PathsInlineOnly {
+		return "", fmt.Errorf("%w: %s must be inline", errBadCfg, name)
+	}
+	e := fmt.Errorf("%w: %s expects a valid file", errBadCfg, name)
+	below := fmt.Errorf("%w: %s must be below config path", errBadCfg, name)
+	if f.fsys == nil {
+		p := toAbs(file, f.dir)
+		if sub, _ := isSubdir(f.dir, p); !sub && f.policy == PathsBelowConfig {
+			return "", below
+		}
+		if !existsFile(p) {
+			return "", e
+		}
+		return p, nil
+	}
+
+	dir := path.Clean(f.dir)
+	p := path.Join(dir, file)
+	if path.IsAbs(file) {
+		p = strings.TrimPrefix(path.Clean(file), "/")
+	}
+	if !fs.ValidPath(p) {
+		return "", fmt.Errorf("%w: %s is out of the filesystem", errBadCfg, name)
+	}
+	if dir != "." && p != dir && !strings.HasPrefix(p, dir+"/") && f.policy == PathsBelowConfig {
+		return "", below
+	}
+	info, err := fs.Stat(f.fsys, p)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", e
+	}
+	return p, nil
+}
+
+// load resolves the file that the option name refers to. On disk, its path is
+// stored in path, and it is read when connecting; in fsys, it is read now, and
+// its content is stored in data, as if it was inline.
+func (f *configFiles) load(name, file string, path *string, data *[]byte) error {
+	p, err := f.resolve(name, file)
+	if err != nil {
+		return err
+	}
+	if f.fsys == nil {
+		*path = p
+		return nil
+	}
+	b, err := fs.ReadFile(f.fsys, p)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %s", errBadCfg, name, err)
+	}
+	*data = b
+	return nil
+}
+
+// credentials reads a credentials file (user and pass on a line each) that
+// the option name refers to.
+func (f *configFiles) credentials(name, file string) ([]string, error) {
+	p, err := f.resolve(name, file)
+	if err != nil {
+		return nil, err
+	}
+	if f.fsys == nil {
+		return getCredentialsFromFile(p)
+	}
+	b, err := fs.ReadFile(f.fsys, p)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", errBadCfg, name, err)
+	}
+	lines, err := readLines(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errBadCfg, err)
+	}
+	return parseCredentials(lines)
+}
@@ -0,0 +1,119 @@
+package vpn
+
+import (
+	"errors"
+	"os"
+	fp "path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func Test_configFiles_resolve(t *testing.T) {
+	d := t.TempDir()
+	cfgDir := fp.Join(d, "profiles")
+	os.Mkdir(cfgDir, 0700)
+	os.WriteFile(fp.Join(cfgDir, "ca.crt"), []byte("ca"), 0600)
+	os.WriteFile(fp.Join(d, "shared.crt"), []byte("ca"), 0600)
+	os.Mkdir(fp.Join(d, "profiles-other"), 0700)
+	os.WriteFile(fp.Join(d, "profiles-other", "ca.crt"), []byte("ca"), 0600)
+
+	fsys := fstest.MapFS{
+		"profiles/ca.crt": {Data: []byte("ca")},
+		"shared.crt":      {Data: []byte("ca")},
+	}
+	tests := []struct {
+		name    string
+		files   *configFiles
+		file    string
+		want    string
+		wantErr bool
+	}{
+		{"disk", &configFiles{dir: cfgDir}, "ca.crt", fp.Join(cfgDir, "ca.crt"), false},
+		{"disk above", &configFiles{dir: cfgDir}, "../shared.crt", "", true},
+		{"disk sibling with the same prefix", &configFiles{dir: cfgDir}, "../profiles-other/ca.crt", "", true},
+		{"disk anywhere", &configFiles{dir: cfgDir, policy: PathsAnywhere}, "../shared.crt", fp.Join(d, "shared.crt"), false},
+		{"disk missing", &configFiles{dir: cfgDir, policy: PathsAnywhere}, "missing.crt", "", true},
+		{"disk inline only", &configFiles{dir: cfgDir, policy: PathsInlineOnly}, "ca.crt", "", true},
+		{"fs", &configFiles{dir: "profiles", fsys: fsys}, "ca.crt", "profiles/ca.crt", false},
+		{"fs absolute", &configFiles{dir: "profiles", fsys: fsys}, "/profiles/ca.crt", "profiles/ca.crt", false},
+		{"fs above", &configFiles{dir: "profiles", fsys: fsys}, "../shared.crt", "", true},
+		{"fs anywhere", &configFiles{dir: "profiles", fsys: fsys, policy: PathsAnywhere}, "../shared.crt", "shared.crt", false},
+		{"fs out of the filesystem", &configFiles{dir: ".", fsys: fsys, policy: PathsAnywhere}, "../shared.crt", "", true},
+		{"fs directory", &configFiles{dir: ".", fsys: fsys}, "profiles", "", true},
+		{"fs inline only", &configFiles{dir: "profiles", fsys: fsys, policy: PathsInlineOnly}, "ca.crt", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.files.resolve("ca", tt.file)
+			if tt.wantErr {
+				if !errors.Is(err, errBadCfg) {
+					t.Errorf("resolve(): want %v, got %v", errBadCfg, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("resolve() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewOptionsFromFS(t *testing.T) {
+	config := "remote vpn.example.com 1194\nca ca.crt\ncert cert.pem\nkey key.pem\ntls-auth ta.key 1\nauth-user-pass creds\n"
+	fsys := fstest.MapFS{
+		"profiles/config.ovpn": {Data: []byte(config)},
+		"profiles/ca.crt":      {Data: []byte("ca")},
+		"profiles/cert.pem":    {Data: []byte("cert")},
+		"profiles/key.pem":     {Data: []byte("key")},
+		"profiles/ta.key":      {Data: []byte("ta")},
+		"profiles/creds":       {Data: []byte("user\npass\n")},
+		"other/config.ovpn":    {Data: []byte("ca ../profiles/ca.crt\n")},
+	}
+	o, err := NewOptionsFromFS(fsys, "profiles/config.ovpn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(o.Ca) != "ca" || string(o.Cert) != "cert" || string(o.Key) != "key" || string(o.Ta) != "ta" {
+		t.Errorf("NewOptionsFromFS(): ca = %q, cert = %q, key = %q, ta = %q", o.Ca, o.Cert, o.Key, o.Ta)
+	}
+	if o.CaPath != "" || o.CertPath != "" || o.KeyPath != "" || o.TaPath != "" {
+		t.Errorf("NewOptionsFromFS(): got paths %+v", o)
+	}
+	if o.Username != "user" || o.Password != "pass" || o.KeyDirection != "1" {
+		t.Errorf("NewOptionsFromFS(): auth = %q, %q, key-direction = %q", o.Username, o.Password, o.KeyDirection)
+	}
+
+	if _, err := NewOptionsFromFS(fsys, "other/config.ovpn"); !errors.Is(err, errBadCfg) {
+		t.Errorf("NewOptionsFromFS(other): want %v, got %v", errBadCfg, err)
+	}
+	p := &ConfigParser{FS: fsys, Paths: PathsAnywhere}
+	if o, _, err := p.ParseFile("other/config.ovpn"); err != nil || string(o.Ca) != "ca" {
+		t.Errorf("ParseFile(other): got %v", err)
+	}
+	if _, err := NewOptionsFromFS(fsys, "missing.ovpn"); err == nil {
+		t.Error("NewOptionsFromFS(missing): want an error")
+	}
+}
+
+func TestNewOptionsFromReader(t *testing.T) {
+	config := "remote vpn.example.com 1194\n<ca>\nca\n</ca>\n<auth-user-pass>\nuser\npass\n</auth-user-pass>\n"
+	o, err := NewOptionsFromReader(strings.NewReader(config), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Remote != "vpn.example.com" || string(o.Ca) != "ca\n" || o.Username != "user" {
+		t.Errorf("NewOptionsFromReader() = %+v", o)
+	}
+
+	d := t.TempDir()
+	writeDummyCertFiles(d)
+	o, err = NewOptionsFromReader(strings.NewReader("ca ca.crt\n"), d)
+	if err != nil || o.CaPath != fp.Join(d, "ca.crt") {
+		t.Errorf("NewOptionsFromReader(dir): got %v, %+v", err, o)
+	}
+	p := &ConfigParser{Paths: PathsInlineOnly}
+	if _, _, err := p.Parse(strings.NewReader("ca ca.crt\n"), d); !errors.Is(err, errBadCfg) {
+		t.Errorf("Parse(inline only): want %v, got %v", errBadCfg, err)
+	}
+}
@@ -35,7 +35,13 @@ type session struct {
 	keys            []*dataChannelKey
 	keyID           int
 	localPacketID   packetID
+	localMessageID  packetID
 	lastACK         packetID
+	// resetACK is the message packet id of the server hard reset, that
+	// the first control packet acks again, and pendingResetACK tells if it
+	// was not sent yet.
+	resetACK        packetID
+	pendingResetACK bool
 	ackQueue        chan *packet
 	mu              sync.Mutex
 	Log             Logger
@@ -98,6 +104,46 @@ func (s *session) LocalPacketID() (packetID, error) {
 	return pid, nil
 }
 
+// LocalMessageID returns the message packet ID for the next reliable control
+// packet, and increments the counter. The hard reset is message 0, so the
+// first one is 1.
+func (s *session) LocalMessageID() (packetID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.localMessageID == math.MaxUint32 {
+		return 0, errExpiredKey
+	}
+	s.localMessageID++
+	return s.localMessageID, nil
+}
+
+// setResetACK makes the next control packet ack the server hard reset with
+// the given message packet id.
+func (s *session) setResetACK(id packetID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resetACK = id
+	s.pendingResetACK = true
+}
+
+// hasResetACK returns true if the next control packet acks the server hard
+// reset.
+func (s *session) hasResetACK() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pendingResetACK
+}
+
+// takeResetACK returns the message packet id of the server hard reset, and
+// true if it has to be acked by the next control packet, only once.
+func (s *session) takeResetACK() (packetID, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := s.pendingResetACK
+	s.pendingResetACK = false
+	return s.resetACK, pending
+}
+
 // UpdateLastACK will update the internal variable for the last acknowledged
 // packet to the passed packetID, only if packetID is greater than the lastACK.
 func (s *session) UpdateLastACK(newPacketID packetID) error {
@@ -136,14 +182,23 @@ func (c *control) SendHardReset(conn net.Conn, s *session) error {
 	return err
 }
 
-// ParseHardReset extracts the sessionID from a hard-reset server response, and
-// an error if the operation was not successful.
-func (c *control) ParseHardReset(b []byte) (sessionID, error) {
+// ParseHardReset parses a hard-reset server response, and returns an error if
+// the operation was not successful, or if we cannot answer it.
+func (c *control) ParseHardReset(b []byte) (*serverHardResetReply, error) {
 	p, err := newServerHardReset(b)
 	if err != nil {
-		return sessionID{}, err
+		return nil, err
+	}
+	r, err := parseServerHardResetReply(p)
+	if err != nil {
+		return nil, err
+	}
+	if r.earlyNegFlags&earlyNegResendWKC != 0 {
+		// we never announce early negotiation, and have no tls-crypt-v2
+		// key to resend.
+		return nil, fmt.Errorf("%w: %s", errBadReset, "server asks to resend a tls-crypt-v2 key")
 	}
-	return parseServerHardResetPacket(p)
+	return r, nil
 }
 
 // PushRequest returns a byte array with the PUSH_REQUEST command.
@@ -154,14 +209,10 @@ func (c *control) PushRequest() []byte {
 	return out.Bytes()
 }
 
-// ReadReadPushResponse reads a byte array returned from the server,
-// as the response to a Push Request, and returns a string containing the
-// tunnel IP.
-// For now, this is a single string containing _only_ the tunnel ip,
-// but we might want to pass a pointer to the tunnel struct in the
-// future.
-func (*control) ReadPushResponse(b []byte) map[string][]string {
-	return pushedOptionsAsMap(b)
+// ReadPushResponse reads a byte array returned from the server, as the
+// response to a Push Request, and returns the pushed options in order.
+func (*control) ReadPushResponse(b []byte) []string {
+	return pushedOptionsAsList(b)
 }
 
 // ControlMessage returns a byte array containing a message over the control
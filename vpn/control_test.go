@@ -284,3 +284,33 @@ func Test_control_PushRequest(t *testing.T) {
 		t.Errorf("control_PushRequest(): expected trailing null byte")
 	}
 }
+
+func Test_control_ParseHardReset(t *testing.T) {
+	remote := sessionID{1, 2, 3, 4, 5, 6, 7, 8}
+	c := &control{}
+	r, err := c.ParseHardReset(makeTestingServerHardReset(remote, sessionID{}, []uint32{0}, 0))
+	if err != nil || r.sessionID != remote {
+		t.Errorf("ParseHardReset() = %+v, %v, want session id %x", r, err, remote)
+	}
+	wkc := makeTestingServerHardReset(remote, sessionID{}, []uint32{0}, 0, 0x00, 0x01, 0x00, 0x02, 0x00, 0x01)
+	if _, err := c.ParseHardReset(wkc); !errors.Is(err, errBadReset) {
+		t.Errorf("ParseHardReset(resend wkc): want %v, got %v", errBadReset, err)
+	}
+}
+
+func Test_session_takeResetACK(t *testing.T) {
+	s := &session{}
+	if _, ok := s.takeResetACK(); ok || s.hasResetACK() {
+		t.Error("takeResetACK(): got an ack before setResetACK()")
+	}
+	s.setResetACK(3)
+	if !s.hasResetACK() {
+		t.Error("hasResetACK() = false after setResetACK()")
+	}
+	if id, ok := s.takeResetACK(); !ok || id != 3 {
+		t.Errorf("takeResetACK() = %d, %v, want 3, true", id, ok)
+	}
+	if _, ok := s.takeResetACK(); ok {
+		t.Error("takeResetACK(): the reset is acked only once")
+	}
+}
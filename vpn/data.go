@@ -16,6 +16,7 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"time"
 )
 
 var (
@@ -45,6 +46,9 @@ type dataChannelState struct {
 	hmacKeyRemote   keySlot
 	keyID           int // not used at the moment, paving the way for key rotation.
 	peerID          int
+	// dataV1 is set when the server did not push a peer-id: we then send
+	// P_DATA_V1 packets, without one.
+	dataV1 bool
 
 	mu sync.Mutex
 }
@@ -158,6 +162,10 @@ type data struct {
 	decodeFn        func([]byte, *dataChannelState) (*encryptedData, error)
 	encryptEncodeFn func([]byte, *session, *dataChannelState) ([]byte, error)
 	decryptFn       func([]byte, *encryptedData) ([]byte, error)
+
+	// staticKey is set in static key mode, where packets carry the long
+	// form of the packet id (with the time).
+	staticKey bool
 }
 
 var _ dataHandler = &data{} // Ensure that we implement dataHandler
@@ -256,9 +264,20 @@ func (d *data) SetupKeys(dck *dataChannelKey) error {
 	return nil
 }
 
+// noPeerID is passed to SetPeerID when the server did not push a peer-id.
+const noPeerID = -1
+
 // SetPeerID updates the data state field with the info sent by the server.
+// With noPeerID, we fall back to P_DATA_V1, like servers that do not know
+// about peer-ids expect.
 func (d *data) SetPeerID(i int) error {
+	if i < 0 {
+		d.state.peerID = 0
+		d.state.dataV1 = true
+		return nil
+	}
 	d.state.peerID = i
+	d.state.dataV1 = false
 	return nil
 }
 
@@ -300,12 +319,14 @@ func encryptAndEncodePayloadAEAD(padded []byte, session *session, state *dataCha
 	}
 
 	// in AEAD mode, we authenticate:
-	// - 1 byte: opcode/key
-	// - 3 bytes: peer-id (we're using P_DATA_V2)
+	// - 1 byte: opcode/key (only with P_DATA_V2)
+	// - 3 bytes: peer-id (only with P_DATA_V2)
 	// - 4 bytes: packet-id
+	header := dataHeader(state)
 	aead := &bytes.Buffer{}
-	aead.WriteByte(opcodeAndKeyHeader(state))
-	bufWriteUint24(aead, uint32(state.peerID))
+	if !state.dataV1 {
+		aead.Write(header)
+	}
 	bufWriteUint32(aead, uint32(nextPacketID))
 
 	// the iv is the packetID (again) concatenated with the 8 bytes of the
@@ -333,7 +354,10 @@ func encryptAndEncodePayloadAEAD(padded []byte, session *session, state *dataCha
 
 	// we now write to the output buffer
 	out := bytes.Buffer{}
-	out.Write(data.aead) // opcode|peer-id|packet_id
+	if state.dataV1 {
+		out.Write(header)
+	}
+	out.Write(data.aead) // opcode|[peer-id]|packet_id
 	out.Write(tag)
 	out.Write(ciphertext)
 	return out.Bytes(), nil
@@ -342,6 +366,19 @@ func encryptAndEncodePayloadAEAD(padded []byte, session *session, state *dataCha
 
 // encryptAndEncodePayloadNonAEAD peforms encryption and encoding of the payload in Non-AEAD modes (i.e., AES-CBC).
 func encryptAndEncodePayloadNonAEAD(padded []byte, session *session, state *dataChannelState) ([]byte, error) {
+	sealed, err := sealPayloadNonAEAD(padded, state)
+	if err != nil {
+		return []byte{}, err
+	}
+	out := &bytes.Buffer{}
+	out.Write(dataHeader(state))
+	out.Write(sealed)
+	return out.Bytes(), nil
+}
+
+// sealPayloadNonAEAD encrypts the payload with a random iv, and returns the
+// hmac, the iv and the ciphertext, without any header.
+func sealPayloadNonAEAD(padded []byte, state *dataChannelState) ([]byte, error) {
 	// For iv generation, OpenVPN uses a nonce-based PRNG that is initially seeded with
 	// OpenSSL RAND_bytes function. I am assuming this is good enough for our current purposes.
 	blockSize := state.dataCipher.blockSize()
@@ -368,9 +405,6 @@ func encryptAndEncodePayloadNonAEAD(padded []byte, session *session, state *data
 	computedMAC := state.hmacLocal.Sum(nil)
 
 	out := &bytes.Buffer{}
-	out.WriteByte(opcodeAndKeyHeader(state))
-	bufWriteUint24(out, uint32(state.peerID))
-
 	out.Write(computedMAC)
 	out.Write(iv)
 	out.Write(ciphertext)
@@ -452,7 +486,11 @@ func (d *data) WritePacket(conn net.Conn, payload []byte) (int, error) {
 		}
 	case false: // non-aead
 		localPacketID, _ := d.session.LocalPacketID()
-		plain = prependPacketID(localPacketID, payload)
+		if d.staticKey {
+			plain = prependLongPacketID(localPacketID, time.Now(), payload)
+		} else {
+			plain = prependPacketID(localPacketID, payload)
+		}
 
 		plain, err = doCompress(plain, d.options.Compress)
 		if err != nil {
@@ -476,6 +514,9 @@ func (d *data) WritePacket(conn net.Conn, payload []byte) (int, error) {
 	logger.Debug("data: write packet")
 	logger.Debugf("\n" + hex.Dump(out))
 
+	if d.options != nil {
+		d.options.WriteLimiter.Wait(len(out))
+	}
 	return conn.Write(out)
 }
 
@@ -484,6 +525,12 @@ func (d *data) WritePacket(conn net.Conn, payload []byte) (int, error) {
 //
 
 func (d *data) decrypt(encrypted []byte) ([]byte, error) {
+	return d.decryptPacket(encrypted, pDataV2)
+}
+
+// decryptPacket decrypts the payload of a data packet with the given opcode.
+// We accept both P_DATA_V1 and P_DATA_V2, whatever we send.
+func (d *data) decryptPacket(encrypted []byte, opcode uint8) ([]byte, error) {
 	if d.decryptFn == nil {
 		return []byte{}, errInitError
 	}
@@ -496,6 +543,10 @@ func (d *data) decrypt(encrypted []byte) ([]byte, error) {
 	if err != nil {
 		return []byte{}, fmt.Errorf("%w: %s", errCannotDecrypt, err)
 	}
+	if opcode == pDataV1 && len(encryptedData.aead) > 4 {
+		// P_DATA_V1 only authenticates the packet id.
+		encryptedData.aead = encryptedData.aead[len(encryptedData.aead)-4:]
+	}
 	plainText, err := d.decryptFn(d.state.cipherKeyRemote[:], encryptedData)
 	if err != nil {
 		return []byte{}, fmt.Errorf("%w: %s", errCannotDecrypt, err)
@@ -521,8 +572,10 @@ func decodeEncryptedPayloadAEAD(buf []byte, state *dataChannelState) (*encrypted
 	remoteHMAC := state.hmacKeyRemote[:8]
 	packet_id := buf[:4]
 
+	// the authenticated header of P_DATA_V2. The caller keeps only the
+	// packet id for P_DATA_V1.
 	headers := &bytes.Buffer{}
-	headers.WriteByte(opcodeAndKeyHeader(state))
+	headers.WriteByte(byte((pDataV2 << 3) | (state.keyID & 0x07)))
 	bufWriteUint24(headers, uint32(state.peerID))
 	headers.Write(packet_id)
 
@@ -586,10 +639,18 @@ func (d *data) ReadPacket(p *packet) ([]byte, error) {
 	}
 	panicIfFalse(p.isData(), "ReadPacket expects data packet")
 
-	plaintext, err := d.decrypt(p.payload)
+	plaintext, err := d.decryptPacket(p.payload, p.opcode)
 	if err != nil {
 		return []byte{}, err
 	}
+	if d.options != nil {
+		d.options.ReadLimiter.Wait(len(p.payload))
+	}
+	if d.staticKey {
+		if plaintext, err = dropPacketIDTime(plaintext); err != nil {
+			return []byte{}, err
+		}
+	}
 
 	// get plaintext payload from the decrypted plaintext
 	return maybeDecompress(plaintext, d.state, d.options)
@@ -669,5 +730,19 @@ func maybeDecompress(b []byte, st *dataChannelState, opt *Options) ([]byte, erro
 // opcodeAndKeyHeader returns the header byte encoding the opcode and keyID (3 upper
 // and 5 lower bits, respectively)
 func opcodeAndKeyHeader(st *dataChannelState) byte {
+	if st.dataV1 {
+		return byte((pDataV1 << 3) | (st.keyID & 0x07))
+	}
 	return byte((pDataV2 << 3) | (st.keyID & 0x07))
 }
+
+// dataHeader returns the header of the data packets that we send: the
+// opcode and keyID, followed by the peer-id with P_DATA_V2.
+func dataHeader(st *dataChannelState) []byte {
+	h := &bytes.Buffer{}
+	h.WriteByte(opcodeAndKeyHeader(st))
+	if !st.dataV1 {
+		bufWriteUint24(h, uint32(st.peerID))
+	}
+	return h.Bytes()
+}
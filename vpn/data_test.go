@@ -1423,3 +1423,87 @@ func Test_Crash_DecodeEncryptedPayload_Too_Short(t *testing.T) {
 	b := &args{[]byte(input), makeTestingState()}
 	a.DecodeEncryptedPayload(b.encrypted, b.dcs)
 }
+
+func makeTestingStateReversed() *dataChannelState {
+	st := makeTestingState()
+	st.cipherKeyLocal, st.cipherKeyRemote = st.cipherKeyRemote, st.cipherKeyLocal
+	st.hmacKeyLocal, st.hmacKeyRemote = st.hmacKeyRemote, st.hmacKeyLocal
+	st.hmacLocal = hmac.New(st.hash, st.hmacKeyLocal[:20])
+	st.hmacRemote = hmac.New(st.hash, st.hmacKeyRemote[:20])
+	return st
+}
+
+func Test_data_dataV1RoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		local      func() *dataChannelState
+		remote     func() *dataChannelState
+		encodeFn   func([]byte, *session, *dataChannelState) ([]byte, error)
+		decodeFn   func([]byte, *dataChannelState) (*encryptedData, error)
+		dataV1     bool
+		wantOpcode uint8
+		headerLen  int
+	}{
+		{"aead v2", makeTestingState, makeTestingStateReversed, encryptAndEncodePayloadAEAD, decodeEncryptedPayloadAEAD, false, pDataV2, 4},
+		{"aead v1", makeTestingState, makeTestingStateReversed, encryptAndEncodePayloadAEAD, decodeEncryptedPayloadAEAD, true, pDataV1, 1},
+		{"cbc v2", makeTestingStateNonAEAD, makeTestingStateNonAEADReversed, encryptAndEncodePayloadNonAEAD, decodeEncryptedPayloadNonAEAD, false, pDataV2, 4},
+		{"cbc v1", makeTestingStateNonAEAD, makeTestingStateNonAEADReversed, encryptAndEncodePayloadNonAEAD, decodeEncryptedPayloadNonAEAD, true, pDataV1, 1},
+	}
+	plaintext := bytes.Repeat([]byte{0x42}, 32)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			local := tt.local()
+			local.peerID = 7
+			local.dataV1 = tt.dataV1
+			input := plaintext
+			if !local.dataCipher.isAEAD() {
+				input, _ = bytesPadPKCS7(plaintext, int(local.dataCipher.blockSize()))
+			}
+			encrypted, err := tt.encodeFn(input, makeTestingSession(), local)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := parsePacketFromBytes(encrypted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.opcode != tt.wantOpcode || len(encrypted)-len(p.payload) != tt.headerLen {
+				t.Errorf("got opcode %d and a %d bytes header", p.opcode, len(encrypted)-len(p.payload))
+			}
+
+			remote := tt.remote()
+			remote.peerID = 7
+			d := &data{options: &Options{}, state: remote, decodeFn: tt.decodeFn, decryptFn: remote.dataCipher.decrypt}
+			got, err := d.decryptPacket(p.payload, p.opcode)
+			if err != nil {
+				t.Fatalf("decryptPacket(): unexpected error %v", err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Errorf("decryptPacket() = %x, want %x", got, plaintext)
+			}
+		})
+	}
+
+	// the authenticated data differs, so a P_DATA_V1 packet cannot pass
+	// for a P_DATA_V2 one.
+	local := makeTestingState()
+	local.dataV1 = true
+	encrypted, _ := encryptAndEncodePayloadAEAD(plaintext, makeTestingSession(), local)
+	remote := makeTestingStateReversed()
+	d := &data{options: &Options{}, state: remote, decodeFn: decodeEncryptedPayloadAEAD, decryptFn: remote.dataCipher.decrypt}
+	if _, err := d.decryptPacket(encrypted[1:], pDataV2); !errors.Is(err, errCannotDecrypt) {
+		t.Errorf("decryptPacket(v1 as v2): want %v, got %v", errCannotDecrypt, err)
+	}
+}
+
+func Test_data_SetPeerID(t *testing.T) {
+	d := &data{state: &dataChannelState{}}
+	d.SetPeerID(noPeerID)
+	if !d.state.dataV1 || d.state.peerID != 0 || opcodeAndKeyHeader(d.state)>>3 != pDataV1 {
+		t.Errorf("SetPeerID(noPeerID): got %+v", d.state)
+	}
+	d.SetPeerID(0)
+	if d.state.dataV1 || opcodeAndKeyHeader(d.state)>>3 != pDataV2 {
+		t.Errorf("SetPeerID(0): got %+v", d.state)
+	}
+}
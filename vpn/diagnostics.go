@@ -0,0 +1,182 @@
+package vpn
+
+//
+// Diagnostics about what minivpn ignores in a config file, so that tools can
+// tell their users what part of a profile has no effect.
+//
+
+import "fmt"
+
+// ParseMode tells how the config parser treats the directives that minivpn
+// does not support.
+type ParseMode int
+
+const (
+	// ParseLenient ignores the directives that minivpn does not support,
+	// and reports them as diagnostics.
+	ParseLenient ParseMode = iota
+
+	// ParseStrict fails on the first directive that minivpn does not
+	// support, or does not enforce.
+	ParseStrict
+)
+
+// Severity is how much an ignored directive matters.
+type Severity int
+
+const (
+	// SeverityInfo is for directives that have no effect for minivpn, by
+	// design: strict parsing accepts them.
+	SeverityInfo Severity = iota
+
+	// SeverityWarning is for directives that minivpn does not support.
+	SeverityWarning
+
+	// SeverityError is for directives that minivpn does not enforce, and
+	// that make the tunnel less secure than the profile asks.
+	SeverityError
+)
+
+// String returns the name of the severity.
+func (s Severity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "info"
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	default:
+		return fmt.Sprintf("severity(%d)", int(s))
+	}
+}
+
+// Diagnostic describes a directive of a config file that minivpn ignores.
+type Diagnostic struct {
+	// Line is the line of the directive, starting at 1.
+	Line int
+	// Directive is the name of the option, or of the inline file.
+	Directive string
+	Severity  Severity
+	Reason    string
+	// Security is true when ignoring the directive weakens the security
+	// of the tunnel (verify-x509-name, tls-crypt...).
+	Security bool
+}
+
+// String returns a line that describes the diagnostic.
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("line %d: %s: %s (%s)", d.Line, d.Directive, d.Reason, d.Severity)
+}
+
+// noopDirectives are the directives that minivpn accepts without doing
+// anything, with the reason.
+var noopDirectives = map[string]string{
+	"client":               "minivpn is always a TLS client that pulls its options",
+	"tls-client":           "minivpn is always a TLS client",
+	"pull":                 "minivpn always pulls its options",
+	"key-method":           "minivpn always uses key method 2",
+	"persist-key":          "minivpn does not restart",
+	"persist-tun":          "minivpn does not restart",
+	"resolv-retry":         "the remote is resolved on each dial",
+	"verb":                 "logging is configured with Options.Log",
+	"mute":                 "logging is configured with Options.Log",
+	"mute-replay-warnings": "logging is configured with Options.Log",
+	"auth-nocache":         "minivpn does not cache credentials",
+	"script-security":      "minivpn does not run scripts",
+}
+
+// securityDirectives are the directives that minivpn does not support, and
+// that make the tunnel less secure when ignored, with the reason.
+var securityDirectives = map[string]string{
+	"verify-x509-name":      "the name of the server certificate is not checked",
+	"remote-cert-tls":       "the key usage of the server certificate is not checked",
+	"remote-cert-ku":        "the key usage of the server certificate is not checked",
+	"remote-cert-eku":       "the extended key usage of the server certificate is not checked",
+	"ns-cert-type":          "the type of the server certificate is not checked",
+	"tls-verify":            "the verification script is not run",
+	"crl-verify":            "revoked certificates are accepted",
+	"verify-hash":           "the certificate authority is not pinned",
+	"peer-fingerprint":      "the server certificate is not pinned",
+	"tls-version-min":       "the minimum TLS version is not enforced",
+	"tls-cipher":            "the TLS ciphers are not restricted",
+	"tls-ciphersuites":      "the TLS 1.3 ciphersuites are not restricted",
+	"tls-groups":            "the TLS groups are not restricted",
+	"tls-cert-profile":      "the certificate profile is not enforced",
+	"tls-crypt-v2":          "the control channel is not wrapped with tls-crypt-v2",
+	"data-ciphers":          "the data channel cipher is not negotiated, only cipher is used",
+	"data-ciphers-fallback": "the data channel cipher is not negotiated, only cipher is used",
+	"ncp-ciphers":           "the data channel cipher is not negotiated, only cipher is used",
+	"reneg-sec":             "the data channel keys are never renegotiated",
+	"reneg-bytes":           "the data channel keys are never renegotiated",
+	"reneg-pkts":            "the data channel keys are never renegotiated",
+	"redirect-gateway":      "the traffic is not redirected to the tunnel",
+	"block-outside-dns":     "DNS queries outside of the tunnel are not blocked",
+}
+
+// unenforcedDirectives are directives that minivpn parses, but does not
+// enforce yet, with the reason and whether it weakens the tunnel.
+var unenforcedDirectives = map[string]struct {
+	reason   string
+	security bool
+}{
+	"tls-auth":        {"the control channel does not use the tls-auth key of the profile", true},
+	"tls-crypt":       {"the control channel is not wrapped with tls-crypt", true},
+	"tls-version-max": {"the TLS version is the one of the parroted client hello", false},
+}
+
+// diagnoseDirective returns the diagnostic for a directive, or an inline
+// file, that is on the given line, or nil if minivpn supports it. supported
+// tells if the parser knows the directive.
+func diagnoseDirective(key string, lineno int, supported bool) *Diagnostic {
+	d := &Diagnostic{Line: lineno, Directive: key}
+	if u, ok := unenforcedDirectives[key]; ok && supported {
+		d.Reason, d.Security = u.reason, u.security
+		d.Severity = SeverityWarning
+		if u.security {
+			d.Severity = SeverityError
+		}
+		return d
+	}
+	if supported {
+		return nil
+	}
+	if reason, ok := noopDirectives[key]; ok {
+		d.Severity, d.Reason = SeverityInfo, reason
+		return d
+	}
+	if reason, ok := securityDirectives[key]; ok {
+		d.Severity, d.Reason, d.Security = SeverityError, reason, true
+		return d
+	}
+	d.Severity, d.Reason = SeverityWarning, "not supported, ignored"
+	return d
+}
+
+// dhcpOptionTypes are the dhcp-option types that minivpn uses.
+var dhcpOptionTypes = []string{"DNS", "DNS6", "DOMAIN", "DOMAIN-SEARCH"}
+
+// diagnoseArgs returns the diagnostic for a supported directive whose
+// arguments ask for something that minivpn ignores, or nil.
+func diagnoseArgs(d *configDirective) *Diagnostic {
+	if d.key == "dhcp-option" && len(d.args) == 2 && !hasElement(d.args[0], dhcpOptionTypes) {
+		return &Diagnostic{
+			Line:      d.lineno,
+			Directive: d.key,
+			Severity:  SeverityWarning,
+			Reason:    fmt.Sprintf("the %s type is not supported, ignored", d.args[0]),
+		}
+	}
+	return nil
+}
+
+// logDiagnostics logs what minivpn ignores in a config file.
+func logDiagnostics(diagnostics []Diagnostic) {
+	for _, d := range diagnostics {
+		if d.Severity == SeverityInfo {
+			logger.Debugf("config: %s", d)
+		} else {
+			logger.Warnf("config: %s", d)
+		}
+	}
+}
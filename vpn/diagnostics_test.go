@@ -0,0 +1,171 @@
+package vpn
+
+import (
+	"errors"
+	"os"
+	fp "path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_diagnoseDirective(t *testing.T) {
+	tests := []struct {
+		key       string
+		supported bool
+		want      *Diagnostic
+	}{
+		{"cipher", true, nil},
+		{"client", false, &Diagnostic{Line: 3, Directive: "client", Severity: SeverityInfo, Reason: noopDirectives["client"]}},
+		{"verify-x509-name", false, &Diagnostic{Line: 3, Directive: "verify-x509-name", Severity: SeverityError, Reason: securityDirectives["verify-x509-name"], Security: true}},
+		{"tls-crypt", true, &Diagnostic{Line: 3, Directive: "tls-crypt", Severity: SeverityError, Reason: unenforcedDirectives["tls-crypt"].reason, Security: true}},
+		{"tls-version-max", true, &Diagnostic{Line: 3, Directive: "tls-version-max", Severity: SeverityWarning, Reason: unenforcedDirectives["tls-version-max"].reason}},
+		{"fragment", false, &Diagnostic{Line: 3, Directive: "fragment", Severity: SeverityWarning, Reason: "not supported, ignored"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := diagnoseDirective(tt.key, 3, tt.supported); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diagnoseDirective() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigParser_lenient(t *testing.T) {
+	l := []string{
+		"client",
+		"remote vpn.example.com 1194",
+		"fragment 1300",
+		"<connection>",
+		"remote second.example.com",
+		"connect-retry 5",
+		"</connection>",
+		"verify-x509-name server name",
+		"<dh>",
+		"dh-params",
+		"</dh>",
+		"cipher AES-256-GCM",
+		"dhcp-option WINS 10.8.0.2",
+		"dhcp-option DNS 10.8.0.1",
+	}
+	o, diagnostics, err := (&ConfigParser{}).parseLines(l, newConfigFiles(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Remote != "second.example.com" || o.Cipher != "AES-256-GCM" || len(o.Connections) != 1 || len(o.DNS) != 1 {
+		t.Errorf("parseLines() = %+v", o)
+	}
+	type short struct {
+		line      int
+		directive string
+		severity  Severity
+		security  bool
+	}
+	want := []short{
+		{1, "client", SeverityInfo, false},
+		{3, "fragment", SeverityWarning, false},
+		{6, "connect-retry", SeverityWarning, false},
+		{8, "verify-x509-name", SeverityError, true},
+		{9, "dh", SeverityWarning, false},
+		{13, "dhcp-option", SeverityWarning, false},
+	}
+	var got []short
+	for _, d := range diagnostics {
+		got = append(got, short{d.Line, d.Directive, d.Severity, d.Security})
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseLines() diagnostics = %+v, want %+v", got, want)
+	}
+}
+
+func TestConfigParser_strict(t *testing.T) {
+	strict := &ConfigParser{Mode: ParseStrict}
+	tests := []struct {
+		name    string
+		lines   []string
+		wantErr error
+	}{
+		{"supported", []string{"remote vpn.example.com 1194", "cipher AES-256-GCM"}, nil},
+		{"no effect", []string{"client", "persist-key", "remote vpn.example.com 1194"}, nil},
+		{"unsupported", []string{"remote vpn.example.com 1194", "fragment 1300"}, errBadCfg},
+		{"security", []string{"verify-x509-name server name"}, errBadCfg},
+		{"unenforced", []string{"<tls-crypt>", "key", "</tls-crypt>"}, errBadCfg},
+		{"inline file", []string{"<dh>", "dh-params", "</dh>"}, errBadCfg},
+		{"in a connection", []string{"<connection>", "remote a 1", "connect-retry 5", "</connection>"}, errBadCfg},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, diagnostics, err := strict.parseLines(tt.lines, newConfigFiles(t.TempDir()))
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("parseLines(): want %v, got %v", tt.wantErr, err)
+			}
+			for _, d := range diagnostics {
+				if d.Severity != SeverityInfo {
+					t.Errorf("parseLines(): strict mode returned %s", d)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigParser_proxyPT(t *testing.T) {
+	l := []string{
+		"proto tcp",
+		"remote bridge.example.com 443",
+		"proxy-pt webtunnel /usr/bin/webtunnel-client",
+	}
+
+	o, diagnostics, err := (&ConfigParser{}).parseLines(l, newConfigFiles(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.ProxyPT != "" || len(o.ProxyPTCmd) != 0 {
+		t.Errorf("parseLines(): proxy-pt should be dropped, got %v %v", o.ProxyPT, o.ProxyPTCmd)
+	}
+	if len(diagnostics) != 1 || diagnostics[0].Directive != "proxy-pt" || !diagnostics[0].Security || diagnostics[0].Severity != SeverityError {
+		t.Errorf("parseLines() diagnostics = %+v", diagnostics)
+	}
+
+	strict := &ConfigParser{Mode: ParseStrict, PTBinaries: []string{"/usr/bin/obfs4proxy"}}
+	if _, _, err := strict.parseLines(l, newConfigFiles(t.TempDir())); !errors.Is(err, errBadCfg) {
+		t.Errorf("parseLines(strict): want %v, got %v", errBadCfg, err)
+	}
+
+	strict.PTBinaries = append(strict.PTBinaries, "/usr/bin/webtunnel-client")
+	o, _, err = strict.parseLines(l, newConfigFiles(t.TempDir()))
+	if err != nil {
+		t.Fatalf("parseLines(allowed): unexpected error %v", err)
+	}
+	if o.ProxyPT != "webtunnel" || !reflect.DeepEqual(o.ProxyPTCmd, []string{"/usr/bin/webtunnel-client"}) {
+		t.Errorf("parseLines(allowed): got %v %v", o.ProxyPT, o.ProxyPTCmd)
+	}
+}
+
+func TestConfigParser_bareCompLZO(t *testing.T) {
+	l := []string{"remote vpn.example.com 1194", "comp-lzo"}
+	for _, mode := range []ParseMode{ParseLenient, ParseStrict} {
+		_, _, err := (&ConfigParser{Mode: mode}).parseLines(l, newConfigFiles(t.TempDir()))
+		if !errors.Is(err, errBadCfg) {
+			t.Errorf("parseLines(mode %d): want %v, got %v", mode, errBadCfg, err)
+		}
+	}
+}
+
+func TestConfigParser_ParseFile(t *testing.T) {
+	d := t.TempDir()
+	writeDummyCertFiles(d)
+	cfg := fp.Join(d, "config.ovpn")
+	os.WriteFile(cfg, []byte("remote vpn.example.com 1194\nca ca.crt\ncert cert.pem\nkey key.pem\nremote-cert-tls server\n"), 0600)
+	o, diagnostics, err := (&ConfigParser{}).ParseFile(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.CaPath != fp.Join(d, "ca.crt") {
+		t.Errorf("ParseFile(): ca = %s", o.CaPath)
+	}
+	if len(diagnostics) != 1 || diagnostics[0].String() != "line 5: remote-cert-tls: the key usage of the server certificate is not checked (error)" {
+		t.Errorf("ParseFile() diagnostics = %v", diagnostics)
+	}
+	if _, _, err := (&ConfigParser{Mode: ParseStrict}).ParseFile(cfg); !errors.Is(err, errBadCfg) {
+		t.Errorf("ParseFile(strict): want %v, got %v", errBadCfg, err)
+	}
+}
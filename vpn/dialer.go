@@ -139,12 +139,31 @@ func (td *TunDialer) DialTimeout(network, address string, timeout time.Duration)
 	return conn, err
 }
 
+// ShapingStats returns the shaping stats of the underlying Client.
+func (td *TunDialer) ShapingStats() ShapingStats {
+	return td.client.ShapingStats()
+}
+
 func (td *TunDialer) createNetTUN(ctx context.Context) (*netstack.Net, error) {
-	localIP := td.client.LocalAddr().String()
+	var vpn net.Conn = td.client
+	var addrs []netip.Addr
+
+	// in tap mode, the tunnel carries Ethernet frames, and the address
+	// may come from a DHCP server on the bridge.
+	if td.client.Opts.tapMode() {
+		tap, err := td.setupTap(ctx)
+		if err != nil {
+			return nil, err
+		}
+		vpn, addrs = tap, tap.addrs()
+	} else {
+		localIP := td.client.LocalAddr().String()
+		addrs = []netip.Addr{netip.MustParseAddr(localIP)}
+	}
 
 	// create a virtual device in userspace, courtesy of wireguard-go
 	tun, tnet, err := netstack.CreateNetTUN(
-		[]netip.Addr{netip.Addr(netip.MustParseAddr(localIP))},
+		addrs,
 		[]netip.Addr{
 			netip.MustParseAddr(td.ns1),
 			netip.MustParseAddr(td.ns2)},
@@ -160,13 +179,42 @@ func (td *TunDialer) createNetTUN(ctx context.Context) (*netstack.Net, error) {
 
 	// connect the virtual device to our openvpn tunnel
 	if !td.skipDeviceSetup {
-		dev := &device{tun, td.client}
+		dev := &device{tun, vpn}
 		dev.Up()
 		td.device = dev
 	}
 	return tnet, nil
 }
 
+// setupTap returns a tapConn over the client. If the server did not push
+// an address, it gets one with DHCP, and stores it in the tunnel info.
+func (td *TunDialer) setupTap(ctx context.Context) (*tapConn, error) {
+	tap, err := newTapConn(td.client, td.client.tunInfo)
+	if err != nil {
+		return nil, err
+	}
+	if td.client.tunInfo.ip != "" {
+		return tap, nil
+	}
+	lease, err := tap.runDHCP(ctx)
+	if err != nil {
+		tap.Close()
+		return nil, err
+	}
+	td.client.tunInfo.ip = lease.ip.String()
+	td.client.tunInfo.netmask = net.IP(net.CIDRMask(lease.prefix.Bits(), 32)).String()
+	if lease.router.IsValid() {
+		td.client.tunInfo.gw = lease.router.String()
+	}
+	if info := td.client.tunInfo.info; info != nil {
+		info.IP, info.Netmask = td.client.tunInfo.ip, td.client.tunInfo.netmask
+		if lease.router.IsValid() {
+			info.RouteGateway = td.client.tunInfo.gw
+		}
+	}
+	return tap, nil
+}
+
 // device contains the two halves of the tunnel that we are connecting in our
 // toy implementation: the virtual tun device that is handled by netstack, and
 // the vpn.Client (that satisfies a net.Conn) that writes and reads to sockets
@@ -214,7 +214,7 @@ func makeTestingConnForReadWrite(network, addr string, n int) net.Conn {
 			return len(p), nil
 		case 1:
 			// control message data (pushed options)
-			p := []byte("PUSH_REPLY,ifconfig 2.2.2.2")
+			p := []byte("PUSH_REPLY,ifconfig 2.2.2.2\x00")
 			copy(b[:], p)
 			mockConn.Count += 1
 			return len(p), nil
@@ -0,0 +1,236 @@
+package vpn
+
+//
+// HTTP proxy (CONNECT method) support for the outer connection.
+//
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"openVPN/internal/netutil"
+)
+
+const (
+	// httpProxyAuthNone sends no credentials to the proxy.
+	httpProxyAuthNone = "none"
+
+	// httpProxyAuthBasic uses the basic authentication scheme.
+	httpProxyAuthBasic = "basic"
+
+	// httpProxyAuthDigest uses the digest authentication scheme (RFC 2617).
+	httpProxyAuthDigest = "digest"
+)
+
+var (
+	// ErrProxy is returned when the proxy cannot establish a connection to
+	// the remote.
+	ErrProxy = errors.New("proxy error")
+
+	// ErrProxyNetwork is returned when the proxy cannot carry the requested
+	// network.
+	ErrProxyNetwork = errors.New("network not supported by proxy")
+)
+
+// HTTPProxyDialer is a DialerContext that connects to the remote through an
+// HTTP proxy, using the CONNECT method. It only supports TCP.
+type HTTPProxyDialer struct {
+	// Addr is the host:port of the proxy.
+	Addr string
+	// Username and Password are the proxy credentials, if any.
+	Username string
+	Password string
+	// AuthMethod is one of "none", "basic" or "digest". If empty, basic
+	// authentication is used when credentials are given.
+	AuthMethod string
+	// Dialer is used to connect to the proxy. If nil, a net.Dialer is used.
+	Dialer DialerContext
+}
+
+// DialContext connects to the address through the proxy. The network must
+// be a TCP network.
+func (d *HTTPProxyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("%w: http-proxy cannot carry %s", ErrProxyNetwork, network)
+	}
+	authorization := ""
+	if d.Username != "" && d.AuthMethod != httpProxyAuthDigest && d.AuthMethod != httpProxyAuthNone {
+		authorization = basicAuthorization(d.Username, d.Password)
+	}
+	conn, resp, err := d.connect(ctx, network, address, authorization)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusProxyAuthRequired && d.AuthMethod == httpProxyAuthDigest {
+		conn.Close()
+		challenge := resp.Header.Get("Proxy-Authenticate")
+		authorization, err = digestAuthorization(challenge, d.Username, d.Password, address)
+		if err != nil {
+			return nil, err
+		}
+		conn, resp, err = d.connect(ctx, network, address, authorization)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("%w: http-proxy says: %s", ErrProxy, resp.Status)
+	}
+	return conn, nil
+}
+
+// connect dials the proxy and sends a CONNECT request for the address. It
+// returns the conn and the proxy response.
+func (d *HTTPProxyDialer) connect(ctx context.Context, network, address, authorization string) (net.Conn, *http.Response, error) {
+	dialer := d.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	conn, err := dialer.DialContext(ctx, network, d.Addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	stop := netutil.WatchContext(ctx, conn)
+	defer stop()
+
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", address, address)
+	if authorization != "" {
+		req += fmt.Sprintf("Proxy-Authorization: %s\r\n", authorization)
+	}
+	req += "\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("%w: %s", ErrProxy, err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("%w: %s", ErrProxy, err)
+	}
+	resp.Body.Close()
+	if br.Buffered() > 0 {
+		conn = &bufferedConn{Conn: conn, r: br}
+	}
+	return conn, resp, nil
+}
+
+// basicAuthorization returns the value of the Proxy-Authorization header
+// for the basic scheme.
+func basicAuthorization(username, password string) string {
+	creds := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	return "Basic " + creds
+}
+
+// digestAuthorization returns the value of the Proxy-Authorization header for
+// the digest scheme, as a response to the passed Proxy-Authenticate challenge.
+func digestAuthorization(challenge, username, password, uri string) (string, error) {
+	if !strings.HasPrefix(strings.ToLower(challenge), "digest ") {
+		return "", fmt.Errorf("%w: expected digest challenge, got: %q", ErrProxy, challenge)
+	}
+	params := parseAuthParams(challenge[len("digest "):])
+	realm, nonce := params["realm"], params["nonce"]
+	if nonce == "" {
+		return "", fmt.Errorf("%w: %s", ErrProxy, "digest challenge without nonce")
+	}
+	if algo := params["algorithm"]; algo != "" && !strings.EqualFold(algo, "MD5") {
+		return "", fmt.Errorf("%w: unsupported digest algorithm: %s", ErrProxy, algo)
+	}
+	ha1 := md5Hex(username + ":" + realm + ":" + password)
+	ha2 := md5Hex(http.MethodConnect + ":" + uri)
+
+	var response string
+	out := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`,
+		username, realm, nonce, uri)
+	if qopAuth(params["qop"]) {
+		cnonce, err := randomFn(8)
+		if err != nil {
+			return "", err
+		}
+		cn := hex.EncodeToString(cnonce)
+		const nc = "00000001"
+		response = md5Hex(strings.Join([]string{ha1, nonce, nc, cn, "auth", ha2}, ":"))
+		out += fmt.Sprintf(`, qop=auth, nc=%s, cnonce="%s"`, nc, cn)
+	} else {
+		response = md5Hex(ha1 + ":" + nonce + ":" + ha2)
+	}
+	out += fmt.Sprintf(`, response="%s"`, response)
+	if opaque, ok := params["opaque"]; ok {
+		out += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	return out, nil
+}
+
+// qopAuth returns true if the qop list in a digest challenge offers "auth".
+func qopAuth(qop string) bool {
+	for _, v := range strings.Split(qop, ",") {
+		if strings.TrimSpace(v) == "auth" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAuthParams parses a comma-separated list of key=value pairs, where
+// values can be quoted.
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = s[eq+1:]
+		var val string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				val, s = s[1:], ""
+			} else {
+				val, s = s[1:end+1], s[end+2:]
+			}
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				val, s = s, ""
+			} else {
+				val, s = s[:end], s[end:]
+			}
+		}
+		params[key] = strings.TrimSpace(val)
+	}
+	return params
+}
+
+// md5Hex returns the hex-encoded md5 digest of the passed string.
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s)) // #nosec G401
+	return hex.EncodeToString(sum[:])
+}
+
+// bufferedConn is a net.Conn that first returns any bytes that were already
+// buffered while reading the proxy response.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Read reads from the buffered reader.
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+var _ DialerContext = &HTTPProxyDialer{} // Ensure that we implement DialerContext
@@ -0,0 +1,194 @@
+package vpn
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// startEchoServer starts a TCP server that echoes back anything it reads.
+func startEchoServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// startHTTPProxy starts a CONNECT proxy. The authorize function is called
+// with the Proxy-Authorization header; if it returns false, the proxy
+// answers with a 407 and the given challenge.
+func startHTTPProxy(t *testing.T, challenge string, authorize func(string) bool) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				req, err := http.ReadRequest(br)
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				if !authorize(req.Header.Get("Proxy-Authorization")) {
+					io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n")
+					io.WriteString(c, "Proxy-Authenticate: "+challenge+"\r\n\r\n")
+					return
+				}
+				remote, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer remote.Close()
+				io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(remote, br)
+				io.Copy(c, remote)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	msg := []byte("alles ist green")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(got) != string(msg) {
+		t.Errorf("echo: got %q, want %q", got, msg)
+	}
+}
+
+func TestHTTPProxyDialer_DialContext(t *testing.T) {
+	echo := startEchoServer(t)
+
+	t.Run("no auth", func(t *testing.T) {
+		proxy := startHTTPProxy(t, "", func(string) bool { return true })
+		d := &HTTPProxyDialer{Addr: proxy}
+		conn, err := d.DialContext(context.Background(), "tcp", echo)
+		if err != nil {
+			t.Fatalf("DialContext() error = %v", err)
+		}
+		defer conn.Close()
+		assertEcho(t, conn)
+	})
+
+	t.Run("basic auth", func(t *testing.T) {
+		want := basicAuthorization("user", "pass")
+		proxy := startHTTPProxy(t, `Basic realm="test"`, func(h string) bool { return h == want })
+		d := &HTTPProxyDialer{Addr: proxy, Username: "user", Password: "pass"}
+		conn, err := d.DialContext(context.Background(), "tcp", echo)
+		if err != nil {
+			t.Fatalf("DialContext() error = %v", err)
+		}
+		defer conn.Close()
+		assertEcho(t, conn)
+
+		d = &HTTPProxyDialer{Addr: proxy, Username: "user", Password: "bad"}
+		if _, err := d.DialContext(context.Background(), "tcp", echo); !errors.Is(err, ErrProxy) {
+			t.Errorf("DialContext(): want %v, got %v", ErrProxy, err)
+		}
+	})
+
+	t.Run("digest auth", func(t *testing.T) {
+		challenge := `Digest realm="test", nonce="abcdef", qop="auth", opaque="xyz"`
+		proxy := startHTTPProxy(t, challenge, func(h string) bool {
+			if !strings.HasPrefix(h, "Digest ") {
+				return false
+			}
+			p := parseAuthParams(h[len("Digest "):])
+			ha1 := md5Hex("user:test:pass")
+			ha2 := md5Hex("CONNECT:" + p["uri"])
+			want := md5Hex(strings.Join([]string{ha1, "abcdef", p["nc"], p["cnonce"], "auth", ha2}, ":"))
+			return p["response"] == want && p["opaque"] == "xyz"
+		})
+		d := &HTTPProxyDialer{Addr: proxy, Username: "user", Password: "pass", AuthMethod: "digest"}
+		conn, err := d.DialContext(context.Background(), "tcp", echo)
+		if err != nil {
+			t.Fatalf("DialContext() error = %v", err)
+		}
+		defer conn.Close()
+		assertEcho(t, conn)
+	})
+
+	t.Run("udp is not supported", func(t *testing.T) {
+		d := &HTTPProxyDialer{Addr: "127.0.0.1:1"}
+		if _, err := d.DialContext(context.Background(), "udp", echo); !errors.Is(err, ErrProxyNetwork) {
+			t.Errorf("DialContext(): want %v, got %v", ErrProxyNetwork, err)
+		}
+	})
+
+	t.Run("canceled context interrupts the handshake", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		// a proxy that never answers
+		accepted := make(chan struct{})
+		go func() {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			br := bufio.NewReader(c)
+			br.ReadString('\n')
+			close(accepted)
+			io.Copy(io.Discard, br)
+		}()
+		ctx, cancel := context.WithCancel(context.Background())
+		d := &HTTPProxyDialer{Addr: ln.Addr().String()}
+		errch := make(chan error)
+		go func() {
+			_, err := d.DialContext(ctx, "tcp", echo)
+			errch <- err
+		}()
+		<-accepted
+		cancel()
+		if err := <-errch; !errors.Is(err, ErrProxy) {
+			t.Errorf("DialContext(): want %v, got %v", ErrProxy, err)
+		}
+	})
+}
+
+func Test_parseAuthParams(t *testing.T) {
+	got := parseAuthParams(`realm="a, b", nonce=abc, qop="auth,auth-int"`)
+	want := map[string]string{"realm": "a, b", "nonce": "abc", "qop": "auth,auth-int"}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("parseAuthParams(): %s = %q, want %q", k, got[k], v)
+		}
+	}
+}
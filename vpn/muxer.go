@@ -6,8 +6,10 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"strings"
 )
 
 //
@@ -19,6 +21,17 @@ var (
 	ErrBadDataHandshake = errors.New("bad data handshake")
 )
 
+const (
+	// maxControlMessageSize bounds what we buffer while waiting for the end
+	// of a control message.
+	maxControlMessageSize = 1 << 16
+
+	// pushContinuation is the pushed option that tells whether more
+	// PUSH_REPLY messages follow (pushContinuationMore) or not.
+	pushContinuation     = "push-continuation"
+	pushContinuationMore = "2"
+)
+
 /*
  The vpnMuxer interface represents the VPN transport multiplexer.
 
@@ -71,12 +84,19 @@ type muxer struct {
 	// and written to the tls Conn.
 	tls net.Conn
 
+	// tlsBuf keeps what was read from tls past the end of the last control
+	// message.
+	tlsBuf []byte
+
 	// control and data are the handlers for the control and data channels.
 	// they implement the methods needed for the handshake and handling of
 	// packets.
 	control controlHandler
 	data    dataHandler
 
+	// occ is the state of the OCC protocol, that runs on the data channel.
+	occ *occ
+
 	// bufReader is used to buffer data channel reads. We only write to
 	// this buffer when we have correctly decrypted an incoming
 	bufReader *bytes.Buffer
@@ -117,10 +137,10 @@ type vpnMuxer interface {
 // controlHandler manages the control "channel".
 type controlHandler interface {
 	SendHardReset(net.Conn, *session) error
-	ParseHardReset([]byte) (sessionID, error)
+	ParseHardReset([]byte) (*serverHardResetReply, error)
 	SendACK(net.Conn, *session, packetID) error
 	PushRequest() []byte
-	ReadPushResponse([]byte) map[string][]string
+	ReadPushResponse([]byte) []string
 	ControlMessage(*session, *Options) ([]byte, error)
 	ReadControlMessage([]byte) (*keySource, string, error)
 }
@@ -168,6 +188,9 @@ func newMuxerFromOptions(conn net.Conn, options *Options, tunnel *tunnelInfo) (v
 		tunnel:    tunnel,
 		bufReader: br,
 	}
+	m.occ = newOCC(options.String(), func(b []byte) (int, error) {
+		return m.data.WritePacket(m.conn, b)
+	})
 	return m, nil
 }
 
@@ -242,6 +265,9 @@ func (m *muxer) handshake() error {
 	if err != nil {
 		return fmt.Errorf("%w: %s", ErrBadTLSHandshake, err)
 	}
+	if m.options != nil {
+		tlsConn.mtu = m.options.TLSMTU
+	}
 
 	m.emit(EventTLSHandshake)
 
@@ -284,22 +310,28 @@ func (m *muxer) Reset(conn net.Conn, s *session) error {
 		return err
 	}
 
-	remoteSessionID, err := m.control.ParseHardReset(resp)
+	reset, err := m.control.ParseHardReset(resp)
 
 	// here we could check if we have received a remote session id but
 	// our session.remoteSessionID is != from all zeros
 	if err != nil {
 		return err
 	}
-	m.session.RemoteSessionID = remoteSessionID
+	if len(reset.acks) > 0 && reset.ackedSessionID != m.session.LocalSessionID {
+		return fmt.Errorf("%w: %s", errBadReset, "server acked another session")
+	}
+	m.session.RemoteSessionID = reset.sessionID
 
 	logger.Infof("Remote session ID: %x", m.session.RemoteSessionID)
 	logger.Infof("Local session ID:  %x", m.session.LocalSessionID)
 
-	// we assume id is 0, this is the first packet we ack.
-	// XXX I could parse the real packet id from server instead. this
-	// _might_ be important when re-keying?
-	return m.control.SendACK(m.conn, m.session, packetID(1))
+	// a 2.6 server may have answered statelessly, with its session id as a
+	// cookie: it only creates the session once a packet acks its reset and
+	// echoes the cookie. We ack it now, and again in the first control
+	// packet, in case this ack is lost. SendACK acks the message before the
+	// given id.
+	m.session.setResetACK(reset.messageID)
+	return m.control.SendACK(m.conn, m.session, reset.messageID+1)
 }
 
 //
@@ -367,6 +399,13 @@ func (m *muxer) handleIncomingPacket(data []byte) (bool, error) {
 		return false, err
 	}
 
+	if m.occ != nil {
+		m.occ.received(len(input))
+		if isOCC(plaintext) {
+			return false, m.occ.dispatch(plaintext)
+		}
+	}
+
 	// all good! we write the plaintext into the read buffer.
 	// the caller is responsible for reading from there.
 	m.bufReader.Write(plaintext)
@@ -387,6 +426,34 @@ func (m *muxer) readTLSPacket() ([]byte, error) {
 	return data, err
 }
 
+// readControlMessage reads one NUL-terminated control message from the TLS
+// channel, which can span several TLS records. What comes after the
+// terminator is kept for the next message.
+func (m *muxer) readControlMessage() ([]byte, error) {
+	empty := 0
+	for {
+		if i := bytes.IndexByte(m.tlsBuf, 0x00); i >= 0 {
+			msg := m.tlsBuf[:i+1]
+			m.tlsBuf = append([]byte(nil), m.tlsBuf[i+1:]...)
+			return msg, nil
+		}
+		if len(m.tlsBuf) > maxControlMessageSize {
+			return nil, fmt.Errorf("%w: %s", errBadServerReply, "control message too long")
+		}
+		data := make([]byte, 4096)
+		n, err := m.tls.Read(data)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			if empty++; empty >= 100 {
+				return nil, io.ErrNoProgress
+			}
+		}
+		m.tlsBuf = append(m.tlsBuf, data[:n]...)
+	}
+}
+
 // readAndLoadRemoteKey reads one incoming TLS packet, and tries to parse the
 // response contained in it. If the server response is the right kind of
 // packet, it will store the remote key and the parts of the remote options
@@ -424,6 +491,14 @@ func (m *muxer) readAndLoadRemoteKey() error {
 	// Parse and update the useful fields from the remote options (mtu).
 	ti := newTunnelInfoFromRemoteOptionsString(remoteOptStr)
 	m.tunnel.mtu = ti.mtu
+
+	// Like the reference implementation, we only warn about the options
+	// that do not match.
+	if m.options != nil {
+		for _, w := range optionsStringMismatches(m.options.String(), remoteOptStr) {
+			logger.Warn(w)
+		}
+	}
 	return nil
 }
 
@@ -432,36 +507,65 @@ func (m *muxer) sendPushRequest() (int, error) {
 	return m.tls.Write(m.control.PushRequest())
 }
 
-// readPushReply reads one incoming TLS packet, where we expect to find the
-// response to our push request. If the server response is the right kind of
-// packet, it will store the parts of the pushed options that will be of use
-// later.
+// readPushReply reads the response to our push request. Servers that push
+// many options split them over several PUSH_REPLY messages, all but the last
+// one ending with "push-continuation 2", so we read until the last one and
+// merge the options. If the server response is the right kind of packet, it
+// will store the parts of the pushed options that will be of use later.
 func (m *muxer) readPushReply() error {
 	if m.control == nil || m.tunnel == nil {
 		return fmt.Errorf("%w:%s", errBadInput, "muxer badly initialized")
 
 	}
-	resp, err := m.readTLSPacket()
-	if err != nil {
-		return err
-	}
+	var pushed []string
+	for {
+		resp, err := m.readControlMessage()
+		if err != nil {
+			return err
+		}
 
-	logger.Info("Server pushed options")
+		logger.Info("Server pushed options")
 
-	if isBadAuthReply(resp) {
-		return errBadAuth
-	}
+		if isBadAuthReply(resp) {
+			return errBadAuth
+		}
 
-	if !isPushReply(resp) {
-		return fmt.Errorf("%w:%s", errBadServerReply, "expected push reply")
-	}
+		if !isPushReply(resp) {
+			return fmt.Errorf("%w:%s", errBadServerReply, "expected push reply")
+		}
 
-	optsMap := m.control.ReadPushResponse(resp)
-	ti := newTunnelInfoFromPushedOptions(optsMap)
+		more := false
+		for _, opt := range m.control.ReadPushResponse(resp) {
+			if f := strings.Fields(opt); len(f) == 2 && f[0] == pushContinuation {
+				more = f[1] == pushContinuationMore
+				continue
+			}
+			pushed = append(pushed, opt)
+		}
+		if !more {
+			break
+		}
+	}
+	pushed, dropped, err := filterPushedOptions(pushed, m.options)
+	if err != nil {
+		return err
+	}
+	for _, opt := range dropped {
+		logger.Infof("Dropped pushed option: %s", opt)
+	}
+	ti := newTunnelInfoFromPushedOptions(optionsListAsMap(pushed))
 
 	m.tunnel.ip = ti.ip
 	m.tunnel.gw = ti.gw
 	m.tunnel.peerID = ti.peerID
+	m.tunnel.hasPeerID = ti.hasPeerID
+	m.tunnel.netmask = ti.netmask
+	m.tunnel.routeGw = ti.routeGw
+	m.tunnel.ip6 = ti.ip6
+	m.tunnel.gw6 = ti.gw6
+	m.tunnel.info = newTunnelInfoFromPushedList(pushed)
+	m.tunnel.info.Dropped = dropped
+	m.tunnel.info.addClientOptions(m.options)
 
 	logger.Infof("Tunnel IP: %s", m.tunnel.ip)
 	logger.Infof("Gateway IP: %s", m.tunnel.gw)
@@ -522,7 +626,13 @@ func (m *muxer) InitDataWithRemoteKey() error {
 		return err
 	}
 
-	err = m.data.SetPeerID(m.tunnel.peerID)
+	// servers that do not push a peer-id do not know about P_DATA_V2.
+	peerID := m.tunnel.peerID
+	if !m.tunnel.hasPeerID {
+		logger.Info("No peer-id pushed, using P_DATA_V1")
+		peerID = noPeerID
+	}
+	err = m.data.SetPeerID(peerID)
 	if err != nil {
 		return err
 	}
@@ -537,7 +647,25 @@ func (m *muxer) Write(b []byte) (int, error) {
 		return 0, fmt.Errorf("%w:%s", errBadInput, "data not initialized")
 
 	}
-	return m.data.WritePacket(m.conn, b)
+	n, err := m.data.WritePacket(m.conn, b)
+	if err == nil && m.occ != nil {
+		m.occ.sent(len(b), n)
+	}
+	return n, err
+}
+
+// occState returns the OCC state of the muxer.
+func (m *muxer) occState() *occ {
+	return m.occ
+}
+
+// writePing sends an openvpn-ping in the data channel.
+func (m *muxer) writePing() error {
+	if m.data == nil {
+		return fmt.Errorf("%w:%s", errBadInput, "data not initialized")
+	}
+	_, err := m.data.WritePacket(m.conn, pingPayload)
+	return err
 }
 
 // Read reads bytes after decrypting packets from the data channel. This is the
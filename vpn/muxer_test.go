@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"net"
 	"reflect"
 	"testing"
@@ -82,11 +84,7 @@ func makeTestingConnForHandshake(network, addr string, n int) net.Conn {
 		switch c.Count {
 		case 0:
 			// this is the expected reset response from server
-			rp := []byte{
-				0x40,
-				0x00, 0x01, 0x02, 0x03, 0x04,
-				0x05, 0x06, 0x07, 0x08,
-			}
+			rp := makeTestingServerHardReset(sessionID{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}, sessionID{}, nil, 0)
 			copy(b[:], rp)
 			c.Count += 1
 			return len(rp), nil
@@ -99,7 +97,7 @@ func makeTestingConnForHandshake(network, addr string, n int) net.Conn {
 			return len(p), nil
 		case 2:
 			// control message data (to load remote key)
-			p := []byte("PUSH_REPLY")
+			p := []byte("PUSH_REPLY\x00")
 			copy(b[:], p)
 			c.Count += 1
 			return len(p), nil
@@ -604,3 +602,80 @@ func Test_muxer_emitSendsToListener(t *testing.T) {
 		}
 	})
 }
+
+// makeTestingTLSConnForRecords returns a conn that returns each record in a
+// read of its own.
+func makeTestingTLSConnForRecords(records ...string) net.Conn {
+	c := &mocks.Conn{}
+	c.MockRead = func(b []byte) (int, error) {
+		if c.Count == len(records) {
+			return 0, io.EOF
+		}
+		n := copy(b, records[c.Count])
+		c.Count++
+		return n, nil
+	}
+	return c
+}
+
+func Test_muxer_readPushReplyContinuation(t *testing.T) {
+	m := &muxer{
+		control: &control{},
+		tunnel:  &tunnelInfo{},
+		tls: makeTestingTLSConnForRecords(
+			"PUSH_REPLY,route 10.0.0.0 255.0.0.0,ifconf",
+			"ig 10.8.0.2 255.255.255.0,push-continuation 2\x00PUSH_REPLY,route-gateway 10.8.0.1,",
+			"peer-id 3,push-continuation 1\x00",
+		),
+	}
+	if err := m.readPushReply(); err != nil {
+		t.Fatalf("readPushReply(): unexpected error %v", err)
+	}
+	if m.tunnel.ip != "10.8.0.2" || m.tunnel.netmask != "255.255.255.0" || m.tunnel.routeGw != "10.8.0.1" || m.tunnel.peerID != 3 {
+		t.Errorf("readPushReply(): tunnel = %+v", m.tunnel)
+	}
+
+	// a bad auth in the middle still fails.
+	m.tls = makeTestingTLSConnForRecords("PUSH_REPLY,push-continuation 2\x00", "AUTH_FAILED\x00")
+	if err := m.readPushReply(); !errors.Is(err, errBadAuth) {
+		t.Errorf("readPushReply(): want %v, got %v", errBadAuth, err)
+	}
+}
+
+func Test_muxer_readPushReplyLarge(t *testing.T) {
+	// a reply with hundreds of routes does not fit in one read.
+	reply := "PUSH_REPLY"
+	for i := 0; i < 500; i++ {
+		reply += fmt.Sprintf(",route 10.%d.%d.0 255.255.255.0", i/256, i%256)
+	}
+	reply += ",ifconfig 10.8.0.2 10.8.0.1,peer-id 7\x00"
+	var records []string
+	for len(reply) > 0 {
+		n := 1000
+		if n > len(reply) {
+			n = len(reply)
+		}
+		records = append(records, reply[:n])
+		reply = reply[n:]
+	}
+	m := &muxer{control: &control{}, tunnel: &tunnelInfo{}, tls: makeTestingTLSConnForRecords(records...)}
+	if err := m.readPushReply(); err != nil {
+		t.Fatalf("readPushReply(): unexpected error %v", err)
+	}
+	if m.tunnel.ip != "10.8.0.2" || m.tunnel.peerID != 7 {
+		t.Errorf("readPushReply(): tunnel = %+v", m.tunnel)
+	}
+}
+
+func Test_muxer_readControlMessage(t *testing.T) {
+	m := &muxer{tls: makeTestingTLSConnForRecords(string(bytes.Repeat([]byte{'A'}, 4096)))}
+	m.tlsBuf = bytes.Repeat([]byte{'A'}, maxControlMessageSize)
+	if _, err := m.readControlMessage(); !errors.Is(err, errBadServerReply) {
+		t.Errorf("readControlMessage(): want %v, got %v", errBadServerReply, err)
+	}
+
+	m = &muxer{tls: makeTestingTLSConnForRecords("PUSH_RE")}
+	if _, err := m.readControlMessage(); !errors.Is(err, io.EOF) {
+		t.Errorf("readControlMessage(): want %v, got %v", io.EOF, err)
+	}
+}
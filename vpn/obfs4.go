@@ -0,0 +1,61 @@
+package vpn
+
+//
+// obfs4 support for the outer connection (proxy-obfs4).
+//
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"openVPN/obfs4"
+)
+
+// obfs4Dialer is a DialerContext that connects to the remote through the
+// obfs4 bridge given in the proxy-obfs4 option. The bridge is expected to
+// forward the connection to the OpenVPN gateway, so the address passed to
+// DialContext is ignored. Only TCP is supported.
+type obfs4Dialer struct {
+	uri        string
+	underlying DialerContext
+
+	once   sync.Once
+	dialer *obfs4.Dialer
+	err    error
+}
+
+// newOBFS4Dialer returns an obfs4Dialer for the given obfs4:// uri or bridge
+// line, that uses the passed dialer to reach the bridge. The obfs4 client is
+// initialized on the first dial.
+func newOBFS4Dialer(uri string, underlying DialerContext) *obfs4Dialer {
+	return &obfs4Dialer{uri: uri, underlying: underlying}
+}
+
+// DialContext performs the obfs4 handshake with the bridge, and returns the
+// obfuscated conn.
+func (d *obfs4Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("%w: proxy-obfs4 cannot carry %s", ErrProxyNetwork, network)
+	}
+	d.once.Do(func() {
+		node, err := obfs4.NewNodeFromURI(d.uri)
+		if err != nil {
+			d.err = err
+			return
+		}
+		d.dialer, d.err = obfs4.NewDialerFromNode(node)
+		if d.err == nil {
+			d.dialer.UnderlyingDialer = d.underlying
+		}
+	})
+	if d.err != nil {
+		return nil, fmt.Errorf("%w: obfs4: %s", ErrProxy, d.err)
+	}
+	return d.dialer.DialContext(ctx, network, address)
+}
+
+var _ DialerContext = &obfs4Dialer{} // Ensure that we implement DialerContext
@@ -0,0 +1,65 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"openVPN/obfs4"
+)
+
+func Test_obfs4Dialer_DialContext(t *testing.T) {
+	t.Run("udp is not supported", func(t *testing.T) {
+		d := newOBFS4Dialer("obfs4://127.0.0.1:1?cert=foo&iat-mode=0", nil)
+		_, err := d.DialContext(context.Background(), "udp", "127.0.0.1:1194")
+		if !errors.Is(err, ErrProxyNetwork) {
+			t.Errorf("DialContext(): want %v, got %v", ErrProxyNetwork, err)
+		}
+	})
+
+	t.Run("bad node fails and keeps failing", func(t *testing.T) {
+		d := newOBFS4Dialer("obfs4://127.0.0.1:1?cert=foo&iat-mode=0", nil)
+		for i := 0; i < 2; i++ {
+			_, err := d.DialContext(context.Background(), "tcp", "127.0.0.1:1194")
+			if !errors.Is(err, ErrProxy) {
+				t.Errorf("DialContext(): want %v, got %v", ErrProxy, err)
+			}
+		}
+	})
+}
+
+func Test_obfs4Dialer_loopback(t *testing.T) {
+	echo := startEchoServer(t)
+	l, err := obfs4.Listen("tcp", "127.0.0.1:0", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go (&obfs4.Server{Forward: echo}).Serve(l)
+
+	c := NewClientFromOptions(&Options{ProxyOBFS4: l.BridgeLine(""), Proto: TCPMode})
+	conn, err := c.Dialer.DialContext(context.Background(), "tcp", "10.0.0.1:1194")
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn)
+}
+
+func TestNewClientFromOptions_obfs4(t *testing.T) {
+	uri := "obfs4://127.0.0.1:443?cert=foo&iat-mode=0"
+	c := NewClientFromOptions(&Options{ProxyOBFS4: uri, Proto: TCPMode})
+	d, ok := c.Dialer.(*obfs4Dialer)
+	if !ok {
+		t.Fatalf("NewClientFromOptions(): expected an obfs4 dialer, got %T", c.Dialer)
+	}
+	if d.uri != uri {
+		t.Errorf("NewClientFromOptions(): uri = %v, want %v", d.uri, uri)
+	}
+
+	c = NewClientFromOptions(&Options{ProxyOBFS4: uri, Proto: TCPMode, SOCKSProxy: "127.0.0.1:9050"})
+	d = c.Dialer.(*obfs4Dialer)
+	if _, ok := d.underlying.(*SOCKS5Dialer); !ok {
+		t.Errorf("NewClientFromOptions(): expected obfs4 over socks, got %T", d.underlying)
+	}
+}
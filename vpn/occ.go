@@ -0,0 +1,365 @@
+package vpn
+
+//
+// OCC, the options consistency check protocol. OCC messages travel on the
+// data channel, as packets that start with a magic string. The peers use them
+// to exchange their options strings, to measure the path MTU (mtu-test), and
+// to tell each other that they are exiting.
+//
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the OCC message types.
+	occRequest        = 0
+	occReply          = 1
+	occMTURequest     = 2
+	occMTUReply       = 3
+	occMTULoadRequest = 4
+	occMTULoad        = 5
+	occExit           = 6
+
+	// occMTURequestTries is how many times we send an OCC_MTU_REQUEST at the
+	// end of the mtu-test before giving up.
+	occMTURequestTries = 5
+)
+
+var (
+	// ErrRemoteExit is returned by Read when the remote sent an OCC_EXIT,
+	// because it is shutting down or restarting.
+	ErrRemoteExit = errors.New("remote exited")
+
+	errBadOCC = errors.New("bad occ message")
+
+	// occMagic is the prefix of all the OCC messages.
+	occMagic = []byte{0x28, 0x7f, 0x34, 0x6b, 0xd4, 0xef, 0x7a, 0x81, 0x2d, 0x56, 0xb8, 0xd3, 0xaf, 0xc5, 0x45, 0x9c}
+
+	// occMTULoadInterval and occMTURequestInterval are the pace of the
+	// mtu-test. They are variables so that tests run fast.
+	occMTULoadInterval    = time.Second
+	occMTURequestInterval = 2 * time.Second
+
+	// occMTULoadSequence are the sizes, relative to the link-mtu, that the
+	// mtu-test tries in each direction. It is the sequence of the reference
+	// implementation.
+	occMTULoadSequence = []int{
+		-1000, -750, -500, -400, -300, -200, -100, -50, -40, -30, -20, -10,
+		-5, -4, -3, -2, -1, 0, 1, 2, 3, 4, 5, 10, 20, 30, 40, 50, 100,
+	}
+)
+
+// occMuxer is implemented by the muxers that speak OCC.
+type occMuxer interface {
+	occState() *occ
+}
+
+// MTUTestResult is the outcome of mtu-test: the largest packets, on the
+// wire, that each end tried to send and that the other end received.
+type MTUTestResult struct {
+	LocalToRemoteTried int
+	LocalToRemote      int
+	RemoteToLocalTried int
+	RemoteToLocal      int
+}
+
+// occ is the OCC state of a muxer.
+type occ struct {
+	// localOptions is our options string, that we send in OCC_REPLY.
+	localOptions string
+
+	// write encrypts and sends a packet on the data channel, and returns
+	// its size on the wire.
+	write func([]byte) (int, error)
+
+	mu sync.Mutex
+	// maxRecv and maxSend are the largest packets received and sent on
+	// the data channel, and overhead is what the data channel adds to a
+	// payload.
+	maxRecv  int
+	maxSend  int
+	overhead int
+	// result is the mtu-test result, once the remote replied.
+	result *MTUTestResult
+}
+
+// newOCC returns the OCC state for a muxer that writes with write.
+func newOCC(localOptions string, write func([]byte) (int, error)) *occ {
+	return &occ{localOptions: localOptions, write: write}
+}
+
+// isOCC returns true if b is an OCC message.
+func isOCC(b []byte) bool {
+	return len(b) > len(occMagic) && bytes.HasPrefix(b, occMagic)
+}
+
+// received records a data packet of n bytes on the wire.
+func (o *occ) received(n int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if n > o.maxRecv {
+		o.maxRecv = n
+	}
+}
+
+// sent records a payload of size bytes that took n bytes on the wire.
+func (o *occ) sent(size, n int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if n > o.maxSend {
+		o.maxSend = n
+	}
+	if n > size {
+		o.overhead = n - size
+	}
+}
+
+// send sends an OCC message of the given type, with the given body, padded
+// with zeros so that it takes size bytes on the wire, if size is not zero.
+func (o *occ) send(opcode byte, body []byte, size int) error {
+	msg := append(append(append([]byte(nil), occMagic...), opcode), body...)
+	if size > 0 {
+		o.mu.Lock()
+		pad := size - o.overhead - len(msg)
+		o.mu.Unlock()
+		if pad > 0 {
+			msg = append(msg, make([]byte, pad)...)
+		}
+	}
+	n, err := o.write(msg)
+	if err != nil {
+		return err
+	}
+	o.sent(len(msg), n)
+	return nil
+}
+
+// handle processes an OCC message. It returns ErrRemoteExit for OCC_EXIT.
+func (o *occ) handle(b []byte) error {
+	if !isOCC(b) {
+		return fmt.Errorf("%w: %s", errBadOCC, "no magic")
+	}
+	opcode, body := b[len(occMagic)], b[len(occMagic)+1:]
+	switch opcode {
+	case occRequest:
+		logger.Debug("occ: got request")
+		return o.send(occReply, append([]byte(o.localOptions), 0x00), 0)
+
+	case occReply:
+		if i := bytes.IndexByte(body, 0x00); i >= 0 {
+			body = body[:i]
+		}
+		remote := string(body)
+		logger.Debugf("occ: remote options: %s", remote)
+		for _, w := range optionsStringMismatches(o.localOptions, remote) {
+			logger.Warn(w)
+		}
+
+	case occMTURequest:
+		o.mu.Lock()
+		reply := make([]byte, 4)
+		binary.BigEndian.PutUint16(reply, uint16(o.maxRecv))
+		binary.BigEndian.PutUint16(reply[2:], uint16(o.maxSend))
+		o.mu.Unlock()
+		return o.send(occMTUReply, reply, 0)
+
+	case occMTUReply:
+		if len(body) < 4 {
+			return fmt.Errorf("%w: %s", errBadOCC, "short mtu reply")
+		}
+		o.mu.Lock()
+		r := &MTUTestResult{
+			LocalToRemoteTried: o.maxSend,
+			LocalToRemote:      int(binary.BigEndian.Uint16(body)),
+			RemoteToLocalTried: int(binary.BigEndian.Uint16(body[2:])),
+			RemoteToLocal:      o.maxRecv,
+		}
+		o.result = r
+		o.mu.Unlock()
+		logger.Infof(
+			"Empirical MTU test completed [Tried,Actual] local->remote=[%d,%d] remote->local=[%d,%d]",
+			r.LocalToRemoteTried, r.LocalToRemote, r.RemoteToLocalTried, r.RemoteToLocal)
+
+	case occMTULoadRequest:
+		if len(body) < 2 {
+			return fmt.Errorf("%w: %s", errBadOCC, "short mtu load request")
+		}
+		return o.send(occMTULoad, nil, int(binary.BigEndian.Uint16(body)))
+
+	case occMTULoad:
+		// only its size matters, and received already counted it.
+
+	case occExit:
+		logger.Info("occ: remote exited")
+		return ErrRemoteExit
+
+	default:
+		logger.Debugf("occ: unknown message type: %d", opcode)
+	}
+	return nil
+}
+
+// dispatch handles an OCC message read by a muxer. Bad messages are logged
+// and dropped, and only ErrRemoteExit is returned.
+func (o *occ) dispatch(b []byte) error {
+	err := o.handle(b)
+	if err != nil && !errors.Is(err, ErrRemoteExit) {
+		logger.Warnf("occ: %s", err)
+		return nil
+	}
+	return err
+}
+
+// sendExit tells the remote that we exit, n times.
+func (o *occ) sendExit(n int) {
+	for i := 0; i < n; i++ {
+		if err := o.send(occExit, nil, 0); err != nil {
+			logger.Warnf("occ: cannot send exit: %s", err)
+			return
+		}
+	}
+}
+
+// mtuTestResult returns the mtu-test result, and false if there is none yet.
+func (o *occ) mtuTestResult() (MTUTestResult, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.result == nil {
+		return MTUTestResult{}, false
+	}
+	return *o.result, true
+}
+
+// runMTUTest runs the mtu-test: it sends packets of growing sizes around
+// linkMTU and asks the remote to do the same, and then asks the remote for
+// the largest packets it received and sent. The answer is handled by
+// handle, as the muxer reads. runMTUTest stops early if done is closed.
+func (o *occ) runMTUTest(linkMTU int, done <-chan struct{}) {
+	wait := func(d time.Duration) bool {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-done:
+			return false
+		case <-t.C:
+			return true
+		}
+	}
+	logger.Infof("mtu-test: starting, link-mtu %d", linkMTU)
+	// a first small message teaches us the overhead of the data channel.
+	if err := o.send(occRequest, nil, 0); err != nil {
+		logger.Warnf("mtu-test: %s", err)
+		return
+	}
+	for _, delta := range occMTULoadSequence {
+		size := linkMTU + delta
+		req := make([]byte, 2)
+		binary.BigEndian.PutUint16(req, uint16(size))
+		if err := o.send(occMTULoadRequest, req, 0); err != nil {
+			logger.Warnf("mtu-test: %s", err)
+			return
+		}
+		if err := o.send(occMTULoad, nil, size); err != nil {
+			// too large for the local network.
+			logger.Debugf("mtu-test: cannot send %d bytes: %s", size, err)
+		}
+		if !wait(occMTULoadInterval) {
+			return
+		}
+	}
+	for i := 0; i < occMTURequestTries; i++ {
+		if err := o.send(occMTURequest, nil, 0); err != nil {
+			logger.Warnf("mtu-test: %s", err)
+			return
+		}
+		if !wait(occMTURequestInterval) {
+			return
+		}
+		if _, ok := o.mtuTestResult(); ok {
+			return
+		}
+	}
+	logger.Warn("mtu-test: no reply from the remote")
+}
+
+// optionsStringMismatches compares, field by field, our options string with
+// the one of the remote, and describes each inconsistency. What differs
+// between the two ends by design (tls-client and tls-server, the order of the
+// ifconfig addresses, the _SERVER suffix of a TCP proto) is not reported.
+func optionsStringMismatches(local, remote string) []string {
+	if local == "" || remote == "" {
+		return nil
+	}
+	want := optionsStringFields(expectedRemoteOptions(local))
+	got := optionsStringFields(remote)
+	wantByKey, gotByKey := fieldsByKey(want), fieldsByKey(got)
+	var out []string
+	for _, f := range want {
+		r, ok := gotByKey[f.key]
+		switch {
+		case !ok:
+			out = append(out, fmt.Sprintf("'%s' is present in local config but missing in remote config, local='%s'", f.key, f.value))
+		case r.value != f.value:
+			out = append(out, fmt.Sprintf("'%s' is used inconsistently, local='%s', remote='%s'", f.key, f.value, r.value))
+		}
+	}
+	for _, f := range got {
+		if _, ok := wantByKey[f.key]; !ok {
+			out = append(out, fmt.Sprintf("'%s' is present in remote config but missing in local config, remote='%s'", f.key, f.value))
+		}
+	}
+	return out
+}
+
+// optionsField is a field of an options string: the option name, and the
+// whole field.
+type optionsField struct {
+	key, value string
+}
+
+// optionsStringFields splits an options string in fields.
+func optionsStringFields(s string) []optionsField {
+	var out []optionsField
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		out = append(out, optionsField{key: strings.SplitN(field, " ", 2)[0], value: field})
+	}
+	return out
+}
+
+// fieldsByKey indexes fields by option name.
+func fieldsByKey(fields []optionsField) map[string]optionsField {
+	m := make(map[string]optionsField, len(fields))
+	for _, f := range fields {
+		m[f.key] = f
+	}
+	return m
+}
+
+// expectedRemoteOptions returns the options string that the remote should
+// send, given ours.
+func expectedRemoteOptions(local string) string {
+	fields := strings.Split(local, ",")
+	for i, f := range fields {
+		p := strings.Split(f, " ")
+		switch {
+		case f == "tls-client":
+			fields[i] = "tls-server"
+		case p[0] == "proto" && len(p) == 2 && strings.HasPrefix(p[1], "TCP"):
+			fields[i] = f + "_SERVER"
+		case p[0] == "ifconfig" && len(p) == 3:
+			fields[i] = strings.Join([]string{p[0], p[2], p[1]}, " ")
+		}
+	}
+	return strings.Join(fields, ",")
+}
@@ -0,0 +1,237 @@
+package vpn
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// makeTestingOCC returns an occ whose writes are recorded, and take 10 more
+// bytes on the wire.
+func makeTestingOCC(options string) (*occ, *[][]byte) {
+	var written [][]byte
+	o := newOCC(options, func(b []byte) (int, error) {
+		written = append(written, append([]byte(nil), b...))
+		return len(b) + 10, nil
+	})
+	return o, &written
+}
+
+func makeTestingOCCMessage(opcode byte, body ...byte) []byte {
+	return append(append(append([]byte(nil), occMagic...), opcode), body...)
+}
+
+func Test_isOCC(t *testing.T) {
+	if !isOCC(makeTestingOCCMessage(occRequest)) {
+		t.Error("isOCC(request) = false")
+	}
+	if isOCC(occMagic) || isOCC(pingPayload) || isOCC(nil) {
+		t.Error("isOCC() = true for a non-OCC payload")
+	}
+}
+
+func Test_occ_handle(t *testing.T) {
+	o, written := makeTestingOCC("V4,dev-type tun")
+
+	if err := o.handle(makeTestingOCCMessage(occRequest)); err != nil {
+		t.Fatal(err)
+	}
+	want := makeTestingOCCMessage(occReply, []byte("V4,dev-type tun\x00")...)
+	if got := (*written)[0]; !bytes.Equal(got, want) {
+		t.Errorf("reply to request = %q, want %q", got, want)
+	}
+
+	// the reply taught the overhead, and a load request is answered with a
+	// packet of the requested size on the wire.
+	if err := o.handle(makeTestingOCCMessage(occMTULoadRequest, 0x01, 0x00)); err != nil {
+		t.Fatal(err)
+	}
+	load := (*written)[1]
+	if len(load)+10 != 256 || load[len(occMagic)] != occMTULoad {
+		t.Errorf("mtu load: got %d bytes, opcode %d", len(load), load[len(occMagic)])
+	}
+
+	o.received(300)
+	if err := o.handle(makeTestingOCCMessage(occMTURequest)); err != nil {
+		t.Fatal(err)
+	}
+	want = makeTestingOCCMessage(occMTUReply, 0x01, 0x2c, 0x01, 0x00)
+	if got := (*written)[2]; !bytes.Equal(got, want) {
+		t.Errorf("reply to mtu request = %x, want %x", got, want)
+	}
+
+	if _, ok := o.mtuTestResult(); ok {
+		t.Error("mtuTestResult(): got a result before the reply")
+	}
+	if err := o.handle(makeTestingOCCMessage(occMTUReply, 0x00, 0xfa, 0x01, 0x00)); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := o.mtuTestResult()
+	wantResult := MTUTestResult{LocalToRemoteTried: 256, LocalToRemote: 250, RemoteToLocalTried: 256, RemoteToLocal: 300}
+	if !ok || got != wantResult {
+		t.Errorf("mtuTestResult() = %+v, %v, want %+v", got, ok, wantResult)
+	}
+
+	if err := o.handle(makeTestingOCCMessage(occExit)); !errors.Is(err, ErrRemoteExit) {
+		t.Errorf("handle(exit): want %v, got %v", ErrRemoteExit, err)
+	}
+	for _, m := range [][]byte{pingPayload, makeTestingOCCMessage(occMTUReply, 0x01), makeTestingOCCMessage(occMTULoadRequest)} {
+		if err := o.handle(m); !errors.Is(err, errBadOCC) {
+			t.Errorf("handle(%x): want %v, got %v", m, errBadOCC, err)
+		}
+		if err := o.dispatch(m); err != nil {
+			t.Errorf("dispatch(%x): bad messages are dropped, got %v", m, err)
+		}
+	}
+	if err := o.dispatch(makeTestingOCCMessage(occExit)); !errors.Is(err, ErrRemoteExit) {
+		t.Errorf("dispatch(exit): want %v, got %v", ErrRemoteExit, err)
+	}
+}
+
+func Test_optionsStringMismatches(t *testing.T) {
+	local := "V4,dev-type tun,link-mtu 1549,tun-mtu 1500,proto TCPv4,cipher AES-256-GCM,auth [null-digest],keysize 256,key-method 2,tls-client"
+	tests := []struct {
+		name   string
+		remote string
+		want   []string
+	}{
+		{
+			"consistent",
+			"V4,dev-type tun,link-mtu 1549,tun-mtu 1500,proto TCPv4_SERVER,cipher AES-256-GCM,auth [null-digest],keysize 256,key-method 2,tls-server",
+			nil,
+		},
+		{
+			"inconsistent",
+			"V4,dev-type tun,link-mtu 1551,tun-mtu 1500,proto TCPv4_SERVER,cipher AES-128-GCM,auth [null-digest],key-method 2,tls-server,comp-lzo",
+			[]string{
+				"'link-mtu' is used inconsistently, local='link-mtu 1549', remote='link-mtu 1551'",
+				"'cipher' is used inconsistently, local='cipher AES-256-GCM', remote='cipher AES-128-GCM'",
+				"'keysize' is present in local config but missing in remote config, local='keysize 256'",
+				"'comp-lzo' is present in remote config but missing in local config, remote='comp-lzo'",
+			},
+		},
+		{
+			"no remote options",
+			"",
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := optionsStringMismatches(local, tt.remote); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("optionsStringMismatches() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	static := "V4,dev-type tun,link-mtu 1549,tun-mtu 1500,proto UDPv4,ifconfig 10.8.0.2 10.8.0.1,cipher AES-256-CBC,auth SHA256,keysize 256,secret"
+	remote := "V4,dev-type tun,link-mtu 1549,tun-mtu 1500,proto UDPv4,ifconfig 10.8.0.1 10.8.0.2,cipher AES-256-CBC,auth SHA256,keysize 256,secret"
+	if got := optionsStringMismatches(static, remote); got != nil {
+		t.Errorf("optionsStringMismatches(static) = %q, want none", got)
+	}
+}
+
+func TestOptions_String_staticKey(t *testing.T) {
+	o := makeTestingStaticKeyOptions([]byte("secret"), "1")
+	want := "V4,dev-type tun,link-mtu 1549,tun-mtu 1500,proto UDPv4,ifconfig 10.8.0.2 10.8.0.1,cipher AES-256-CBC,auth SHA256,keysize 256,secret"
+	if got := o.String(); got != want {
+		t.Errorf("Options.String() = %q, want %q", got, want)
+	}
+}
+
+func Test_parseOCCOptions(t *testing.T) {
+	o, err := getOptionsFromLines([]string{"mtu-test", "explicit-exit-notify 3"}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !o.MTUTest || o.ExplicitExitNotify != 3 {
+		t.Errorf("getOptionsFromLines(): mtu-test = %v, explicit-exit-notify = %d", o.MTUTest, o.ExplicitExitNotify)
+	}
+	o = &Options{}
+	if err := parseExplicitExitNotify(nil, o); err != nil || o.ExplicitExitNotify != 1 {
+		t.Errorf("parseExplicitExitNotify(): got %d, %v, want 1", o.ExplicitExitNotify, err)
+	}
+	bad := []struct {
+		fn func([]string, *Options) error
+		p  []string
+	}{
+		{parseMTUTest, []string{"1"}},
+		{parseExplicitExitNotify, []string{"many"}},
+		{parseExplicitExitNotify, []string{"-1"}},
+		{parseExplicitExitNotify, []string{"1", "2"}},
+	}
+	for _, b := range bad {
+		if err := b.fn(b.p, &Options{}); !errors.Is(err, errBadCfg) {
+			t.Errorf("parsing %v: want %v, got %v", b.p, errBadCfg, err)
+		}
+	}
+}
+
+// makeTestingStaticKeyPair returns two static key muxers that talk to each
+// other over UDP.
+func makeTestingStaticKeyPair(t *testing.T) (*staticKeyMuxer, *staticKeyMuxer) {
+	useRealRandomFn()
+	_, secret := makeTestingStaticKey()
+	c1, c2 := makeTestingUDPPair(t)
+	a, err := newStaticKeyMuxerFromOptions(c1, makeTestingStaticKeyOptions(secret, "1"), &tunnelInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := makeTestingStaticKeyOptions(secret, "0")
+	opts.IfconfigLocal, opts.IfconfigRemote = opts.IfconfigRemote, opts.IfconfigLocal
+	b, err := newStaticKeyMuxerFromOptions(c2, opts, &tunnelInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a.(*staticKeyMuxer), b.(*staticKeyMuxer)
+}
+
+func Test_staticKeyMuxer_occExit(t *testing.T) {
+	a, b := makeTestingStaticKeyPair(t)
+	a.occState().sendExit(1)
+	b.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := b.Read(make([]byte, 64)); !errors.Is(err, ErrRemoteExit) {
+		t.Errorf("Read(): want %v, got %v", ErrRemoteExit, err)
+	}
+}
+
+func Test_occ_runMTUTest(t *testing.T) {
+	defer func(l, r time.Duration) { occMTULoadInterval, occMTURequestInterval = l, r }(occMTULoadInterval, occMTURequestInterval)
+	occMTULoadInterval, occMTURequestInterval = time.Millisecond, 100*time.Millisecond
+
+	a, b := makeTestingStaticKeyPair(t)
+	var wg sync.WaitGroup
+	for _, m := range []*staticKeyMuxer{a, b} {
+		wg.Add(1)
+		go func(m *staticKeyMuxer) {
+			defer wg.Done()
+			buf := make([]byte, 4096)
+			for {
+				if _, err := m.Read(buf); err != nil {
+					return
+				}
+			}
+		}(m)
+	}
+	a.occState().runMTUTest(1549, make(chan struct{}))
+	a.conn.SetReadDeadline(time.Now())
+	b.conn.SetReadDeadline(time.Now())
+	wg.Wait()
+
+	r, ok := a.occState().mtuTestResult()
+	if !ok {
+		t.Fatal("mtuTestResult(): no result")
+	}
+	// nothing is lost on the loopback, and the largest packets are the
+	// link-mtu plus 100, give or take the cbc padding.
+	if r.LocalToRemote != r.LocalToRemoteTried || r.RemoteToLocal != r.RemoteToLocalTried {
+		t.Errorf("mtuTestResult() = %+v, want no loss", r)
+	}
+	for _, size := range []int{r.LocalToRemote, r.RemoteToLocal} {
+		if size < 1649-16 || size > 1649+16 {
+			t.Errorf("mtuTestResult() = %+v, want sizes close to 1649", r)
+		}
+	}
+}
@@ -8,12 +8,16 @@ package vpn
 // and fat dependencies, the main `vpn` module only supports mainline
 // capabilities. It is still useful to carry all options in a single type,
 // so it's up to the user of this library to do something useful with
-// such options. The `extra` package provides some of these extra features, like
-// obfuscation support.
+// such options. The `extra` package provides some of these extra features.
+// The exception is obfuscation with obfs4: when the `proxy-obfs4` option is
+// present, the Client dials through the obfs4 bridge on its own. The same goes
+// for `proxy-pt`, which launches a managed pluggable transport, and for
+// `proxy-websocket` and `proxy-tls`.
 //
 // Following the configuration format in the reference implementation, `minivpn`
-// allows including files in the main configuration file, but only for the `ca`,
-// `cert` and `key` options.
+// allows including files in the main configuration file, for the `ca`, `cert`,
+// `extra-certs`, `key`, `tls-auth`, `tls-crypt`, `secret` and `auth-user-pass`
+// options. See config.go for the grammar.
 //
 // Each inline file is started by the line <option> and ended by the line
 // </option>.
@@ -30,14 +34,18 @@ package vpn
 
 import (
 	"bufio"
-	"bytes"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"math"
+	"net"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type (
@@ -114,9 +122,124 @@ type Options struct {
 	Cipher    string
 	Auth      string
 	TLSMaxVer string
+	// TLSMTU is the largest control packet that we send (tls-mtu). Zero
+	// means the default, 1250 bytes.
+	TLSMTU int
+	// ExtraCertsPath and ExtraCerts are the intermediate certificates sent
+	// along with Cert (extra-certs).
+	ExtraCertsPath string
+	ExtraCerts     []byte
+	// TLSCryptPath and TLSCrypt are the tls-crypt key. The control channel
+	// does not use it yet.
+	TLSCryptPath string
+	TLSCrypt     []byte
+	// SecretPath and Secret are the static key for the pre-shared secret
+	// point-to-point mode, where there is no TLS. KeyDirection is empty
+	// (both directions use the same keys), "0" or "1".
+	SecretPath   string
+	Secret       []byte
+	KeyDirection string
+	// IfconfigLocal and IfconfigRemote are the tunnel addresses in static
+	// key mode, where the server does not push them.
+	IfconfigLocal  string
+	IfconfigRemote string
+	// PullFilters are checked in order against each pushed option, and the
+	// first one that matches decides. RouteNoPull drops the pushed routes
+	// and dhcp-options.
+	PullFilters []PullFilter
+	RouteNoPull bool
+	// Routes, RoutesIPv6, DNS and Domains are given on the client side,
+	// and added to the pushed ones in Client.TunnelInfo.
+	Routes     []Route
+	RoutesIPv6 []Route
+	DNS        []string
+	Domains    []string
+	// DevType is the kind of virtual device: "tun" (the default), or "tap"
+	// for bridged servers, that carry Ethernet frames.
+	DevType string
+	// SetEnv holds the variables given with setenv. IV_GUI_VER and IV_SSO
+	// go in the peer-info; IV_PLAT_VER and the UV_* variables too, but only
+	// with PushPeerInfo (push-peer-info).
+	SetEnv       map[string]string
+	PushPeerInfo bool
+	// PeerInfo overrides the keys of the peer-info that we send by default
+	// (IV_VER, IV_NCP, IV_MTU...), or adds new ones. An empty value removes
+	// a key.
+	PeerInfo map[string]string
+	// MTUTest runs the empirical path MTU test (mtu-test) after the
+	// handshake. See Client.MTUTestResult.
+	MTUTest bool
+	// ExplicitExitNotify is how many times Close tells the remote that we
+	// exit, over UDP (explicit-exit-notify).
+	ExplicitExitNotify int
+	// Local and LPort are the address and port the outer socket is bound
+	// to. They are ignored when NoBind is set.
+	Local  string
+	LPort  string
+	NoBind bool
+	// BindDev is the network interface the outer socket is bound to
+	// (SO_BINDTODEVICE), and Mark is the SO_MARK set on it. Linux only.
+	BindDev string
+	Mark    int
+	// HTTPProxy is the host:port of an HTTP proxy that the outer TCP
+	// connection goes through (with the CONNECT method).
+	HTTPProxy     string
+	HTTPProxyUser string
+	HTTPProxyPass string
+	HTTPProxyAuth string
+	// SOCKSProxy is the host:port of a SOCKS5 proxy that the outer
+	// connection goes through (CONNECT for TCP, UDP ASSOCIATE for UDP).
+	SOCKSProxy     string
+	SOCKSProxyUser string
+	SOCKSProxyPass string
+	// ScrambleMethod is one of xormask, xorptrpos, reverse or obfuscate,
+	// as in the scramble patch. ScrambleMask is the mask for xormask and
+	// obfuscate.
+	ScrambleMethod string
+	ScrambleMask   string
+	// WriteLimiter caps the rate of outgoing data packets (the shaper
+	// directive), and ReadLimiter the rate of incoming ones. They can be
+	// set programmatically, and shared by several tunnels.
+	WriteLimiter *RateLimiter
+	ReadLimiter  *RateLimiter
 	// below are options that do not conform to the OpenVPN configuration format.
 	ProxyOBFS4 string
-	Log        Logger
+	// ProxyPT is the name of a managed pluggable transport, ProxyPTCmd the
+	// binary (and arguments) that provides it, and ProxyPTArgs the
+	// key=value arguments for the bridge.
+	ProxyPT     string
+	ProxyPTCmd  []string
+	ProxyPTArgs []string
+	// ProxyWebSocket is the ws:// or wss:// url of a websocket relay,
+	// ProxyWebSocketHost overrides the Host header, and
+	// ProxyWebSocketFingerprint names the uTLS preset used for wss://.
+	ProxyWebSocket            string
+	ProxyWebSocketHost        string
+	ProxyWebSocketFingerprint string
+	// ProxyTLS wraps the outer TCP connection in a TLS session, with the
+	// given server name, ALPN protocols, uTLS preset and public key pins.
+	ProxyTLS            bool
+	ProxyTLSServerName  string
+	ProxyTLSALPN        []string
+	ProxyTLSFingerprint string
+	ProxyTLSPins        []string
+	// Shaping is the packet length and timing policy for the outer
+	// connection (shaping-buckets, shaping-jitter and shaping-cover).
+	Shaping *ShapingPolicy
+	// PortHopInterval, if set, is how often the outer UDP socket is moved
+	// to a new source port. If PortHopLow is set, the server port is also
+	// picked at random in [PortHopLow, PortHopHigh].
+	PortHopInterval time.Duration
+	PortHopLow      int
+	PortHopHigh     int
+	// Connections are the <connection> blocks of the config file, the
+	// first of which is used.
+	Connections []Connection
+	Log         Logger
+
+	// port is the port given with the port directive, for the remotes
+	// that have none.
+	port string
 }
 
 // NewOptionsFromFilePath expects a string with a path to a valid config file,
@@ -131,6 +254,37 @@ func NewOptionsFromFilePath(filePath string) (*Options, error) {
 	return getOptionsFromLines(lines, dir)
 }
 
+// NewOptionsFromReader parses a config file that it reads from r. The files
+// that it refers to must be below dir, on disk. With an empty dir, they are
+// relative to the working directory. Use a ConfigParser for other policies,
+// or to get the diagnostics.
+func NewOptionsFromReader(r io.Reader, dir string) (*Options, error) {
+	o, diagnostics, err := (&ConfigParser{}).Parse(r, dir)
+	if err != nil {
+		return nil, err
+	}
+	logDiagnostics(diagnostics)
+	return o, nil
+}
+
+// NewOptionsFromFS parses the config file at name in fsys, an embedded
+// filesystem for instance. The files that it refers to are read from fsys,
+// and must be below the directory of the config file.
+func NewOptionsFromFS(fsys fs.FS, name string) (*Options, error) {
+	o, diagnostics, err := (&ConfigParser{FS: fsys}).ParseFile(name)
+	if err != nil {
+		return nil, err
+	}
+	logDiagnostics(diagnostics)
+	return o, nil
+}
+
+// staticKeyMode returns true when the options configure the pre-shared
+// secret point-to-point mode.
+func (o *Options) staticKeyMode() bool {
+	return o.SecretPath != "" || len(o.Secret) != 0
+}
+
 // certsFromPath returns true when the options object is configured to load
 // certificates from paths; false when we have inline certificates.
 func (o *Options) certsFromPath() bool {
@@ -154,7 +308,39 @@ func (o *Options) hasAuthInfo() bool {
 	return false
 }
 
-const clientOptions = "V4,dev-type tun,link-mtu 1549,tun-mtu 1500,proto %sv4,cipher %s,auth %s,keysize %s,key-method 2,tls-client"
+const clientOptions = "V4,dev-type %s,link-mtu %d,tun-mtu %d,proto %sv4,cipher %s,auth %s,keysize %s,key-method 2,tls-client"
+
+// staticKeyOptions is the options string in static key mode, where the
+// addresses are set on both ends and there is no TLS.
+const staticKeyOptions = "V4,dev-type %s,link-mtu %d,tun-mtu %d,proto %sv4,ifconfig %s %s,cipher %s,auth %s,keysize %s,secret"
+
+// nullDigest is the auth in the options string for AEAD ciphers, that do not
+// use a separate HMAC.
+const nullDigest = "[null-digest]"
+
+const (
+	// devTypeTUN is the default device type, that carries IP packets.
+	devTypeTUN = "tun"
+
+	// devTypeTAP is the device type that carries Ethernet frames.
+	devTypeTAP = "tap"
+)
+
+// tapMode returns true when the options ask for a tap device.
+func (o *Options) tapMode() bool {
+	return o != nil && o.DevType == devTypeTAP
+}
+
+// devMTUs returns the device type, the link-mtu and the tun-mtu that we
+// declare in the options string.
+func (o *Options) devMTUs() (string, int, int) {
+	devType, linkMTU, tunMTU := devTypeTUN, 1549, 1500
+	if o.tapMode() {
+		// the reference implementation adds tun-mtu-extra to tap devices.
+		devType, linkMTU, tunMTU = devTypeTAP, linkMTU+tapMTUExtra, tunMTU+tapMTUExtra
+	}
+	return devType, linkMTU, tunMTU
+}
 
 // String produces a comma-separated representation of the options, in the same
 // order and format that the openvpn server expects from us.
@@ -167,9 +353,21 @@ func (o *Options) String() string {
 	if o.Proto == TCPMode {
 		proto = strings.ToUpper(protoTCP.String())
 	}
-	s := fmt.Sprintf(
-		clientOptions,
-		proto, o.Cipher, o.Auth, keysize)
+	devType, linkMTU, tunMTU := o.devMTUs()
+	auth := o.Auth
+	if strings.HasSuffix(o.Cipher, "-GCM") {
+		auth = nullDigest
+	}
+	var s string
+	if o.staticKeyMode() {
+		s = fmt.Sprintf(
+			staticKeyOptions,
+			devType, linkMTU, tunMTU, proto, o.IfconfigLocal, o.IfconfigRemote, o.Cipher, auth, keysize)
+	} else {
+		s = fmt.Sprintf(
+			clientOptions,
+			devType, linkMTU, tunMTU, proto, o.Cipher, auth, keysize)
+	}
 	if o.Compress == compressionStub {
 		s = s + ",compress stub"
 	} else if o.Compress == "lzo-no" {
@@ -214,15 +412,28 @@ func newTunnelInfoFromPushedOptions(opts map[string][]string) *tunnelInfo {
 	} else if r := opts["route-gateway"]; len(r) >= 1 {
 		t.gw = r[0]
 	}
+	if r := opts["route-gateway"]; len(r) >= 1 {
+		t.routeGw = r[0]
+	}
 	ip := opts["ifconfig"]
 	if len(ip) >= 1 {
 		t.ip = ip[0]
 	}
+	if len(ip) >= 2 && isNetmask(ip[1]) {
+		t.netmask = ip[1]
+	}
+	if ip6 := opts["ifconfig-ipv6"]; len(ip6) >= 1 {
+		t.ip6 = ip6[0]
+		if len(ip6) >= 2 {
+			t.gw6 = ip6[1]
+		}
+	}
 	peerID := opts["peer-id"]
 	if len(peerID) == 1 {
 		i, err := parseIntFromOption(peerID[0])
 		if err == nil {
 			t.peerID = i
+			t.hasPeerID = true
 		} else {
 			log.Println("Cannot parse peer-id:", err.Error())
 		}
@@ -230,30 +441,33 @@ func newTunnelInfoFromPushedOptions(opts map[string][]string) *tunnelInfo {
 	return t
 }
 
-// parseIntFromOption parses an int from a null-terminated string
+// isNetmask returns true if s is an IPv4 netmask in dotted quad form (as
+// pushed with topology subnet, or in tap mode), and not the address of the
+// peer.
+func isNetmask(s string) bool {
+	ip := net.ParseIP(s).To4()
+	if ip == nil {
+		return false
+	}
+	_, bits := net.IPMask(ip).Size()
+	return bits != 0
+}
+
+// parseIntFromOption parses an int from a string, that may be
+// null-terminated.
 func parseIntFromOption(s string) (int, error) {
-	str := ""
-	for i := 0; i < len(s); i++ {
-		if byte(s[i]) == 0x00 {
-			return strconv.Atoi(str)
-		}
-		str = str + string(s[i])
+	if i := strings.IndexByte(s, 0x00); i >= 0 {
+		s = s[:i]
 	}
-	return 0, nil
+	return strconv.Atoi(s)
 }
 
-// pushedOptionsAsMap returns a map for the server-pushed options,
+// optionsListAsMap returns a map for the server-pushed options,
 // where the options are the keys and each space-separated value is the value.
-// This function always returns an initialized map, even if empty.
-func pushedOptionsAsMap(pushedOptions []byte) map[string][]string {
+// A repeated option overwrites the earlier ones; see TunnelInfo for all of
+// them. This function always returns an initialized map, even if empty.
+func optionsListAsMap(opts []string) map[string][]string {
 	optMap := make(map[string][]string)
-	if pushedOptions == nil || len(pushedOptions) == 0 {
-		return optMap
-	}
-
-	optStr := string(pushedOptions[:len(pushedOptions)-1])
-
-	opts := strings.Split(optStr, ",")
 	for _, opt := range opts {
 		vals := strings.Split(opt, " ")
 		k, v := vals[0], vals[1:]
@@ -268,9 +482,9 @@ func parseProto(p []string, o *Options) error {
 	}
 	m := p[0]
 	switch m {
-	case protoUDP.String():
+	case protoUDP.String(), "udp4":
 		o.Proto = UDPMode
-	case protoTCP.String():
+	case protoTCP.String(), "tcp4", "tcp-client", "tcp4-client":
 		o.Proto = TCPMode
 	default:
 		return fmt.Errorf("%w: bad proto: %s", errBadCfg, m)
@@ -281,14 +495,47 @@ func parseProto(p []string, o *Options) error {
 
 // TODO(ainghazal): all these little functions can be better tested if we return the options object too
 
+// parseRemote parses the remote, in the form:
+// remote host [port [proto]]
+// A remote without a port uses the one of the port directive, or 1194.
 func parseRemote(p []string, o *Options) error {
-	if len(p) != 2 {
-		return fmt.Errorf("%w: %s", errBadCfg, "remote needs two args")
+	if len(p) < 1 || len(p) > 3 {
+		return fmt.Errorf("%w: %s", errBadCfg, "remote expects a host, and optional port and proto")
+	}
+	o.Remote, o.Port = p[0], ""
+	if len(p) > 1 {
+		if err := parsePort(p[1:2], &Options{}); err != nil {
+			return err
+		}
+		o.Port = p[1]
+	}
+	if len(p) == 3 {
+		return parseProto(p[2:], o)
+	}
+	return nil
+}
+
+// parsePort parses the port (or rport) of the remotes that have none:
+// port <port>
+func parsePort(p []string, o *Options) error {
+	if len(p) != 1 {
+		return fmt.Errorf("%w: %s", errBadCfg, "port expects one arg")
 	}
-	o.Remote, o.Port = p[0], p[1]
+	if n, err := strconv.Atoi(p[0]); err != nil || n < 0 || n > math.MaxUint16 {
+		return fmt.Errorf("%w: bad port: %s", errBadCfg, p[0])
+	}
+	o.port = p[0]
 	return nil
 }
 
+// defaultPort returns the port for a remote that has none.
+func (o *Options) defaultPort() string {
+	if o.port != "" {
+		return o.port
+	}
+	return "1194"
+}
+
 func parseCipher(p []string, o *Options) error {
 	if len(p) != 1 {
 		return fmt.Errorf("%w: %s", errBadCfg, "cipher expects one arg")
@@ -313,86 +560,293 @@ func parseAuth(p []string, o *Options) error {
 	return nil
 }
 
-func parseCA(p []string, o *Options, basedir string) error {
-	e := fmt.Errorf("%w: %s", errBadCfg, "ca expects a valid file")
+func parseCA(p []string, o *Options, files *configFiles) error {
 	if len(p) != 1 {
-		return e
+		return fmt.Errorf("%w: %s", errBadCfg, "ca expects a valid file")
 	}
-	ca := toAbs(p[0], basedir)
-	if sub, _ := isSubdir(basedir, ca); !sub {
-		return fmt.Errorf("%w: %s", errBadCfg, "ca must be below config path")
+	return files.load("ca", p[0], &o.CaPath, &o.Ca)
+}
+
+// parseTA parses the tls-auth key file, and the optional key direction:
+// tls-auth <file> [0|1]
+func parseTA(p []string, o *Options, files *configFiles) error {
+	if len(p) != 1 && len(p) != 2 {
+		return fmt.Errorf("%w: %s", errBadCfg, "ta expects a valid file")
 	}
-	if !existsFile(ca) {
-		return e
+	if len(p) == 2 {
+		if err := parseKeyDirection(p[1:], o); err != nil {
+			return err
+		}
 	}
-	o.CaPath = ca
-	return nil
+	return files.load("ta", p[0], &o.TaPath, &o.Ta)
 }
 
-func parseTA(p []string, o *Options, basedir string) error {
-	e := fmt.Errorf("%w: %s", errBadCfg, "ta expects a valid file")
+// parseTLSCrypt parses the tls-crypt key file:
+// tls-crypt <file>
+func parseTLSCrypt(p []string, o *Options, files *configFiles) error {
 	if len(p) != 1 {
-		return e
+		return fmt.Errorf("%w: %s", errBadCfg, "tls-crypt expects a valid file")
 	}
-	ta := toAbs(p[0], basedir)
-	if sub, _ := isSubdir(basedir, ta); !sub {
-		return fmt.Errorf("%w: %s", errBadCfg, "ta must be below config path")
+	return files.load("tls-crypt", p[0], &o.TLSCryptPath, &o.TLSCrypt)
+}
+
+// parseExtraCerts parses the file with the intermediate certificates:
+// extra-certs <file>
+func parseExtraCerts(p []string, o *Options, files *configFiles) error {
+	if len(p) != 1 {
+		return fmt.Errorf("%w: %s", errBadCfg, "extra-certs expects a valid file")
+	}
+	return files.load("extra-certs", p[0], &o.ExtraCertsPath, &o.ExtraCerts)
+}
+
+// parseSecret parses the static key file, and the optional key direction:
+// secret <file> [0|1]
+func parseSecret(p []string, o *Options, files *configFiles) error {
+	if len(p) != 1 && len(p) != 2 {
+		return fmt.Errorf("%w: %s", errBadCfg, "secret expects a valid file")
 	}
-	if !existsFile(ta) {
-		return e
+	if len(p) == 2 {
+		if err := parseKeyDirection(p[1:], o); err != nil {
+			return err
+		}
+	}
+	return files.load("secret", p[0], &o.SecretPath, &o.Secret)
+}
+
+// parseKeyDirection parses the direction of the static key:
+// key-direction <0|1>
+func parseKeyDirection(p []string, o *Options) error {
+	if len(p) != 1 || (p[0] != "0" && p[0] != "1") {
+		return fmt.Errorf("%w: %s", errBadCfg, "key-direction expects 0 or 1")
+	}
+	o.KeyDirection = p[0]
+	return nil
+}
+
+// parseIfconfig parses the tunnel addresses for static key mode:
+// ifconfig <local> <remote>, or ifconfig <local> <netmask> with dev tap.
+func parseIfconfig(p []string, o *Options) error {
+	if len(p) != 2 {
+		return fmt.Errorf("%w: %s", errBadCfg, "ifconfig expects a local and a remote address")
+	}
+	for _, addr := range p {
+		if net.ParseIP(addr) == nil {
+			return fmt.Errorf("%w: bad ifconfig address: %s", errBadCfg, addr)
+		}
+	}
+	o.IfconfigLocal, o.IfconfigRemote = p[0], p[1]
+	return nil
+}
+
+// parsePullFilter parses a filter for the pushed options:
+// pull-filter <accept|ignore|reject> "text"
+func parsePullFilter(p []string, o *Options) error {
+	if len(p) != 2 {
+		return fmt.Errorf("%w: %s", errBadCfg, "pull-filter expects an action and a text")
+	}
+	switch p[0] {
+	case pullFilterAccept, pullFilterIgnore, pullFilterReject:
+	default:
+		return fmt.Errorf("%w: bad pull-filter action: %s", errBadCfg, p[0])
+	}
+	o.PullFilters = append(o.PullFilters, PullFilter{Action: p[0], Text: p[1]})
+	return nil
+}
+
+// parseSetenv parses setenv: a variable name and its value.
+func parseSetenv(p []string, o *Options) error {
+	if len(p) != 2 {
+		return fmt.Errorf("%w: %s", errBadCfg, "setenv expects a name and a value")
+	}
+	if o.SetEnv == nil {
+		o.SetEnv = make(map[string]string)
+	}
+	o.SetEnv[p[0]] = p[1]
+	return nil
+}
+
+// parsePushPeerInfo parses push-peer-info, that takes no arguments.
+func parsePushPeerInfo(p []string, o *Options) error {
+	if len(p) != 0 {
+		return fmt.Errorf("%w: %s", errBadCfg, "push-peer-info takes no arguments")
 	}
-	o.TaPath = ta
+	o.PushPeerInfo = true
 	return nil
 }
 
-func parseCert(p []string, o *Options, basedir string) error {
-	e := fmt.Errorf("%w: %s", errBadCfg, "cert expects a valid file")
+// parseTLSMTU parses tls-mtu, the largest control packet that we send.
+func parseTLSMTU(p []string, o *Options) error {
 	if len(p) != 1 {
-		return e
+		return fmt.Errorf("%w: %s", errBadCfg, "tls-mtu expects one argument")
 	}
-	cert := toAbs(p[0], basedir)
-	if sub, _ := isSubdir(basedir, cert); !sub {
-		return fmt.Errorf("%w: %s", errBadCfg, "cert must be below config path")
+	mtu, err := strconv.Atoi(p[0])
+	if err != nil || mtu < minTLSMTU || mtu > math.MaxUint16 {
+		return fmt.Errorf("%w: bad tls-mtu: %s", errBadCfg, p[0])
 	}
-	if !existsFile(cert) {
-		return e
+	o.TLSMTU = mtu
+	return nil
+}
+
+// parseMTUTest parses mtu-test, that takes no arguments.
+func parseMTUTest(p []string, o *Options) error {
+	if len(p) != 0 {
+		return fmt.Errorf("%w: %s", errBadCfg, "mtu-test takes no arguments")
 	}
-	o.CertPath = cert
+	o.MTUTest = true
 	return nil
 }
 
-func parseKey(p []string, o *Options, basedir string) error {
-	e := fmt.Errorf("%w: %s", errBadCfg, "key expects a valid file")
+// parseExplicitExitNotify parses explicit-exit-notify, with an optional
+// number of tries (1 by default).
+func parseExplicitExitNotify(p []string, o *Options) error {
+	switch len(p) {
+	case 0:
+		o.ExplicitExitNotify = 1
+		return nil
+	case 1:
+		n, err := strconv.Atoi(p[0])
+		if err != nil || n < 0 {
+			return fmt.Errorf("%w: bad explicit-exit-notify: %s", errBadCfg, p[0])
+		}
+		o.ExplicitExitNotify = n
+		return nil
+	}
+	return fmt.Errorf("%w: %s", errBadCfg, "explicit-exit-notify takes at most one argument")
+}
+
+// parseRouteNoPull parses route-nopull, that takes no arguments.
+func parseRouteNoPull(p []string, o *Options) error {
+	if len(p) != 0 {
+		return fmt.Errorf("%w: %s", errBadCfg, "route-nopull takes no arguments")
+	}
+	o.RouteNoPull = true
+	return nil
+}
+
+// isRouteGateway returns true if s is an address or one of the keywords
+// that stand for a gateway.
+func isRouteGateway(s string) bool {
+	switch s {
+	case "default", "vpn_gateway", "net_gateway", "remote_host":
+		return true
+	}
+	return net.ParseIP(s) != nil
+}
+
+// parseRoute parses a route set on the client side:
+// route <network> [netmask] [gateway] [metric]
+func parseRoute(p []string, o *Options) error {
+	if len(p) < 1 || len(p) > 4 {
+		return fmt.Errorf("%w: %s", errBadCfg, "route expects a network, and optional netmask, gateway and metric")
+	}
+	if p[0] != "vpn_gateway" && p[0] != "net_gateway" && p[0] != "remote_host" && net.ParseIP(p[0]) == nil {
+		return fmt.Errorf("%w: bad route network: %s", errBadCfg, p[0])
+	}
+	if len(p) >= 2 && p[1] != "default" && !isNetmask(p[1]) {
+		return fmt.Errorf("%w: bad route netmask: %s", errBadCfg, p[1])
+	}
+	if len(p) >= 3 && !isRouteGateway(p[2]) {
+		return fmt.Errorf("%w: bad route gateway: %s", errBadCfg, p[2])
+	}
+	if len(p) == 4 {
+		if _, err := strconv.Atoi(p[3]); err != nil {
+			return fmt.Errorf("%w: bad route metric: %s", errBadCfg, p[3])
+		}
+	}
+	o.Routes = append(o.Routes, routeFromArgs(p))
+	return nil
+}
+
+// parseRouteIPv6 parses an IPv6 route set on the client side:
+// route-ipv6 <prefix> [gateway] [metric]
+func parseRouteIPv6(p []string, o *Options) error {
+	if len(p) < 1 || len(p) > 3 {
+		return fmt.Errorf("%w: %s", errBadCfg, "route-ipv6 expects a prefix, and optional gateway and metric")
+	}
+	if _, _, err := net.ParseCIDR(p[0]); err != nil {
+		return fmt.Errorf("%w: bad route-ipv6 prefix: %s", errBadCfg, p[0])
+	}
+	if len(p) >= 2 && !isRouteGateway(p[1]) {
+		return fmt.Errorf("%w: bad route-ipv6 gateway: %s", errBadCfg, p[1])
+	}
+	if len(p) == 3 {
+		if _, err := strconv.Atoi(p[2]); err != nil {
+			return fmt.Errorf("%w: bad route-ipv6 metric: %s", errBadCfg, p[2])
+		}
+	}
+	o.RoutesIPv6 = append(o.RoutesIPv6, routeIPv6FromArgs(p))
+	return nil
+}
+
+// parseDHCPOption parses a dhcp-option set on the client side:
+// dhcp-option <DNS|DNS6|DOMAIN|DOMAIN-SEARCH> <value>. Other types are
+// ignored; the config parser reports them (see diagnoseArgs).
+func parseDHCPOption(p []string, o *Options) error {
+	if len(p) != 2 {
+		return fmt.Errorf("%w: %s", errBadCfg, "dhcp-option expects a type and a value")
+	}
+	switch p[0] {
+	case "DNS", "DNS6":
+		if net.ParseIP(p[1]) == nil {
+			return fmt.Errorf("%w: bad dhcp-option address: %s", errBadCfg, p[1])
+		}
+		o.DNS = append(o.DNS, p[1])
+	case "DOMAIN", "DOMAIN-SEARCH":
+		o.Domains = append(o.Domains, p[1])
+	}
+	return nil
+}
+
+// parseDev parses the name of the virtual device: dev <tunX|tapX>. The name
+// only matters for its prefix, which gives the device type unless dev-type
+// is also used.
+func parseDev(p []string, o *Options) error {
 	if len(p) != 1 {
-		return e
+		return fmt.Errorf("%w: %s", errBadCfg, "dev expects a device name")
 	}
-	key := toAbs(p[0], basedir)
-	if sub, _ := isSubdir(basedir, key); !sub {
-		return fmt.Errorf("%w: %s", errBadCfg, "key must be below config path")
+	if o.DevType != "" {
+		return nil
 	}
-	if !existsFile(key) {
-		return e
+	switch {
+	case strings.HasPrefix(p[0], devTypeTUN):
+		o.DevType = devTypeTUN
+	case strings.HasPrefix(p[0], devTypeTAP):
+		o.DevType = devTypeTAP
 	}
-	o.KeyPath = key
 	return nil
 }
 
-// parseAuthUser reads credentials from a given file, according to the openvpn
-// format (user and pass on a line each). To avoid path traversal / LFI, the
-// credentials file is expected to be in a subdirectory of the base dir.
-func parseAuthUser(p []string, o *Options, basedir string) error {
-	e := fmt.Errorf("%w: %s", errBadCfg, "auth-user-pass expects a valid file")
+// parseDevType parses the device type: dev-type <tun|tap>
+func parseDevType(p []string, o *Options) error {
+	if len(p) != 1 || (p[0] != devTypeTUN && p[0] != devTypeTAP) {
+		return fmt.Errorf("%w: %s", errBadCfg, "dev-type expects tun or tap")
+	}
+	o.DevType = p[0]
+	return nil
+}
+
+func parseCert(p []string, o *Options, files *configFiles) error {
 	if len(p) != 1 {
-		return e
+		return fmt.Errorf("%w: %s", errBadCfg, "cert expects a valid file")
 	}
-	auth := toAbs(p[0], basedir)
-	if sub, _ := isSubdir(basedir, auth); !sub {
-		return fmt.Errorf("%w: %s", errBadCfg, "auth must be below config path")
+	return files.load("cert", p[0], &o.CertPath, &o.Cert)
+}
+
+func parseKey(p []string, o *Options, files *configFiles) error {
+	if len(p) != 1 {
+		return fmt.Errorf("%w: %s", errBadCfg, "key expects a valid file")
 	}
-	if !existsFile(auth) {
-		return e
+	return files.load("key", p[0], &o.KeyPath, &o.Key)
+}
+
+// parseAuthUser reads credentials from a given file, according to the openvpn
+// format (user and pass on a line each). To avoid path traversal / LFI, the
+// credentials file must be allowed by the path policy.
+func parseAuthUser(p []string, o *Options, files *configFiles) error {
+	if len(p) != 1 {
+		return fmt.Errorf("%w: %s", errBadCfg, "auth-user-pass expects a valid file")
 	}
-	creds, err := getCredentialsFromFile(auth)
+	creds, err := files.credentials("auth", p[0])
 	if err != nil {
 		return err
 	}
@@ -415,8 +869,13 @@ func parseCompress(p []string, o *Options) error {
 	return fmt.Errorf("%w: %s", errBadCfg, "compress: only empty/stub options supported")
 }
 
+// parseCompLZO only accepts comp-lzo no. A bare comp-lzo asks for adaptive
+// compression, that we do not support either.
 func parseCompLZO(p []string, o *Options) error {
-	if p[0] != "no" {
+	if len(p) == 0 {
+		return fmt.Errorf("%w: %s", errBadCfg, "comp-lzo: adaptive compression not supported")
+	}
+	if len(p) > 1 || p[0] != "no" {
 		return fmt.Errorf("%w: %s", errBadCfg, "comp-lzo: compression not supported")
 	}
 	o.Compress = "lzo-no"
@@ -439,171 +898,514 @@ func parseTLSVerMax(p []string, o *Options) error {
 	return nil
 }
 
+// outerTransport returns the option that configures the transport for the
+// outer connection, if any.
+func (o *Options) outerTransport() string {
+	switch {
+	case o.ProxyOBFS4 != "":
+		return "proxy-obfs4"
+	case o.ProxyPT != "":
+		return "proxy-pt"
+	case o.ProxyWebSocket != "":
+		return "proxy-websocket"
+	case o.ProxyTLS:
+		return "proxy-tls"
+	default:
+		return ""
+	}
+}
+
+// checkOuterTransport returns an error if a transport other than the named
+// one is already configured, since only one can be used at a time.
+func (o *Options) checkOuterTransport(name string) error {
+	if t := o.outerTransport(); t != "" && t != name {
+		return fmt.Errorf("%w: %s and %s are mutually exclusive", errBadCfg, t, name)
+	}
+	return nil
+}
+
+// parseProxyOBFS4 accepts either an obfs4:// uri, or a Tor bridge line:
+// proxy-obfs4 obfs4://<ip>:<port>?cert=<cert>&iat-mode=<int>
+// proxy-obfs4 obfs4 <ip>:<port> [<fingerprint>] cert=<cert> iat-mode=<int>
 func parseProxyOBFS4(p []string, o *Options) error {
-	if len(p) != 1 {
+	if len(p) == 0 {
 		return fmt.Errorf("%w: %s", errBadCfg, "proto-obfs4: need a properly configured proxy")
 	}
-	// TODO(ainghazal): can validate the obfs4://... scheme here
-	o.ProxyOBFS4 = p[0]
+	if err := o.checkOuterTransport("proxy-obfs4"); err != nil {
+		return err
+	}
+	switch {
+	case len(p) == 1 && strings.HasPrefix(p[0], "obfs4://"):
+		o.ProxyOBFS4 = p[0]
+	case len(p) > 2 && p[0] == "obfs4":
+		o.ProxyOBFS4 = strings.Join(p, " ")
+	default:
+		return fmt.Errorf("%w: %s", errBadCfg, "proxy-obfs4: expected obfs4:// uri or bridge line")
+	}
 	return nil
 }
 
-var pMap = map[string]interface{}{
-	"proto":           parseProto,
-	"remote":          parseRemote,
-	"cipher":          parseCipher,
-	"auth":            parseAuth,
-	"compress":        parseCompress,
-	"comp-lzo":        parseCompLZO,
-	"proxy-obfs4":     parseProxyOBFS4,
-	"tls-version-max": parseTLSVerMax, // this is currently ignored because of uTLS
+// parseProxyPT parses the proxy-pt directive, in the form:
+// proxy-pt <name> <binary> [args...]
+// The remote is expected to be a bridge for the named transport.
+func parseProxyPT(p []string, o *Options) error {
+	if len(p) < 2 {
+		return fmt.Errorf("%w: %s", errBadCfg, "proxy-pt expects a transport name and a binary")
+	}
+	if err := o.checkOuterTransport("proxy-pt"); err != nil {
+		return err
+	}
+	o.ProxyPT = p[0]
+	o.ProxyPTCmd = p[1:]
+	return nil
 }
 
-var pMapDir = map[string]interface{}{
-	"ca":             parseCA,
-	"cert":           parseCert,
-	"key":            parseKey,
-	"auth-user-pass": parseAuthUser,
-	"tls-auth":       parseTA,
+// parseProxyPTArgs parses the bridge arguments for proxy-pt, in the form:
+// proxy-pt-args key=value [key=value...]
+func parseProxyPTArgs(p []string, o *Options) error {
+	if len(p) == 0 {
+		return fmt.Errorf("%w: %s", errBadCfg, "proxy-pt-args expects key=value args")
+	}
+	for _, arg := range p {
+		if k, _, ok := strings.Cut(arg, "="); !ok || k == "" {
+			return fmt.Errorf("%w: bad proxy-pt-args argument: %s", errBadCfg, arg)
+		}
+	}
+	o.ProxyPTArgs = append(o.ProxyPTArgs, p...)
+	return nil
 }
 
-func parseOption(o *Options, dir, key string, p []string, lineno int) error {
-	switch key {
-	case "proto", "remote", "cipher", "auth", "compress", "comp-lzo", "tls-version-max", "proxy-obfs4":
-		fn := pMap[key].(func([]string, *Options) error)
-		if e := fn(p, o); e != nil {
-			return e
-		}
-	case "ca", "cert", "key", "auth-user-pass", "tls-auth":
-		fn := pMapDir[key].(func([]string, *Options, string) error)
-		if e := fn(p, o, dir); e != nil {
-			return e
+// parseProxyWebSocket parses the proxy-websocket directive, in the form:
+// proxy-websocket <ws:// or wss:// url> [fingerprint]
+func parseProxyWebSocket(p []string, o *Options) error {
+	if len(p) < 1 || len(p) > 2 {
+		return fmt.Errorf("%w: %s", errBadCfg, "proxy-websocket expects an url and an optional fingerprint")
+	}
+	if err := o.checkOuterTransport("proxy-websocket"); err != nil {
+		return err
+	}
+	if !isWebSocketURL(p[0]) {
+		return fmt.Errorf("%w: %s", errBadCfg, "proxy-websocket: expected ws:// or wss:// url")
+	}
+	o.ProxyWebSocket = p[0]
+	if len(p) == 2 {
+		if _, ok := utlsFingerprints[p[1]]; !ok {
+			return fmt.Errorf("%w: proxy-websocket: unknown fingerprint: %s", errBadCfg, p[1])
 		}
-	default:
-		log.Printf("warn: unsupported key in line %d\n", lineno)
+		o.ProxyWebSocketFingerprint = p[1]
 	}
 	return nil
 }
 
-// getOptionsFromLines tries to parse all the lines coming from a config file
-// and raises validation errors if the values do not conform to the expected
-// format.
-// the config file supports inline file inclusion for <ca>, <cert> and <key>.
-func getOptionsFromLines(lines []string, dir string) (*Options, error) {
-	opt := &Options{}
-
-	// tag and inlineBuf are used to parse inline files.
-	// these follow the format used by the reference openvpn implementation.
-	// each block (any of ca, key, cert) is marked by a <option> line, and
-	// closed by a </option> line; lines in between are expected to contain
-	// the crypto block.
-	tag := ""
-	inlineBuf := new(bytes.Buffer)
+func parseProxyWebSocketHost(p []string, o *Options) error {
+	if len(p) != 1 {
+		return fmt.Errorf("%w: %s", errBadCfg, "proxy-websocket-host expects one arg")
+	}
+	o.ProxyWebSocketHost = p[0]
+	return nil
+}
 
-	for lineno, l := range lines {
-		if strings.HasPrefix(l, "#") {
-			continue
-		}
-		l = strings.TrimSpace(l)
-
-		// inline certs
-		if isClosingTag(l) {
-			// we expect an already existing inlineBuf
-			e := parseInlineTag(opt, tag, inlineBuf)
-			if e != nil {
-				return nil, e
-			}
-			tag = ""
-			inlineBuf = new(bytes.Buffer)
-			continue
-		}
-		if tag != "" {
-			inlineBuf.Write([]byte(l))
-			inlineBuf.Write([]byte("\n"))
-			continue
-		}
-		if isOpeningTag(l) {
-			if len(inlineBuf.Bytes()) != 0 {
-				// something wrong: an opening tag should not be found
-				// when we still have bytes in the inline buffer.
-				return opt, fmt.Errorf("%w: %s", errBadInput, "tag not closed")
-			}
-			tag = parseTag(l)
-			continue
+// parseProxyTLS parses the proxy-tls directive, in the form:
+// proxy-tls [server-name] [fingerprint]
+// The server name defaults to the remote host.
+func parseProxyTLS(p []string, o *Options) error {
+	if len(p) > 2 {
+		return fmt.Errorf("%w: %s", errBadCfg, "proxy-tls expects an optional server name and fingerprint")
+	}
+	if err := o.checkOuterTransport("proxy-tls"); err != nil {
+		return err
+	}
+	o.ProxyTLS = true
+	if len(p) > 0 {
+		o.ProxyTLSServerName = p[0]
+	}
+	if len(p) > 1 {
+		if _, ok := utlsFingerprints[p[1]]; !ok {
+			return fmt.Errorf("%w: proxy-tls: unknown fingerprint: %s", errBadCfg, p[1])
 		}
+		o.ProxyTLSFingerprint = p[1]
+	}
+	return nil
+}
 
-		// parse parts in the same line
-		p := strings.Split(l, " ")
-		if len(p) == 0 {
-			continue
-		}
-		var (
-			key   string
-			parts []string
-		)
-		if len(p) == 1 {
-			key = p[0]
-		} else {
-			key, parts = p[0], p[1:]
+// parseProxyTLSALPN parses the protocols offered in the outer TLS session:
+// proxy-tls-alpn <protocol> [protocol...]
+func parseProxyTLSALPN(p []string, o *Options) error {
+	if len(p) == 0 {
+		return fmt.Errorf("%w: %s", errBadCfg, "proxy-tls-alpn expects at least one protocol")
+	}
+	o.ProxyTLSALPN = p
+	return nil
+}
+
+// parseProxyTLSPin parses the pins for the outer TLS session:
+// proxy-tls-pin sha256//<base64> [sha256//<base64>...]
+// It can be repeated.
+func parseProxyTLSPin(p []string, o *Options) error {
+	if len(p) == 0 {
+		return fmt.Errorf("%w: %s", errBadCfg, "proxy-tls-pin expects at least one pin")
+	}
+	for _, pin := range p {
+		if _, err := parseTLSPin(pin); err != nil {
+			return fmt.Errorf("%w: %s", errBadCfg, err)
 		}
-		e := parseOption(opt, dir, key, parts, lineno)
-		if e != nil {
-			return nil, e
+	}
+	o.ProxyTLSPins = append(o.ProxyTLSPins, p...)
+	return nil
+}
+
+// parseShapingBuckets parses the sizes tunneled packets are padded to:
+// shaping-buckets <size> [size...]
+func parseShapingBuckets(p []string, o *Options) error {
+	if len(p) == 0 {
+		return fmt.Errorf("%w: %s", errBadCfg, "shaping-buckets expects at least one size")
+	}
+	buckets := make([]int, 0, len(p))
+	for _, arg := range p {
+		size, err := strconv.Atoi(arg)
+		if err != nil || size <= 0 || size > 65535 {
+			return fmt.Errorf("%w: bad shaping bucket: %s", errBadCfg, arg)
 		}
+		buckets = append(buckets, size)
 	}
-	return opt, nil
+	o.shapingPolicy().PadBuckets = buckets
+	return nil
 }
 
-func isOpeningTag(key string) bool {
-	switch key {
-	case "<ca>", "<cert>", "<key>", "<tls-auth>":
-		return true
-	default:
-		return false
+// parseShapingJitter parses the maximum write delay, in milliseconds:
+// shaping-jitter <ms>
+func parseShapingJitter(p []string, o *Options) error {
+	d, err := parseShapingMillis("shaping-jitter", p)
+	if err != nil {
+		return err
 	}
+	o.shapingPolicy().MaxJitter = d
+	return nil
 }
 
-func isClosingTag(key string) bool {
-	switch key {
-	case "</ca>", "</cert>", "</key>", "</tls-auth>":
-		return true
-	default:
-		return false
+// parseShapingCover parses the mean interval between cover packets, in
+// milliseconds:
+// shaping-cover <ms>
+func parseShapingCover(p []string, o *Options) error {
+	d, err := parseShapingMillis("shaping-cover", p)
+	if err != nil {
+		return err
 	}
+	o.shapingPolicy().CoverInterval = d
+	return nil
 }
 
-func parseTag(tag string) string {
-	switch tag {
-	case "<ca>", "</ca>":
-		return "ca"
-	case "<cert>", "</cert>":
-		return "cert"
-	case "<key>", "</key>":
-		return "key"
-	case "<tls-auth>", "</tls-auth>":
-		return "ta"
-	default:
-		return ""
+// parseShapingMillis parses the single positive duration in milliseconds
+// expected by the named directive.
+func parseShapingMillis(key string, p []string) (time.Duration, error) {
+	if len(p) != 1 {
+		return 0, fmt.Errorf("%w: %s expects one arg", errBadCfg, key)
+	}
+	ms, err := strconv.Atoi(p[0])
+	if err != nil || ms <= 0 {
+		return 0, fmt.Errorf("%w: bad %s: %s", errBadCfg, key, p[0])
 	}
+	return time.Duration(ms) * time.Millisecond, nil
 }
 
-// parseInlineTag
-func parseInlineTag(o *Options, tag string, buf *bytes.Buffer) error {
-	b := buf.Bytes()
-	if len(b) == 0 {
-		return fmt.Errorf("%w: empty inline tag: %d", errBadInput, len(b))
+// parsePortHop parses the hop interval, in seconds, and the optional range
+// of server ports:
+// port-hop <seconds> [low-high]
+func parsePortHop(p []string, o *Options) error {
+	if len(p) != 1 && len(p) != 2 {
+		return fmt.Errorf("%w: %s", errBadCfg, "port-hop expects an interval and an optional port range")
 	}
-	switch tag {
-	case "ca":
-		o.Ca = b
-	case "cert":
-		o.Cert = b
-	case "key":
-		o.Key = b
-	case "ta":
-		o.Ta = b
+	secs, err := strconv.Atoi(p[0])
+	if err != nil || secs <= 0 {
+		return fmt.Errorf("%w: bad port-hop interval: %s", errBadCfg, p[0])
+	}
+	o.PortHopInterval = time.Duration(secs) * time.Second
+	if len(p) == 1 {
+		return nil
+	}
+	bounds := strings.Split(p[1], "-")
+	if len(bounds) != 2 {
+		return fmt.Errorf("%w: bad port-hop range: %s", errBadCfg, p[1])
+	}
+	low, err1 := strconv.Atoi(bounds[0])
+	high, err2 := strconv.Atoi(bounds[1])
+	if err1 != nil || err2 != nil || low <= 0 || high > 65535 || low > high {
+		return fmt.Errorf("%w: bad port-hop range: %s", errBadCfg, p[1])
+	}
+	o.PortHopLow, o.PortHopHigh = low, high
+	return nil
+}
+
+// shapingPolicy returns the shaping policy, creating it if needed.
+func (o *Options) shapingPolicy() *ShapingPolicy {
+	if o.Shaping == nil {
+		o.Shaping = &ShapingPolicy{}
+	}
+	return o.Shaping
+}
+
+// parseShaper parses the rate limit for outgoing data packets, in bytes per
+// second:
+// shaper <bytes-per-sec>
+func parseShaper(p []string, o *Options) error {
+	n, err := parseShaperRate("shaper", p)
+	if err != nil {
+		return err
+	}
+	o.WriteLimiter = NewRateLimiter(n)
+	return nil
+}
+
+// parseShaperRead parses the rate limit for incoming data packets, in bytes
+// per second:
+// shaper-read <bytes-per-sec>
+func parseShaperRead(p []string, o *Options) error {
+	n, err := parseShaperRate("shaper-read", p)
+	if err != nil {
+		return err
+	}
+	o.ReadLimiter = NewRateLimiter(n)
+	return nil
+}
+
+// parseShaperRate parses the single rate expected by the named directive.
+func parseShaperRate(key string, p []string) (int, error) {
+	if len(p) != 1 {
+		return 0, fmt.Errorf("%w: %s expects one arg", errBadCfg, key)
+	}
+	n, err := strconv.Atoi(p[0])
+	if err != nil || n < minShaperRate || n > maxShaperRate {
+		return 0, fmt.Errorf("%w: %s must be between %d and %d bytes per second: %s",
+			errBadCfg, key, minShaperRate, maxShaperRate, p[0])
+	}
+	return n, nil
+}
+
+// parseScramble parses the scramble directive of the Tunnelblick patch:
+// scramble xormask <mask>
+// scramble xorptrpos
+// scramble reverse
+// scramble obfuscate <mask>
+// As in the patch, a single argument that is not a method is a mask for
+// xormask.
+func parseScramble(p []string, o *Options) error {
+	switch {
+	case len(p) == 1 && (p[0] == scrambleXORPtrPos || p[0] == scrambleReverse):
+		o.ScrambleMethod = p[0]
+	case len(p) == 2 && (p[0] == scrambleXORMask || p[0] == scrambleObfuscate):
+		o.ScrambleMethod, o.ScrambleMask = p[0], p[1]
+	case len(p) == 1 && p[0] != scrambleXORMask && p[0] != scrambleObfuscate:
+		o.ScrambleMethod, o.ScrambleMask = scrambleXORMask, p[0]
 	default:
-		return fmt.Errorf("%w: unknown tag: %s", errBadInput, tag)
+		return fmt.Errorf("%w: %s", errBadCfg, "scramble expects xormask <mask>, xorptrpos, reverse or obfuscate <mask>")
+	}
+	return nil
+}
+
+func parseLocal(p []string, o *Options) error {
+	if len(p) != 1 {
+		return fmt.Errorf("%w: %s", errBadCfg, "local expects one arg")
+	}
+	o.Local = p[0]
+	return nil
+}
+
+func parseLPort(p []string, o *Options) error {
+	if len(p) != 1 {
+		return fmt.Errorf("%w: %s", errBadCfg, "lport expects one arg")
+	}
+	port, err := strconv.Atoi(p[0])
+	if err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("%w: bad lport: %s", errBadCfg, p[0])
+	}
+	o.LPort = p[0]
+	return nil
+}
+
+// parseBind accepts the optional ipv6only flag of the reference
+// implementation, which we ignore.
+func parseBind(p []string, o *Options) error {
+	if len(p) > 1 || (len(p) == 1 && p[0] != "ipv6only") {
+		return fmt.Errorf("%w: %s", errBadCfg, "bind: only the ipv6only flag is supported")
+	}
+	o.NoBind = false
+	return nil
+}
+
+func parseNoBind(p []string, o *Options) error {
+	if len(p) != 0 {
+		return fmt.Errorf("%w: %s", errBadCfg, "nobind expects no args")
+	}
+	o.NoBind = true
+	return nil
+}
+
+func parseBindDev(p []string, o *Options) error {
+	if len(p) != 1 {
+		return fmt.Errorf("%w: %s", errBadCfg, "bind-dev expects one arg")
+	}
+	o.BindDev = p[0]
+	return nil
+}
+
+func parseMark(p []string, o *Options) error {
+	if len(p) != 1 {
+		return fmt.Errorf("%w: %s", errBadCfg, "mark expects one arg")
+	}
+	mark, err := strconv.Atoi(p[0])
+	if err != nil || mark < 0 {
+		return fmt.Errorf("%w: bad mark: %s", errBadCfg, p[0])
+	}
+	o.Mark = mark
+	return nil
+}
+
+// parseHTTPProxy parses the http-proxy directive, in the form:
+// http-proxy host port [authfile] [auth-method]
+// The credentials file follows the same format as for auth-user-pass, and
+// must be allowed by the path policy.
+func parseHTTPProxy(p []string, o *Options, files *configFiles) error {
+	if len(p) < 2 || len(p) > 4 {
+		return fmt.Errorf("%w: %s", errBadCfg, "http-proxy expects host, port and optional authfile and auth-method")
+	}
+	if o.SOCKSProxy != "" {
+		return fmt.Errorf("%w: %s", errBadCfg, "http-proxy and socks-proxy are mutually exclusive")
+	}
+	if _, err := strconv.Atoi(p[1]); err != nil {
+		return fmt.Errorf("%w: bad http-proxy port: %s", errBadCfg, p[1])
+	}
+	o.HTTPProxy = net.JoinHostPort(p[0], p[1])
+	if len(p) == 2 {
+		return nil
+	}
+	switch p[2] {
+	case "auto", "auto-nct", "stdin":
+		return fmt.Errorf("%w: http-proxy: unsupported authfile: %s", errBadCfg, p[2])
+	}
+	creds, err := files.credentials("auth", p[2])
+	if err != nil {
+		return err
+	}
+	o.HTTPProxyUser, o.HTTPProxyPass = creds[0], creds[1]
+	o.HTTPProxyAuth = httpProxyAuthBasic
+	if len(p) == 4 {
+		switch p[3] {
+		case httpProxyAuthNone, httpProxyAuthBasic, httpProxyAuthDigest:
+			o.HTTPProxyAuth = p[3]
+		default:
+			return fmt.Errorf("%w: http-proxy: unsupported auth-method: %s", errBadCfg, p[3])
+		}
+	}
+	return nil
+}
+
+// parseSOCKSProxy parses the socks-proxy directive, in the form:
+// socks-proxy host [port] [authfile]
+// The port defaults to 1080.
+func parseSOCKSProxy(p []string, o *Options, files *configFiles) error {
+	if len(p) < 1 || len(p) > 3 {
+		return fmt.Errorf("%w: %s", errBadCfg, "socks-proxy expects host and optional port and authfile")
+	}
+	if o.HTTPProxy != "" {
+		return fmt.Errorf("%w: %s", errBadCfg, "http-proxy and socks-proxy are mutually exclusive")
+	}
+	port := "1080"
+	if len(p) > 1 {
+		if _, err := strconv.Atoi(p[1]); err != nil {
+			return fmt.Errorf("%w: bad socks-proxy port: %s", errBadCfg, p[1])
+		}
+		port = p[1]
+	}
+	o.SOCKSProxy = net.JoinHostPort(p[0], port)
+	if len(p) == 3 {
+		creds, err := files.credentials("auth", p[2])
+		if err != nil {
+			return err
+		}
+		o.SOCKSProxyUser, o.SOCKSProxyPass = creds[0], creds[1]
+	}
+	return nil
+}
+
+var pMap = map[string]interface{}{
+	"proto":                parseProto,
+	"remote":               parseRemote,
+	"cipher":               parseCipher,
+	"auth":                 parseAuth,
+	"compress":             parseCompress,
+	"comp-lzo":             parseCompLZO,
+	"proxy-obfs4":          parseProxyOBFS4,
+	"proxy-pt":             parseProxyPT,
+	"proxy-pt-args":        parseProxyPTArgs,
+	"proxy-websocket":      parseProxyWebSocket,
+	"proxy-websocket-host": parseProxyWebSocketHost,
+	"proxy-tls":            parseProxyTLS,
+	"proxy-tls-alpn":       parseProxyTLSALPN,
+	"proxy-tls-pin":        parseProxyTLSPin,
+	"tls-version-max":      parseTLSVerMax, // this is currently ignored because of uTLS
+	"local":                parseLocal,
+	"lport":                parseLPort,
+	"bind":                 parseBind,
+	"nobind":               parseNoBind,
+	"bind-dev":             parseBindDev,
+	"mark":                 parseMark,
+	"scramble":             parseScramble,
+	"shaping-buckets":      parseShapingBuckets,
+	"shaping-jitter":       parseShapingJitter,
+	"shaping-cover":        parseShapingCover,
+	"port-hop":             parsePortHop,
+	"shaper":               parseShaper,
+	"shaper-read":          parseShaperRead,
+	"key-direction":        parseKeyDirection,
+	"ifconfig":             parseIfconfig,
+	"dev":                  parseDev,
+	"dev-type":             parseDevType,
+	"pull-filter":          parsePullFilter,
+	"route-nopull":         parseRouteNoPull,
+	"route":                parseRoute,
+	"route-ipv6":           parseRouteIPv6,
+	"dhcp-option":          parseDHCPOption,
+	"setenv":               parseSetenv,
+	"push-peer-info":       parsePushPeerInfo,
+	"mtu-test":             parseMTUTest,
+	"explicit-exit-notify": parseExplicitExitNotify,
+	"tls-mtu":              parseTLSMTU,
+	"port":                 parsePort,
+	"rport":                parsePort,
+}
+
+var pMapDir = map[string]interface{}{
+	"ca":             parseCA,
+	"cert":           parseCert,
+	"key":            parseKey,
+	"auth-user-pass": parseAuthUser,
+	"tls-auth":       parseTA,
+	"http-proxy":     parseHTTPProxy,
+	"socks-proxy":    parseSOCKSProxy,
+	"secret":         parseSecret,
+	"tls-crypt":      parseTLSCrypt,
+	"extra-certs":    parseExtraCerts,
+}
+
+func parseOption(o *Options, files *configFiles, key string, p []string, lineno int) error {
+	switch key {
+	case "proto", "remote", "cipher", "auth", "compress", "comp-lzo", "tls-version-max", "proxy-obfs4",
+		"proxy-pt", "proxy-pt-args", "proxy-websocket", "proxy-websocket-host",
+		"proxy-tls", "proxy-tls-alpn", "proxy-tls-pin", "scramble", "local", "lport", "bind", "nobind", "bind-dev", "mark",
+		"shaping-buckets", "shaping-jitter", "shaping-cover", "port-hop",
+		"shaper", "shaper-read", "key-direction", "ifconfig",
+		"dev", "dev-type", "pull-filter", "route-nopull", "route", "route-ipv6", "dhcp-option",
+		"setenv", "push-peer-info", "mtu-test", "explicit-exit-notify", "tls-mtu", "port", "rport":
+		fn := pMap[key].(func([]string, *Options) error)
+		if e := fn(p, o); e != nil {
+			return e
+		}
+	case "ca", "cert", "key", "auth-user-pass", "tls-auth", "http-proxy", "socks-proxy", "secret",
+		"tls-crypt", "extra-certs":
+		fn := pMapDir[key].(func([]string, *Options, *configFiles) error)
+		if e := fn(p, o, files); e != nil {
+			return e
+		}
 	}
 	return nil
 }
@@ -638,14 +1440,17 @@ func getLinesFromFile(path string) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
+	return readLines(f)
+}
 
+// readLines returns the lines that it reads from r.
+func readLines(r io.Reader) ([]string, error) {
 	lines := make([]string, 0)
-	scanner := bufio.NewScanner(f)
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		lines = append(lines, scanner.Text())
 	}
-	err = scanner.Err()
-	if err != nil {
+	if err := scanner.Err(); err != nil {
 		return nil, err
 	}
 	return lines, nil
@@ -659,6 +1464,12 @@ func getCredentialsFromFile(path string) ([]string, error) {
 	if err != nil {
 		return nil, fmt.Errorf("%w: %s", errBadCfg, err)
 	}
+	return parseCredentials(lines)
+}
+
+// parseCredentials returns the user and pass of a credentials file, one on
+// each line, and an error if they are not valid.
+func parseCredentials(lines []string) ([]string, error) {
 	if len(lines) != 2 {
 		return nil, fmt.Errorf("%w: %s", errBadCfg, "malformed credentials file")
 	}
@@ -691,5 +1502,9 @@ func isSubdir(parent, sub string) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	return strings.HasPrefix(s, p), nil
+	rel, err := filepath.Rel(p, s)
+	if err != nil {
+		return false, err
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)), nil
 }
@@ -5,6 +5,7 @@ import (
 	"os"
 	fp "path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -48,7 +49,7 @@ func TestOptions_String(t *testing.T) {
 				Auth:   "sha512",
 				Proto:  1,
 			},
-			want: "V4,dev-type tun,link-mtu 1549,tun-mtu 1500,proto TCPv4,cipher AES-128-GCM,auth sha512,keysize 128,key-method 2,tls-client",
+			want: "V4,dev-type tun,link-mtu 1549,tun-mtu 1500,proto TCPv4,cipher AES-128-GCM,auth [null-digest],keysize 128,key-method 2,tls-client",
 		},
 		{
 			name: "compress stub",
@@ -58,7 +59,7 @@ func TestOptions_String(t *testing.T) {
 				Proto:    2,
 				Compress: compressionStub,
 			},
-			want: "V4,dev-type tun,link-mtu 1549,tun-mtu 1500,proto UDPv4,cipher AES-128-GCM,auth sha512,keysize 128,key-method 2,tls-client,compress stub",
+			want: "V4,dev-type tun,link-mtu 1549,tun-mtu 1500,proto UDPv4,cipher AES-128-GCM,auth [null-digest],keysize 128,key-method 2,tls-client,compress stub",
 		},
 		{
 			name: "compress lzo-no",
@@ -68,7 +69,16 @@ func TestOptions_String(t *testing.T) {
 				Proto:    2,
 				Compress: compressionLZONo,
 			},
-			want: "V4,dev-type tun,link-mtu 1549,tun-mtu 1500,proto UDPv4,cipher AES-128-GCM,auth sha512,keysize 128,key-method 2,tls-client,lzo-comp no",
+			want: "V4,dev-type tun,link-mtu 1549,tun-mtu 1500,proto UDPv4,cipher AES-128-GCM,auth [null-digest],keysize 128,key-method 2,tls-client,lzo-comp no",
+		},
+		{
+			name: "cbc",
+			fields: fields{
+				Cipher: "AES-256-CBC",
+				Auth:   "SHA1",
+				Proto:  2,
+			},
+			want: "V4,dev-type tun,link-mtu 1549,tun-mtu 1500,proto UDPv4,cipher AES-256-CBC,auth SHA1,keysize 256,key-method 2,tls-client",
 		},
 	}
 	for _, tt := range tests {
@@ -377,18 +387,36 @@ func Test_parseProxyOBFS4(t *testing.T) {
 		t.Errorf("parseProxyOBFS4(): want %v, got %v", obfs4Uri, opt.ProxyOBFS4)
 	}
 
+	// bridge line
+	opt = &Options{}
+	bridge := []string{"obfs4", "1.2.3.4:443", "FINGERPRINT", "cert=foo", "iat-mode=0"}
+	err = parseProxyOBFS4(bridge, opt)
+	if err != nil {
+		t.Errorf("parseProxyOBFS4(): wantErr: nil, got %v", err)
+	}
+	if opt.ProxyOBFS4 != "obfs4 1.2.3.4:443 FINGERPRINT cert=foo iat-mode=0" {
+		t.Errorf("parseProxyOBFS4(): got %v", opt.ProxyOBFS4)
+	}
+
+	// other schemes
+	err = parseProxyOBFS4([]string{"socks5://foobar"}, &Options{})
+	wantErr = errBadCfg
+	if !errors.Is(err, wantErr) {
+		t.Errorf("parseProxyOBFS4(): wantErr: %v, got %v", wantErr, err)
+	}
+
 }
 
 func Test_parseCA(t *testing.T) {
 	// more than one part should fail
-	err := parseCA([]string{"one", "two"}, &Options{}, "")
+	err := parseCA([]string{"one", "two"}, &Options{}, newConfigFiles(""))
 	wantErr := errBadCfg
 	if !errors.Is(err, wantErr) {
 		t.Errorf("parseCA(): want %v, got %v", wantErr, err)
 	}
 
 	// empty part should fail
-	err = parseCA([]string{}, &Options{}, "")
+	err = parseCA([]string{}, &Options{}, newConfigFiles(""))
 	wantErr = errBadCfg
 	if !errors.Is(err, wantErr) {
 		t.Errorf("parseCA(): want %v, got %v", wantErr, err)
@@ -397,21 +425,21 @@ func Test_parseCA(t *testing.T) {
 
 func Test_parseCert(t *testing.T) {
 	// more than one part should fail
-	err := parseCert([]string{"one", "two"}, &Options{}, "")
+	err := parseCert([]string{"one", "two"}, &Options{}, newConfigFiles(""))
 	wantErr := errBadCfg
 	if !errors.Is(err, wantErr) {
 		t.Errorf("parseCert(): want %v, got %v", wantErr, err)
 	}
 
 	// empty part should fail
-	err = parseCert([]string{}, &Options{}, "")
+	err = parseCert([]string{}, &Options{}, newConfigFiles(""))
 	wantErr = errBadCfg
 	if !errors.Is(err, wantErr) {
 		t.Errorf("parseCert(): want %v, got %v", wantErr, err)
 	}
 
 	// non-existent cert should fail
-	err = parseCert([]string{"/tmp/nonexistent"}, &Options{}, "")
+	err = parseCert([]string{"/tmp/nonexistent"}, &Options{}, newConfigFiles(""))
 	wantErr = errBadCfg
 	if !errors.Is(err, wantErr) {
 		t.Errorf("parseCert(): want %v, got %v", wantErr, err)
@@ -420,21 +448,21 @@ func Test_parseCert(t *testing.T) {
 
 func Test_parseKey(t *testing.T) {
 	// more than one part should fail
-	err := parseKey([]string{"one", "two"}, &Options{}, "")
+	err := parseKey([]string{"one", "two"}, &Options{}, newConfigFiles(""))
 	wantErr := errBadCfg
 	if !errors.Is(err, wantErr) {
 		t.Errorf("parseKey(): want %v, got %v", wantErr, err)
 	}
 
 	// empty part should fail
-	err = parseKey([]string{}, &Options{}, "")
+	err = parseKey([]string{}, &Options{}, newConfigFiles(""))
 	wantErr = errBadCfg
 	if !errors.Is(err, wantErr) {
 		t.Errorf("parseKey(): want %v, got %v", wantErr, err)
 	}
 
 	// non-existent key should fail
-	err = parseKey([]string{"/tmp/nonexistent"}, &Options{}, "")
+	err = parseKey([]string{"/tmp/nonexistent"}, &Options{}, newConfigFiles(""))
 	wantErr = errBadCfg
 	if !errors.Is(err, wantErr) {
 		t.Errorf("parseKey(): want %v, got %v", wantErr, err)
@@ -461,7 +489,7 @@ func Test_parseCompLZO(t *testing.T) {
 
 func Test_parseOption(t *testing.T) {
 	// unknown key should not fail
-	err := parseOption(&Options{}, t.TempDir(), "unknownKey", []string{"a", "b"}, 0)
+	err := parseOption(&Options{}, newConfigFiles(t.TempDir()), "unknownKey", []string{"a", "b"}, 0)
 	if err != nil {
 		t.Errorf("parseOption(): want %v, got %v", nil, err)
 	}
@@ -546,7 +574,7 @@ func Test_newTunnelInfoFromRemoteOptionsString(t *testing.T) {
 	}
 }
 
-func Test_pushedOptionsAsMap(t *testing.T) {
+func Test_optionsListAsMap(t *testing.T) {
 	type args struct {
 		pushedOptions []byte
 	}
@@ -571,8 +599,8 @@ func Test_pushedOptionsAsMap(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := pushedOptionsAsMap(tt.args.pushedOptions); !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("pushedOptionsAsMap() = %v, want %v", got, tt.want)
+			if got := optionsListAsMap(pushedOptionsAsList(tt.args.pushedOptions)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("optionsListAsMap() = %v, want %v", got, tt.want)
 			}
 		})
 	}
@@ -698,7 +726,7 @@ func Test_parseAuthUser(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if err := parseAuthUser(tt.args.p, tt.args.o, tt.args.d); !errors.Is(err, tt.wantErr) {
+			if err := parseAuthUser(tt.args.p, tt.args.o, newConfigFiles(tt.args.d)); !errors.Is(err, tt.wantErr) {
 				t.Errorf("parseAuthUser() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -889,6 +917,15 @@ func Test_isSubdir(t *testing.T) {
 			want:    false,
 			wantErr: false,
 		},
+		{
+			name: "sibling with the same prefix",
+			args: args{
+				parent: "/foo/bar",
+				sub:    "/foo/barbaz/ca.crt",
+			},
+			want:    false,
+			wantErr: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -932,7 +969,8 @@ func Test_newTunnelInfoFromPushedOptions(t *testing.T) {
 				},
 			},
 			want: &tunnelInfo{
-				gw: "1.1.2.2",
+				gw:      "1.1.2.2",
+				routeGw: "1.1.2.2",
 			},
 		},
 		{
@@ -956,10 +994,31 @@ func Test_newTunnelInfoFromPushedOptions(t *testing.T) {
 				},
 			},
 			want: &tunnelInfo{
-				ip: "1.1.3.3",
-				gw: "1.1.1.1",
+				ip:      "1.1.3.3",
+				gw:      "1.1.1.1",
+				routeGw: "1.1.2.2",
+			},
+		},
+		{
+			name: "get peer-id",
+			args: args{
+				map[string][]string{
+					"peer-id": []string{"0"},
+				},
+			},
+			want: &tunnelInfo{
+				hasPeerID: true,
 			},
 		},
+		{
+			name: "bad peer-id",
+			args: args{
+				map[string][]string{
+					"peer-id": []string{"x"},
+				},
+			},
+			want: &tunnelInfo{},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -969,3 +1028,207 @@ func Test_newTunnelInfoFromPushedOptions(t *testing.T) {
 		})
 	}
 }
+
+func Test_parseBindOptions(t *testing.T) {
+	d := t.TempDir()
+	l := []string{
+		"remote 0.0.0.0 1194",
+		"local 127.0.0.1",
+		"lport 4000",
+		"bind-dev eth0",
+		"mark 42",
+	}
+	o, err := getOptionsFromLines(l, d)
+	if err != nil {
+		t.Fatalf("Good options should not fail: %s", err)
+	}
+	if o.Local != "127.0.0.1" || o.LPort != "4000" {
+		t.Errorf("local/lport not what expected: %s:%s", o.Local, o.LPort)
+	}
+	if o.BindDev != "eth0" || o.Mark != 42 {
+		t.Errorf("bind-dev/mark not what expected: %s %d", o.BindDev, o.Mark)
+	}
+	if o.NoBind {
+		t.Errorf("NoBind should be false")
+	}
+
+	o, err = getOptionsFromLines([]string{"lport 4000", "nobind"}, d)
+	if err != nil {
+		t.Fatalf("Good options should not fail: %s", err)
+	}
+	if !o.NoBind {
+		t.Errorf("NoBind should be true")
+	}
+
+	bad := [][]string{
+		{"lport"},
+		{"lport", "70000"},
+		{"lport", "foo"},
+		{"mark", "-1"},
+		{"nobind", "foo"},
+		{"bind", "foo"},
+		{"local"},
+	}
+	for _, b := range bad {
+		err := parseOption(&Options{}, newConfigFiles(d), b[0], b[1:], 0)
+		if !errors.Is(err, errBadCfg) {
+			t.Errorf("parseOption(%v): want %v, got %v", b, errBadCfg, err)
+		}
+	}
+}
+
+func Test_parseProxies(t *testing.T) {
+	d := t.TempDir()
+	os.WriteFile(fp.Join(d, "creds"), []byte("user\npass\n"), 0600)
+
+	o := &Options{}
+	if err := parseHTTPProxy([]string{"10.0.0.1", "3128", "creds", "digest"}, o, newConfigFiles(d)); err != nil {
+		t.Fatalf("parseHTTPProxy(): unexpected error %v", err)
+	}
+	if o.HTTPProxy != "10.0.0.1:3128" || o.HTTPProxyUser != "user" || o.HTTPProxyPass != "pass" || o.HTTPProxyAuth != "digest" {
+		t.Errorf("parseHTTPProxy(): bad options %+v", o)
+	}
+	if err := parseSOCKSProxy([]string{"127.0.0.1"}, o, newConfigFiles(d)); !errors.Is(err, errBadCfg) {
+		t.Errorf("parseSOCKSProxy(): should fail after http-proxy, got %v", err)
+	}
+
+	o = &Options{}
+	if err := parseSOCKSProxy([]string{"127.0.0.1"}, o, newConfigFiles(d)); err != nil {
+		t.Fatalf("parseSOCKSProxy(): unexpected error %v", err)
+	}
+	if o.SOCKSProxy != "127.0.0.1:1080" {
+		t.Errorf("parseSOCKSProxy(): want default port, got %v", o.SOCKSProxy)
+	}
+
+	bad := [][]string{
+		{"http-proxy", "10.0.0.1"},
+		{"http-proxy", "10.0.0.1", "foo"},
+		{"http-proxy", "10.0.0.1", "3128", "auto"},
+		{"http-proxy", "10.0.0.1", "3128", "creds", "ntlm"},
+		{"http-proxy", "10.0.0.1", "3128", "/etc/passwd"},
+		{"socks-proxy"},
+		{"socks-proxy", "10.0.0.1", "foo"},
+		{"socks-proxy", "10.0.0.1", "1080", "nonexistent"},
+	}
+	for _, b := range bad {
+		err := parseOption(&Options{}, newConfigFiles(d), b[0], b[1:], 0)
+		if !errors.Is(err, errBadCfg) {
+			t.Errorf("parseOption(%v): want %v, got %v", b, errBadCfg, err)
+		}
+	}
+}
+
+func Test_parseProxyPT(t *testing.T) {
+	o := &Options{}
+	if err := parseOption(o, newConfigFiles(""), "proxy-pt", []string{"stub", "/usr/bin/stub-client", "-log", "x"}, 0); err != nil {
+		t.Fatalf("parseOption(proxy-pt): unexpected error %v", err)
+	}
+	if err := parseOption(o, newConfigFiles(""), "proxy-pt-args", []string{"cert=a=b", "url=https://example.com/"}, 0); err != nil {
+		t.Fatalf("parseOption(proxy-pt-args): unexpected error %v", err)
+	}
+	if o.ProxyPT != "stub" || !reflect.DeepEqual(o.ProxyPTCmd, []string{"/usr/bin/stub-client", "-log", "x"}) {
+		t.Errorf("parseProxyPT(): bad options %+v", o)
+	}
+	if !reflect.DeepEqual(o.ProxyPTArgs, []string{"cert=a=b", "url=https://example.com/"}) {
+		t.Errorf("parseProxyPTArgs(): got %v", o.ProxyPTArgs)
+	}
+	if err := parseProxyOBFS4([]string{"obfs4://foobar"}, o); !errors.Is(err, errBadCfg) {
+		t.Errorf("parseProxyOBFS4(): should fail after proxy-pt, got %v", err)
+	}
+
+	bad := [][]string{
+		{"proxy-pt"},
+		{"proxy-pt", "stub"},
+		{"proxy-pt-args"},
+		{"proxy-pt-args", "foo"},
+		{"proxy-pt-args", "=foo"},
+	}
+	for _, b := range bad {
+		err := parseOption(&Options{}, newConfigFiles(""), b[0], b[1:], 0)
+		if !errors.Is(err, errBadCfg) {
+			t.Errorf("parseOption(%v): want %v, got %v", b, errBadCfg, err)
+		}
+	}
+	err := parseProxyPT([]string{"stub", "stub-client"}, &Options{ProxyOBFS4: "obfs4://foobar"})
+	if !errors.Is(err, errBadCfg) {
+		t.Errorf("parseProxyPT(): should fail after proxy-obfs4, got %v", err)
+	}
+}
+
+func Test_parseProxyWebSocket(t *testing.T) {
+	o := &Options{}
+	if err := parseOption(o, newConfigFiles(""), "proxy-websocket", []string{"wss://relay.example.com/vpn", "firefox"}, 0); err != nil {
+		t.Fatalf("parseOption(proxy-websocket): unexpected error %v", err)
+	}
+	if err := parseOption(o, newConfigFiles(""), "proxy-websocket-host", []string{"cdn.example.com"}, 0); err != nil {
+		t.Fatalf("parseOption(proxy-websocket-host): unexpected error %v", err)
+	}
+	if o.ProxyWebSocket != "wss://relay.example.com/vpn" || o.ProxyWebSocketFingerprint != "firefox" || o.ProxyWebSocketHost != "cdn.example.com" {
+		t.Errorf("parseProxyWebSocket(): bad options %+v", o)
+	}
+	if err := parseProxyPT([]string{"stub", "stub-client"}, o); !errors.Is(err, errBadCfg) {
+		t.Errorf("parseProxyPT(): should fail after proxy-websocket, got %v", err)
+	}
+
+	bad := [][]string{
+		{"proxy-websocket"},
+		{"proxy-websocket", "https://relay.example.com"},
+		{"proxy-websocket", "ws://relay.example.com", "netscape"},
+		{"proxy-websocket", "ws://relay.example.com", "chrome", "extra"},
+		{"proxy-websocket-host"},
+	}
+	for _, b := range bad {
+		err := parseOption(&Options{}, newConfigFiles(""), b[0], b[1:], 0)
+		if !errors.Is(err, errBadCfg) {
+			t.Errorf("parseOption(%v): want %v, got %v", b, errBadCfg, err)
+		}
+	}
+}
+
+func Test_parseProxyTLS(t *testing.T) {
+	pin := "sha256//" + strings.Repeat("A", 43) + "="
+	o := &Options{}
+	lines := [][]string{
+		{"proxy-tls", "stunnel.example.com", "chrome"},
+		{"proxy-tls-alpn", "h2", "http/1.1"},
+		{"proxy-tls-pin", pin},
+		{"proxy-tls-pin", pin},
+	}
+	for _, l := range lines {
+		if err := parseOption(o, newConfigFiles(""), l[0], l[1:], 0); err != nil {
+			t.Fatalf("parseOption(%v): unexpected error %v", l, err)
+		}
+	}
+	if !o.ProxyTLS || o.ProxyTLSServerName != "stunnel.example.com" || o.ProxyTLSFingerprint != "chrome" {
+		t.Errorf("parseProxyTLS(): bad options %+v", o)
+	}
+	if !reflect.DeepEqual(o.ProxyTLSALPN, []string{"h2", "http/1.1"}) || len(o.ProxyTLSPins) != 2 {
+		t.Errorf("parseProxyTLS(): bad alpn or pins %+v", o)
+	}
+	if err := parseProxyWebSocket([]string{"ws://relay.example.com"}, o); !errors.Is(err, errBadCfg) {
+		t.Errorf("parseProxyWebSocket(): should fail after proxy-tls, got %v", err)
+	}
+
+	o = &Options{}
+	if err := parseProxyTLS(nil, o); err != nil || !o.ProxyTLS || o.ProxyTLSServerName != "" {
+		t.Errorf("parseProxyTLS(): without args, got %v, %+v", err, o)
+	}
+
+	bad := [][]string{
+		{"proxy-tls", "a", "chrome", "extra"},
+		{"proxy-tls", "a", "netscape"},
+		{"proxy-tls-alpn"},
+		{"proxy-tls-pin"},
+		{"proxy-tls-pin", "AAAA"},
+	}
+	for _, b := range bad {
+		err := parseOption(&Options{}, newConfigFiles(""), b[0], b[1:], 0)
+		if !errors.Is(err, errBadCfg) {
+			t.Errorf("parseOption(%v): want %v, got %v", b, errBadCfg, err)
+		}
+	}
+	err := parseProxyTLS(nil, &Options{ProxyOBFS4: "obfs4://foobar"})
+	if !errors.Is(err, errBadCfg) {
+		t.Errorf("parseProxyTLS(): should fail after proxy-obfs4, got %v", err)
+	}
+}
@@ -101,6 +101,9 @@ func parsePacketFromBytes(buf []byte) (*packet, error) {
 
 	switch opcode {
 	case pDataV2:
+		if len(buf) < 4 {
+			return &packet{}, errBadInput
+		}
 		payload = buf[4:]
 	default:
 		payload = buf[1:]
@@ -110,7 +113,9 @@ func parsePacketFromBytes(buf []byte) (*packet, error) {
 		opcode:  opcode,
 		keyID:   keyID,
 		payload: payload,
-		id:      packetID(binary.BigEndian.Uint32(buf[29:33])),
+	}
+	if len(buf) >= 33 {
+		p.id = packetID(binary.BigEndian.Uint32(buf[29:33]))
 	}
 	fmt.Printf("Got packet №%d\n", p.id)
 	return parsePacket(p)
@@ -339,10 +344,14 @@ func encodeClientControlMessageAsBytes(k *keySource, o *Options) ([]byte, error)
 	out.Write(user)
 	out.Write(pass)
 
-	// we could send IV_PLAT too, but afaik declaring the platform does not
-	// make any difference for our purposes.
-	rawInfo := fmt.Sprintf("IV_VER=%s\nIV_PROTO=%s\n", IV_Ver, IV_Proto)
-	peerInfo, _ := encodeOptionStringToBytes(rawInfo)
+	rawInfo, err := o.peerInfo()
+	if err != nil {
+		return nil, err
+	}
+	peerInfo, err := encodeOptionStringToBytes(rawInfo)
+	if err != nil {
+		return nil, err
+	}
 	out.Write(peerInfo)
 	return out.Bytes(), nil
 }
@@ -377,6 +386,104 @@ func parseServerHardResetPacket(p *serverHardReset) (sessionID, error) {
 	return rs, nil
 }
 
+const (
+	// tlsAuthHeaderSize is what tls-auth adds after the session id: the
+	// hmac, the replay packet id and the time.
+	tlsAuthHeaderSize = 20 + 4 + 4
+
+	// tlvEarlyNegFlags is the type of the EARLY_NEG_FLAGS TLV, that a 2.6
+	// server can append to its hard reset.
+	tlvEarlyNegFlags = 0x0001
+
+	// earlyNegResendWKC is the EARLY_NEG_FLAGS flag with which the server
+	// asks the client to resend its tls-crypt-v2 key.
+	earlyNegResendWKC = 0x0001
+)
+
+// serverHardResetReply holds the fields of a server hard reset that we need
+// to answer it. A 2.6 server can reply statelessly, with a session id that is
+// an HMAC cookie: it keeps no state until the client acks the reset with the
+// same session id, so the reset is acked by its real message packet id, and
+// the cookie is echoed back.
+type serverHardResetReply struct {
+	// sessionID is the remote session id, or cookie.
+	sessionID sessionID
+
+	// replayID is the tls-auth replay packet id of the reset.
+	replayID packetID
+
+	// messageID is the message packet id of the reset, that we ack.
+	messageID packetID
+
+	// acks are the ids of our packets that the server acked, and
+	// ackedSessionID is the session id that it echoed with them.
+	acks           ackArray
+	ackedSessionID sessionID
+
+	// earlyNegFlags are the EARLY_NEG_FLAGS sent by the server, if any.
+	earlyNegFlags uint16
+}
+
+// parseServerHardResetReply parses a server hard reset wrapped with tls-auth,
+// and returns an error if the packet is malformed.
+func parseServerHardResetReply(p *serverHardReset) (*serverHardResetReply, error) {
+	sid, err := parseServerHardResetPacket(p)
+	if err != nil {
+		return nil, err
+	}
+	r := &serverHardResetReply{sessionID: sid}
+	buf := bytes.NewBuffer(p.payload[9:])
+	if buf.Len() < tlsAuthHeaderSize {
+		return nil, fmt.Errorf("%w: %s", errBadReset, "short tls-auth header")
+	}
+	buf.Next(20)
+	replayID, _ := bufReadUint32(buf)
+	r.replayID = packetID(replayID)
+	buf.Next(4)
+
+	nAcks, err := buf.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errBadReset, "missing ack array")
+	}
+	for i := 0; i < int(nAcks); i++ {
+		val, err := bufReadUint32(buf)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad ack: %s", errBadReset, err)
+		}
+		r.acks = append(r.acks, packetID(val))
+	}
+	if nAcks > 0 {
+		if _, err := io.ReadFull(buf, r.ackedSessionID[:]); err != nil {
+			return nil, fmt.Errorf("%w: bad acked session id: %s", errBadReset, err)
+		}
+	}
+	messageID, err := bufReadUint32(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad message id: %s", errBadReset, err)
+	}
+	r.messageID = packetID(messageID)
+
+	// what follows are TLVs, of which we only know EARLY_NEG_FLAGS.
+	for buf.Len() > 0 {
+		if buf.Len() < 4 {
+			return nil, fmt.Errorf("%w: %s", errBadReset, "short tlv")
+		}
+		typ := binary.BigEndian.Uint16(buf.Next(2))
+		size := int(binary.BigEndian.Uint16(buf.Next(2)))
+		if buf.Len() < size {
+			return nil, fmt.Errorf("%w: %s", errBadReset, "short tlv value")
+		}
+		value := buf.Next(size)
+		if typ == tlvEarlyNegFlags {
+			if size != 2 {
+				return nil, fmt.Errorf("%w: bad early negotiation flags size: %d", errBadReset, size)
+			}
+			r.earlyNegFlags = binary.BigEndian.Uint16(value)
+		}
+	}
+	return r, nil
+}
+
 // newACKPacket returns a packet with the P_ACK_V1 opcode.
 func newACKPacket(ackID packetID, s *session) *packet {
 	acks := []packetID{ackID}
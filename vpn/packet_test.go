@@ -2,6 +2,7 @@ package vpn
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"reflect"
@@ -304,8 +305,9 @@ func Test_encodeClientControlMessageAsBytes(t *testing.T) {
 					// auth strings
 					0x00, 0x01, 0x00,
 					0x00, 0x01, 0x00}...)
-				buf = append(buf, []byte{0x00, 0x19}...)
-				buf = append(buf, []byte("IV_VER=2.5.5\nIV_PROTO=2\n")...)
+				info := "IV_VER=2.5.5\nIV_PLAT=" + peerInfoPlatform + "\nIV_PROTO=2\nIV_TCPNL=1\nIV_MTU=1500\n"
+				buf = append(buf, 0x00, byte(len(info)+1))
+				buf = append(buf, []byte(info)...)
 				buf = append(buf, 0x00)
 				return buf
 			}(),
@@ -329,13 +331,23 @@ func Test_encodeClientControlMessageAsBytes(t *testing.T) {
 					0x00,
 					0x00, 0x01, 0x00,
 					0x00, 0x01, 0x00}...)
-				buf = append(buf, []byte{0x00, 0x19}...)
-				buf = append(buf, []byte("IV_VER=2.5.5\nIV_PROTO=2\n")...)
+				info := "IV_VER=2.5.5\nIV_PLAT=" + peerInfoPlatform + "\nIV_PROTO=2\nIV_NCP=2\nIV_CIPHERS=AES-128-CBC\nIV_TCPNL=1\nIV_MTU=1500\n"
+				buf = append(buf, 0x00, byte(len(info)+1))
+				buf = append(buf, []byte(info)...)
 				buf = append(buf, 0x00)
 				return buf
 			}(),
 			false,
 		},
+		{
+			"bad peer-info",
+			args{
+				&keySource{manyA, manyB, manyC},
+				&Options{PeerInfo: map[string]string{"IV_GUI_VER": "a\nb"}},
+			},
+			nil,
+			true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -765,3 +777,90 @@ func Test_Crash_parseServerHardResetPacket(t *testing.T) {
 	p := &serverHardReset{}
 	parseServerHardResetPacket(p)
 }
+
+// makeTestingServerHardReset returns a server hard reset wrapped with
+// tls-auth, that acks our reset when acks is not empty, with a zero hmac.
+func makeTestingServerHardReset(remote, local sessionID, acks []uint32, msgID uint32, tlvs ...byte) []byte {
+	b := append([]byte{0x40}, remote[:]...)
+	b = append(b, make([]byte, 20)...)
+	b = append(b, 0, 0, 0, 7, 0, 0, 0, 0)
+	b = append(b, byte(len(acks)))
+	for _, a := range acks {
+		b = binary.BigEndian.AppendUint32(b, a)
+	}
+	if len(acks) > 0 {
+		b = append(b, local[:]...)
+	}
+	b = binary.BigEndian.AppendUint32(b, msgID)
+	return append(b, tlvs...)
+}
+
+func Test_parseServerHardResetReply(t *testing.T) {
+	remote := sessionID{1, 2, 3, 4, 5, 6, 7, 8}
+	local := sessionID{8, 7, 6, 5, 4, 3, 2, 1}
+	tests := []struct {
+		name    string
+		b       []byte
+		want    *serverHardResetReply
+		wantErr error
+	}{
+		{
+			name: "classic reset",
+			b:    makeTestingServerHardReset(remote, local, []uint32{0}, 0),
+			want: &serverHardResetReply{
+				sessionID:      remote,
+				replayID:       7,
+				acks:           ackArray{0},
+				ackedSessionID: local,
+			},
+		},
+		{
+			name: "no acks, and an unknown tlv",
+			b:    makeTestingServerHardReset(remote, local, nil, 2, 0x00, 0x09, 0x00, 0x01, 0xff),
+			want: &serverHardResetReply{sessionID: remote, replayID: 7, messageID: 2},
+		},
+		{
+			name: "early negotiation flags",
+			b:    makeTestingServerHardReset(remote, local, []uint32{0}, 0, 0x00, 0x01, 0x00, 0x02, 0x00, 0x01),
+			want: &serverHardResetReply{
+				sessionID:      remote,
+				replayID:       7,
+				acks:           ackArray{0},
+				ackedSessionID: local,
+				earlyNegFlags:  earlyNegResendWKC,
+			},
+		},
+		{
+			name:    "short tls-auth header",
+			b:       append([]byte{0x40}, make([]byte, 20)...),
+			wantErr: errBadReset,
+		},
+		{
+			name:    "missing message id",
+			b:       makeTestingServerHardReset(remote, local, []uint32{0}, 0)[:59],
+			wantErr: errBadReset,
+		},
+		{
+			name:    "truncated tlv",
+			b:       makeTestingServerHardReset(remote, local, nil, 0, 0x00, 0x01, 0x00, 0x02, 0x00),
+			wantErr: errBadReset,
+		},
+		{
+			name:    "bad early negotiation flags size",
+			b:       makeTestingServerHardReset(remote, local, nil, 0, 0x00, 0x01, 0x00, 0x01, 0x00),
+			wantErr: errBadReset,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseServerHardResetReply(&serverHardReset{tt.b})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("parseServerHardResetReply() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseServerHardResetReply() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
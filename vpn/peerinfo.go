@@ -0,0 +1,125 @@
+package vpn
+
+//
+// The peer-info that the client sends to the server in its key method 2
+// message.
+//
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// peerInfoPlatform is the IV_PLAT that we declare. It is a variable so that
+// tests do not depend on the platform they run on.
+var peerInfoPlatform = platformName(runtime.GOOS)
+
+// platformName returns the IV_PLAT value that the reference implementation
+// uses for a GOOS.
+func platformName(goos string) string {
+	switch goos {
+	case "darwin":
+		return "mac"
+	case "windows":
+		return "win"
+	default:
+		return goos
+	}
+}
+
+// peerInfoKV is a key of the peer-info, with its value.
+type peerInfoKV struct {
+	k, v string
+}
+
+// peerInfo returns the peer-info for the options, one KEY=value per line, in
+// the order used by the reference implementation:
+//
+// - IV_VER, IV_PLAT and IV_PROTO;
+//
+// - IV_NCP and IV_CIPHERS, when a cipher is set. We only list our cipher, so
+// the server cannot negotiate another one;
+//
+// - IV_LZO_STUB and IV_COMP_STUB, when compression is configured. We do not
+// advertise the stubs otherwise, since we would not understand a pushed
+// compress directive;
+//
+// - IV_TCPNL and IV_MTU, with our tun-mtu;
+//
+// - IV_GUI_VER and IV_SSO, when given with setenv;
+//
+// - IV_PLAT_VER and the UV_* variables given with setenv, only with
+// push-peer-info.
+//
+// The keys in Options.PeerInfo come last: they replace the ones above in
+// place, an empty value removes a key, and the new keys are added in
+// alphabetical order.
+func (o *Options) peerInfo() (string, error) {
+	kvs := []peerInfoKV{
+		{"IV_VER", IV_Ver},
+		{"IV_PLAT", peerInfoPlatform},
+		{"IV_PROTO", IV_Proto},
+	}
+	if o.Cipher != "" {
+		kvs = append(kvs, peerInfoKV{"IV_NCP", "2"}, peerInfoKV{"IV_CIPHERS", o.Cipher})
+	}
+	if o.Compress != "" {
+		kvs = append(kvs, peerInfoKV{"IV_LZO_STUB", "1"}, peerInfoKV{"IV_COMP_STUB", "1"})
+	}
+	_, _, tunMTU := o.devMTUs()
+	kvs = append(kvs, peerInfoKV{"IV_TCPNL", "1"}, peerInfoKV{"IV_MTU", strconv.Itoa(tunMTU)})
+	for _, k := range []string{"IV_GUI_VER", "IV_SSO"} {
+		if v, ok := o.SetEnv[k]; ok {
+			kvs = append(kvs, peerInfoKV{k, v})
+		}
+	}
+	if o.PushPeerInfo {
+		if v, ok := o.SetEnv["IV_PLAT_VER"]; ok {
+			kvs = append(kvs, peerInfoKV{"IV_PLAT_VER", v})
+		}
+		for _, k := range sortedKeys(o.SetEnv) {
+			if strings.HasPrefix(k, "UV_") {
+				kvs = append(kvs, peerInfoKV{k, o.SetEnv[k]})
+			}
+		}
+	}
+
+	for _, k := range sortedKeys(o.PeerInfo) {
+		v := o.PeerInfo[k]
+		if k == "" || strings.ContainsAny(k, "=\n") || strings.Contains(v, "\n") {
+			return "", fmt.Errorf("%w: bad peer-info: %q=%q", errBadInput, k, v)
+		}
+		found := false
+		for i := range kvs {
+			if kvs[i].k == k {
+				kvs[i].v = v
+				found = true
+			}
+		}
+		if !found {
+			kvs = append(kvs, peerInfoKV{k, v})
+		}
+	}
+
+	var b strings.Builder
+	for _, kv := range kvs {
+		if kv.v == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "%s=%s\n", kv.k, kv.v)
+	}
+	return b.String(), nil
+}
+
+// sortedKeys returns the keys of m in alphabetical order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
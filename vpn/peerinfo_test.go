@@ -0,0 +1,107 @@
+package vpn
+
+import (
+	"errors"
+	"testing"
+)
+
+func Test_platformName(t *testing.T) {
+	for goos, want := range map[string]string{"linux": "linux", "darwin": "mac", "windows": "win", "freebsd": "freebsd"} {
+		if got := platformName(goos); got != want {
+			t.Errorf("platformName(%s) = %s, want %s", goos, got, want)
+		}
+	}
+}
+
+func TestOptions_peerInfo(t *testing.T) {
+	defer func(p string) { peerInfoPlatform = p }(peerInfoPlatform)
+	peerInfoPlatform = "linux"
+
+	setenv := map[string]string{
+		"IV_GUI_VER":  "OpenVPN_GUI 11",
+		"IV_SSO":      "openurl,crtext",
+		"IV_PLAT_VER": "10.0",
+		"UV_B":        "2",
+		"UV_A":        "1",
+		"OTHER":       "x",
+	}
+	tests := []struct {
+		name string
+		o    *Options
+		want string
+	}{
+		{
+			"defaults",
+			&Options{},
+			"IV_VER=2.5.5\nIV_PLAT=linux\nIV_PROTO=2\nIV_TCPNL=1\nIV_MTU=1500\n",
+		},
+		{
+			"tap and compression",
+			&Options{DevType: devTypeTAP, Compress: compressionStub},
+			"IV_VER=2.5.5\nIV_PLAT=linux\nIV_PROTO=2\nIV_LZO_STUB=1\nIV_COMP_STUB=1\nIV_TCPNL=1\nIV_MTU=1532\n",
+		},
+		{
+			"cipher and setenv",
+			&Options{Cipher: "AES-256-GCM", SetEnv: setenv},
+			"IV_VER=2.5.5\nIV_PLAT=linux\nIV_PROTO=2\nIV_NCP=2\nIV_CIPHERS=AES-256-GCM\nIV_TCPNL=1\nIV_MTU=1500\nIV_GUI_VER=OpenVPN_GUI 11\nIV_SSO=openurl,crtext\n",
+		},
+		{
+			"push-peer-info",
+			&Options{SetEnv: setenv, PushPeerInfo: true},
+			"IV_VER=2.5.5\nIV_PLAT=linux\nIV_PROTO=2\nIV_TCPNL=1\nIV_MTU=1500\nIV_GUI_VER=OpenVPN_GUI 11\nIV_SSO=openurl,crtext\nIV_PLAT_VER=10.0\nUV_A=1\nUV_B=2\n",
+		},
+		{
+			"peer-info map",
+			&Options{
+				Cipher: "AES-256-GCM",
+				PeerInfo: map[string]string{
+					"IV_VER":     "2.6.8",
+					"IV_PLAT":    "win",
+					"IV_CIPHERS": "",
+					"IV_TCPNL":   "",
+					"IV_MTU":     "1600",
+					"IV_HWADDR":  "00:00:00:00:00:01",
+				},
+			},
+			"IV_VER=2.6.8\nIV_PLAT=win\nIV_PROTO=2\nIV_NCP=2\nIV_MTU=1600\nIV_HWADDR=00:00:00:00:00:01\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.o.peerInfo()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("peerInfo() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	for _, m := range []map[string]string{{"": "x"}, {"IV=X": "1"}, {"UV_X": "a\nb"}} {
+		o := &Options{PeerInfo: m}
+		if _, err := o.peerInfo(); !errors.Is(err, errBadInput) {
+			t.Errorf("peerInfo() with %q: want %v, got %v", m, errBadInput, err)
+		}
+	}
+}
+
+func Test_parsePeerInfoOptions(t *testing.T) {
+	o, err := getOptionsFromLines([]string{
+		`setenv IV_GUI_VER "my-client 1.2"`,
+		"setenv UV_ID 42",
+		"push-peer-info",
+	}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.SetEnv["IV_GUI_VER"] != "my-client 1.2" || o.SetEnv["UV_ID"] != "42" || !o.PushPeerInfo {
+		t.Errorf("getOptionsFromLines(): setenv = %q, push-peer-info = %v", o.SetEnv, o.PushPeerInfo)
+	}
+	if err := parseSetenv([]string{"UV_ID"}, &Options{}); !errors.Is(err, errBadCfg) {
+		t.Errorf("parseSetenv(): want %v, got %v", errBadCfg, err)
+	}
+	if err := parsePushPeerInfo([]string{"yes"}, &Options{}); !errors.Is(err, errBadCfg) {
+		t.Errorf("parsePushPeerInfo(): want %v, got %v", errBadCfg, err)
+	}
+}
@@ -0,0 +1,228 @@
+package vpn
+
+//
+// UDP port hopping: the outer socket is periodically replaced by a new one,
+// with a new source port and, optionally, a new server port.
+//
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// portHopDialTimeout bounds the time spent opening each new socket.
+const portHopDialTimeout = 10 * time.Second
+
+// hoppingConn is a UDP net.Conn that moves to a new socket every interval,
+// once started. The server keeps the session because data packets carry the
+// peer-id (P_DATA_V2), which lets it float the client to the new address; so
+// hopping must not be started when the server assigns no peer-id. onHop is
+// called after each hop so that an authenticated packet is sent right away.
+// Datagrams still in flight to the old socket are lost.
+type hoppingConn struct {
+	dialer   DialerContext
+	host     string
+	port     string
+	low      int
+	high     int
+	interval time.Duration
+
+	mu            sync.Mutex
+	cur           net.Conn
+	onHop         func()
+	readDeadline  time.Time
+	writeDeadline time.Time
+	closed        bool
+
+	done chan struct{}
+	hops int64
+
+	// randMu protects rand, which is not safe for concurrent use.
+	randMu sync.Mutex
+	rand   *rand.Rand
+}
+
+// newHoppingConnFromOptions wraps conn, the first socket to the remote, to
+// hop every PortHopInterval once started. New sockets are opened with dialer.
+func newHoppingConnFromOptions(o *Options, dialer DialerContext, conn net.Conn) *hoppingConn {
+	c := &hoppingConn{
+		dialer:   dialer,
+		host:     o.Remote,
+		port:     o.Port,
+		low:      o.PortHopLow,
+		high:     o.PortHopHigh,
+		interval: o.PortHopInterval,
+		cur:      conn,
+		done:     make(chan struct{}),
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())), // #nosec G404 -- port choice does not need a CSPRNG
+	}
+	return c
+}
+
+// start starts hopping every interval.
+func (c *hoppingConn) start() {
+	go c.loop()
+}
+
+// setOnHop sets the function called after each hop.
+func (c *hoppingConn) setOnHop(fn func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onHop = fn
+}
+
+// loop hops every interval until the conn is closed. A failed hop is logged,
+// and the current socket is kept until the next one.
+func (c *hoppingConn) loop() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), portHopDialTimeout)
+		err := c.hop(ctx)
+		cancel()
+		if err != nil {
+			logger.Warnf("port-hop: %s", err)
+		}
+	}
+}
+
+// nextAddress returns the address for the next socket: the remote port, or
+// a random port in the configured range.
+func (c *hoppingConn) nextAddress() string {
+	port := c.port
+	if c.low != 0 {
+		c.randMu.Lock()
+		port = strconv.Itoa(c.low + c.rand.Intn(c.high-c.low+1))
+		c.randMu.Unlock()
+	}
+	return net.JoinHostPort(c.host, port)
+}
+
+// hop opens a new socket, makes it the current one and closes the old one.
+func (c *hoppingConn) hop(ctx context.Context) error {
+	conn, err := c.dialer.DialContext(ctx, "udp", c.nextAddress())
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		conn.Close()
+		return net.ErrClosed
+	}
+	if !c.readDeadline.IsZero() {
+		conn.SetReadDeadline(c.readDeadline)
+	}
+	if !c.writeDeadline.IsZero() {
+		conn.SetWriteDeadline(c.writeDeadline)
+	}
+	old := c.cur
+	c.cur = conn
+	onHop := c.onHop
+	c.mu.Unlock()
+
+	old.Close()
+	atomic.AddInt64(&c.hops, 1)
+	logger.Debugf("port-hop: now %s -> %s", conn.LocalAddr(), conn.RemoteAddr())
+	if onHop != nil {
+		onHop()
+	}
+	return nil
+}
+
+// current returns the current socket, and whether the conn was closed.
+func (c *hoppingConn) current() (net.Conn, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cur, c.closed
+}
+
+// Read reads a datagram from the current socket. If the socket is replaced
+// while reading, the read continues on the new one.
+func (c *hoppingConn) Read(b []byte) (int, error) {
+	for {
+		conn, _ := c.current()
+		n, err := conn.Read(b)
+		if err != nil {
+			if next, closed := c.current(); next != conn && !closed {
+				continue
+			}
+		}
+		return n, err
+	}
+}
+
+// Write writes a datagram to the current socket. If the socket is replaced
+// while writing, the datagram is sent again on the new one.
+func (c *hoppingConn) Write(b []byte) (int, error) {
+	conn, _ := c.current()
+	n, err := conn.Write(b)
+	if err != nil {
+		if next, closed := c.current(); next != conn && !closed {
+			return next.Write(b)
+		}
+	}
+	return n, err
+}
+
+// Close stops hopping and closes the current socket.
+func (c *hoppingConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return net.ErrClosed
+	}
+	c.closed = true
+	close(c.done)
+	conn := c.cur
+	c.mu.Unlock()
+	return conn.Close()
+}
+
+// LocalAddr returns the local address of the current socket.
+func (c *hoppingConn) LocalAddr() net.Addr {
+	conn, _ := c.current()
+	return conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the current socket.
+func (c *hoppingConn) RemoteAddr() net.Addr {
+	conn, _ := c.current()
+	return conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines, which are kept across hops.
+func (c *hoppingConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline, which is kept across hops.
+func (c *hoppingConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.cur.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline, which is kept across hops.
+func (c *hoppingConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return c.cur.SetWriteDeadline(t)
+}
+
+var _ net.Conn = &hoppingConn{} // Ensure that we implement net.Conn
@@ -0,0 +1,190 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_hoppingConn_hop(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.LocalAddr().String())
+	o := &Options{Remote: host, Port: port, PortHopInterval: time.Hour}
+	first, err := net.Dial("udp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newHoppingConnFromOptions(o, &net.Dialer{}, first)
+	defer c.Close()
+	hopped := make(chan struct{}, 1)
+	c.setOnHop(func() { hopped <- struct{}{} })
+
+	// a read blocked on the first socket continues on the next one.
+	read := make(chan []byte)
+	go func() {
+		buf := make([]byte, 16)
+		n, err := c.Read(buf)
+		if err != nil {
+			read <- nil
+			return
+		}
+		read <- buf[:n]
+	}()
+
+	before := c.LocalAddr().String()
+	if err := c.hop(context.Background()); err != nil {
+		t.Fatalf("hop() error = %v", err)
+	}
+	<-hopped
+	if c.LocalAddr().String() == before {
+		t.Errorf("hop(): the source port did not change")
+	}
+
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	_, addr, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.String() != c.LocalAddr().String() {
+		t.Errorf("datagram came from %v, want %v", addr, c.LocalAddr())
+	}
+	server.WriteTo([]byte("pong"), addr)
+	select {
+	case got := <-read:
+		if string(got) != "pong" {
+			t.Errorf("Read() = %q, want pong", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read(): no datagram after the hop")
+	}
+}
+
+func Test_hoppingConn_nextAddress(t *testing.T) {
+	c := newHoppingConnFromOptions(
+		&Options{Remote: "10.0.0.1", Port: "1194", PortHopInterval: time.Hour, PortHopLow: 2000, PortHopHigh: 2002},
+		&net.Dialer{}, makeTestingConnForReadWrite("udp", "10.0.0.1", 0))
+	defer close(c.done)
+	for i := 0; i < 20; i++ {
+		_, port, _ := net.SplitHostPort(c.nextAddress())
+		p, _ := strconv.Atoi(port)
+		if p < 2000 || p > 2002 {
+			t.Fatalf("nextAddress(): port %d out of range", p)
+		}
+	}
+	c.low = 0
+	if got := c.nextAddress(); got != "10.0.0.1:1194" {
+		t.Errorf("nextAddress() = %v, want 10.0.0.1:1194", got)
+	}
+}
+
+func Test_hoppingConn_Close(t *testing.T) {
+	conn, err := net.Dial("udp", "127.0.0.1:9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newHoppingConnFromOptions(&Options{Remote: "127.0.0.1", Port: "9", PortHopInterval: time.Hour}, &net.Dialer{}, conn)
+	if err := c.Close(); err != nil {
+		t.Errorf("Close(): unexpected error %v", err)
+	}
+	if err := c.hop(context.Background()); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("hop() after Close(): want %v, got %v", net.ErrClosed, err)
+	}
+}
+
+func TestClient_dialPortHop(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.LocalAddr().String())
+
+	c := NewClientFromOptions(&Options{Remote: host, Port: port, Proto: UDPMode, PortHopInterval: time.Hour})
+	conn, err := c.dial(context.Background())
+	if err != nil {
+		t.Fatalf("Client.dial() error = %v", err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*hoppingConn); !ok {
+		t.Errorf("Client.dial(): expected a hoppingConn, got %T", conn)
+	}
+
+	bad := []*Options{
+		{Remote: host, Port: port, Proto: TCPMode, PortHopInterval: time.Hour},
+		{Remote: host, Port: port, Proto: UDPMode, PortHopInterval: time.Hour, LPort: "1194"},
+	}
+	for _, o := range bad {
+		_, err := NewClientFromOptions(o).dial(context.Background())
+		if !errors.Is(err, errBadInput) {
+			t.Errorf("Client.dial(): want %v, got %v", errBadInput, err)
+		}
+	}
+}
+
+func TestClient_StartPortHopNeedsPeerID(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.LocalAddr().String())
+
+	for _, hasPeerID := range []bool{true, false} {
+		c := NewClientFromOptions(&Options{Remote: host, Port: port, Proto: UDPMode, PortHopInterval: 5 * time.Millisecond})
+		c.muxerFactoryFn = func(conn net.Conn, o *Options, ti *tunnelInfo) (vpnMuxer, error) {
+			// as readPushReply does
+			ti.hasPeerID = hasPeerID
+			return &mockMuxerWithDummyHandshake{}, nil
+		}
+		if err := c.Start(context.Background()); err != nil {
+			t.Fatalf("Client.Start(): unexpected error %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		hops := atomic.LoadInt64(&c.hopper.hops)
+		c.Close()
+		if hasPeerID && hops == 0 {
+			t.Errorf("Client.Start(): no hop with a peer-id")
+		}
+		if !hasPeerID && hops != 0 {
+			t.Errorf("Client.Start(): %d hops without a peer-id", hops)
+		}
+	}
+}
+
+func Test_parsePortHop(t *testing.T) {
+	o := &Options{}
+	if err := parsePortHop([]string{"30", "1194-1200"}, o); err != nil {
+		t.Fatal(err)
+	}
+	if o.PortHopInterval != 30*time.Second || o.PortHopLow != 1194 || o.PortHopHigh != 1200 {
+		t.Errorf("parsePortHop(): got %v %v %v", o.PortHopInterval, o.PortHopLow, o.PortHopHigh)
+	}
+
+	bad := [][]string{{}, {"0"}, {"soon"}, {"30", "1194"}, {"30", "1200-1194"}, {"30", "0-10"}, {"30", "1-70000"}, {"30", "1-2", "3"}}
+	for _, p := range bad {
+		if err := parsePortHop(p, &Options{}); !errors.Is(err, errBadCfg) {
+			t.Errorf("parsePortHop(%v): want %v, got %v", p, errBadCfg, err)
+		}
+	}
+}
+
+func Test_getOptionsFromLines_portHop(t *testing.T) {
+	o, err := getOptionsFromLines([]string{"proto udp", "port-hop 60 1194-1200"}, t.TempDir())
+	if err != nil {
+		t.Fatalf("getOptionsFromLines(): unexpected error %v", err)
+	}
+	if o.PortHopInterval != time.Minute || o.PortHopLow != 1194 || o.PortHopHigh != 1200 {
+		t.Errorf("getOptionsFromLines(): got %v %v %v", o.PortHopInterval, o.PortHopLow, o.PortHopHigh)
+	}
+}
@@ -0,0 +1,296 @@
+package vpn
+
+//
+// Managed pluggable transports (Tor PT spec, version 1) for the outer
+// connection.
+//
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ptExitTimeout is how long we wait for a pluggable transport to exit after
+// closing its stdin, before killing it.
+const ptExitTimeout = 2 * time.Second
+
+// PTDialer is a DialerContext that launches a managed pluggable transport
+// client (as in the Tor PT v1 specification), and connects to the remote
+// through the SOCKS5 port the transport announces. The remote is expected to
+// be the bridge for that transport, which forwards the connection to the
+// OpenVPN gateway. Only TCP is supported.
+//
+// The transport is started on the first dial, and restarted if it exits. Call
+// Close to stop it.
+type PTDialer struct {
+	// Name is the transport name, as passed in TOR_PT_CLIENT_TRANSPORTS.
+	Name string
+	// Command is the transport binary followed by its arguments.
+	Command []string
+	// Args are the key=value arguments for the bridge, that are passed to
+	// the transport in the SOCKS credentials.
+	Args []string
+	// StateDir is passed in TOR_PT_STATE_LOCATION. If empty, a private
+	// directory is created in the system temp dir, and removed by Close.
+	StateDir string
+	// Proxy is an upstream proxy uri (socks5:// or http://), passed in
+	// TOR_PT_PROXY.
+	Proxy string
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	socks  string
+	exited chan struct{}
+	// tmpState is the state dir that we created, if StateDir is empty.
+	tmpState string
+}
+
+// NewPTDialerFromOptions returns a PTDialer configured from the proxy-pt and
+// proxy-pt-args options. Any http-proxy or socks-proxy is handed to the
+// transport as its upstream proxy.
+func NewPTDialerFromOptions(o *Options) *PTDialer {
+	return &PTDialer{
+		Name:    o.ProxyPT,
+		Command: o.ProxyPTCmd,
+		Args:    o.ProxyPTArgs,
+		Proxy:   o.ptUpstreamProxy(),
+	}
+}
+
+// ptUpstreamProxy returns the uri for the configured http-proxy or
+// socks-proxy, if any.
+func (o *Options) ptUpstreamProxy() string {
+	u := &url.URL{}
+	switch {
+	case o.SOCKSProxy != "":
+		u.Scheme, u.Host = "socks5", o.SOCKSProxy
+		if o.SOCKSProxyUser != "" {
+			u.User = url.UserPassword(o.SOCKSProxyUser, o.SOCKSProxyPass)
+		}
+	case o.HTTPProxy != "":
+		u.Scheme, u.Host = "http", o.HTTPProxy
+		if o.HTTPProxyUser != "" {
+			u.User = url.UserPassword(o.HTTPProxyUser, o.HTTPProxyPass)
+		}
+	default:
+		return ""
+	}
+	return u.String()
+}
+
+// DialContext starts the transport if needed, and connects to the address
+// through it.
+func (d *PTDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("%w: proxy-pt cannot carry %s", ErrProxyNetwork, network)
+	}
+	user, pass, err := ptSocksCredentials(d.Args)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := d.start(ctx)
+	if err != nil {
+		return nil, err
+	}
+	socks := &SOCKS5Dialer{Addr: addr, Username: user, Password: pass}
+	return socks.DialContext(ctx, network, address)
+}
+
+// Close stops the transport, if it is running.
+func (d *PTDialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cmd != nil {
+		d.stop()
+	}
+	if d.tmpState != "" {
+		os.RemoveAll(d.tmpState)
+		d.tmpState = ""
+	}
+	return nil
+}
+
+// start launches the transport, unless it is already running, and returns the
+// address of its SOCKS port.
+func (d *PTDialer) start(ctx context.Context) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cmd != nil {
+		select {
+		case <-d.exited:
+			d.cmd = nil
+		default:
+			return d.socks, nil
+		}
+	}
+	if len(d.Command) == 0 {
+		return "", fmt.Errorf("%w: %s", errBadInput, "proxy-pt: no command")
+	}
+	stateDir := d.StateDir
+	if stateDir == "" {
+		// the dir is only readable by us (0700), and its name is not
+		// predictable, so other users cannot tamper with the state.
+		if d.tmpState == "" {
+			dir, err := os.MkdirTemp("", "minivpn-pt-"+d.Name+"-")
+			if err != nil {
+				return "", fmt.Errorf("%w: proxy-pt: %s", ErrProxy, err)
+			}
+			d.tmpState = dir
+		}
+		stateDir = d.tmpState
+	}
+	cmd := exec.Command(d.Command[0], d.Command[1:]...)
+	cmd.Env = append(os.Environ(),
+		"TOR_PT_MANAGED_TRANSPORT_VER=1",
+		"TOR_PT_CLIENT_TRANSPORTS="+d.Name,
+		"TOR_PT_STATE_LOCATION="+stateDir,
+		"TOR_PT_EXIT_ON_STDIN_CLOSE=1",
+	)
+	if d.Proxy != "" {
+		cmd.Env = append(cmd.Env, "TOR_PT_PROXY="+d.Proxy)
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return "", err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("%w: proxy-pt: %s", ErrProxy, err)
+	}
+	d.cmd, d.stdin, d.exited = cmd, stdin, make(chan struct{})
+
+	type result struct {
+		addr string
+		err  error
+	}
+	negotiated := make(chan result, 1)
+	go func(exited chan struct{}) {
+		s := bufio.NewScanner(stdout)
+		addr, err := ptNegotiate(s, d.Name, d.Proxy != "")
+		negotiated <- result{addr, err}
+		// keep draining stdout (LOG and STATUS lines) until the transport exits.
+		for s.Scan() {
+		}
+		cmd.Wait()
+		close(exited)
+	}(d.exited)
+
+	select {
+	case r := <-negotiated:
+		if r.err != nil {
+			d.stop()
+			return "", r.err
+		}
+		d.socks = r.addr
+		return d.socks, nil
+	case <-ctx.Done():
+		d.stop()
+		return "", ctx.Err()
+	}
+}
+
+// stop closes the stdin of the transport, so that it exits, and kills it if
+// it does not exit in time. The caller must hold the mutex.
+func (d *PTDialer) stop() {
+	d.stdin.Close()
+	select {
+	case <-d.exited:
+	case <-time.After(ptExitTimeout):
+		d.cmd.Process.Kill()
+		<-d.exited
+	}
+	d.cmd = nil
+}
+
+// ptNegotiate reads the configuration messages of a client transport until
+// CMETHODS DONE, and returns the address of the SOCKS port for the named
+// transport. If wantProxy is true, the transport must acknowledge the
+// upstream proxy.
+func ptNegotiate(s *bufio.Scanner, name string, wantProxy bool) (string, error) {
+	var addr string
+	proxyDone := false
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "VERSION":
+			if len(fields) != 2 || fields[1] != "1" {
+				return "", fmt.Errorf("%w: proxy-pt: unsupported version: %s", ErrProxy, s.Text())
+			}
+		case "VERSION-ERROR", "ENV-ERROR", "PROXY-ERROR", "CMETHOD-ERROR":
+			return "", fmt.Errorf("%w: proxy-pt says: %s", ErrProxy, s.Text())
+		case "PROXY":
+			proxyDone = len(fields) == 2 && fields[1] == "DONE"
+		case "CMETHOD":
+			if len(fields) < 4 || fields[1] != name {
+				continue
+			}
+			if fields[2] != "socks5" {
+				return "", fmt.Errorf("%w: proxy-pt: unsupported protocol: %s", ErrProxy, fields[2])
+			}
+			addr = fields[3]
+		case "CMETHODS":
+			if len(fields) != 2 || fields[1] != "DONE" {
+				continue
+			}
+			if addr == "" {
+				return "", fmt.Errorf("%w: proxy-pt: transport %s not provided", ErrProxy, name)
+			}
+			if wantProxy && !proxyDone {
+				return "", fmt.Errorf("%w: %s", ErrProxy, "proxy-pt: upstream proxy not supported by transport")
+			}
+			return addr, nil
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", fmt.Errorf("%w: proxy-pt: %s", ErrProxy, err)
+	}
+	return "", fmt.Errorf("%w: %s", ErrProxy, "proxy-pt: transport exited during negotiation")
+}
+
+// ptSocksCredentials encodes the bridge arguments into the SOCKS5 username
+// and password, as described in the PT specification: the escaped arguments
+// are joined with semicolons, and split across username and password if they
+// do not fit in the username. An empty password is sent as a single NUL.
+func ptSocksCredentials(args []string) (string, string, error) {
+	if len(args) == 0 {
+		return "", "", nil
+	}
+	escape := strings.NewReplacer(`\`, `\\`, `=`, `\=`, `;`, `\;`)
+	encoded := make([]string, 0, len(args))
+	for _, arg := range args {
+		k, v, ok := strings.Cut(arg, "=")
+		if !ok || k == "" {
+			return "", "", fmt.Errorf("%w: bad proxy-pt argument: %s", errBadInput, arg)
+		}
+		encoded = append(encoded, escape.Replace(k)+"="+escape.Replace(v))
+	}
+	s := strings.Join(encoded, ";")
+	switch {
+	case len(s) <= 255:
+		return s, "\x00", nil
+	case len(s) <= 2*255:
+		return s[:255], s[255:], nil
+	default:
+		return "", "", fmt.Errorf("%w: %s", errBadInput, "proxy-pt arguments too long")
+	}
+}
+
+var _ DialerContext = &PTDialer{} // Ensure that we implement DialerContext
@@ -0,0 +1,193 @@
+package vpn
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	pt "git.torproject.org/pluggable-transports/goptlib.git"
+)
+
+// TestPTHelperProcess is not a real test: it is the stub pluggable transport
+// that the PTDialer tests launch, by running the test binary again. The stub
+// provides the "stub" transport, which connects to the SOCKS target if the
+// bridge arguments contain secret=s3cret.
+func TestPTHelperProcess(t *testing.T) {
+	if os.Getenv("MINIVPN_WANT_PT_HELPER") != "1" {
+		return
+	}
+	defer os.Exit(0)
+
+	info, err := pt.ClientSetup(nil)
+	if err != nil {
+		os.Exit(1)
+	}
+	if info.ProxyURL != nil {
+		pt.ProxyDone()
+	}
+	ln, err := pt.ListenSocks("tcp", "127.0.0.1:0")
+	if err != nil {
+		os.Exit(1)
+	}
+	for _, name := range info.MethodNames {
+		if name == "stub" {
+			pt.Cmethod(name, ln.Version(), ln.Addr())
+		} else {
+			pt.CmethodError(name, "no such transport")
+		}
+	}
+	pt.CmethodsDone()
+
+	go func() {
+		io.Copy(io.Discard, os.Stdin)
+		os.Exit(0)
+	}()
+	for {
+		c, err := ln.AcceptSocks()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			if secret, _ := c.Req.Args.Get("secret"); secret != "s3cret" {
+				c.Reject()
+				return
+			}
+			remote, err := net.Dial("tcp", c.Req.Target)
+			if err != nil {
+				c.Reject()
+				return
+			}
+			defer remote.Close()
+			c.Grant(nil)
+			go io.Copy(remote, c)
+			io.Copy(c, remote)
+		}()
+	}
+}
+
+// stubPTDialer returns a PTDialer that runs the stub transport.
+func stubPTDialer(t *testing.T, name string, args ...string) *PTDialer {
+	t.Setenv("MINIVPN_WANT_PT_HELPER", "1")
+	d := &PTDialer{
+		Name:     name,
+		Command:  []string{os.Args[0], "-test.run=^TestPTHelperProcess$"},
+		Args:     args,
+		StateDir: t.TempDir(),
+	}
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func TestPTDialer_DialContext(t *testing.T) {
+	echo := startEchoServer(t)
+
+	t.Run("tunnels through the transport", func(t *testing.T) {
+		d := stubPTDialer(t, "stub", "secret=s3cret")
+		conn, err := d.DialContext(context.Background(), "tcp", echo)
+		if err != nil {
+			t.Fatalf("DialContext() error = %v", err)
+		}
+		defer conn.Close()
+		assertEcho(t, conn)
+
+		// the transport is restarted after Close
+		d.Close()
+		conn, err = d.DialContext(context.Background(), "tcp", echo)
+		if err != nil {
+			t.Fatalf("DialContext() after Close error = %v", err)
+		}
+		defer conn.Close()
+		assertEcho(t, conn)
+	})
+
+	t.Run("the upstream proxy must be acknowledged", func(t *testing.T) {
+		d := stubPTDialer(t, "stub", "secret=s3cret")
+		d.Proxy = "socks5://127.0.0.1:1080"
+		conn, err := d.DialContext(context.Background(), "tcp", echo)
+		if err != nil {
+			t.Fatalf("DialContext() error = %v", err)
+		}
+		conn.Close()
+	})
+
+	t.Run("bridge args are checked by the transport", func(t *testing.T) {
+		d := stubPTDialer(t, "stub", "secret=wrong")
+		_, err := d.DialContext(context.Background(), "tcp", echo)
+		if !errors.Is(err, ErrProxy) {
+			t.Errorf("DialContext(): want %v, got %v", ErrProxy, err)
+		}
+	})
+
+	t.Run("unknown transport", func(t *testing.T) {
+		d := stubPTDialer(t, "nonexistent")
+		_, err := d.DialContext(context.Background(), "tcp", echo)
+		if !errors.Is(err, ErrProxy) || !strings.Contains(err.Error(), "CMETHOD-ERROR") {
+			t.Errorf("DialContext(): want CMETHOD-ERROR, got %v", err)
+		}
+	})
+
+	t.Run("missing binary", func(t *testing.T) {
+		d := &PTDialer{Name: "stub", Command: []string{"/nonexistent/pt-client"}}
+		_, err := d.DialContext(context.Background(), "tcp", echo)
+		if !errors.Is(err, ErrProxy) {
+			t.Errorf("DialContext(): want %v, got %v", ErrProxy, err)
+		}
+	})
+
+	t.Run("the default state dir is private", func(t *testing.T) {
+		d := stubPTDialer(t, "stub", "secret=s3cret")
+		d.StateDir = ""
+		conn, err := d.DialContext(context.Background(), "tcp", echo)
+		if err != nil {
+			t.Fatalf("DialContext() error = %v", err)
+		}
+		conn.Close()
+		dir := d.tmpState
+		info, err := os.Stat(dir)
+		if err != nil {
+			t.Fatalf("state dir: %v", err)
+		}
+		if perm := info.Mode().Perm(); perm != 0o700 {
+			t.Errorf("state dir mode = %o, want 700", perm)
+		}
+		d.Close()
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("Close() did not remove the state dir: %v", err)
+		}
+	})
+
+	t.Run("udp is not supported", func(t *testing.T) {
+		d := &PTDialer{Name: "stub", Command: []string{"stub-client"}}
+		_, err := d.DialContext(context.Background(), "udp", echo)
+		if !errors.Is(err, ErrProxyNetwork) {
+			t.Errorf("DialContext(): want %v, got %v", ErrProxyNetwork, err)
+		}
+	})
+}
+
+func Test_ptSocksCredentials(t *testing.T) {
+	user, pass, err := ptSocksCredentials([]string{"cert=a;b", `url=c\d=e`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != `cert=a\;b;url=c\\d\=e` || pass != "\x00" {
+		t.Errorf("ptSocksCredentials(): got %q, %q", user, pass)
+	}
+
+	user, pass, _ = ptSocksCredentials([]string{"k=" + strings.Repeat("x", 300)})
+	if len(user) != 255 || user+pass != "k="+strings.Repeat("x", 300) {
+		t.Errorf("ptSocksCredentials(): bad split: %d, %d", len(user), len(pass))
+	}
+
+	if _, _, err := ptSocksCredentials([]string{"k=" + strings.Repeat("x", 600)}); !errors.Is(err, errBadInput) {
+		t.Errorf("ptSocksCredentials(): want %v, got %v", errBadInput, err)
+	}
+	if _, _, err := ptSocksCredentials([]string{"novalue"}); !errors.Is(err, errBadInput) {
+		t.Errorf("ptSocksCredentials(): want %v, got %v", errBadInput, err)
+	}
+}
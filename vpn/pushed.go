@@ -0,0 +1,285 @@
+package vpn
+
+//
+// The options that the server pushes to the client.
+//
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// pullFilterAccept, pullFilterIgnore and pullFilterReject are the
+	// actions of a pull-filter.
+	pullFilterAccept = "accept"
+	pullFilterIgnore = "ignore"
+	pullFilterReject = "reject"
+)
+
+// PullFilter is a pull-filter directive: the pushed options that start with
+// Text are accepted, ignored, or make the connection fail (reject).
+type PullFilter struct {
+	Action string
+	Text   string
+}
+
+// TunnelInfo is the configuration of the tunnel, as pushed by the server in
+// its PUSH_REPLY (or given with ifconfig in static key mode). Applications
+// that configure their own networking can find here all they need. The
+// addresses are kept as strings, as the server sent them.
+type TunnelInfo struct {
+	// IP is the local address of the tunnel. Netmask is its netmask with
+	// topology subnet or in tap mode; with topology net30 or p2p, Peer is
+	// the address of the other end instead.
+	IP      string
+	Netmask string
+	Peer    string
+
+	// IPv6 is the local IPv6 address, in prefix form, and GatewayIPv6 the
+	// address of the other end.
+	IPv6        string
+	GatewayIPv6 string
+
+	// Topology is the pushed topology (net30, p2p or subnet), if any.
+	Topology string
+
+	// RouteGateway is the default gateway for the routes. It is "dhcp"
+	// in tap mode when the gateway must be learned with DHCP.
+	RouteGateway string
+
+	// Routes and RoutesIPv6 are all the pushed routes, in order, followed
+	// by the ones set on the client side.
+	Routes     []Route
+	RoutesIPv6 []Route
+
+	// RedirectGateway tells whether the server asked to send all the
+	// traffic through the tunnel, with RedirectGatewayFlags as modifiers
+	// (def1, bypass-dhcp, ipv6, !ipv4...).
+	RedirectGateway      bool
+	RedirectGatewayFlags []string
+
+	// DNS are the DNS servers (dhcp-option DNS and DNS6), and Domains the
+	// domains (dhcp-option DOMAIN and DOMAIN-SEARCH), the ones set on the
+	// client side first.
+	DNS     []string
+	Domains []string
+
+	// Ping and PingRestart are the keepalive settings.
+	Ping        time.Duration
+	PingRestart time.Duration
+
+	// Cipher is the data channel cipher chosen by the server, if pushed.
+	Cipher string
+
+	// TunMTU is the pushed tun-mtu, or zero.
+	TunMTU int
+
+	// PeerID is the pushed peer-id, or zero.
+	PeerID int
+
+	// Options are all the pushed options that we kept, in order, as
+	// received, and Dropped the ones that pull-filter or route-nopull
+	// dropped.
+	Options []string
+	Dropped []string
+}
+
+// Route is a route, pushed by the server or set on the client side.
+type Route struct {
+	// Network is the destination: an IPv4 network with its Netmask, or an
+	// IPv6 prefix (with an empty Netmask).
+	Network string
+	Netmask string
+
+	// Gateway is the next hop. It is empty when the route goes through the
+	// tunnel gateway, and it can be one of the keywords of the reference
+	// implementation (vpn_gateway, net_gateway, remote_host).
+	Gateway string
+
+	// Metric is the route metric, or zero.
+	Metric int
+}
+
+// pushedOptionsAsList returns the options in a PUSH_REPLY message, in order,
+// without the PUSH_REPLY marker and the terminating null byte.
+func pushedOptionsAsList(b []byte) []string {
+	s := string(b)
+	if i := strings.IndexByte(s, 0x00); i >= 0 {
+		s = s[:i]
+	}
+	var opts []string
+	for _, opt := range strings.Split(s, ",") {
+		opt = strings.TrimSpace(opt)
+		if opt == "" || opt == string(serverPushReply) {
+			continue
+		}
+		opts = append(opts, opt)
+	}
+	return opts
+}
+
+// newTunnelInfoFromPushedList parses the pushed options. Options that we do
+// not know, or cannot parse, are only kept in the raw list.
+func newTunnelInfoFromPushedList(opts []string) *TunnelInfo {
+	t := &TunnelInfo{Options: opts}
+	for _, opt := range opts {
+		f := strings.Fields(opt)
+		if len(f) == 0 {
+			continue
+		}
+		k, v := f[0], f[1:]
+		switch {
+		case k == "ifconfig" && len(v) >= 1:
+			t.IP = v[0]
+			if len(v) >= 2 {
+				if isNetmask(v[1]) {
+					t.Netmask = v[1]
+				} else {
+					t.Peer = v[1]
+				}
+			}
+		case k == "ifconfig-ipv6" && len(v) >= 1:
+			t.IPv6 = v[0]
+			if len(v) >= 2 {
+				t.GatewayIPv6 = v[1]
+			}
+		case k == "topology" && len(v) == 1:
+			t.Topology = v[0]
+		case k == "route-gateway" && len(v) == 1:
+			t.RouteGateway = v[0]
+		case k == "route" && len(v) >= 1:
+			t.Routes = append(t.Routes, routeFromArgs(v))
+		case k == "route-ipv6" && len(v) >= 1:
+			t.RoutesIPv6 = append(t.RoutesIPv6, routeIPv6FromArgs(v))
+		case k == "redirect-gateway":
+			t.RedirectGateway = true
+			t.RedirectGatewayFlags = append(t.RedirectGatewayFlags, v...)
+		case k == "dhcp-option" && len(v) == 2:
+			switch v[0] {
+			case "DNS", "DNS6":
+				t.DNS = append(t.DNS, v[1])
+			case "DOMAIN", "DOMAIN-SEARCH":
+				t.Domains = append(t.Domains, v[1])
+			}
+		case k == "ping" && len(v) == 1:
+			t.Ping = parsePushedSeconds(k, v[0])
+		case k == "ping-restart" && len(v) == 1:
+			t.PingRestart = parsePushedSeconds(k, v[0])
+		case k == "cipher" && len(v) == 1:
+			t.Cipher = v[0]
+		case k == "tun-mtu" && len(v) == 1:
+			t.TunMTU = parsePushedInt(k, v[0])
+		case k == "peer-id" && len(v) == 1:
+			t.PeerID = parsePushedInt(k, v[0])
+		}
+	}
+	return t
+}
+
+// routeFromArgs returns the route for the arguments of a route option:
+// network [netmask] [gateway] [metric], where "default" can stand for the
+// netmask or the gateway.
+func routeFromArgs(v []string) Route {
+	r := Route{Network: v[0], Netmask: "255.255.255.255"}
+	if len(v) >= 2 && v[1] != "default" {
+		r.Netmask = v[1]
+	}
+	if len(v) >= 3 && v[2] != "default" {
+		r.Gateway = v[2]
+	}
+	if len(v) >= 4 {
+		r.Metric, _ = strconv.Atoi(v[3])
+	}
+	return r
+}
+
+// routeIPv6FromArgs returns the route for the arguments of a route-ipv6
+// option: prefix [gateway] [metric].
+func routeIPv6FromArgs(v []string) Route {
+	r := Route{Network: v[0]}
+	if len(v) >= 2 && v[1] != "default" {
+		r.Gateway = v[1]
+	}
+	if len(v) >= 3 {
+		r.Metric, _ = strconv.Atoi(v[2])
+	}
+	return r
+}
+
+// pullFilterAction returns the action of the first pull-filter that matches
+// a pushed option, or pullFilterAccept if none does.
+func (o *Options) pullFilterAction(opt string) string {
+	for _, f := range o.PullFilters {
+		if strings.HasPrefix(opt, f.Text) {
+			return f.Action
+		}
+	}
+	return pullFilterAccept
+}
+
+// isRouteOption returns true for the pushed options that route-nopull
+// drops: routes, redirect-gateway and dhcp-options.
+func isRouteOption(opt string) bool {
+	switch strings.SplitN(opt, " ", 2)[0] {
+	case "route", "route-ipv6", "redirect-gateway", "redirect-private", "dhcp-option", "block-outside-dns":
+		return true
+	}
+	return false
+}
+
+// filterPushedOptions applies the pull-filter and route-nopull directives to
+// the pushed options. It returns the options to keep and the dropped ones,
+// or an error if a pull-filter rejects an option.
+func filterPushedOptions(opts []string, o *Options) ([]string, []string, error) {
+	if o == nil {
+		return opts, nil, nil
+	}
+	var kept, dropped []string
+	for _, opt := range opts {
+		switch o.pullFilterAction(opt) {
+		case pullFilterReject:
+			return nil, nil, fmt.Errorf("%w: pushed option rejected by pull-filter: %s", errBadServerReply, opt)
+		case pullFilterIgnore:
+			dropped = append(dropped, opt)
+			continue
+		}
+		if o.RouteNoPull && isRouteOption(opt) {
+			dropped = append(dropped, opt)
+			continue
+		}
+		kept = append(kept, opt)
+	}
+	return kept, dropped, nil
+}
+
+// addClientOptions adds the routes, DNS servers and domains given on the
+// client side. The routes go after the pushed ones, and the DNS servers and
+// domains before them, so that they are preferred.
+func (t *TunnelInfo) addClientOptions(o *Options) {
+	if o == nil {
+		return
+	}
+	t.Routes = append(t.Routes, o.Routes...)
+	t.RoutesIPv6 = append(t.RoutesIPv6, o.RoutesIPv6...)
+	t.DNS = append(append([]string(nil), o.DNS...), t.DNS...)
+	t.Domains = append(append([]string(nil), o.Domains...), t.Domains...)
+}
+
+// parsePushedInt parses the integer value of a pushed option, and logs bad
+// ones.
+func parsePushedInt(k, v string) int {
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		logger.Warnf("cannot parse pushed %s: %s", k, v)
+		return 0
+	}
+	return i
+}
+
+// parsePushedSeconds parses a pushed duration, in seconds.
+func parsePushedSeconds(k, v string) time.Duration {
+	return time.Duration(parsePushedInt(k, v)) * time.Second
+}
@@ -0,0 +1,226 @@
+package vpn
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_pushedOptionsAsList(t *testing.T) {
+	got := pushedOptionsAsList([]byte("PUSH_REPLY,route 10.0.0.0 255.0.0.0,,route 10.1.0.0 255.255.0.0,peer-id 1\x00garbage"))
+	want := []string{"route 10.0.0.0 255.0.0.0", "route 10.1.0.0 255.255.0.0", "peer-id 1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("pushedOptionsAsList() = %q, want %q", got, want)
+	}
+}
+
+func Test_newTunnelInfoFromPushedList(t *testing.T) {
+	opts := []string{
+		"redirect-gateway def1 bypass-dhcp",
+		"dhcp-option DNS 10.8.0.1",
+		"dhcp-option DNS6 fd00::1",
+		"dhcp-option DOMAIN example.com",
+		"dhcp-option DOMAIN-SEARCH corp.example.com",
+		"dhcp-option WINS 10.8.0.2",
+		"route-gateway 10.8.0.1",
+		"topology subnet",
+		"ping 10",
+		"ping-restart 60",
+		"route 192.168.10.0 255.255.255.0",
+		"route 192.168.20.0 255.255.255.0 net_gateway 5",
+		"route 10.10.10.10",
+		"route-ipv6 2001:db8::/32",
+		"route-ipv6 2001:db9::/32 fd00::2 3",
+		"ifconfig-ipv6 fd00::1000/64 fd00::1",
+		"ifconfig 10.8.0.2 255.255.255.0",
+		"peer-id 3",
+		"cipher AES-256-GCM",
+		"tun-mtu 1400",
+		"something-new 1 2",
+	}
+	want := &TunnelInfo{
+		IP:                   "10.8.0.2",
+		Netmask:              "255.255.255.0",
+		IPv6:                 "fd00::1000/64",
+		GatewayIPv6:          "fd00::1",
+		Topology:             "subnet",
+		RouteGateway:         "10.8.0.1",
+		RedirectGateway:      true,
+		RedirectGatewayFlags: []string{"def1", "bypass-dhcp"},
+		Routes: []Route{
+			{Network: "192.168.10.0", Netmask: "255.255.255.0"},
+			{Network: "192.168.20.0", Netmask: "255.255.255.0", Gateway: "net_gateway", Metric: 5},
+			{Network: "10.10.10.10", Netmask: "255.255.255.255"},
+		},
+		RoutesIPv6: []Route{
+			{Network: "2001:db8::/32"},
+			{Network: "2001:db9::/32", Gateway: "fd00::2", Metric: 3},
+		},
+		DNS:         []string{"10.8.0.1", "fd00::1"},
+		Domains:     []string{"example.com", "corp.example.com"},
+		Ping:        10 * time.Second,
+		PingRestart: time.Minute,
+		Cipher:      "AES-256-GCM",
+		TunMTU:      1400,
+		PeerID:      3,
+		Options:     opts,
+	}
+	if got := newTunnelInfoFromPushedList(opts); !reflect.DeepEqual(got, want) {
+		t.Errorf("newTunnelInfoFromPushedList() = %+v, want %+v", got, want)
+	}
+
+	// net30 gives the address of the peer, and bad numbers are skipped.
+	got := newTunnelInfoFromPushedList([]string{"ifconfig 10.8.0.6 10.8.0.5", "peer-id x", "redirect-gateway"})
+	if got.Peer != "10.8.0.5" || got.Netmask != "" || got.PeerID != 0 || !got.RedirectGateway || len(got.RedirectGatewayFlags) != 0 {
+		t.Errorf("newTunnelInfoFromPushedList() = %+v", got)
+	}
+}
+
+func TestClient_TunnelInfo(t *testing.T) {
+	if got := (&Client{}).TunnelInfo(); !reflect.DeepEqual(got, TunnelInfo{}) {
+		t.Errorf("TunnelInfo() before start = %+v", got)
+	}
+	m := &muxer{
+		control: &control{},
+		tunnel:  &tunnelInfo{},
+		tls: makeTestingTLSConnForRecords(
+			"PUSH_REPLY,route 10.1.0.0 255.255.0.0,push-continuation 2\x00",
+			"PUSH_REPLY,route 10.2.0.0 255.255.0.0,ifconfig 10.8.0.2 255.255.255.0,push-continuation 1\x00"),
+	}
+	if err := m.readPushReply(); err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{tunInfo: m.tunnel}
+	info := c.TunnelInfo()
+	if len(info.Routes) != 2 || info.Routes[1].Network != "10.2.0.0" || info.IP != "10.8.0.2" {
+		t.Errorf("TunnelInfo() = %+v", info)
+	}
+	// the continuation markers are not options.
+	if len(info.Options) != 3 {
+		t.Errorf("TunnelInfo().Options = %q", info.Options)
+	}
+}
+
+func Test_filterPushedOptions(t *testing.T) {
+	pushed := []string{
+		"route-gateway 10.8.0.1",
+		"route 10.0.0.0 255.0.0.0",
+		"route 192.168.1.0 255.255.255.0",
+		"dhcp-option DNS 10.8.0.1",
+		"redirect-gateway def1",
+		"ifconfig 10.8.0.2 255.255.255.0",
+	}
+	o := &Options{PullFilters: []PullFilter{
+		{Action: pullFilterAccept, Text: "route 192.168."},
+		{Action: pullFilterIgnore, Text: "route "},
+		{Action: pullFilterIgnore, Text: "redirect-gateway"},
+	}}
+	kept, dropped, err := filterPushedOptions(pushed, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantKept := []string{"route-gateway 10.8.0.1", "route 192.168.1.0 255.255.255.0", "dhcp-option DNS 10.8.0.1", "ifconfig 10.8.0.2 255.255.255.0"}
+	wantDropped := []string{"route 10.0.0.0 255.0.0.0", "redirect-gateway def1"}
+	if !reflect.DeepEqual(kept, wantKept) || !reflect.DeepEqual(dropped, wantDropped) {
+		t.Errorf("filterPushedOptions() = %q, %q", kept, dropped)
+	}
+
+	// route-nopull keeps the addresses and the route-gateway.
+	kept, dropped, _ = filterPushedOptions(pushed, &Options{RouteNoPull: true})
+	if !reflect.DeepEqual(kept, []string{"route-gateway 10.8.0.1", "ifconfig 10.8.0.2 255.255.255.0"}) || len(dropped) != 4 {
+		t.Errorf("filterPushedOptions() with route-nopull = %q, %q", kept, dropped)
+	}
+
+	o = &Options{PullFilters: []PullFilter{{Action: pullFilterReject, Text: "redirect-gateway"}}}
+	if _, _, err := filterPushedOptions(pushed, o); !errors.Is(err, errBadServerReply) {
+		t.Errorf("filterPushedOptions(): want %v, got %v", errBadServerReply, err)
+	}
+}
+
+func Test_muxer_readPushReplyFiltered(t *testing.T) {
+	opts, err := getOptionsFromLines([]string{
+		`pull-filter ignore "route 10."`,
+		"route 172.16.0.0 255.240.0.0 vpn_gateway 10",
+		"route-ipv6 2001:db8::/32",
+		"dhcp-option DNS 1.1.1.1",
+		"dhcp-option DOMAIN corp.example.com",
+	}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &muxer{
+		control: &control{},
+		tunnel:  &tunnelInfo{},
+		options: opts,
+		tls: makeTestingTLSConnForRecords(
+			"PUSH_REPLY,route 10.0.0.0 255.0.0.0,route 192.168.1.0,dhcp-option DNS 10.8.0.1,route-gateway 10.8.0.1,ifconfig 10.8.0.2 255.255.255.0\x00"),
+	}
+	if err := m.readPushReply(); err != nil {
+		t.Fatal(err)
+	}
+	// the dropped route does not reach the tunnel info either.
+	if m.tunnel.gw == "10.0.0.0" {
+		t.Errorf("tunnel gw comes from a dropped route")
+	}
+	info := (&Client{tunInfo: m.tunnel}).TunnelInfo()
+	wantRoutes := []Route{
+		{Network: "192.168.1.0", Netmask: "255.255.255.255"},
+		{Network: "172.16.0.0", Netmask: "255.240.0.0", Gateway: "vpn_gateway", Metric: 10},
+	}
+	if !reflect.DeepEqual(info.Routes, wantRoutes) {
+		t.Errorf("TunnelInfo().Routes = %+v", info.Routes)
+	}
+	if !reflect.DeepEqual(info.RoutesIPv6, []Route{{Network: "2001:db8::/32"}}) {
+		t.Errorf("TunnelInfo().RoutesIPv6 = %+v", info.RoutesIPv6)
+	}
+	if !reflect.DeepEqual(info.DNS, []string{"1.1.1.1", "10.8.0.1"}) || !reflect.DeepEqual(info.Domains, []string{"corp.example.com"}) {
+		t.Errorf("TunnelInfo() DNS = %v, domains = %v", info.DNS, info.Domains)
+	}
+	if !reflect.DeepEqual(info.Dropped, []string{"route 10.0.0.0 255.0.0.0"}) {
+		t.Errorf("TunnelInfo().Dropped = %q", info.Dropped)
+	}
+}
+
+func Test_parsePullOptions(t *testing.T) {
+	o, err := getOptionsFromLines([]string{
+		`pull-filter ignore "dhcp-option DNS"`,
+		"pull-filter reject redirect-gateway",
+		"route-nopull",
+	}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PullFilter{{Action: pullFilterIgnore, Text: "dhcp-option DNS"}, {Action: pullFilterReject, Text: "redirect-gateway"}}
+	if !reflect.DeepEqual(o.PullFilters, want) || !o.RouteNoPull {
+		t.Errorf("getOptionsFromLines(): filters = %+v, route-nopull = %v", o.PullFilters, o.RouteNoPull)
+	}
+
+	bad := []struct {
+		fn func([]string, *Options) error
+		p  []string
+	}{
+		{parsePullFilter, []string{"accept"}},
+		{parsePullFilter, []string{"drop", "route"}},
+		{parseRouteNoPull, []string{"yes"}},
+		{parseRoute, []string{}},
+		{parseRoute, []string{"example.com"}},
+		{parseRoute, []string{"10.0.0.0", "255.0.255.0"}},
+		{parseRoute, []string{"10.0.0.0", "255.0.0.0", "gw"}},
+		{parseRoute, []string{"10.0.0.0", "255.0.0.0", "default", "low"}},
+		{parseRoute, []string{"10.0.0.0", "255.0.0.0", "default", "1", "2"}},
+		{parseRouteIPv6, []string{"2001:db8::"}},
+		{parseRouteIPv6, []string{"2001:db8::/32", "gw"}},
+		{parseRouteIPv6, []string{"2001:db8::/32", "default", "low"}},
+		{parseDHCPOption, []string{"DNS"}},
+		{parseDHCPOption, []string{"DNS", "resolver"}},
+	}
+	for _, b := range bad {
+		if err := b.fn(b.p, &Options{}); !errors.Is(err, errBadCfg) {
+			t.Errorf("parsing %v: want %v, got %v", b.p, errBadCfg, err)
+		}
+	}
+	if err := parseDHCPOption([]string{"WINS", "10.8.0.1"}, &Options{}); err != nil {
+		t.Errorf("parseDHCPOption(): unsupported types are ignored, got %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package vpn
+
+//
+// Token bucket rate limiter for the data channel (the shaper directive).
+//
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// minShaperRate and maxShaperRate are the bounds the reference
+	// implementation accepts for the shaper directive, in bytes per second.
+	minShaperRate = 100
+	maxShaperRate = 100000000
+)
+
+// RateLimiter is a token bucket that limits the throughput of data packets
+// to a number of bytes per second. The bucket holds a tenth of a second of
+// traffic, so short bursts go through; a packet that does not fit is
+// delayed until the bucket has refilled. A RateLimiter is safe for
+// concurrent use, and can be shared by several tunnels to cap them together.
+type RateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	stats  RateLimiterStats
+}
+
+// RateLimiterStats counts the packets that went through a RateLimiter, and
+// how long they were delayed.
+type RateLimiterStats struct {
+	// Packets is the number of packets that went through.
+	Packets int64
+	// DelayedPackets is the number of packets that had to wait.
+	DelayedPackets int64
+	// Delay is the total time packets waited.
+	Delay time.Duration
+}
+
+// String returns a one-line summary of the stats.
+func (s RateLimiterStats) String() string {
+	return fmt.Sprintf("packets=%d delayed=%d delay=%s", s.Packets, s.DelayedPackets, s.Delay)
+}
+
+// NewRateLimiter returns a RateLimiter for the given rate, in bytes per
+// second.
+func NewRateLimiter(bytesPerSec int) *RateLimiter {
+	burst := float64(bytesPerSec) / 10
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{rate: float64(bytesPerSec), burst: burst}
+}
+
+// Wait blocks until n bytes can be sent, and returns how long it waited. It
+// does nothing on a nil RateLimiter.
+func (l *RateLimiter) Wait(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	d := l.reserve(n, time.Now())
+	if d > 0 {
+		time.Sleep(d)
+	}
+	return d
+}
+
+// reserve takes n tokens from the bucket at time now, and returns how long
+// the caller must wait before sending. The bucket may go into debt, so that
+// the following packets wait for this one too.
+func (l *RateLimiter) reserve(n int, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.last.IsZero() {
+		l.tokens = l.burst
+	} else if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	l.stats.Packets++
+	if l.tokens >= 0 {
+		return 0
+	}
+	d := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.stats.DelayedPackets++
+	l.stats.Delay += d
+	return d
+}
+
+// Stats returns a snapshot of the stats. It returns the zero value on a nil
+// RateLimiter.
+func (l *RateLimiter) Stats() RateLimiterStats {
+	if l == nil {
+		return RateLimiterStats{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stats
+}
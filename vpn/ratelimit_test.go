@@ -0,0 +1,114 @@
+package vpn
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_reserve(t *testing.T) {
+	l := NewRateLimiter(1000) // the bucket holds 100 bytes
+	start := time.Now()
+	steps := []struct {
+		name  string
+		at    time.Duration
+		n     int
+		delay time.Duration
+	}{
+		{"fits in the burst", 0, 100, 0},
+		{"bucket is empty", 0, 50, 50 * time.Millisecond},
+		{"debt is paid first", 0, 100, 150 * time.Millisecond},
+		{"refilled after a while", time.Second, 100, 0},
+		{"refill is capped to the burst", 10 * time.Second, 200, 100 * time.Millisecond},
+	}
+	for _, s := range steps {
+		got := l.reserve(s.n, start.Add(s.at))
+		if got != s.delay {
+			t.Errorf("%s: reserve() = %v, want %v", s.name, got, s.delay)
+		}
+	}
+	want := RateLimiterStats{Packets: 5, DelayedPackets: 3, Delay: 300 * time.Millisecond}
+	if got := l.Stats(); got != want {
+		t.Errorf("Stats() = %v, want %v", got, want)
+	}
+}
+
+func TestRateLimiter_Wait(t *testing.T) {
+	var nilLimiter *RateLimiter
+	if d := nilLimiter.Wait(1 << 20); d != 0 {
+		t.Errorf("Wait() on nil = %v, want 0", d)
+	}
+	if s := nilLimiter.Stats(); s != (RateLimiterStats{}) {
+		t.Errorf("Stats() on nil = %v, want zero", s)
+	}
+
+	l := NewRateLimiter(10000)
+	start := time.Now()
+	l.Wait(1000)
+	l.Wait(200)
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Errorf("Wait(): elapsed %v, want about 20ms", elapsed)
+	}
+}
+
+func Test_data_WritePacketIsRateLimited(t *testing.T) {
+	opt := &Options{WriteLimiter: NewRateLimiter(minShaperRate)}
+	d := &data{
+		options: opt,
+		state:   makeTestingState(),
+		encryptEncodeFn: func([]byte, *session, *dataChannelState) ([]byte, error) {
+			return []byte("x"), nil
+		},
+	}
+	if _, err := d.WritePacket(makeTestingConnForWrite("udp", "10.0.42.1", 1), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if got := opt.WriteLimiter.Stats().Packets; got != 1 {
+		t.Errorf("WriteLimiter: Packets = %d, want 1", got)
+	}
+}
+
+func TestClient_RateLimiterStats(t *testing.T) {
+	c := NewClientFromOptions(&Options{ReadLimiter: NewRateLimiter(minShaperRate)})
+	c.Opts.ReadLimiter.Wait(1)
+	write, read := c.RateLimiterStats()
+	if write != (RateLimiterStats{}) || read.Packets != 1 {
+		t.Errorf("RateLimiterStats() = %v, %v", write, read)
+	}
+	if write, read := (&Client{}).RateLimiterStats(); write != read {
+		t.Errorf("RateLimiterStats() without options = %v, %v", write, read)
+	}
+}
+
+func Test_parseShaper(t *testing.T) {
+	o := &Options{}
+	if err := parseShaper([]string{"100000"}, o); err != nil {
+		t.Fatal(err)
+	}
+	if err := parseShaperRead([]string{"200000"}, o); err != nil {
+		t.Fatal(err)
+	}
+	if o.WriteLimiter == nil || o.WriteLimiter.rate != 100000 || o.ReadLimiter == nil || o.ReadLimiter.rate != 200000 {
+		t.Errorf("parseShaper(): got %+v %+v", o.WriteLimiter, o.ReadLimiter)
+	}
+
+	bad := [][]string{{}, {"99"}, {"100000001"}, {"fast"}, {"1000", "2000"}}
+	for _, p := range bad {
+		if err := parseShaper(p, &Options{}); !errors.Is(err, errBadCfg) {
+			t.Errorf("parseShaper(%v): want %v, got %v", p, errBadCfg, err)
+		}
+		if err := parseShaperRead(p, &Options{}); !errors.Is(err, errBadCfg) {
+			t.Errorf("parseShaperRead(%v): want %v, got %v", p, errBadCfg, err)
+		}
+	}
+}
+
+func Test_getOptionsFromLines_shaper(t *testing.T) {
+	o, err := getOptionsFromLines([]string{"shaper 100000", "shaper-read 200000"}, t.TempDir())
+	if err != nil {
+		t.Fatalf("getOptionsFromLines(): unexpected error %v", err)
+	}
+	if o.WriteLimiter == nil || o.ReadLimiter == nil {
+		t.Errorf("getOptionsFromLines(): limiters not set")
+	}
+}
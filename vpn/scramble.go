@@ -0,0 +1,192 @@
+package vpn
+
+//
+// XOR "scramble" obfuscation, compatible with the patch shipped by Tunnelblick
+// and widely deployed by providers (scramble xormask|xorptrpos|reverse|obfuscate).
+//
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+)
+
+const (
+	// scrambleXORMask xors every byte with the mask, repeated as needed.
+	scrambleXORMask = "xormask"
+
+	// scrambleXORPtrPos xors every byte with its position (starting at 1).
+	scrambleXORPtrPos = "xorptrpos"
+
+	// scrambleReverse reverses every byte but the first one.
+	scrambleReverse = "reverse"
+
+	// scrambleObfuscate combines the three methods above.
+	scrambleObfuscate = "obfuscate"
+)
+
+// scrambler applies one of the scramble methods to packets.
+type scrambler struct {
+	method string
+	mask   []byte
+}
+
+// newScramblerFromOptions returns a scrambler for the configured scramble
+// method, or nil if there is none.
+func newScramblerFromOptions(o *Options) *scrambler {
+	if o.ScrambleMethod == "" {
+		return nil
+	}
+	return &scrambler{method: o.ScrambleMethod, mask: []byte(o.ScrambleMask)}
+}
+
+// scramble transforms an outgoing packet in place.
+func (s *scrambler) scramble(b []byte) {
+	switch s.method {
+	case scrambleXORMask:
+		xorMask(b, s.mask)
+	case scrambleXORPtrPos:
+		xorPtrPos(b)
+	case scrambleReverse:
+		reverseBytes(b)
+	case scrambleObfuscate:
+		xorPtrPos(b)
+		reverseBytes(b)
+		xorPtrPos(b)
+		xorMask(b, s.mask)
+	}
+}
+
+// unscramble transforms an incoming packet in place. It undoes scramble.
+func (s *scrambler) unscramble(b []byte) {
+	switch s.method {
+	case scrambleObfuscate:
+		xorMask(b, s.mask)
+		xorPtrPos(b)
+		reverseBytes(b)
+		xorPtrPos(b)
+	default:
+		// the other methods are their own inverse.
+		s.scramble(b)
+	}
+}
+
+// xorMask xors every byte with the mask, repeated as needed.
+func xorMask(b, mask []byte) {
+	if len(mask) == 0 {
+		return
+	}
+	for i := range b {
+		b[i] ^= mask[i%len(mask)]
+	}
+}
+
+// xorPtrPos xors every byte with its position, starting at 1 and wrapping
+// around at 256.
+func xorPtrPos(b []byte) {
+	for i := range b {
+		b[i] ^= byte(i + 1)
+	}
+}
+
+// reverseBytes reverses every byte but the first one.
+func reverseBytes(b []byte) {
+	if len(b) <= 2 {
+		return
+	}
+	for i, j := 1, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+}
+
+// scrambleConn is a net.Conn that scrambles every packet it writes, and
+// unscrambles every packet it reads. With UDP, a packet is a datagram; with
+// TCP, it is the payload of a size frame, and the size header is left as is.
+type scrambleConn struct {
+	net.Conn
+	s   *scrambler
+	tcp bool
+
+	// rbuf holds the part of the last unscrambled frame not read yet.
+	rbuf []byte
+
+	// wbuf holds an incomplete frame, until the rest of it is written.
+	wbuf []byte
+	wmu  sync.Mutex
+}
+
+// newScrambleConn wraps the passed conn. The framing is chosen from the
+// network of conn, as it is done by the muxer.
+func newScrambleConn(conn net.Conn, s *scrambler) (*scrambleConn, error) {
+	c := &scrambleConn{Conn: conn, s: s}
+	switch network := conn.LocalAddr().Network(); network {
+	case "tcp", "tcp4", "tcp6":
+		c.tcp = true
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrBadConnNetwork, network)
+	}
+	return c, nil
+}
+
+// Read reads an unscrambled datagram, or the unscrambled frames of the stream.
+func (c *scrambleConn) Read(b []byte) (int, error) {
+	if !c.tcp {
+		n, err := c.Conn.Read(b)
+		if n > 0 {
+			c.s.unscramble(b[:n])
+		}
+		return n, err
+	}
+	if len(c.rbuf) == 0 {
+		payload, err := readPacketFromTCP(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		c.s.unscramble(payload)
+		c.rbuf = make([]byte, 2, 2+len(payload))
+		binary.BigEndian.PutUint16(c.rbuf, uint16(len(payload)))
+		c.rbuf = append(c.rbuf, payload...)
+	}
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+// Write scrambles and writes a datagram, or every complete frame in the
+// stream. An incomplete frame is kept until the rest of it is written.
+func (c *scrambleConn) Write(b []byte) (int, error) {
+	if !c.tcp {
+		out := make([]byte, len(b))
+		copy(out, b)
+		c.s.scramble(out)
+		if _, err := c.Conn.Write(out); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.wbuf = append(c.wbuf, b...)
+	var out []byte
+	for len(c.wbuf) >= 2 {
+		size := 2 + int(binary.BigEndian.Uint16(c.wbuf))
+		if len(c.wbuf) < size {
+			break
+		}
+		frame := make([]byte, size)
+		copy(frame, c.wbuf)
+		c.s.scramble(frame[2:])
+		out = append(out, frame...)
+		c.wbuf = c.wbuf[size:]
+	}
+	if len(out) > 0 {
+		if _, err := c.Conn.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+var _ net.Conn = &scrambleConn{} // Ensure that we implement net.Conn
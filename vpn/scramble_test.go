@@ -0,0 +1,188 @@
+package vpn
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func Test_scrambler(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		mask   string
+		in     []byte
+		want   []byte
+	}{
+		{"xormask", scrambleXORMask, "ab", []byte{0, 0, 0}, []byte{0x61, 0x62, 0x61}},
+		{"xorptrpos", scrambleXORPtrPos, "", []byte{0, 0, 0}, []byte{1, 2, 3}},
+		{"reverse keeps the first byte", scrambleReverse, "", []byte{1, 2, 3, 4}, []byte{1, 4, 3, 2}},
+		{"reverse ignores short packets", scrambleReverse, "", []byte{1, 2}, []byte{1, 2}},
+		{"obfuscate", scrambleObfuscate, "k", []byte{0x10, 0x20, 0x30}, []byte{0x7b, 0x5a, 0x4a}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &scrambler{method: tt.method, mask: []byte(tt.mask)}
+			b := append([]byte{}, tt.in...)
+			s.scramble(b)
+			if !bytes.Equal(b, tt.want) {
+				t.Errorf("scramble() = %x, want %x", b, tt.want)
+			}
+			s.unscramble(b)
+			if !bytes.Equal(b, tt.in) {
+				t.Errorf("unscramble() = %x, want %x", b, tt.in)
+			}
+		})
+	}
+
+	t.Run("long packets round trip", func(t *testing.T) {
+		in := make([]byte, 600)
+		for i := range in {
+			in[i] = byte(i * 7)
+		}
+		for _, m := range []string{scrambleXORMask, scrambleXORPtrPos, scrambleReverse, scrambleObfuscate} {
+			s := &scrambler{method: m, mask: []byte("s3cr3t")}
+			b := append([]byte{}, in...)
+			s.scramble(b)
+			s.unscramble(b)
+			if !bytes.Equal(b, in) {
+				t.Errorf("%s: round trip failed", m)
+			}
+		}
+	})
+}
+
+func Test_scrambleConn_udp(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	conn, err := net.Dial("udp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &scrambler{method: scrambleXORPtrPos}
+	sconn, err := newScrambleConn(conn, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sconn.Close()
+
+	if _, err := sconn.Write([]byte{0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, addr, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], []byte{1, 2, 3}) {
+		t.Errorf("datagram on the wire = %x, want 010203", buf[:n])
+	}
+
+	server.WriteTo([]byte{1, 2, 3, 4}, addr)
+	n, err = sconn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], []byte{0, 0, 0, 0}) {
+		t.Errorf("Read() = %x, want 00000000", buf[:n])
+	}
+}
+
+func Test_scrambleConn_tcp(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	sconn, err := newScrambleConn(conn, &scrambler{method: scrambleXORMask, mask: []byte{0xff}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sconn.Close()
+
+	// a frame written in two pieces, followed by a second frame
+	sconn.Write([]byte{0x00, 0x03, 0x01})
+	sconn.Write([]byte{0x02, 0x03, 0x00, 0x01, 0x0f})
+	got := make([]byte, 8)
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0x00, 0x03, 0xfe, 0xfd, 0xfc, 0x00, 0x01, 0xf0}
+	if !bytes.Equal(got, want) {
+		t.Errorf("stream on the wire = %x, want %x", got, want)
+	}
+
+	server.Write([]byte{0x00, 0x02, 0xfe, 0xfd})
+	payload, err := readPacketFromTCP(sconn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(payload, []byte{0x01, 0x02}) {
+		t.Errorf("readPacketFromTCP() = %x, want 0102", payload)
+	}
+}
+
+func Test_newScrambleConn_badNetwork(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	_, err := newScrambleConn(c1, &scrambler{method: scrambleReverse})
+	if !errors.Is(err, ErrBadConnNetwork) {
+		t.Errorf("newScrambleConn(): want %v, got %v", ErrBadConnNetwork, err)
+	}
+}
+
+func Test_parseScramble(t *testing.T) {
+	tests := []struct {
+		p          []string
+		wantMethod string
+		wantMask   string
+	}{
+		{[]string{"xormask", "abc"}, scrambleXORMask, "abc"},
+		{[]string{"xorptrpos"}, scrambleXORPtrPos, ""},
+		{[]string{"reverse"}, scrambleReverse, ""},
+		{[]string{"obfuscate", "abc"}, scrambleObfuscate, "abc"},
+		{[]string{"abc"}, scrambleXORMask, "abc"},
+	}
+	for _, tt := range tests {
+		o := &Options{}
+		if err := parseScramble(tt.p, o); err != nil {
+			t.Errorf("parseScramble(%v): unexpected error %v", tt.p, err)
+			continue
+		}
+		if o.ScrambleMethod != tt.wantMethod || o.ScrambleMask != tt.wantMask {
+			t.Errorf("parseScramble(%v): got %v %v", tt.p, o.ScrambleMethod, o.ScrambleMask)
+		}
+	}
+
+	bad := [][]string{{}, {"xormask"}, {"obfuscate"}, {"reverse", "abc"}, {"a", "b", "c"}}
+	for _, p := range bad {
+		if err := parseScramble(p, &Options{}); !errors.Is(err, errBadCfg) {
+			t.Errorf("parseScramble(%v): want %v, got %v", p, errBadCfg, err)
+		}
+	}
+}
+
+func Test_getOptionsFromLines_scramble(t *testing.T) {
+	o, err := getOptionsFromLines([]string{"scramble obfuscate s3cr3t"}, t.TempDir())
+	if err != nil {
+		t.Fatalf("getOptionsFromLines(): unexpected error %v", err)
+	}
+	if o.ScrambleMethod != scrambleObfuscate || o.ScrambleMask != "s3cr3t" {
+		t.Errorf("getOptionsFromLines(): got %v %v", o.ScrambleMethod, o.ScrambleMask)
+	}
+}
@@ -0,0 +1,237 @@
+package vpn
+
+//
+// Packet length and timing shaping for the outer connection: padding of the
+// tunneled packets to size buckets, jitter on writes, and cover traffic.
+//
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// ShapingPolicy controls how the traffic on the outer connection is shaped.
+// The zero value disables shaping.
+type ShapingPolicy struct {
+	// PadBuckets are the sizes tunneled IP packets are padded to: a packet
+	// is padded with zeroes up to the smallest bucket that fits it, and is
+	// sent as is if it is larger than all of them. The remote stack ignores
+	// the padding, since it reads the length from the IP header. Control
+	// packets and openvpn-pings are never padded, since the server would
+	// reject them. In tap mode, only the Ethernet frames that carry IP are
+	// padded. No bucket can be larger than the tun-mtu.
+	PadBuckets []int
+	// MaxJitter is the upper bound of the random delay added before each
+	// write on the outer connection.
+	MaxJitter time.Duration
+	// CoverInterval is the mean interval between the openvpn-pings sent as
+	// cover traffic, drawn from an exponential distribution. The server
+	// does not answer them, so cover traffic only flows from the client.
+	CoverInterval time.Duration
+}
+
+// checkMTU returns an error if a size bucket is larger than tunMTU, since the
+// padded packets would not fit the tunnel.
+func (p *ShapingPolicy) checkMTU(tunMTU int) error {
+	if p == nil {
+		return nil
+	}
+	for _, size := range p.PadBuckets {
+		if size > tunMTU {
+			return fmt.Errorf("%w: shaping bucket %d is larger than tun-mtu %d", errBadCfg, size, tunMTU)
+		}
+	}
+	return nil
+}
+
+// enabled returns true if the policy shapes anything.
+func (p *ShapingPolicy) enabled() bool {
+	return p != nil && (len(p.PadBuckets) != 0 || p.MaxJitter > 0 || p.CoverInterval > 0)
+}
+
+// ShapingStats counts what the shaper did, so that the cost of a policy can
+// be measured.
+type ShapingStats struct {
+	// PaddedPackets is the number of packets that were padded.
+	PaddedPackets int64
+	// PaddingBytes is the number of padding bytes added.
+	PaddingBytes int64
+	// CoverPackets is the number of openvpn-pings sent as cover traffic.
+	CoverPackets int64
+	// JitterDelay is the total delay added to the writes.
+	JitterDelay time.Duration
+}
+
+// String returns a one-line summary of the stats.
+func (s ShapingStats) String() string {
+	return fmt.Sprintf("padded=%d padding-bytes=%d cover=%d jitter=%s",
+		s.PaddedPackets, s.PaddingBytes, s.CoverPackets, s.JitterDelay)
+}
+
+// shaper applies a ShapingPolicy, and keeps the stats.
+type shaper struct {
+	policy ShapingPolicy
+	// tap is true when the tunnel carries Ethernet frames.
+	tap bool
+
+	paddedPackets int64
+	paddingBytes  int64
+	coverPackets  int64
+	jitterDelay   int64
+
+	// randMu protects rand, which is not safe for concurrent use.
+	randMu sync.Mutex
+	rand   *rand.Rand
+}
+
+// newShaperFromOptions returns a shaper for the configured policy, adjusted
+// for the outer transport, or nil if there is nothing to shape. obfs4 and
+// pluggable transports already pad and delay what they carry, so only the
+// cover traffic is kept for them.
+func newShaperFromOptions(o *Options) *shaper {
+	if !o.Shaping.enabled() {
+		return nil
+	}
+	policy := *o.Shaping
+	switch o.outerTransport() {
+	case "proxy-obfs4", "proxy-pt":
+		policy.PadBuckets = nil
+		policy.MaxJitter = 0
+	}
+	if !policy.enabled() {
+		return nil
+	}
+	policy.PadBuckets = append([]int{}, policy.PadBuckets...)
+	sort.Ints(policy.PadBuckets)
+	return &shaper{
+		policy: policy,
+		tap:    o.tapMode(),
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())), // #nosec G404 -- timing does not need a CSPRNG
+	}
+}
+
+// pad returns the packet padded to its size bucket. Anything that is not an
+// IPv4 or IPv6 packet (or, in tap mode, an Ethernet frame that carries one) is
+// returned as is.
+func (s *shaper) pad(b []byte) []byte {
+	if len(s.policy.PadBuckets) == 0 || !s.carriesIP(b) {
+		return b
+	}
+	for _, size := range s.policy.PadBuckets {
+		if size < len(b) {
+			continue
+		}
+		if size == len(b) {
+			return b
+		}
+		out := make([]byte, size)
+		copy(out, b)
+		atomic.AddInt64(&s.paddedPackets, 1)
+		atomic.AddInt64(&s.paddingBytes, int64(size-len(b)))
+		return out
+	}
+	return b
+}
+
+// carriesIP returns true if b is an IP packet, or an Ethernet frame with an
+// IP payload in tap mode.
+func (s *shaper) carriesIP(b []byte) bool {
+	if s.tap {
+		if len(b) < ethHeaderLen {
+			return false
+		}
+		switch layers.EthernetType(binary.BigEndian.Uint16(b[12:14])) {
+		case layers.EthernetTypeIPv4, layers.EthernetTypeIPv6:
+			return true
+		}
+		return false
+	}
+	if len(b) == 0 {
+		return false
+	}
+	v := b[0] >> 4
+	return v == 4 || v == 6
+}
+
+// jitter returns a random delay in [0, MaxJitter).
+func (s *shaper) jitter() time.Duration {
+	if s.policy.MaxJitter <= 0 {
+		return 0
+	}
+	s.randMu.Lock()
+	defer s.randMu.Unlock()
+	return time.Duration(s.rand.Int63n(int64(s.policy.MaxJitter)))
+}
+
+// coverWait returns the time to wait before the next cover packet.
+func (s *shaper) coverWait() time.Duration {
+	s.randMu.Lock()
+	defer s.randMu.Unlock()
+	return time.Duration(s.rand.ExpFloat64() * float64(s.policy.CoverInterval))
+}
+
+// stats returns a snapshot of the stats.
+func (s *shaper) stats() ShapingStats {
+	if s == nil {
+		return ShapingStats{}
+	}
+	return ShapingStats{
+		PaddedPackets: atomic.LoadInt64(&s.paddedPackets),
+		PaddingBytes:  atomic.LoadInt64(&s.paddingBytes),
+		CoverPackets:  atomic.LoadInt64(&s.coverPackets),
+		JitterDelay:   time.Duration(atomic.LoadInt64(&s.jitterDelay)),
+	}
+}
+
+// pingWriter is implemented by muxers that can send an openvpn-ping.
+type pingWriter interface {
+	writePing() error
+}
+
+// sendCover sends openvpn-pings at random intervals until done is closed or a
+// write fails.
+func (s *shaper) sendCover(w pingWriter, done chan struct{}) {
+	for {
+		timer := time.NewTimer(s.coverWait())
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := w.writePing(); err != nil {
+			logger.Warnf("shaping: cannot send cover packet: %s", err)
+			return
+		}
+		atomic.AddInt64(&s.coverPackets, 1)
+	}
+}
+
+// shapedConn is a net.Conn that waits a random delay before each write.
+// Writes are serialized, so that the order of the packets is kept.
+type shapedConn struct {
+	net.Conn
+	s   *shaper
+	wmu sync.Mutex
+}
+
+// Write waits for the jitter delay, and writes b.
+func (c *shapedConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if d := c.s.jitter(); d > 0 {
+		time.Sleep(d)
+		atomic.AddInt64(&c.s.jitterDelay, int64(d))
+	}
+	return c.Conn.Write(b)
+}
+
+var _ net.Conn = &shapedConn{} // Ensure that we implement net.Conn
@@ -0,0 +1,269 @@
+package vpn
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_shaper_pad(t *testing.T) {
+	s := &shaper{policy: ShapingPolicy{PadBuckets: []int{64, 128}}}
+	tests := []struct {
+		name    string
+		in      []byte
+		wantLen int
+	}{
+		{"ipv4 padded to the first bucket", append([]byte{0x45}, make([]byte, 19)...), 64},
+		{"ipv6 padded to the second bucket", append([]byte{0x60}, make([]byte, 99)...), 128},
+		{"exact size is kept", append([]byte{0x45}, make([]byte, 63)...), 64},
+		{"larger than all buckets", append([]byte{0x45}, make([]byte, 199)...), 200},
+		{"not an ip packet", pingPayload, len(pingPayload)},
+		{"empty", []byte{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := s.pad(tt.in)
+			if len(got) != tt.wantLen {
+				t.Errorf("pad(): len = %d, want %d", len(got), tt.wantLen)
+			}
+			if !bytes.Equal(got[:len(tt.in)], tt.in) {
+				t.Errorf("pad(): the packet was modified")
+			}
+		})
+	}
+	want := ShapingStats{PaddedPackets: 2, PaddingBytes: 44 + 28}
+	if got := s.stats(); got != want {
+		t.Errorf("stats() = %v, want %v", got, want)
+	}
+}
+
+func Test_shaper_padTAP(t *testing.T) {
+	s := newShaperFromOptions(&Options{DevType: devTypeTAP, Shaping: &ShapingPolicy{PadBuckets: []int{128}}})
+	frame := func(dst byte, etherType uint16) []byte {
+		b := make([]byte, 60)
+		b[0] = dst
+		binary.BigEndian.PutUint16(b[12:14], etherType)
+		return b
+	}
+	tests := []struct {
+		name    string
+		in      []byte
+		wantLen int
+	}{
+		{"ipv4 frame", frame(0x02, 0x0800), 128},
+		{"ipv6 frame", frame(0x33, 0x86dd), 128},
+		{"arp frame to a MAC that looks like ipv4", frame(0x45, 0x0806), 60},
+		{"arp frame to a MAC that looks like ipv6", frame(0x60, 0x0806), 60},
+		{"short frame", []byte{0x45, 0x00}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.pad(tt.in); len(got) != tt.wantLen {
+				t.Errorf("pad(): len = %d, want %d", len(got), tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestShapingPolicy_checkMTU(t *testing.T) {
+	l := []string{"remote 10.0.0.1 1194", "shaping-buckets 256 1501"}
+	if _, err := getOptionsFromLines(l, t.TempDir()); !errors.Is(err, errBadCfg) {
+		t.Errorf("getOptionsFromLines(): want %v, got %v", errBadCfg, err)
+	}
+	// tap devices have a larger tun-mtu.
+	if _, err := getOptionsFromLines(append(l, "dev tap"), t.TempDir()); err != nil {
+		t.Errorf("getOptionsFromLines(tap): unexpected error %v", err)
+	}
+
+	c := &Client{
+		Opts:   &Options{Proto: TCPMode, Shaping: &ShapingPolicy{PadBuckets: []int{9000}}},
+		Dialer: &mockedDialerContext{},
+	}
+	if _, err := c.dial(context.Background()); !errors.Is(err, errBadCfg) {
+		t.Errorf("dial(): want %v, got %v", errBadCfg, err)
+	}
+}
+
+func Test_newShaperFromOptions(t *testing.T) {
+	policy := &ShapingPolicy{PadBuckets: []int{512, 128}, MaxJitter: time.Millisecond, CoverInterval: time.Second}
+
+	if s := newShaperFromOptions(&Options{}); s != nil {
+		t.Errorf("newShaperFromOptions(): expected nil without a policy")
+	}
+	if s := newShaperFromOptions(&Options{Shaping: &ShapingPolicy{}}); s != nil {
+		t.Errorf("newShaperFromOptions(): expected nil with an empty policy")
+	}
+
+	s := newShaperFromOptions(&Options{Shaping: policy})
+	if s == nil {
+		t.Fatal("newShaperFromOptions(): expected a shaper")
+	}
+	if s.policy.PadBuckets[0] != 128 || policy.PadBuckets[0] != 512 {
+		t.Errorf("newShaperFromOptions(): buckets should be sorted on a copy")
+	}
+
+	s = newShaperFromOptions(&Options{Shaping: policy, ProxyOBFS4: "obfs4://127.0.0.1:443"})
+	if s == nil {
+		t.Fatal("newShaperFromOptions(): expected a shaper with obfs4")
+	}
+	if len(s.policy.PadBuckets) != 0 || s.policy.MaxJitter != 0 || s.policy.CoverInterval != time.Second {
+		t.Errorf("newShaperFromOptions(): with obfs4, only cover traffic should be kept, got %+v", s.policy)
+	}
+
+	noCover := &ShapingPolicy{PadBuckets: []int{128}}
+	if s := newShaperFromOptions(&Options{Shaping: noCover, ProxyPT: "meek_lite"}); s != nil {
+		t.Errorf("newShaperFromOptions(): expected nil with a pluggable transport and no cover traffic")
+	}
+}
+
+func Test_shapedConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	s := newShaperFromOptions(&Options{Shaping: &ShapingPolicy{MaxJitter: 5 * time.Millisecond}})
+	conn := &shapedConn{Conn: c1, s: s}
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			if _, err := c2.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := s.stats().JitterDelay; d <= 0 || d >= 50*time.Millisecond {
+		t.Errorf("JitterDelay = %v, want in (0, 50ms)", d)
+	}
+}
+
+type mockPingWriter struct {
+	pings chan struct{}
+}
+
+func (m *mockPingWriter) writePing() error {
+	m.pings <- struct{}{}
+	return nil
+}
+
+func Test_shaper_sendCover(t *testing.T) {
+	s := newShaperFromOptions(&Options{Shaping: &ShapingPolicy{CoverInterval: time.Millisecond}})
+	w := &mockPingWriter{pings: make(chan struct{}, 100)}
+	done := make(chan struct{})
+	go s.sendCover(w, done)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-w.pings:
+		case <-time.After(time.Second):
+			t.Fatal("sendCover(): no cover packet sent")
+		}
+	}
+	close(done)
+	if got := s.stats().CoverPackets; got < 2 {
+		t.Errorf("CoverPackets = %d, want at least 2", got)
+	}
+}
+
+type mockMuxerWithPing struct {
+	mockMuxerWithDummyHandshake
+	mockPingWriter
+}
+
+func TestClient_StartSendsCover(t *testing.T) {
+	w := mockPingWriter{pings: make(chan struct{}, 100)}
+	c := &Client{
+		Opts: &Options{
+			Proto:   TCPMode,
+			Shaping: &ShapingPolicy{CoverInterval: time.Millisecond},
+		},
+		Dialer: &mockedDialerContext{},
+	}
+	c.muxerFactoryFn = func(net.Conn, *Options, *tunnelInfo) (vpnMuxer, error) {
+		return &mockMuxerWithPing{mockPingWriter: w}, nil
+	}
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatalf("Client.Start(): expected no error, got %v", err)
+	}
+	select {
+	case <-w.pings:
+	case <-time.After(time.Second):
+		t.Fatal("Client.Start(): no cover packet sent")
+	}
+	c.Close()
+	if c.coverDone != nil {
+		t.Errorf("Client.Close(): cover traffic not stopped")
+	}
+}
+
+type mockMuxerForShaping struct {
+	mockMuxerForClient
+	written []byte
+}
+
+func (mm *mockMuxerForShaping) Write(b []byte) (int, error) {
+	mm.written = b
+	return len(b), nil
+}
+
+func TestClient_WritePadsPackets(t *testing.T) {
+	cl, _ := makeTestingClientConn()
+	cl.shaper = newShaperFromOptions(&Options{Shaping: &ShapingPolicy{PadBuckets: []int{256}}})
+	mux := &mockMuxerForShaping{}
+	cl.mux = mux
+	packet := append([]byte{0x45}, make([]byte, 39)...)
+	n, err := cl.Write(packet)
+	if err != nil {
+		t.Fatalf("Client.Write(): expected err = nil, got %v", err)
+	}
+	if n != len(packet) {
+		t.Errorf("Client.Write(): n = %d, want %d", n, len(packet))
+	}
+	if len(mux.written) != 256 {
+		t.Errorf("Client.Write(): muxer got %d bytes, want 256", len(mux.written))
+	}
+	if got := cl.ShapingStats().PaddedPackets; got != 1 {
+		t.Errorf("ShapingStats(): PaddedPackets = %d, want 1", got)
+	}
+}
+
+func Test_parseShaping(t *testing.T) {
+	o := &Options{}
+	if err := parseShapingBuckets([]string{"128", "1500"}, o); err != nil {
+		t.Fatal(err)
+	}
+	if err := parseShapingJitter([]string{"20"}, o); err != nil {
+		t.Fatal(err)
+	}
+	if err := parseShapingCover([]string{"1000"}, o); err != nil {
+		t.Fatal(err)
+	}
+	if len(o.Shaping.PadBuckets) != 2 || o.Shaping.MaxJitter != 20*time.Millisecond || o.Shaping.CoverInterval != time.Second {
+		t.Errorf("parsed policy = %+v", o.Shaping)
+	}
+
+	bad := []struct {
+		fn func([]string, *Options) error
+		p  []string
+	}{
+		{parseShapingBuckets, []string{}},
+		{parseShapingBuckets, []string{"0"}},
+		{parseShapingBuckets, []string{"128", "big"}},
+		{parseShapingBuckets, []string{"70000"}},
+		{parseShapingJitter, []string{}},
+		{parseShapingJitter, []string{"-1"}},
+		{parseShapingCover, []string{"1", "2"}},
+		{parseShapingCover, []string{"soon"}},
+	}
+	for _, tt := range bad {
+		if err := tt.fn(tt.p, &Options{}); !errors.Is(err, errBadCfg) {
+			t.Errorf("parse(%v): want %v, got %v", tt.p, errBadCfg, err)
+		}
+	}
+}
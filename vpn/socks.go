@@ -0,0 +1,319 @@
+package vpn
+
+//
+// SOCKS5 proxy support for the outer connection (RFC 1928, RFC 1929).
+//
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"openVPN/internal/netutil"
+)
+
+const (
+	socksVersion5 = 0x05
+
+	socksAuthNone     = 0x00
+	socksAuthUserPass = 0x02
+
+	socksCmdConnect      = 0x01
+	socksCmdUDPAssociate = 0x03
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+)
+
+// SOCKS5Dialer is a DialerContext that connects to the remote through a
+// SOCKS5 proxy. TCP connections use the CONNECT command, and UDP
+// connections use UDP ASSOCIATE.
+type SOCKS5Dialer struct {
+	// Addr is the host:port of the proxy.
+	Addr string
+	// Username and Password are the proxy credentials, if any.
+	Username string
+	Password string
+	// Dialer is used to connect to the proxy. If nil, a net.Dialer is used.
+	Dialer DialerContext
+}
+
+// DialContext connects to the address through the proxy.
+func (d *SOCKS5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return d.dialTCP(ctx, network, address)
+	case "udp", "udp4", "udp6":
+		return d.dialUDP(ctx, network, address)
+	default:
+		return nil, fmt.Errorf("%w: socks-proxy cannot carry %s", ErrProxyNetwork, network)
+	}
+}
+
+// dialer returns the underlying dialer.
+func (d *SOCKS5Dialer) dialer() DialerContext {
+	if d.Dialer == nil {
+		return &net.Dialer{}
+	}
+	return d.Dialer
+}
+
+// dialTCP opens a connection to the proxy and asks it to CONNECT to address.
+func (d *SOCKS5Dialer) dialTCP(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.dialer().DialContext(ctx, "tcp", d.Addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := netutil.WatchContext(ctx, conn)
+	defer stop()
+	if _, err := d.request(conn, socksCmdConnect, address); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialUDP opens a control connection to the proxy, asks it for an UDP
+// relay, and returns a net.Conn that sends and receives datagrams to and
+// from address through that relay.
+func (d *SOCKS5Dialer) dialUDP(ctx context.Context, network, address string) (net.Conn, error) {
+	ctrl, err := d.dialer().DialContext(ctx, "tcp", d.Addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := netutil.WatchContext(ctx, ctrl)
+	relay, err := d.request(ctrl, socksCmdUDPAssociate, "0.0.0.0:0")
+	stop()
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	// a relay on the unspecified address means "the same host as the proxy".
+	host, port, _ := net.SplitHostPort(relay)
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host, _, _ = net.SplitHostPort(ctrl.RemoteAddr().String())
+	}
+	conn, err := d.dialer().DialContext(ctx, network, net.JoinHostPort(host, port))
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	header, err := socksAddrBytes(address)
+	if err != nil {
+		ctrl.Close()
+		conn.Close()
+		return nil, err
+	}
+	return &socksUDPConn{Conn: conn, ctrl: ctrl, header: header}, nil
+}
+
+// request performs the method negotiation and sends the given command for
+// the passed address. It returns the bound address in the proxy reply.
+func (d *SOCKS5Dialer) request(conn net.Conn, cmd byte, address string) (string, error) {
+	if err := d.negotiate(conn); err != nil {
+		return "", err
+	}
+	addr, err := socksAddrBytes(address)
+	if err != nil {
+		return "", err
+	}
+	req := append([]byte{socksVersion5, cmd, 0x00}, addr...)
+	if _, err := conn.Write(req); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrProxy, err)
+	}
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrProxy, err)
+	}
+	if reply[0] != socksVersion5 {
+		return "", fmt.Errorf("%w: bad socks version: %d", ErrProxy, reply[0])
+	}
+	if reply[1] != 0x00 {
+		return "", fmt.Errorf("%w: socks-proxy says: error %d", ErrProxy, reply[1])
+	}
+	bound, err := readSocksAddr(conn)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrProxy, err)
+	}
+	return bound, nil
+}
+
+// negotiate selects the authentication method, and authenticates if needed.
+func (d *SOCKS5Dialer) negotiate(conn net.Conn) error {
+	methods := []byte{socksAuthNone}
+	if d.Username != "" {
+		methods = append(methods, socksAuthUserPass)
+	}
+	greeting := append([]byte{socksVersion5, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return fmt.Errorf("%w: %s", ErrProxy, err)
+	}
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return fmt.Errorf("%w: %s", ErrProxy, err)
+	}
+	if resp[0] != socksVersion5 {
+		return fmt.Errorf("%w: bad socks version: %d", ErrProxy, resp[0])
+	}
+	switch resp[1] {
+	case socksAuthNone:
+		return nil
+	case socksAuthUserPass:
+		if d.Username == "" {
+			return fmt.Errorf("%w: %s", ErrProxy, "socks-proxy asks for credentials")
+		}
+		return d.authenticate(conn)
+	default:
+		return fmt.Errorf("%w: %s", ErrProxy, "socks-proxy: no acceptable auth method")
+	}
+}
+
+// authenticate performs the username/password authentication (RFC 1929).
+func (d *SOCKS5Dialer) authenticate(conn net.Conn) error {
+	if len(d.Username) > 255 || len(d.Password) > 255 {
+		return fmt.Errorf("%w: %s", errBadInput, "socks credentials too long")
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteByte(0x01)
+	buf.WriteByte(byte(len(d.Username)))
+	buf.WriteString(d.Username)
+	buf.WriteByte(byte(len(d.Password)))
+	buf.WriteString(d.Password)
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("%w: %s", ErrProxy, err)
+	}
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return fmt.Errorf("%w: %s", ErrProxy, err)
+	}
+	if resp[1] != 0x00 {
+		return fmt.Errorf("%w: %s", ErrProxy, "socks-proxy: authentication failed")
+	}
+	return nil
+}
+
+// socksAddrBytes encodes a host:port as ATYP | DST.ADDR | DST.PORT.
+func socksAddrBytes(address string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errBadInput, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("%w: bad port: %s", errBadInput, portStr)
+	}
+	buf := &bytes.Buffer{}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf.WriteByte(socksAtypIPv4)
+			buf.Write(ip4)
+		} else {
+			buf.WriteByte(socksAtypIPv6)
+			buf.Write(ip.To16())
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("%w: %s", errBadInput, "hostname too long")
+		}
+		buf.WriteByte(socksAtypDomain)
+		buf.WriteByte(byte(len(host)))
+		buf.WriteString(host)
+	}
+	binary.Write(buf, binary.BigEndian, uint16(port))
+	return buf.Bytes(), nil
+}
+
+// readSocksAddr reads an ATYP | ADDR | PORT triple and returns it as host:port.
+func readSocksAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case socksAtypIPv4, socksAtypIPv6:
+		size := net.IPv4len
+		if atyp[0] == socksAtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(r, size); err != nil {
+			return "", err
+		}
+		name := make([]byte, size[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("unknown address type: %d", atyp[0])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// socksUDPConn is a connected UDP socket to a SOCKS5 relay. Each datagram is
+// encapsulated with the UDP request header for the remote address.
+// LocalAddr returns the local UDP address, so that the OpenVPN framing
+// remains the one for UDP.
+type socksUDPConn struct {
+	net.Conn
+	// ctrl is the TCP connection that keeps the association alive.
+	ctrl net.Conn
+	// header is the encoded remote address.
+	header []byte
+}
+
+// Read reads a datagram from the relay, and strips the encapsulation.
+func (c *socksUDPConn) Read(b []byte) (int, error) {
+	// RSV | FRAG | ATYP | the longest address (a domain) | PORT
+	const maxHeader = 2 + 1 + 1 + 1 + 255 + 2
+	buf := make([]byte, len(b)+maxHeader)
+	for {
+		n, err := c.Conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		// short datagrams and fragments are dropped
+		if n < 3 || buf[2] != 0x00 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		if _, err := readSocksAddr(r); err != nil || r.Len() == 0 {
+			continue
+		}
+		return r.Read(b)
+	}
+}
+
+// Write encapsulates the payload and writes it to the relay.
+func (c *socksUDPConn) Write(b []byte) (int, error) {
+	out := append([]byte{0x00, 0x00, 0x00}, c.header...)
+	out = append(out, b...)
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes both the UDP socket and the control connection.
+func (c *socksUDPConn) Close() error {
+	c.ctrl.Close()
+	return c.Conn.Close()
+}
+
+var _ DialerContext = &SOCKS5Dialer{} // Ensure that we implement DialerContext
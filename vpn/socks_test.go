@@ -0,0 +1,239 @@
+package vpn
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startSOCKS5Proxy starts a minimal SOCKS5 server that supports CONNECT and
+// UDP ASSOCIATE. If user is not empty, it requires username/password auth.
+func startSOCKS5Proxy(t *testing.T, user, pass string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(c, user, pass)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func serveSOCKS5(c net.Conn, user, pass string) {
+	defer c.Close()
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(c, hdr); err != nil {
+		return
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return
+	}
+	if user == "" {
+		c.Write([]byte{socksVersion5, socksAuthNone})
+	} else {
+		if !bytes.Contains(methods, []byte{socksAuthUserPass}) {
+			c.Write([]byte{socksVersion5, 0xff})
+			return
+		}
+		c.Write([]byte{socksVersion5, socksAuthUserPass})
+		b := make([]byte, 2)
+		io.ReadFull(c, b)
+		u := make([]byte, b[1])
+		io.ReadFull(c, u)
+		io.ReadFull(c, b[:1])
+		p := make([]byte, b[0])
+		io.ReadFull(c, p)
+		if string(u) != user || string(p) != pass {
+			c.Write([]byte{0x01, 0x01})
+			return
+		}
+		c.Write([]byte{0x01, 0x00})
+	}
+	req := make([]byte, 3)
+	if _, err := io.ReadFull(c, req); err != nil {
+		return
+	}
+	addr, err := readSocksAddr(c)
+	if err != nil {
+		return
+	}
+	switch req[1] {
+	case socksCmdConnect:
+		remote, err := net.Dial("tcp", addr)
+		if err != nil {
+			c.Write([]byte{socksVersion5, 0x05, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer remote.Close()
+		bound, _ := socksAddrBytes(remote.LocalAddr().String())
+		c.Write(append([]byte{socksVersion5, 0x00, 0x00}, bound...))
+		go io.Copy(remote, c)
+		io.Copy(c, remote)
+	case socksCmdUDPAssociate:
+		relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		// announce the unspecified address, clients should use the proxy host.
+		port := relay.LocalAddr().(*net.UDPAddr).Port
+		c.Write([]byte{socksVersion5, 0x00, 0x00, socksAtypIPv4, 0, 0, 0, 0, byte(port >> 8), byte(port)})
+		go relayUDP(relay)
+		io.Copy(io.Discard, c)
+	}
+}
+
+// relayUDP forwards encapsulated datagrams from the client to their
+// destination, and encapsulates the replies back.
+func relayUDP(relay net.PacketConn) {
+	buf := make([]byte, 4096)
+	var client net.Addr
+	for {
+		n, from, err := relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if client == nil || from.String() == client.String() {
+			client = from
+			r := bytes.NewReader(buf[3:n])
+			dst, err := readSocksAddr(r)
+			if err != nil {
+				continue
+			}
+			udst, _ := net.ResolveUDPAddr("udp", dst)
+			payload := make([]byte, r.Len())
+			r.Read(payload)
+			relay.WriteTo(payload, udst)
+			continue
+		}
+		hdr, _ := socksAddrBytes(from.String())
+		out := append([]byte{0, 0, 0}, hdr...)
+		relay.WriteTo(append(out, buf[:n]...), client)
+	}
+}
+
+// startUDPEchoServer starts an UDP server that echoes back any datagram.
+func startUDPEchoServer(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestSOCKS5Dialer_DialContext(t *testing.T) {
+	t.Run("tcp connect", func(t *testing.T) {
+		echo := startEchoServer(t)
+		d := &SOCKS5Dialer{Addr: startSOCKS5Proxy(t, "", "")}
+		conn, err := d.DialContext(context.Background(), "tcp", echo)
+		if err != nil {
+			t.Fatalf("DialContext() error = %v", err)
+		}
+		defer conn.Close()
+		assertEcho(t, conn)
+	})
+
+	t.Run("tcp connect with auth", func(t *testing.T) {
+		echo := startEchoServer(t)
+		proxy := startSOCKS5Proxy(t, "user", "pass")
+		d := &SOCKS5Dialer{Addr: proxy, Username: "user", Password: "pass"}
+		conn, err := d.DialContext(context.Background(), "tcp", echo)
+		if err != nil {
+			t.Fatalf("DialContext() error = %v", err)
+		}
+		defer conn.Close()
+		assertEcho(t, conn)
+
+		d = &SOCKS5Dialer{Addr: proxy, Username: "user", Password: "bad"}
+		if _, err := d.DialContext(context.Background(), "tcp", echo); !errors.Is(err, ErrProxy) {
+			t.Errorf("DialContext(): want %v, got %v", ErrProxy, err)
+		}
+		d = &SOCKS5Dialer{Addr: proxy}
+		if _, err := d.DialContext(context.Background(), "tcp", echo); !errors.Is(err, ErrProxy) {
+			t.Errorf("DialContext(): want %v, got %v", ErrProxy, err)
+		}
+	})
+
+	t.Run("udp associate", func(t *testing.T) {
+		echo := startUDPEchoServer(t)
+		d := &SOCKS5Dialer{Addr: startSOCKS5Proxy(t, "", "")}
+		conn, err := d.DialContext(context.Background(), "udp", echo)
+		if err != nil {
+			t.Fatalf("DialContext() error = %v", err)
+		}
+		defer conn.Close()
+		if network := conn.LocalAddr().Network(); network != "udp" {
+			t.Errorf("LocalAddr().Network() = %v, want udp", network)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		msg := []byte("alles ist green")
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		buf := make([]byte, 1500)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if !bytes.Equal(buf[:n], msg) {
+			t.Errorf("echo: got %q, want %q", buf[:n], msg)
+		}
+	})
+
+	t.Run("unknown network fails", func(t *testing.T) {
+		d := &SOCKS5Dialer{Addr: "127.0.0.1:1"}
+		if _, err := d.DialContext(context.Background(), "unix", "/tmp/foo"); !errors.Is(err, ErrProxyNetwork) {
+			t.Errorf("DialContext(): want %v, got %v", ErrProxyNetwork, err)
+		}
+	})
+}
+
+func Test_socksAddrBytes(t *testing.T) {
+	tests := []struct {
+		addr string
+		want []byte
+	}{
+		{"1.2.3.4:80", []byte{socksAtypIPv4, 1, 2, 3, 4, 0, 80}},
+		{"example.org:443", append(append([]byte{socksAtypDomain, 11}, "example.org"...), 1, 187)},
+		{"[::1]:1", append(append([]byte{socksAtypIPv6}, net.IPv6loopback...), 0, 1)},
+	}
+	for _, tt := range tests {
+		got, err := socksAddrBytes(tt.addr)
+		if err != nil {
+			t.Fatalf("socksAddrBytes(%s): %v", tt.addr, err)
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("socksAddrBytes(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+		back, err := readSocksAddr(bytes.NewReader(got))
+		if err != nil || back != tt.addr {
+			t.Errorf("readSocksAddr() = %v, %v; want %v", back, err, tt.addr)
+		}
+	}
+	if _, err := socksAddrBytes("nope"); !errors.Is(err, errBadInput) {
+		t.Errorf("socksAddrBytes(): want %v, got %v", errBadInput, err)
+	}
+}
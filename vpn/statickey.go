@@ -0,0 +1,293 @@
+package vpn
+
+//
+// Static key (pre-shared secret) point-to-point mode: there is no TLS and no
+// control channel, both peers derive the data channel keys from the same
+// 2048-bit key file.
+//
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	// staticKeySize is the size of a static key: two pairs of cipher and
+	// hmac keys, of 64 bytes each.
+	staticKeySize = 256
+
+	// staticKeyTunMTU is the tun-mtu used in static key mode, where there
+	// is no server to push it.
+	staticKeyTunMTU = 1500
+)
+
+// parseStaticKey reads an "OpenVPN Static key V1" file, as written by
+// openvpn --genkey, with the same parser as tls-auth keys.
+func parseStaticKey(b []byte) ([]byte, error) {
+	hexed, err := parseTAFromBytes(b)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad static key: %s", errBadInput, err)
+	}
+	if len(hexed) == 0 {
+		return nil, fmt.Errorf("%w: %s", errBadInput, "no static key block found")
+	}
+	key, err := hex.DecodeString(string(hexed))
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad static key: %s", errBadInput, err)
+	}
+	if len(key) != staticKeySize {
+		return nil, fmt.Errorf("%w: static key has %d bytes, want %d", errBadInput, len(key), staticKeySize)
+	}
+	return key, nil
+}
+
+// staticKeySlots splits a static key into the local and remote cipher and
+// hmac keys. Without a key direction, both peers use the first pair in both
+// directions; with key-direction 0 the first pair is used to send and the
+// second one to receive, and the other way around with key-direction 1.
+func staticKeySlots(key []byte, direction string) (cipherLocal, hmacLocal, cipherRemote, hmacRemote keySlot, err error) {
+	if len(key) != staticKeySize {
+		err = fmt.Errorf("%w: bad static key size: %d", errBadInput, len(key))
+		return
+	}
+	var out, in int
+	switch direction {
+	case "":
+		out, in = 0, 0
+	case "0":
+		out, in = 0, 1
+	case "1":
+		out, in = 1, 0
+	default:
+		err = fmt.Errorf("%w: bad key direction: %s", errBadInput, direction)
+		return
+	}
+	copy(cipherLocal[:], key[out*128:])
+	copy(hmacLocal[:], key[out*128+64:])
+	copy(cipherRemote[:], key[in*128:])
+	copy(hmacRemote[:], key[in*128+64:])
+	return
+}
+
+// setupStaticKeys initializes the data channel state from a static key.
+func (d *data) setupStaticKeys(key []byte, direction string) error {
+	cipherLocal, hmacLocal, cipherRemote, hmacRemote, err := staticKeySlots(key, direction)
+	if err != nil {
+		return err
+	}
+	d.state.cipherKeyLocal = cipherLocal
+	d.state.hmacKeyLocal = hmacLocal
+	d.state.cipherKeyRemote = cipherRemote
+	d.state.hmacKeyRemote = hmacRemote
+
+	hashSize := d.state.hash().Size()
+	d.state.hmacLocal = hmac.New(d.state.hash, hmacLocal[:hashSize])
+	d.state.hmacRemote = hmac.New(d.state.hash, hmacRemote[:hashSize])
+
+	logger.Info("Static key loaded")
+	return nil
+}
+
+// encryptAndEncodePayloadStatic encrypts the payload for static key mode,
+// where packets have no opcode nor peer-id header: only the hmac, the iv and
+// the ciphertext.
+func encryptAndEncodePayloadStatic(padded []byte, session *session, state *dataChannelState) ([]byte, error) {
+	return sealPayloadNonAEAD(padded, state)
+}
+
+// prependLongPacketID returns the buffer with the long form of the packet id
+// used in static key mode (packet id and time, 4 bytes each) at the
+// beginning.
+func prependLongPacketID(p packetID, now time.Time, buf []byte) []byte {
+	out := make([]byte, 8, 8+len(buf))
+	binary.BigEndian.PutUint32(out, uint32(p))
+	binary.BigEndian.PutUint32(out[4:], uint32(now.Unix()))
+	return append(out, buf...)
+}
+
+// dropPacketIDTime removes the time from a plaintext that starts with a long
+// form packet id, so that it can be handled as one with a short packet id.
+func dropPacketIDTime(b []byte) ([]byte, error) {
+	if len(b) < 8 {
+		return nil, fmt.Errorf("%w: too short for a packet id", errBadInput)
+	}
+	out := make([]byte, 0, len(b)-4)
+	out = append(out, b[:4]...)
+	return append(out, b[8:]...), nil
+}
+
+// staticKeyMuxer is the vpnMuxer for static key mode. There is no handshake:
+// every packet on the wire is a data packet, without an opcode.
+type staticKeyMuxer struct {
+	conn          net.Conn
+	options       *Options
+	data          *data
+	tunnel        *tunnelInfo
+	eventListener chan uint8
+	bufReader     *bytes.Buffer
+	occ           *occ
+}
+
+var _ vpnMuxer = &staticKeyMuxer{} // Ensure that we implement vpnMuxer
+
+// newStaticKeyMuxerFromOptions is the muxFactory for static key mode. It
+// loads the key from Secret, or from SecretPath.
+func newStaticKeyMuxerFromOptions(conn net.Conn, options *Options, tunnel *tunnelInfo) (vpnMuxer, error) {
+	raw := options.Secret
+	if len(raw) == 0 {
+		b, err := os.ReadFile(options.SecretPath)
+		if err != nil {
+			return nil, fmt.Errorf("%w: cannot read secret: %s", errBadInput, err)
+		}
+		raw = b
+	}
+	key, err := parseStaticKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	session, err := newSession()
+	if err != nil {
+		return nil, err
+	}
+	// packet ids start at 1.
+	if _, err := session.LocalPacketID(); err != nil {
+		return nil, err
+	}
+	data, err := newDataFromOptions(options, session)
+	if err != nil {
+		return nil, err
+	}
+	if data.state.dataCipher.isAEAD() {
+		return nil, fmt.Errorf("%w: static key mode needs a cbc cipher, not %s", errBadInput, options.Cipher)
+	}
+	data.staticKey = true
+	data.encryptEncodeFn = encryptAndEncodePayloadStatic
+	if err := data.setupStaticKeys(key, options.KeyDirection); err != nil {
+		return nil, err
+	}
+	m := &staticKeyMuxer{
+		conn:      conn,
+		options:   options,
+		data:      data,
+		tunnel:    tunnel,
+		bufReader: bytes.NewBuffer(nil),
+	}
+	m.occ = newOCC(options.String(), func(b []byte) (int, error) {
+		return m.data.WritePacket(m.conn, b)
+	})
+	return m, nil
+}
+
+// Handshake sets up the tunnel addresses from the ifconfig option, and sends
+// a ping so that the peer learns our address, and an OCC request.
+func (m *staticKeyMuxer) Handshake(ctx context.Context) error {
+	if m.tunnel == nil {
+		return fmt.Errorf("%w:%s", errBadInput, "muxer badly initialized")
+	}
+	m.tunnel.ip = m.options.IfconfigLocal
+	if m.options.tapMode() {
+		m.tunnel.netmask = m.options.IfconfigRemote
+	} else {
+		m.tunnel.gw = m.options.IfconfigRemote
+	}
+	m.tunnel.mtu = staticKeyTunMTU
+	m.tunnel.info = &TunnelInfo{
+		IP:      m.tunnel.ip,
+		Netmask: m.tunnel.netmask,
+		Peer:    m.tunnel.gw,
+		TunMTU:  m.tunnel.mtu,
+	}
+	m.tunnel.info.addClientOptions(m.options)
+	logger.Infof("Tunnel IP: %s", m.tunnel.ip)
+	logger.Infof("Gateway IP: %s", m.tunnel.gw)
+	m.emit(EventDataInitDone)
+	if err := m.writePing(); err != nil {
+		return err
+	}
+	// there is no key exchange to compare the options strings, so we ask
+	// the peer for its own.
+	return m.occ.send(occRequest, nil, 0)
+}
+
+// Reset does nothing, since there is no session to reset.
+func (m *staticKeyMuxer) Reset(net.Conn, *session) error {
+	return nil
+}
+
+// InitDataWithRemoteKey does nothing, since the keys come from the static
+// key.
+func (m *staticKeyMuxer) InitDataWithRemoteKey() error {
+	return nil
+}
+
+// SetEventListener assigns the passed channel as the event listener for this
+// muxer.
+func (m *staticKeyMuxer) SetEventListener(el chan uint8) {
+	m.eventListener = el
+}
+
+// emit sends the passed stage into any configured EventListener.
+func (m *staticKeyMuxer) emit(stage uint8) {
+	select {
+	case m.eventListener <- stage:
+	default:
+		// do not deliver
+	}
+}
+
+// Write sends user bytes as encrypted packets.
+func (m *staticKeyMuxer) Write(b []byte) (int, error) {
+	n, err := m.data.WritePacket(m.conn, b)
+	if err == nil {
+		m.occ.sent(len(b), n)
+	}
+	return n, err
+}
+
+// occState returns the OCC state of the muxer.
+func (m *staticKeyMuxer) occState() *occ {
+	return m.occ
+}
+
+// Read reads the next user packet. Packets that cannot be authenticated or
+// decrypted, replayed packets and pings are dropped, and OCC messages are
+// handled.
+func (m *staticKeyMuxer) Read(b []byte) (int, error) {
+	for m.bufReader.Len() == 0 {
+		buf, err := readPacket(m.conn)
+		if err != nil {
+			return 0, err
+		}
+		plaintext, err := m.data.ReadPacket(&packet{opcode: pDataV1, payload: buf})
+		if err != nil {
+			logger.Warnf("static key: dropping packet: %s", err)
+			continue
+		}
+		m.occ.received(len(buf))
+		if isPing(plaintext) {
+			logger.Debug("static key: got ping")
+			continue
+		}
+		if isOCC(plaintext) {
+			if err := m.occ.dispatch(plaintext); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		m.bufReader.Write(plaintext)
+	}
+	return m.bufReader.Read(b)
+}
+
+// writePing sends an openvpn-ping.
+func (m *staticKeyMuxer) writePing() error {
+	_, err := m.data.WritePacket(m.conn, pingPayload)
+	return err
+}
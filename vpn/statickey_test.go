@@ -0,0 +1,347 @@
+package vpn
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// makeTestingStaticKey returns a static key and its file, as written by
+// openvpn --genkey.
+func makeTestingStaticKey() ([]byte, []byte) {
+	key := make([]byte, staticKeySize)
+	for i := range key {
+		key[i] = byte(i*7 + 3)
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteString("#\n# 2048 bit OpenVPN static key\n#\n")
+	buf.WriteString(staticKeyHeader + "\n")
+	for i := 0; i < len(key); i += 16 {
+		buf.WriteString(hex.EncodeToString(key[i:i+16]) + "\n")
+	}
+	buf.WriteString(staticKeyFooter + "\n")
+	return key, buf.Bytes()
+}
+
+func Test_parseStaticKey(t *testing.T) {
+	key, file := makeTestingStaticKey()
+	got, err := parseStaticKey(file)
+	if err != nil {
+		t.Fatalf("parseStaticKey(): unexpected error %v", err)
+	}
+	if !bytes.Equal(got, key) {
+		t.Errorf("parseStaticKey(): got %x, want %x", got, key)
+	}
+
+	bad := map[string][]byte{
+		"no block":     []byte("just some text\n"),
+		"not closed":   []byte(staticKeyHeader + "\n00ff\n"),
+		"bad hex":      []byte(staticKeyHeader + "\nzz\n" + staticKeyFooter + "\n"),
+		"too short":    []byte(staticKeyHeader + "\n00ff\n" + staticKeyFooter + "\n"),
+		"footer first": []byte(staticKeyFooter + "\n" + staticKeyHeader + "\n"),
+	}
+	for name, b := range bad {
+		if _, err := parseStaticKey(b); !errors.Is(err, errBadInput) {
+			t.Errorf("parseStaticKey(%s): want %v, got %v", name, errBadInput, err)
+		}
+	}
+}
+
+func Test_encryptAndEncodePayloadStatic(t *testing.T) {
+	useRealRandomFn()
+	padded := bytes.Repeat([]byte{0x42}, 32)
+	// hmac (sha1), iv and ciphertext, whatever the data packet header would be.
+	want := 20 + 16 + 32
+	for _, dataV1 := range []bool{false, true} {
+		st := makeTestingStateNonAEAD()
+		st.dataV1 = dataV1
+		st.peerID = 0x0a0b0c
+		out, err := encryptAndEncodePayloadStatic(padded, makeTestingSession(), st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != want {
+			t.Fatalf("encryptAndEncodePayloadStatic(dataV1=%v): got %d bytes, want %d", dataV1, len(out), want)
+		}
+		st.hmacLocal.Reset()
+		st.hmacLocal.Write(out[20:])
+		if !bytes.Equal(st.hmacLocal.Sum(nil), out[:20]) {
+			t.Errorf("encryptAndEncodePayloadStatic(dataV1=%v): the packet does not start with the hmac", dataV1)
+		}
+	}
+}
+
+func Test_staticKeySlots(t *testing.T) {
+	key, _ := makeTestingStaticKey()
+	pair := func(i int) (keySlot, keySlot) {
+		var c, h keySlot
+		copy(c[:], key[i*128:])
+		copy(h[:], key[i*128+64:])
+		return c, h
+	}
+	c0, h0 := pair(0)
+	c1, h1 := pair(1)
+	tests := []struct {
+		direction            string
+		wantCipherLocal      keySlot
+		wantHMACLocal        keySlot
+		wantCipherRemote     keySlot
+		wantHMACRemoteRemote keySlot
+	}{
+		{"", c0, h0, c0, h0},
+		{"0", c0, h0, c1, h1},
+		{"1", c1, h1, c0, h0},
+	}
+	for _, tt := range tests {
+		cl, hl, cr, hr, err := staticKeySlots(key, tt.direction)
+		if err != nil {
+			t.Fatalf("staticKeySlots(%q): unexpected error %v", tt.direction, err)
+		}
+		if cl != tt.wantCipherLocal || hl != tt.wantHMACLocal || cr != tt.wantCipherRemote || hr != tt.wantHMACRemoteRemote {
+			t.Errorf("staticKeySlots(%q): wrong keys", tt.direction)
+		}
+	}
+	if _, _, _, _, err := staticKeySlots(key, "2"); !errors.Is(err, errBadInput) {
+		t.Errorf("staticKeySlots(2): want %v, got %v", errBadInput, err)
+	}
+	if _, _, _, _, err := staticKeySlots(key[:128], ""); !errors.Is(err, errBadInput) {
+		t.Errorf("staticKeySlots(short key): want %v, got %v", errBadInput, err)
+	}
+}
+
+func Test_prependLongPacketID(t *testing.T) {
+	b := prependLongPacketID(packetID(7), time.Unix(0x01020304, 0), []byte{0xaa})
+	want := []byte{0, 0, 0, 7, 1, 2, 3, 4, 0xaa}
+	if !bytes.Equal(b, want) {
+		t.Errorf("prependLongPacketID() = %x, want %x", b, want)
+	}
+	short, err := dropPacketIDTime(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(short, []byte{0, 0, 0, 7, 0xaa}) {
+		t.Errorf("dropPacketIDTime() = %x", short)
+	}
+	if _, err := dropPacketIDTime([]byte{1, 2, 3}); !errors.Is(err, errBadInput) {
+		t.Errorf("dropPacketIDTime(short): want %v, got %v", errBadInput, err)
+	}
+}
+
+// useRealRandomFn undoes any mock of randomFn left by other tests, since the
+// peers need real IVs.
+func useRealRandomFn() {
+	randomFn = genRandomBytes
+}
+
+func makeTestingStaticKeyOptions(secret []byte, direction string) *Options {
+	return &Options{
+		Cipher:         "AES-256-CBC",
+		Auth:           "SHA256",
+		Secret:         secret,
+		KeyDirection:   direction,
+		IfconfigLocal:  "10.8.0.2",
+		IfconfigRemote: "10.8.0.1",
+	}
+}
+
+// startStaticKeyPeer returns a static key muxer, with key-direction 0, that
+// answers on a local UDP socket.
+func startStaticKeyPeer(t *testing.T, secret []byte) (*net.UDPConn, func(net.Addr) vpnMuxer) {
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	// the peer muxer needs a connected socket; it is created once the
+	// client address is known.
+	connect := func(client net.Addr) vpnMuxer {
+		conn, err := net.DialUDP("udp", pc.LocalAddr().(*net.UDPAddr), client.(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		m, err := newStaticKeyMuxerFromOptions(conn, makeTestingStaticKeyOptions(secret, "0"), &tunnelInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	return pc, connect
+}
+
+func TestClient_staticKeyMode(t *testing.T) {
+	useRealRandomFn()
+	_, secret := makeTestingStaticKey()
+	pc, connect := startStaticKeyPeer(t, secret)
+
+	host, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	opts := makeTestingStaticKeyOptions(secret, "1")
+	opts.Remote, opts.Port, opts.Proto = host, port, UDPMode
+	client := NewClientFromOptions(opts)
+	if err := client.Start(context.Background()); err != nil {
+		t.Fatalf("Client.Start(): unexpected error %v", err)
+	}
+	defer client.Close()
+	if got := client.LocalAddr().String(); got != "10.8.0.2" {
+		t.Errorf("Client.LocalAddr() = %v, want 10.8.0.2", got)
+	}
+	if got := client.RemoteAddr().String(); got != "10.8.0.1" {
+		t.Errorf("Client.RemoteAddr() = %v, want 10.8.0.1", got)
+	}
+	if info := client.TunnelInfo(); info.IP != "10.8.0.2" || info.Peer != "10.8.0.1" {
+		t.Errorf("Client.TunnelInfo() = %+v", info)
+	}
+
+	// the handshake sent a ping, that tells the peer our address.
+	buf := make([]byte, 2048)
+	_, addr, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc.Close()
+	peer := connect(addr)
+
+	packet := append([]byte{0x45}, bytes.Repeat([]byte{0x42}, 99)...)
+	if _, err := client.Write(packet); err != nil {
+		t.Fatalf("Client.Write(): unexpected error %v", err)
+	}
+	n, err := peer.Read(buf)
+	if err != nil {
+		t.Fatalf("peer Read(): unexpected error %v", err)
+	}
+	if !bytes.Equal(buf[:n], packet) {
+		t.Errorf("peer Read() = %x, want %x", buf[:n], packet)
+	}
+
+	reply := append([]byte{0x45}, bytes.Repeat([]byte{0x24}, 59)...)
+	if _, err := peer.Write(reply); err != nil {
+		t.Fatal(err)
+	}
+	n, err = client.Read(buf)
+	if err != nil {
+		t.Fatalf("Client.Read(): unexpected error %v", err)
+	}
+	if !bytes.Equal(buf[:n], reply) {
+		t.Errorf("Client.Read() = %x, want %x", buf[:n], reply)
+	}
+}
+
+func Test_staticKeyMuxer_dropsBadPackets(t *testing.T) {
+	useRealRandomFn()
+	_, secret := makeTestingStaticKey()
+	c1, c2 := makeTestingUDPPair(t)
+	// both ends use key-direction 1, so neither can authenticate the other.
+	a, err := newStaticKeyMuxerFromOptions(c1, makeTestingStaticKeyOptions(secret, "1"), &tunnelInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newStaticKeyMuxerFromOptions(c2, makeTestingStaticKeyOptions(secret, "1"), &tunnelInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Write([]byte{0x45, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	c2.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := b.Read(make([]byte, 64)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read(): want the packet dropped and a timeout, got %v", err)
+	}
+}
+
+func makeTestingUDPPair(t *testing.T) (net.Conn, net.Conn) {
+	l1, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a1, a2 := l1.LocalAddr().(*net.UDPAddr), l2.LocalAddr().(*net.UDPAddr)
+	l1.Close()
+	l2.Close()
+	c1, err := net.DialUDP("udp", a1, a2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := net.DialUDP("udp", a2, a1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c1.Close(); c2.Close() })
+	return c1, c2
+}
+
+func Test_newStaticKeyMuxerFromOptions(t *testing.T) {
+	useRealRandomFn()
+	_, secret := makeTestingStaticKey()
+	conn := makeTestingConnForReadWrite("udp", "10.0.0.1", 0)
+
+	opts := makeTestingStaticKeyOptions(secret, "")
+	opts.Cipher = "AES-128-GCM"
+	if _, err := newStaticKeyMuxerFromOptions(conn, opts, &tunnelInfo{}); !errors.Is(err, errBadInput) {
+		t.Errorf("newStaticKeyMuxerFromOptions(gcm): want %v, got %v", errBadInput, err)
+	}
+
+	opts = makeTestingStaticKeyOptions(nil, "")
+	opts.SecretPath = filepath.Join(t.TempDir(), "missing.key")
+	if _, err := newStaticKeyMuxerFromOptions(conn, opts, &tunnelInfo{}); !errors.Is(err, errBadInput) {
+		t.Errorf("newStaticKeyMuxerFromOptions(missing file): want %v, got %v", errBadInput, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "static.key")
+	os.WriteFile(path, secret, 0600)
+	opts.SecretPath = path
+	if _, err := newStaticKeyMuxerFromOptions(conn, opts, &tunnelInfo{}); err != nil {
+		t.Errorf("newStaticKeyMuxerFromOptions(file): unexpected error %v", err)
+	}
+}
+
+func Test_parseStaticKeyOptions(t *testing.T) {
+	dir := t.TempDir()
+	_, secret := makeTestingStaticKey()
+	os.WriteFile(filepath.Join(dir, "static.key"), secret, 0600)
+
+	o := &Options{}
+	if err := parseSecret([]string{"static.key", "1"}, o, newConfigFiles(dir)); err != nil {
+		t.Fatalf("parseSecret(): unexpected error %v", err)
+	}
+	if o.SecretPath != filepath.Join(dir, "static.key") || o.KeyDirection != "1" || !o.staticKeyMode() {
+		t.Errorf("parseSecret(): got %v %v", o.SecretPath, o.KeyDirection)
+	}
+	for _, p := range [][]string{{}, {"missing.key"}, {"static.key", "2"}, {"../static.key"}} {
+		if err := parseSecret(p, &Options{}, newConfigFiles(dir)); !errors.Is(err, errBadCfg) {
+			t.Errorf("parseSecret(%v): want %v, got %v", p, errBadCfg, err)
+		}
+	}
+
+	if err := parseIfconfig([]string{"10.8.0.2", "10.8.0.1"}, o); err != nil || o.IfconfigLocal != "10.8.0.2" || o.IfconfigRemote != "10.8.0.1" {
+		t.Errorf("parseIfconfig(): got %v %v %v", o.IfconfigLocal, o.IfconfigRemote, err)
+	}
+	for _, p := range [][]string{{}, {"10.8.0.2"}, {"10.8.0.2", "gateway"}} {
+		if err := parseIfconfig(p, &Options{}); !errors.Is(err, errBadCfg) {
+			t.Errorf("parseIfconfig(%v): want %v, got %v", p, errBadCfg, err)
+		}
+	}
+	if err := parseKeyDirection([]string{"up"}, &Options{}); !errors.Is(err, errBadCfg) {
+		t.Errorf("parseKeyDirection(up): want %v, got %v", errBadCfg, err)
+	}
+
+	lines := []string{"dev tun", "ifconfig 10.8.0.2 10.8.0.1", "key-direction 1", "<secret>"}
+	lines = append(lines, strings.Split(strings.TrimSpace(string(secret)), "\n")...)
+	lines = append(lines, "</secret>")
+	o, err := getOptionsFromLines(lines, dir)
+	if err != nil {
+		t.Fatalf("getOptionsFromLines(): unexpected error %v", err)
+	}
+	if _, err := parseStaticKey(o.Secret); err != nil || o.KeyDirection != "1" {
+		t.Errorf("getOptionsFromLines(): inline secret not loaded: %v", err)
+	}
+}
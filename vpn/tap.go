@@ -0,0 +1,798 @@
+package vpn
+
+//
+// TAP mode: Ethernet framing on the data channel, for server-bridge setups.
+//
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// tapMTUExtra is the tun-mtu-extra that the reference implementation
+	// adds to tap devices.
+	tapMTUExtra = 32
+
+	// ethHeaderLen is the length of an Ethernet header without VLAN tags.
+	ethHeaderLen = 14
+
+	// tapMaxPending is how many packets are kept for a neighbor whose MAC
+	// address is not known yet.
+	tapMaxPending = 16
+
+	// tapSolicitInterval is the minimum time between two ARP requests (or
+	// neighbor solicitations) for the same neighbor.
+	tapSolicitInterval = time.Second
+
+	// tapDHCPTimeout is how long we wait for each DHCP reply, and
+	// tapDHCPAttempts how many times we start over.
+	tapDHCPTimeout  = 4 * time.Second
+	tapDHCPAttempts = 3
+
+	// dhcpMinLen is the minimum length of a BOOTP message; some servers
+	// ignore shorter ones.
+	dhcpMinLen = 300
+)
+
+var (
+	// errDHCP is returned when we cannot get an address with DHCP.
+	errDHCP = errors.New("dhcp failed")
+
+	// errDHCPTimeout is returned when a DHCP reply does not come in time.
+	errDHCPTimeout = errors.New("dhcp timeout")
+
+	broadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+)
+
+// tapConn adapts a tunnel that carries Ethernet frames (dev tap) to the IP
+// packets that the netstack device reads and writes. It has a locally
+// generated MAC address, answers ARP requests and IPv6 neighbor
+// solicitations for its addresses, and resolves the MAC address of the next
+// hop before sending a packet. Neighbors are never forgotten, which is fine
+// for the handful of hosts a client talks to on a bridge.
+type tapConn struct {
+	net.Conn
+	mac net.HardwareAddr
+
+	mu      sync.Mutex
+	ip4     netip.Addr
+	net4    netip.Prefix
+	gw4     netip.Addr
+	ip6     netip.Addr
+	net6    netip.Prefix
+	gw6     netip.Addr
+	neigh   map[netip.Addr]net.HardwareAddr
+	pending map[netip.Addr]*tapPending
+	dhcp    chan *layers.DHCPv4
+
+	wmu sync.Mutex
+
+	in        chan []byte
+	err       error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// tapPending holds the packets for a neighbor that we are resolving.
+type tapPending struct {
+	packets [][]byte
+	asked   time.Time
+}
+
+// dhcpLease is what a DHCP server gave us.
+type dhcpLease struct {
+	ip     netip.Addr
+	prefix netip.Prefix
+	router netip.Addr
+	time   time.Duration
+}
+
+// newTapConn returns a tapConn over conn, which must read and write
+// Ethernet frames, with the addresses in the tunnel info. It starts reading
+// from conn.
+func newTapConn(conn net.Conn, ti *tunnelInfo) (*tapConn, error) {
+	mac, err := randomFn(6)
+	if err != nil {
+		return nil, err
+	}
+	// locally administered, unicast.
+	mac[0] = (mac[0] | 0x02) &^ 0x01
+	t := &tapConn{
+		Conn:    conn,
+		mac:     mac,
+		neigh:   make(map[netip.Addr]net.HardwareAddr),
+		pending: make(map[netip.Addr]*tapPending),
+		in:      make(chan []byte, 64),
+		done:    make(chan struct{}),
+	}
+	if ti != nil {
+		if err := t.setAddresses(ti); err != nil {
+			return nil, err
+		}
+	}
+	go t.readLoop()
+	return t, nil
+}
+
+// setAddresses configures the addresses from the tunnel info. The IPv4
+// address may be missing, in which case it comes from DHCP.
+func (t *tapConn) setAddresses(ti *tunnelInfo) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if ti.ip != "" {
+		ip, err := netip.ParseAddr(ti.ip)
+		if err != nil || !ip.Is4() {
+			return fmt.Errorf("%w: bad tunnel address: %s", errBadInput, ti.ip)
+		}
+		bits := 32
+		if ti.netmask != "" {
+			bits, _ = net.IPMask(net.ParseIP(ti.netmask).To4()).Size()
+		}
+		t.ip4, t.net4 = ip, netip.PrefixFrom(ip, bits).Masked()
+	}
+	gw := ti.routeGw
+	if gw == "" {
+		gw = ti.gw
+	}
+	if gw != "" {
+		ip, err := netip.ParseAddr(gw)
+		if err != nil || !ip.Is4() {
+			return fmt.Errorf("%w: bad gateway: %s", errBadInput, gw)
+		}
+		t.gw4 = ip
+	}
+	if ti.ip6 != "" {
+		p, err := netip.ParsePrefix(ti.ip6)
+		if err != nil || !p.Addr().Is6() {
+			return fmt.Errorf("%w: bad tunnel address: %s", errBadInput, ti.ip6)
+		}
+		t.ip6, t.net6 = p.Addr(), p.Masked()
+	}
+	if ti.gw6 != "" {
+		ip, err := netip.ParseAddr(ti.gw6)
+		if err != nil || !ip.Is6() {
+			return fmt.Errorf("%w: bad gateway: %s", errBadInput, ti.gw6)
+		}
+		t.gw6 = ip
+	}
+	return nil
+}
+
+// addrs returns the addresses to give to the netstack device.
+func (t *tapConn) addrs() []netip.Addr {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var a []netip.Addr
+	if t.ip4.IsValid() {
+		a = append(a, t.ip4)
+	}
+	if t.ip6.IsValid() {
+		a = append(a, t.ip6)
+	}
+	return a
+}
+
+// Read returns the next IP packet that came in the tunnel.
+func (t *tapConn) Read(b []byte) (int, error) {
+	pkt, ok := <-t.in
+	if !ok {
+		return 0, t.err
+	}
+	return copy(b, pkt), nil
+}
+
+// Write sends an IP packet in an Ethernet frame. If the MAC address of the
+// next hop is not known yet, the packet is held until it is resolved.
+func (t *tapConn) Write(b []byte) (int, error) {
+	var etherType layers.EthernetType
+	var dst netip.Addr
+	switch {
+	case len(b) >= 20 && b[0]>>4 == 4:
+		etherType = layers.EthernetTypeIPv4
+		dst, _ = netip.AddrFromSlice(b[16:20])
+	case len(b) >= 40 && b[0]>>4 == 6:
+		etherType = layers.EthernetTypeIPv6
+		dst, _ = netip.AddrFromSlice(b[24:40])
+	default:
+		return 0, fmt.Errorf("%w: not an ip packet", errBadInput)
+	}
+	mac, ok := t.resolve(dst, b)
+	if !ok {
+		return len(b), nil
+	}
+	if err := t.writeFrame(mac, etherType, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close stops reading and closes the underlying conn.
+func (t *tapConn) Close() error {
+	t.closeOnce.Do(func() { close(t.done) })
+	return t.Conn.Close()
+}
+
+// readLoop reads frames from the tunnel, handles ARP, NDP and DHCP, and
+// queues the IP packets for Read.
+func (t *tapConn) readLoop() {
+	buf := make([]byte, 1<<16)
+	for {
+		n, err := t.Conn.Read(buf)
+		if err != nil {
+			t.err = err
+			close(t.in)
+			return
+		}
+		pkt := t.handleFrame(buf[:n])
+		if pkt == nil {
+			continue
+		}
+		select {
+		case t.in <- append([]byte(nil), pkt...):
+		case <-t.done:
+			t.err = net.ErrClosed
+			close(t.in)
+			return
+		}
+	}
+}
+
+// handleFrame handles an incoming frame, and returns the IP packet that it
+// carries for the netstack device, if any.
+func (t *tapConn) handleFrame(frame []byte) []byte {
+	if len(frame) < ethHeaderLen {
+		return nil
+	}
+	if dst := frame[0:6]; dst[0]&0x01 == 0 && !bytes.Equal(dst, t.mac) {
+		// unicast for another host on the bridge.
+		return nil
+	}
+	payload := frame[ethHeaderLen:]
+	switch layers.EthernetType(binary.BigEndian.Uint16(frame[12:14])) {
+	case layers.EthernetTypeARP:
+		t.handleARP(frame)
+	case layers.EthernetTypeIPv4:
+		if len(payload) < 20 || payload[0]>>4 != 4 {
+			return nil
+		}
+		// drop the padding of short frames.
+		if l := int(binary.BigEndian.Uint16(payload[2:4])); l <= len(payload) {
+			payload = payload[:l]
+		}
+		if isDHCPClientPacket(payload) {
+			t.handleDHCP(frame)
+			return nil
+		}
+		return payload
+	case layers.EthernetTypeIPv6:
+		if len(payload) < 40 || payload[0]>>4 != 6 {
+			return nil
+		}
+		if l := 40 + int(binary.BigEndian.Uint16(payload[4:6])); l <= len(payload) {
+			payload = payload[:l]
+		}
+		if isNDP(payload) {
+			t.handleNDP(frame)
+			return nil
+		}
+		return payload
+	}
+	return nil
+}
+
+// resolve returns the destination MAC address for a packet to dst. If the
+// address of the next hop is not resolved yet, it keeps a copy of the packet,
+// sends a solicitation, and returns false.
+func (t *tapConn) resolve(dst netip.Addr, pkt []byte) (net.HardwareAddr, bool) {
+	t.mu.Lock()
+	if mac := t.multicastMAC(dst); mac != nil {
+		t.mu.Unlock()
+		return mac, true
+	}
+	hop := t.nextHop(dst)
+	if mac, ok := t.neigh[hop]; ok {
+		t.mu.Unlock()
+		return mac, true
+	}
+	q := t.pending[hop]
+	if q == nil {
+		q = &tapPending{}
+		t.pending[hop] = q
+	}
+	if len(q.packets) == tapMaxPending {
+		q.packets = q.packets[1:]
+	}
+	q.packets = append(q.packets, append([]byte(nil), pkt...))
+	ask := time.Since(q.asked) >= tapSolicitInterval
+	if ask {
+		q.asked = time.Now()
+	}
+	t.mu.Unlock()
+	if ask {
+		if err := t.solicit(hop); err != nil {
+			logger.Warnf("tap: cannot resolve %s: %s", hop, err)
+		}
+	}
+	return nil, false
+}
+
+// multicastMAC returns the MAC address for a broadcast or multicast dst, or
+// nil for unicast addresses. It must be called with the lock held.
+func (t *tapConn) multicastMAC(dst netip.Addr) net.HardwareAddr {
+	switch {
+	case dst.Is4() && (dst == netip.AddrFrom4([4]byte{255, 255, 255, 255}) || t.isBroadcast4(dst)):
+		return broadcastMAC
+	case dst.Is4() && dst.IsMulticast():
+		a := dst.As4()
+		return net.HardwareAddr{0x01, 0x00, 0x5e, a[1] & 0x7f, a[2], a[3]}
+	case dst.Is6() && dst.IsMulticast():
+		a := dst.As16()
+		return net.HardwareAddr{0x33, 0x33, a[12], a[13], a[14], a[15]}
+	}
+	return nil
+}
+
+// isBroadcast4 returns true for the directed broadcast address of our
+// subnet. It must be called with the lock held.
+func (t *tapConn) isBroadcast4(dst netip.Addr) bool {
+	if !t.net4.IsValid() || t.net4.Bits() >= 31 || !t.net4.Contains(dst) {
+		return false
+	}
+	a := t.net4.Addr().As4()
+	host := ^uint32(0) >> t.net4.Bits()
+	return binary.BigEndian.Uint32(a[:])|host == binary.BigEndian.Uint32(dst.AsSlice())
+}
+
+// nextHop returns the address to resolve to reach dst: dst itself when it
+// is on the bridge, the gateway otherwise. It must be called with the lock
+// held.
+func (t *tapConn) nextHop(dst netip.Addr) netip.Addr {
+	if dst.Is4() {
+		if t.gw4.IsValid() && !t.net4.Contains(dst) {
+			return t.gw4
+		}
+		return dst
+	}
+	if t.gw6.IsValid() && !t.net6.Contains(dst) && !dst.IsLinkLocalUnicast() {
+		return t.gw6
+	}
+	return dst
+}
+
+// learn records the MAC address of a neighbor, and returns the packets that
+// were waiting for it. It must be called with the lock held.
+func (t *tapConn) learn(ip netip.Addr, mac net.HardwareAddr) [][]byte {
+	t.neigh[ip] = append(net.HardwareAddr(nil), mac...)
+	q := t.pending[ip]
+	if q == nil {
+		return nil
+	}
+	delete(t.pending, ip)
+	return q.packets
+}
+
+// flush sends the packets that were waiting for mac.
+func (t *tapConn) flush(mac net.HardwareAddr, packets [][]byte) {
+	for _, pkt := range packets {
+		etherType := layers.EthernetTypeIPv4
+		if pkt[0]>>4 == 6 {
+			etherType = layers.EthernetTypeIPv6
+		}
+		if err := t.writeFrame(mac, etherType, pkt); err != nil {
+			logger.Warnf("tap: cannot send queued packet: %s", err)
+			return
+		}
+	}
+}
+
+// solicit sends an ARP request, or an IPv6 neighbor solicitation, for ip.
+func (t *tapConn) solicit(ip netip.Addr) error {
+	t.mu.Lock()
+	ip4, ip6 := t.ip4, t.ip6
+	t.mu.Unlock()
+	if ip.Is4() {
+		if !ip4.IsValid() {
+			return fmt.Errorf("%w: no ipv4 address", errBadInput)
+		}
+		return t.writeLayers(
+			&layers.Ethernet{SrcMAC: t.mac, DstMAC: broadcastMAC, EthernetType: layers.EthernetTypeARP},
+			&layers.ARP{
+				AddrType:          layers.LinkTypeEthernet,
+				Protocol:          layers.EthernetTypeIPv4,
+				HwAddressSize:     6,
+				ProtAddressSize:   4,
+				Operation:         layers.ARPRequest,
+				SourceHwAddress:   t.mac,
+				SourceProtAddress: ip4.AsSlice(),
+				DstHwAddress:      make([]byte, 6),
+				DstProtAddress:    ip.AsSlice(),
+			})
+	}
+	if !ip6.IsValid() {
+		return fmt.Errorf("%w: no ipv6 address", errBadInput)
+	}
+	// the solicited-node multicast address of ip.
+	a := ip.As16()
+	dst := netip.AddrFrom16([16]byte{0xff, 0x02, 10: 0, 11: 0x01, 12: 0xff, 13: a[13], 14: a[14], 15: a[15]})
+	ip6l := &layers.IPv6{Version: 6, HopLimit: 255, NextHeader: layers.IPProtocolICMPv6, SrcIP: ip6.AsSlice(), DstIP: dst.AsSlice()}
+	icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborSolicitation, 0)}
+	icmp.SetNetworkLayerForChecksum(ip6l)
+	return t.writeLayers(
+		&layers.Ethernet{SrcMAC: t.mac, DstMAC: t.multicastMAC(dst), EthernetType: layers.EthernetTypeIPv6},
+		ip6l, icmp,
+		&layers.ICMPv6NeighborSolicitation{
+			TargetAddress: ip.AsSlice(),
+			Options:       layers.ICMPv6Options{{Type: layers.ICMPv6OptSourceAddress, Data: t.mac}},
+		})
+}
+
+// handleARP learns the sender of ARP requests for us and of ARP replies,
+// and answers ARP requests for our IPv4 address.
+func (t *tapConn) handleARP(frame []byte) {
+	p := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.NoCopy)
+	arp, ok := p.Layer(layers.LayerTypeARP).(*layers.ARP)
+	if !ok || arp.Protocol != layers.EthernetTypeIPv4 || len(arp.SourceProtAddress) != 4 || len(arp.DstProtAddress) != 4 {
+		return
+	}
+	sender, _ := netip.AddrFromSlice(arp.SourceProtAddress)
+	target, _ := netip.AddrFromSlice(arp.DstProtAddress)
+	mac := net.HardwareAddr(arp.SourceHwAddress)
+
+	t.mu.Lock()
+	ours := t.ip4.IsValid() && target == t.ip4
+	var packets [][]byte
+	if ours || arp.Operation == layers.ARPReply {
+		packets = t.learn(sender, mac)
+	}
+	t.mu.Unlock()
+	t.flush(mac, packets)
+
+	if !ours || arp.Operation != layers.ARPRequest {
+		return
+	}
+	err := t.writeLayers(
+		&layers.Ethernet{SrcMAC: t.mac, DstMAC: mac, EthernetType: layers.EthernetTypeARP},
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPReply,
+			SourceHwAddress:   t.mac,
+			SourceProtAddress: target.AsSlice(),
+			DstHwAddress:      mac,
+			DstProtAddress:    sender.AsSlice(),
+		})
+	if err != nil {
+		logger.Warnf("tap: cannot send arp reply: %s", err)
+	}
+}
+
+// isNDP returns true if an IPv6 packet is a neighbor solicitation or
+// advertisement.
+func isNDP(pkt []byte) bool {
+	if len(pkt) < 41 || layers.IPProtocol(pkt[6]) != layers.IPProtocolICMPv6 {
+		return false
+	}
+	typ := pkt[40]
+	return typ == layers.ICMPv6TypeNeighborSolicitation || typ == layers.ICMPv6TypeNeighborAdvertisement
+}
+
+// handleNDP learns neighbors from solicitations and advertisements, and
+// answers the solicitations for our IPv6 address.
+func (t *tapConn) handleNDP(frame []byte) {
+	p := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.NoCopy)
+	ip6l, ok := p.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	if !ok {
+		return
+	}
+	eth := p.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if na, ok := p.Layer(layers.LayerTypeICMPv6NeighborAdvertisement).(*layers.ICMPv6NeighborAdvertisement); ok {
+		target, ok := netip.AddrFromSlice(na.TargetAddress)
+		if !ok {
+			return
+		}
+		mac := eth.SrcMAC
+		for _, o := range na.Options {
+			if o.Type == layers.ICMPv6OptTargetAddress && len(o.Data) == 6 {
+				mac = o.Data
+			}
+		}
+		t.mu.Lock()
+		packets := t.learn(target, mac)
+		t.mu.Unlock()
+		t.flush(mac, packets)
+		return
+	}
+	ns, ok := p.Layer(layers.LayerTypeICMPv6NeighborSolicitation).(*layers.ICMPv6NeighborSolicitation)
+	if !ok {
+		return
+	}
+	src, _ := netip.AddrFromSlice(ip6l.SrcIP)
+	target, _ := netip.AddrFromSlice(ns.TargetAddress)
+	t.mu.Lock()
+	ours := t.ip6.IsValid() && target == t.ip6
+	var packets [][]byte
+	if ours && !src.IsUnspecified() {
+		packets = t.learn(src, eth.SrcMAC)
+	}
+	t.mu.Unlock()
+	t.flush(eth.SrcMAC, packets)
+	if !ours || src.IsUnspecified() {
+		// not for us, or duplicate address detection.
+		return
+	}
+	reply := &layers.IPv6{Version: 6, HopLimit: 255, NextHeader: layers.IPProtocolICMPv6, SrcIP: target.AsSlice(), DstIP: src.AsSlice()}
+	icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborAdvertisement, 0)}
+	icmp.SetNetworkLayerForChecksum(reply)
+	err := t.writeLayers(
+		&layers.Ethernet{SrcMAC: t.mac, DstMAC: eth.SrcMAC, EthernetType: layers.EthernetTypeIPv6},
+		reply, icmp,
+		&layers.ICMPv6NeighborAdvertisement{
+			Flags:         0x60, // solicited, override
+			TargetAddress: target.AsSlice(),
+			Options:       layers.ICMPv6Options{{Type: layers.ICMPv6OptTargetAddress, Data: t.mac}},
+		})
+	if err != nil {
+		logger.Warnf("tap: cannot send neighbor advertisement: %s", err)
+	}
+}
+
+// writeFrame sends payload in an Ethernet frame to dst.
+func (t *tapConn) writeFrame(dst net.HardwareAddr, etherType layers.EthernetType, payload []byte) error {
+	frame := make([]byte, ethHeaderLen+len(payload))
+	copy(frame[0:6], dst)
+	copy(frame[6:12], t.mac)
+	binary.BigEndian.PutUint16(frame[12:14], uint16(etherType))
+	copy(frame[ethHeaderLen:], payload)
+	return t.write(frame)
+}
+
+// writeLayers serializes and sends a frame.
+func (t *tapConn) writeLayers(l ...gopacket.SerializableLayer) error {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+		return err
+	}
+	return t.write(buf.Bytes())
+}
+
+// write sends a frame; the netstack device and the read loop both write.
+func (t *tapConn) write(frame []byte) error {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	_, err := t.Conn.Write(frame)
+	return err
+}
+
+// isDHCPClientPacket returns true if an IPv4 packet is UDP to the DHCP
+// client port.
+func isDHCPClientPacket(pkt []byte) bool {
+	ihl := int(pkt[0]&0x0f) * 4
+	if layers.IPProtocol(pkt[9]) != layers.IPProtocolUDP || len(pkt) < ihl+8 {
+		return false
+	}
+	return binary.BigEndian.Uint16(pkt[ihl+2:ihl+4]) == 68
+}
+
+// handleDHCP passes a DHCP reply to runDHCP, if it is waiting for one.
+func (t *tapConn) handleDHCP(frame []byte) {
+	p := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	msg, ok := p.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
+	if !ok || msg.Operation != layers.DHCPOpReply {
+		return
+	}
+	t.mu.Lock()
+	ch := t.dhcp
+	t.mu.Unlock()
+	if ch == nil {
+		return
+	}
+	select {
+	case ch <- msg:
+	default:
+	}
+}
+
+// runDHCP gets an IPv4 address, netmask and gateway from a DHCP server on
+// the bridge, and configures them. It renews the lease in the background
+// until the tapConn is closed.
+func (t *tapConn) runDHCP(ctx context.Context) (*dhcpLease, error) {
+	ch := make(chan *layers.DHCPv4, 4)
+	t.mu.Lock()
+	t.dhcp = ch
+	t.mu.Unlock()
+
+	for attempt := 0; attempt < tapDHCPAttempts; attempt++ {
+		xid, err := randomFn(4)
+		if err != nil {
+			return nil, err
+		}
+		id := binary.BigEndian.Uint32(xid)
+		offer, err := t.dhcpExchange(ctx, ch, id, layers.DHCPMsgTypeDiscover, netip.Addr{}, nil,
+			layers.DHCPMsgTypeOffer)
+		if errors.Is(err, errDHCPTimeout) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		server := dhcpOption(offer, layers.DHCPOptServerID)
+		ack, err := t.dhcpExchange(ctx, ch, id, layers.DHCPMsgTypeRequest, netip.Addr{},
+			[]layers.DHCPOption{
+				layers.NewDHCPOption(layers.DHCPOptRequestIP, offer.YourClientIP.To4()),
+				layers.NewDHCPOption(layers.DHCPOptServerID, server),
+			},
+			layers.DHCPMsgTypeAck, layers.DHCPMsgTypeNak)
+		if errors.Is(err, errDHCPTimeout) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if dhcpMessageType(ack) == layers.DHCPMsgTypeNak {
+			continue
+		}
+		lease, err := newDHCPLease(ack)
+		if err != nil {
+			return nil, err
+		}
+		t.setLease(lease)
+		logger.Infof("tap: dhcp lease %s via %s", lease.prefix, lease.router)
+		go t.renewLoop(ch, lease)
+		return lease, nil
+	}
+	return nil, fmt.Errorf("%w: no reply from a dhcp server", errDHCP)
+}
+
+// renewLoop renews the lease at half its time, until the tapConn is closed
+// or the lease cannot be renewed anymore.
+func (t *tapConn) renewLoop(ch chan *layers.DHCPv4, lease *dhcpLease) {
+	for lease.time > 0 {
+		select {
+		case <-time.After(lease.time / 2):
+		case <-t.done:
+			return
+		}
+		xid, err := randomFn(4)
+		if err != nil {
+			return
+		}
+		ack, err := t.dhcpExchange(context.Background(), ch, binary.BigEndian.Uint32(xid),
+			layers.DHCPMsgTypeRequest, lease.ip, nil, layers.DHCPMsgTypeAck, layers.DHCPMsgTypeNak)
+		if err != nil || dhcpMessageType(ack) == layers.DHCPMsgTypeNak {
+			logger.Warnf("tap: cannot renew the dhcp lease for %s", lease.ip)
+			return
+		}
+		if renewed, err := newDHCPLease(ack); err == nil && renewed.ip == lease.ip {
+			lease.time = renewed.time
+		}
+	}
+}
+
+// setLease configures the addresses from a DHCP lease.
+func (t *tapConn) setLease(lease *dhcpLease) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ip4, t.net4 = lease.ip, lease.prefix.Masked()
+	if lease.router.IsValid() {
+		t.gw4 = lease.router
+	}
+}
+
+// dhcpExchange broadcasts a DHCP message, and waits for a reply with the
+// same transaction id and one of the wanted types.
+func (t *tapConn) dhcpExchange(ctx context.Context, ch chan *layers.DHCPv4, xid uint32,
+	typ layers.DHCPMsgType, ciaddr netip.Addr, opts []layers.DHCPOption, want ...layers.DHCPMsgType) (*layers.DHCPv4, error) {
+	if err := t.sendDHCP(xid, typ, ciaddr, opts); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(tapDHCPTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case msg := <-ch:
+			if msg.Xid != xid {
+				continue
+			}
+			got := dhcpMessageType(msg)
+			for _, w := range want {
+				if got == w {
+					return msg, nil
+				}
+			}
+		case <-timer.C:
+			return nil, errDHCPTimeout
+		case <-t.done:
+			return nil, net.ErrClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// sendDHCP broadcasts a DHCP message of the given type. ciaddr is our
+// address when renewing a lease, and the zero address otherwise.
+func (t *tapConn) sendDHCP(xid uint32, typ layers.DHCPMsgType, ciaddr netip.Addr, opts []layers.DHCPOption) error {
+	src := net.IPv4zero.To4()
+	if ciaddr.IsValid() {
+		src = ciaddr.AsSlice()
+	}
+	msg := &layers.DHCPv4{
+		Operation:    layers.DHCPOpRequest,
+		HardwareType: layers.LinkTypeEthernet,
+		HardwareLen:  6,
+		Xid:          xid,
+		Flags:        0x8000, // ask for broadcast replies
+		ClientIP:     src,
+		ClientHWAddr: t.mac,
+		Options: append([]layers.DHCPOption{
+			layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(typ)}),
+			layers.NewDHCPOption(layers.DHCPOptParamsRequest, []byte{
+				byte(layers.DHCPOptSubnetMask),
+				byte(layers.DHCPOptRouter),
+				byte(layers.DHCPOptLeaseTime),
+			}),
+		}, opts...),
+	}
+	for msg.Len() < dhcpMinLen {
+		msg.Options = append(msg.Options, layers.DHCPOption{Type: layers.DHCPOptPad})
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: src, DstIP: net.IPv4bcast.To4()}
+	udp := &layers.UDP{SrcPort: 68, DstPort: 67}
+	udp.SetNetworkLayerForChecksum(ip)
+	return t.writeLayers(
+		&layers.Ethernet{SrcMAC: t.mac, DstMAC: broadcastMAC, EthernetType: layers.EthernetTypeIPv4},
+		ip, udp, msg)
+}
+
+// dhcpOption returns the data of an option in a DHCP message, or nil.
+func dhcpOption(msg *layers.DHCPv4, typ layers.DHCPOpt) []byte {
+	for _, o := range msg.Options {
+		if o.Type == typ {
+			return o.Data
+		}
+	}
+	return nil
+}
+
+// dhcpMessageType returns the type of a DHCP message.
+func dhcpMessageType(msg *layers.DHCPv4) layers.DHCPMsgType {
+	if d := dhcpOption(msg, layers.DHCPOptMessageType); len(d) == 1 {
+		return layers.DHCPMsgType(d[0])
+	}
+	return layers.DHCPMsgTypeUnspecified
+}
+
+// newDHCPLease returns the lease in a DHCP ack.
+func newDHCPLease(ack *layers.DHCPv4) (*dhcpLease, error) {
+	ip, ok := netip.AddrFromSlice(ack.YourClientIP.To4())
+	if !ok || ip.IsUnspecified() {
+		return nil, fmt.Errorf("%w: no address in the dhcp ack", errDHCP)
+	}
+	lease := &dhcpLease{ip: ip, prefix: netip.PrefixFrom(ip, 32)}
+	if m := dhcpOption(ack, layers.DHCPOptSubnetMask); len(m) == 4 {
+		if ones, bits := net.IPMask(m).Size(); bits != 0 {
+			lease.prefix = netip.PrefixFrom(ip, ones)
+		}
+	}
+	if r := dhcpOption(ack, layers.DHCPOptRouter); len(r) >= 4 {
+		lease.router, _ = netip.AddrFromSlice(r[:4])
+	}
+	if l := dhcpOption(ack, layers.DHCPOptLeaseTime); len(l) == 4 {
+		lease.time = time.Duration(binary.BigEndian.Uint32(l)) * time.Second
+	}
+	return lease, nil
+}
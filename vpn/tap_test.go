@@ -0,0 +1,394 @@
+package vpn
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// tapTestMuxer is a muxer that exchanges Ethernet frames over channels:
+// the test writes into rx the frames that the client reads, and reads from
+// tx the frames that the client writes.
+type tapTestMuxer struct {
+	muxer
+	rx chan []byte
+	tx chan []byte
+}
+
+func (m *tapTestMuxer) Read(b []byte) (int, error) {
+	f, ok := <-m.rx
+	if !ok {
+		return 0, net.ErrClosed
+	}
+	return copy(b, f), nil
+}
+
+func (m *tapTestMuxer) Write(b []byte) (int, error) {
+	m.tx <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+// next returns the next frame that the client wrote.
+func (m *tapTestMuxer) next(t *testing.T) gopacket.Packet {
+	t.Helper()
+	select {
+	case f := <-m.tx:
+		return gopacket.NewPacket(f, layers.LayerTypeEthernet, gopacket.Default)
+	case <-time.After(time.Second):
+		t.Fatal("no frame written")
+	}
+	return nil
+}
+
+// send serializes a frame for the client to read.
+func (m *tapTestMuxer) send(t *testing.T, l ...gopacket.SerializableLayer) {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+		t.Fatal(err)
+	}
+	m.rx <- buf.Bytes()
+}
+
+func makeTestingTapClient(ti *tunnelInfo) (*Client, *tapTestMuxer) {
+	mux := &tapTestMuxer{rx: make(chan []byte, 16), tx: make(chan []byte, 16)}
+	c := &Client{Opts: &Options{DevType: devTypeTAP}, mux: mux, tunInfo: ti}
+	return c, mux
+}
+
+func makeTestingTapConn(t *testing.T, ti *tunnelInfo) (*tapConn, *tapTestMuxer) {
+	useRealRandomFn()
+	c, mux := makeTestingTapClient(ti)
+	tap, err := newTapConn(c, ti)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { close(mux.rx) })
+	return tap, mux
+}
+
+var gatewayMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01}
+
+func makeTestingIPv4Packet(t *testing.T, src, dst string) []byte {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP,
+		SrcIP: net.ParseIP(src).To4(), DstIP: net.ParseIP(dst).To4()}
+	udp := &layers.UDP{SrcPort: 4000, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(ip)
+	if err := gopacket.SerializeLayers(buf, opts, ip, udp, gopacket.Payload("hello")); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func Test_tapConn_resolvesTheGateway(t *testing.T) {
+	tap, mux := makeTestingTapConn(t, &tunnelInfo{ip: "10.8.0.4", netmask: "255.255.255.0", routeGw: "10.8.0.1"})
+	pkt := makeTestingIPv4Packet(t, "10.8.0.4", "1.1.1.1")
+	if _, err := tap.Write(pkt); err != nil {
+		t.Fatal(err)
+	}
+
+	arp, ok := mux.next(t).Layer(layers.LayerTypeARP).(*layers.ARP)
+	if !ok || arp.Operation != layers.ARPRequest || !net.IP(arp.DstProtAddress).Equal(net.ParseIP("10.8.0.1")) {
+		t.Fatalf("expected an arp request for the gateway, got %+v", arp)
+	}
+	mux.send(t,
+		&layers.Ethernet{SrcMAC: gatewayMAC, DstMAC: tap.mac, EthernetType: layers.EthernetTypeARP},
+		&layers.ARP{AddrType: layers.LinkTypeEthernet, Protocol: layers.EthernetTypeIPv4,
+			HwAddressSize: 6, ProtAddressSize: 4, Operation: layers.ARPReply,
+			SourceHwAddress: gatewayMAC, SourceProtAddress: net.ParseIP("10.8.0.1").To4(),
+			DstHwAddress: tap.mac, DstProtAddress: net.ParseIP("10.8.0.4").To4()})
+
+	// the packet was held until the reply.
+	frame := mux.next(t)
+	eth := frame.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if !bytes.Equal(eth.DstMAC, gatewayMAC) || !bytes.Equal(eth.SrcMAC, tap.mac) {
+		t.Errorf("queued packet sent from %v to %v", eth.SrcMAC, eth.DstMAC)
+	}
+	if !bytes.Equal(eth.Payload, pkt) {
+		t.Errorf("queued packet changed")
+	}
+
+	// the next one goes at once, and on-link hosts are resolved directly.
+	tap.Write(pkt)
+	if eth := mux.next(t).Layer(layers.LayerTypeEthernet).(*layers.Ethernet); !bytes.Equal(eth.DstMAC, gatewayMAC) {
+		t.Errorf("second packet sent to %v", eth.DstMAC)
+	}
+	tap.Write(makeTestingIPv4Packet(t, "10.8.0.4", "10.8.0.9"))
+	arp, ok = mux.next(t).Layer(layers.LayerTypeARP).(*layers.ARP)
+	if !ok || !net.IP(arp.DstProtAddress).Equal(net.ParseIP("10.8.0.9")) {
+		t.Errorf("expected an arp request for the on-link host, got %+v", arp)
+	}
+}
+
+func Test_tapConn_answersARP(t *testing.T) {
+	tap, mux := makeTestingTapConn(t, &tunnelInfo{ip: "10.8.0.4", netmask: "255.255.255.0"})
+	mux.send(t,
+		&layers.Ethernet{SrcMAC: gatewayMAC, DstMAC: broadcastMAC, EthernetType: layers.EthernetTypeARP},
+		&layers.ARP{AddrType: layers.LinkTypeEthernet, Protocol: layers.EthernetTypeIPv4,
+			HwAddressSize: 6, ProtAddressSize: 4, Operation: layers.ARPRequest,
+			SourceHwAddress: gatewayMAC, SourceProtAddress: net.ParseIP("10.8.0.1").To4(),
+			DstHwAddress: make([]byte, 6), DstProtAddress: net.ParseIP("10.8.0.4").To4()})
+	arp, ok := mux.next(t).Layer(layers.LayerTypeARP).(*layers.ARP)
+	if !ok || arp.Operation != layers.ARPReply || !bytes.Equal(arp.SourceHwAddress, tap.mac) ||
+		!bytes.Equal(arp.DstHwAddress, gatewayMAC) {
+		t.Fatalf("expected an arp reply, got %+v", arp)
+	}
+	// the asker was learned.
+	tap.Write(makeTestingIPv4Packet(t, "10.8.0.4", "10.8.0.1"))
+	if eth := mux.next(t).Layer(layers.LayerTypeEthernet).(*layers.Ethernet); !bytes.Equal(eth.DstMAC, gatewayMAC) {
+		t.Errorf("packet sent to %v", eth.DstMAC)
+	}
+}
+
+func Test_tapConn_Read(t *testing.T) {
+	tap, mux := makeTestingTapConn(t, &tunnelInfo{ip: "10.8.0.4", netmask: "255.255.255.0"})
+	pkt := makeTestingIPv4Packet(t, "10.8.0.1", "10.8.0.4")
+
+	other := append(append(append([]byte{}, gatewayMAC...), gatewayMAC...), 0x08, 0x00)
+	mux.rx <- append(other, pkt...)
+	ours := append(append(append([]byte{}, tap.mac...), gatewayMAC...), 0x08, 0x00)
+	// short frames are padded.
+	mux.rx <- append(append(ours, pkt...), make([]byte, 8)...)
+
+	b := make([]byte, 1500)
+	n, err := tap.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b[:n], pkt) {
+		t.Errorf("Read() = %x, want %x", b[:n], pkt)
+	}
+}
+
+func Test_tapConn_NDP(t *testing.T) {
+	tap, mux := makeTestingTapConn(t, &tunnelInfo{ip6: "fd00::4/64", gw6: "fd00::1"})
+	src := net.ParseIP("fd00::1")
+	ip6 := &layers.IPv6{Version: 6, HopLimit: 255, NextHeader: layers.IPProtocolICMPv6, SrcIP: src, DstIP: net.ParseIP("ff02::1:ff00:4")}
+	icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborSolicitation, 0)}
+	icmp.SetNetworkLayerForChecksum(ip6)
+	mux.send(t,
+		&layers.Ethernet{SrcMAC: gatewayMAC, DstMAC: net.HardwareAddr{0x33, 0x33, 0xff, 0, 0, 0x04}, EthernetType: layers.EthernetTypeIPv6},
+		ip6, icmp,
+		&layers.ICMPv6NeighborSolicitation{TargetAddress: net.ParseIP("fd00::4")})
+
+	frame := mux.next(t)
+	na, ok := frame.Layer(layers.LayerTypeICMPv6NeighborAdvertisement).(*layers.ICMPv6NeighborAdvertisement)
+	if !ok || !na.TargetAddress.Equal(net.ParseIP("fd00::4")) || !na.Solicited() {
+		t.Fatalf("expected a neighbor advertisement, got %v", frame)
+	}
+	if len(na.Options) != 1 || !bytes.Equal(na.Options[0].Data, tap.mac) {
+		t.Errorf("neighbor advertisement options = %v", na.Options)
+	}
+
+	// off-link destinations go through the gateway, that is now known.
+	buf := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		&layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolNoNextHeader,
+			SrcIP: net.ParseIP("fd00::4"), DstIP: net.ParseIP("2001:db8::1")})
+	tap.Write(buf.Bytes())
+	if eth := mux.next(t).Layer(layers.LayerTypeEthernet).(*layers.Ethernet); !bytes.Equal(eth.DstMAC, gatewayMAC) {
+		t.Errorf("packet sent to %v", eth.DstMAC)
+	}
+
+	// on-link ones are solicited.
+	buf = gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		&layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolNoNextHeader,
+			SrcIP: net.ParseIP("fd00::4"), DstIP: net.ParseIP("fd00::9")})
+	tap.Write(buf.Bytes())
+	frame = mux.next(t)
+	ns, ok := frame.Layer(layers.LayerTypeICMPv6NeighborSolicitation).(*layers.ICMPv6NeighborSolicitation)
+	if !ok || !ns.TargetAddress.Equal(net.ParseIP("fd00::9")) {
+		t.Fatalf("expected a neighbor solicitation, got %v", frame)
+	}
+	if ip := frame.Layer(layers.LayerTypeIPv6).(*layers.IPv6); !ip.DstIP.Equal(net.ParseIP("ff02::1:ff00:9")) {
+		t.Errorf("neighbor solicitation sent to %v", ip.DstIP)
+	}
+}
+
+func Test_tapConn_multicastMAC(t *testing.T) {
+	tap := &tapConn{net4: netip.MustParsePrefix("10.8.0.0/24")}
+	tests := []struct {
+		dst  string
+		want net.HardwareAddr
+	}{
+		{"255.255.255.255", broadcastMAC},
+		{"10.8.0.255", broadcastMAC},
+		{"224.0.0.251", net.HardwareAddr{0x01, 0x00, 0x5e, 0x00, 0x00, 0xfb}},
+		{"ff02::1", net.HardwareAddr{0x33, 0x33, 0, 0, 0, 0x01}},
+		{"10.8.0.1", nil},
+		{"10.9.0.255", nil},
+	}
+	for _, tt := range tests {
+		if got := tap.multicastMAC(netip.MustParseAddr(tt.dst)); !bytes.Equal(got, tt.want) {
+			t.Errorf("multicastMAC(%s) = %v, want %v", tt.dst, got, tt.want)
+		}
+	}
+}
+
+func Test_tapConn_setAddresses(t *testing.T) {
+	bad := []*tunnelInfo{
+		{ip: "foo"},
+		{ip: "fd00::4"},
+		{ip: "10.8.0.4", routeGw: "bar"},
+		{ip6: "fd00::4"},
+		{ip6: "fd00::4/64", gw6: "10.8.0.1"},
+	}
+	for _, ti := range bad {
+		if err := (&tapConn{}).setAddresses(ti); !errors.Is(err, errBadInput) {
+			t.Errorf("setAddresses(%+v): want %v, got %v", ti, errBadInput, err)
+		}
+	}
+}
+
+// serveDHCP answers a discover and a request from the client, giving it
+// 10.8.0.50/24 via 10.8.0.1.
+func serveDHCP(t *testing.T, mux *tapTestMuxer) {
+	t.Helper()
+	server := net.ParseIP("10.8.0.1").To4()
+	for _, reply := range []layers.DHCPMsgType{layers.DHCPMsgTypeOffer, layers.DHCPMsgTypeAck} {
+		msg, ok := mux.next(t).Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4)
+		if !ok {
+			t.Fatal("expected a dhcp message")
+		}
+		if msg.Len() < dhcpMinLen {
+			t.Errorf("dhcp message is %d bytes long", msg.Len())
+		}
+		if reply == layers.DHCPMsgTypeAck {
+			if ip := dhcpOption(msg, layers.DHCPOptRequestIP); !net.IP(ip).Equal(net.ParseIP("10.8.0.50")) {
+				t.Errorf("dhcp request for %v", net.IP(ip))
+			}
+		}
+		lease := make([]byte, 4)
+		binary.BigEndian.PutUint32(lease, 3600)
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: server, DstIP: net.IPv4bcast.To4()}
+		udp := &layers.UDP{SrcPort: 67, DstPort: 68}
+		udp.SetNetworkLayerForChecksum(ip)
+		mux.send(t,
+			&layers.Ethernet{SrcMAC: gatewayMAC, DstMAC: broadcastMAC, EthernetType: layers.EthernetTypeIPv4},
+			ip, udp,
+			&layers.DHCPv4{Operation: layers.DHCPOpReply, HardwareType: layers.LinkTypeEthernet, HardwareLen: 6,
+				Xid: msg.Xid, YourClientIP: net.ParseIP("10.8.0.50").To4(), ClientHWAddr: msg.ClientHWAddr,
+				Options: layers.DHCPOptions{
+					layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(reply)}),
+					layers.NewDHCPOption(layers.DHCPOptServerID, server),
+					layers.NewDHCPOption(layers.DHCPOptSubnetMask, []byte{255, 255, 255, 0}),
+					layers.NewDHCPOption(layers.DHCPOptRouter, server),
+					layers.NewDHCPOption(layers.DHCPOptLeaseTime, lease),
+				}})
+	}
+}
+
+func TestTunDialer_tapWithDHCP(t *testing.T) {
+	useRealRandomFn()
+	c, mux := makeTestingTapClient(&tunnelInfo{mtu: 1532})
+	defer close(mux.rx)
+	td := &TunDialer{client: c, ns1: "10.8.0.1", ns2: "10.8.0.1", skipDeviceSetup: true}
+	errch := make(chan error)
+	go func() {
+		_, err := td.createNetTUN(context.Background())
+		errch <- err
+	}()
+	serveDHCP(t, mux)
+	if err := <-errch; err != nil {
+		t.Fatalf("createNetTUN(): %v", err)
+	}
+	if got := c.LocalAddr().String(); got != "10.8.0.50" {
+		t.Errorf("LocalAddr() = %v, want 10.8.0.50", got)
+	}
+	if c.tunInfo.gw != "10.8.0.1" || c.tunInfo.netmask != "255.255.255.0" {
+		t.Errorf("tunnel info = %+v", c.tunInfo)
+	}
+}
+
+func Test_tapConn_runDHCPContext(t *testing.T) {
+	tap, _ := makeTestingTapConn(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := tap.runDHCP(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("runDHCP(): want %v, got %v", context.Canceled, err)
+	}
+}
+
+func Test_newDHCPLease(t *testing.T) {
+	if _, err := newDHCPLease(&layers.DHCPv4{YourClientIP: net.IPv4zero}); !errors.Is(err, errDHCP) {
+		t.Errorf("newDHCPLease(): want %v, got %v", errDHCP, err)
+	}
+	lease, err := newDHCPLease(&layers.DHCPv4{YourClientIP: net.ParseIP("192.168.1.20"), Options: layers.DHCPOptions{
+		layers.NewDHCPOption(layers.DHCPOptSubnetMask, []byte{255, 255, 0, 0}),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.prefix.String() != "192.168.1.20/16" || lease.router.IsValid() || lease.time != 0 {
+		t.Errorf("newDHCPLease() = %+v", lease)
+	}
+}
+
+func TestOptions_StringTap(t *testing.T) {
+	o := &Options{Cipher: "AES-256-CBC", Auth: "SHA1", Proto: UDPMode, DevType: devTypeTAP}
+	want := "V4,dev-type tap,link-mtu 1581,tun-mtu 1532,proto UDPv4,cipher AES-256-CBC,auth SHA1,keysize 256,key-method 2,tls-client"
+	if got := o.String(); got != want {
+		t.Errorf("String() = %v, want %v", got, want)
+	}
+}
+
+func Test_getOptionsFromLines_dev(t *testing.T) {
+	tests := []struct {
+		lines []string
+		want  string
+	}{
+		{[]string{"dev tun"}, devTypeTUN},
+		{[]string{"dev tap0"}, devTypeTAP},
+		{[]string{"dev tap0", "dev-type tun"}, devTypeTUN},
+		{[]string{"dev-type tap", "dev mybridge"}, devTypeTAP},
+		{[]string{"dev-type tap", "dev tun0"}, devTypeTAP},
+	}
+	for _, tt := range tests {
+		o, err := getOptionsFromLines(tt.lines, t.TempDir())
+		if err != nil {
+			t.Fatalf("getOptionsFromLines(%v): unexpected error %v", tt.lines, err)
+		}
+		if o.DevType != tt.want {
+			t.Errorf("getOptionsFromLines(%v): DevType = %v, want %v", tt.lines, o.DevType, tt.want)
+		}
+	}
+	for _, p := range [][]string{{}, {"tun", "tap"}} {
+		if err := parseDev(p, &Options{}); !errors.Is(err, errBadCfg) {
+			t.Errorf("parseDev(%v): want %v, got %v", p, errBadCfg, err)
+		}
+	}
+	for _, p := range [][]string{{}, {"null"}, {"tun", "tap"}} {
+		if err := parseDevType(p, &Options{}); !errors.Is(err, errBadCfg) {
+			t.Errorf("parseDevType(%v): want %v, got %v", p, errBadCfg, err)
+		}
+	}
+}
+
+func Test_newTunnelInfoFromPushedOptions_tap(t *testing.T) {
+	ti := newTunnelInfoFromPushedOptions(map[string][]string{
+		"ifconfig":      {"10.8.0.4", "255.255.255.0"},
+		"route-gateway": {"10.8.0.1"},
+		"ifconfig-ipv6": {"fd00::4/64", "fd00::1"},
+	})
+	want := &tunnelInfo{ip: "10.8.0.4", netmask: "255.255.255.0", gw: "10.8.0.1", routeGw: "10.8.0.1", ip6: "fd00::4/64", gw6: "fd00::1"}
+	if *ti != *want {
+		t.Errorf("newTunnelInfoFromPushedOptions() = %+v, want %+v", ti, want)
+	}
+	// the peer address of net30 is not a netmask.
+	if ti := newTunnelInfoFromPushedOptions(map[string][]string{"ifconfig": {"10.8.0.6", "10.8.0.5"}}); ti.netmask != "" {
+		t.Errorf("newTunnelInfoFromPushedOptions(): netmask = %v", ti.netmask)
+	}
+}
@@ -11,6 +11,7 @@ package vpn
 import (
 	"crypto/x509"
 	"encoding/hex"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -149,7 +150,38 @@ func newCertConfigFromOptions(o *Options) (*certConfig, error) {
 			ta:   o.Ta,
 		})
 	}
-	return cfg, err
+	if err != nil {
+		return nil, err
+	}
+	extra := o.ExtraCerts
+	if o.ExtraCertsPath != "" {
+		if extra, err = ioutil.ReadFile(o.ExtraCertsPath); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrBadKeypair, err)
+		}
+	}
+	if err := appendExtraCerts(&cfg.cert, extra); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// appendExtraCerts appends the PEM certificates in b to the chain that we
+// send with the client certificate.
+func appendExtraCerts(cert *tls.Certificate, b []byte) error {
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return fmt.Errorf("%w: bad extra cert: %s", ErrBadKeypair, err)
+		}
+		cert.Certificate = append(cert.Certificate, block.Bytes)
+	}
 }
 
 func parseTAFromBytes(taBytes []byte) ([]byte, error) {
@@ -166,6 +198,15 @@ func loadTAFromFile(taPath string) ([]byte, error) {
 	return parseTAFromLines(lines)
 }
 
+const (
+	staticKeyHeader = "-----BEGIN OpenVPN Static key V1-----"
+	staticKeyFooter = "-----END OpenVPN Static key V1-----"
+)
+
+// parseTAFromLines parses an "OpenVPN Static key V1" file, the format of both
+// the tls-auth keys and the static keys (secret), and returns the hex text of
+// the key block. Comments and lines outside of the block are ignored. It
+// returns nothing if there is no block.
 func parseTAFromLines(lines []string) ([]byte, error) {
 	const (
 		initState = iota
@@ -176,17 +217,18 @@ func parseTAFromLines(lines []string) ([]byte, error) {
 	e := fmt.Errorf("invalid tls-auth key")
 	var res []byte
 	for _, line := range lines {
+		line = strings.TrimSpace(line)
 		if strings.HasPrefix(line, "#") {
 			continue
 		}
-		if strings.Contains(line, "BEGIN") {
+		if line == staticKeyHeader {
 			if state != initState {
 				return nil, e
 			}
 			state = beginState
 			continue
 		}
-		if strings.Contains(line, "END") {
+		if line == staticKeyFooter {
 			if state != beginState {
 				return nil, e
 			}
@@ -201,6 +243,9 @@ func parseTAFromLines(lines []string) ([]byte, error) {
 			break
 		}
 	}
+	if state == beginState {
+		return nil, e
+	}
 	return res, nil
 }
 
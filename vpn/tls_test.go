@@ -469,6 +469,24 @@ func Test_loadCertAndCAFromBytes(t *testing.T) {
 	})
 }
 
+func Test_parseTAFromLines(t *testing.T) {
+	lines := []string{"# comment", staticKeyHeader + "\r", "00ff\r", "# 2048 bit", "ee11", staticKeyFooter, "trailer"}
+	got, err := parseTAFromLines(lines)
+	if err != nil {
+		t.Fatalf("parseTAFromLines(): unexpected error %v", err)
+	}
+	if string(got) != "00ffee11" {
+		t.Errorf("parseTAFromLines() = %q, want %q", got, "00ffee11")
+	}
+	// no key at all is fine for tls-auth, that is optional.
+	if got, err := parseTAFromLines([]string{""}); err != nil || len(got) != 0 {
+		t.Errorf("parseTAFromLines(empty) = %q, %v", got, err)
+	}
+	if _, err := parseTAFromLines([]string{staticKeyHeader, "00ff"}); err == nil {
+		t.Errorf("parseTAFromLines(): expected error with an unclosed block")
+	}
+}
+
 func Test_initTLSLoadTestCertificates(t *testing.T) {
 
 	t.Run("default options should not fail", func(t *testing.T) {
@@ -0,0 +1,221 @@
+package vpn
+
+//
+// Outer TLS session for the TCP connection to the remote (stunnel-style),
+// with uTLS fingerprints.
+//
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// tlsPinPrefix is the prefix of a pin: the base64 sha256 digest of the
+// SubjectPublicKeyInfo of a certificate, as in curl --pinnedpubkey.
+const tlsPinPrefix = "sha256//"
+
+var (
+	// ErrBadFingerprint is returned when the requested TLS fingerprint is
+	// not known.
+	ErrBadFingerprint = errors.New("unknown tls fingerprint")
+
+	// ErrPinMismatch is returned when the certificate of the server does
+	// not match the configured pins.
+	ErrPinMismatch = errors.New("the server certificate does not match the pins")
+)
+
+// utlsFingerprints maps the fingerprint names that can be used in the config
+// to the uTLS presets.
+var utlsFingerprints = map[string]tls.ClientHelloID{
+	"golang":     tls.HelloGolang,
+	"chrome":     tls.HelloChrome_Auto,
+	"firefox":    tls.HelloFirefox_Auto,
+	"safari":     tls.HelloSafari_Auto,
+	"ios":        tls.HelloIOS_Auto,
+	"edge":       tls.HelloEdge_Auto,
+	"randomized": tls.HelloRandomized,
+}
+
+// utlsClient returns an uTLS client for the given conn, that parrots the
+// named fingerprint (the Go TLS stack if empty). If alpn is not empty, it
+// replaces the ALPN protocols offered by the preset.
+func utlsClient(conn net.Conn, config *tls.Config, fingerprint string, alpn []string) (*tls.UConn, error) {
+	if fingerprint == "" {
+		fingerprint = "golang"
+	}
+	id, ok := utlsFingerprints[fingerprint]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrBadFingerprint, fingerprint)
+	}
+	config = config.Clone()
+	if len(alpn) != 0 {
+		config.NextProtos = alpn
+	}
+	if id == tls.HelloGolang {
+		return tls.UClient(conn, config, id), nil
+	}
+	spec, err := tls.UTLSIdToSpec(id)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadParrot, err)
+	}
+	if len(alpn) != 0 {
+		for _, ext := range spec.Extensions {
+			if e, ok := ext.(*tls.ALPNExtension); ok {
+				e.AlpnProtocols = alpn
+			}
+		}
+	}
+	client := tls.UClient(conn, config, tls.HelloCustom)
+	if err := client.ApplyPreset(&spec); err != nil {
+		return nil, fmt.Errorf("%w: cannot apply spec: %s", ErrBadParrot, err)
+	}
+	return client, nil
+}
+
+// TLSDialer is a DialerContext that wraps the TCP connection to the remote in
+// an outer TLS session, as expected by stunnel or sslh frontends. The OpenVPN
+// TLS session then runs inside it. Only TCP is supported.
+type TLSDialer struct {
+	// ServerName is sent in the SNI extension, and used to verify the
+	// certificate. If empty, the host of the dialed address is used.
+	ServerName string
+	// ALPN is the list of protocols offered. If empty, the ones of the
+	// fingerprint preset are kept.
+	ALPN []string
+	// Fingerprint is the uTLS preset for the ClientHello (golang, chrome,
+	// firefox, safari, ios, edge or randomized). The Go TLS stack is used if
+	// empty.
+	Fingerprint string
+	// Pins are sha256//<base64> digests of the SubjectPublicKeyInfo of
+	// certificates. If set, the certificate chain is not verified against
+	// the roots; instead, the leaf certificate sent by the server must
+	// match a pin. The other certificates of the chain are ignored, since
+	// anyone can send them.
+	Pins []string
+	// TLSConfig is the base TLS configuration. If nil, the default
+	// configuration (with the system roots) is used.
+	TLSConfig *tls.Config
+	// Dialer is used to connect to the remote. If nil, a net.Dialer is used.
+	Dialer DialerContext
+}
+
+// NewTLSDialerFromOptions returns a TLSDialer configured from the proxy-tls,
+// proxy-tls-alpn and proxy-tls-pin options, that uses the passed dialer to
+// reach the remote.
+func NewTLSDialerFromOptions(o *Options, dialer DialerContext) *TLSDialer {
+	return &TLSDialer{
+		ServerName:  o.ProxyTLSServerName,
+		ALPN:        o.ProxyTLSALPN,
+		Fingerprint: o.ProxyTLSFingerprint,
+		Pins:        o.ProxyTLSPins,
+		Dialer:      dialer,
+	}
+}
+
+// DialContext connects to the address and performs the outer TLS handshake.
+func (d *TLSDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("%w: proxy-tls cannot carry %s", ErrProxyNetwork, network)
+	}
+	config, err := d.config(address)
+	if err != nil {
+		return nil, err
+	}
+	dialer := d.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	client, err := utlsClient(conn, config, d.Fingerprint, d.ALPN)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := client.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %s", ErrBadTLSHandshake, err)
+	}
+	return client, nil
+}
+
+// config returns the TLS configuration for a connection to address.
+func (d *TLSDialer) config(address string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if d.TLSConfig != nil {
+		config = d.TLSConfig.Clone()
+	}
+	if d.ServerName != "" {
+		config.ServerName = d.ServerName
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errBadInput, err)
+		}
+		config.ServerName = host
+	}
+	if len(d.Pins) == 0 {
+		return config, nil
+	}
+	pins := make([][]byte, 0, len(d.Pins))
+	for _, p := range d.Pins {
+		pin, err := parseTLSPin(p)
+		if err != nil {
+			return nil, err
+		}
+		pins = append(pins, pin)
+	}
+	config.InsecureSkipVerify = true // #nosec G402 -- the pins are checked below
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		return verifyTLSPins(rawCerts, pins)
+	}
+	return config, nil
+}
+
+// parseTLSPin decodes a sha256//<base64> pin.
+func parseTLSPin(s string) ([]byte, error) {
+	if !strings.HasPrefix(s, tlsPinPrefix) {
+		return nil, fmt.Errorf("%w: pin must start with %s", errBadInput, tlsPinPrefix)
+	}
+	pin, err := base64.StdEncoding.DecodeString(s[len(tlsPinPrefix):])
+	if err != nil || len(pin) != sha256.Size {
+		return nil, fmt.Errorf("%w: bad pin: %s", errBadInput, s)
+	}
+	return pin, nil
+}
+
+// verifyTLSPins returns nil if the public key of the leaf certificate
+// matches one of the pins. Only the leaf is checked: the handshake proves
+// that the server holds its key, while the rest of the chain is not verified.
+func verifyTLSPins(rawCerts [][]byte, pins [][]byte) error {
+	if len(rawCerts) == 0 {
+		return ErrPinMismatch
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if subtle.ConstantTimeCompare(digest[:], pin) == 1 {
+			return nil
+		}
+	}
+	return ErrPinMismatch
+}
+
+var _ DialerContext = &TLSDialer{} // Ensure that we implement DialerContext
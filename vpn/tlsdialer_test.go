@@ -0,0 +1,237 @@
+package vpn
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	stdtls "crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// startTLSEchoServer starts a TLS echo server with a self-signed cert for
+// stunnel.example.com and 127.0.0.1. It returns the address, the cert, and a
+// channel with the ALPN protocol negotiated for each connection.
+func startTLSEchoServer(t *testing.T) (string, *x509.Certificate, chan string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "stunnel.example.com"},
+		DNSNames:              []string{"stunnel.example.com"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	config := &stdtls.Config{
+		Certificates: []stdtls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{"h2", "http/1.1", "openvpn"},
+	}
+	ln, err := stdtls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	alpn := make(chan string, 10)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				tc := c.(*stdtls.Conn)
+				if err := tc.Handshake(); err != nil {
+					return
+				}
+				alpn <- tc.ConnectionState().NegotiatedProtocol
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().String(), cert, alpn
+}
+
+// startTLSServerWithChain starts a TLS server with a new self-signed leaf,
+// followed by the passed certificates in the chain it sends. It returns the
+// address.
+func startTLSServerWithChain(t *testing.T, extra ...[]byte) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "mitm.example.com"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &stdtls.Config{
+		Certificates: []stdtls.Certificate{{Certificate: append([][]byte{der}, extra...), PrivateKey: key}},
+	}
+	ln, err := stdtls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.(*stdtls.Conn).Handshake()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func tlsPinFor(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return tlsPinPrefix + base64.StdEncoding.EncodeToString(digest[:])
+}
+
+func TestTLSDialer_DialContext(t *testing.T) {
+	addr, cert, alpn := startTLSEchoServer(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	for _, fp := range []string{"", "chrome", "firefox"} {
+		t.Run("sni and alpn with fingerprint "+fp, func(t *testing.T) {
+			d := &TLSDialer{
+				ServerName:  "stunnel.example.com",
+				ALPN:        []string{"openvpn"},
+				Fingerprint: fp,
+				TLSConfig:   &tls.Config{RootCAs: pool},
+			}
+			conn, err := d.DialContext(context.Background(), "tcp", addr)
+			if err != nil {
+				t.Fatalf("DialContext() error = %v", err)
+			}
+			defer conn.Close()
+			if conn.LocalAddr().Network() != "tcp" {
+				t.Errorf("LocalAddr(): network = %v, want tcp", conn.LocalAddr().Network())
+			}
+			assertEcho(t, conn)
+			if got := <-alpn; got != "openvpn" {
+				t.Errorf("negotiated protocol = %v, want openvpn", got)
+			}
+		})
+	}
+
+	t.Run("server name defaults to the remote host", func(t *testing.T) {
+		d := &TLSDialer{TLSConfig: &tls.Config{RootCAs: pool}}
+		conn, err := d.DialContext(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatalf("DialContext() error = %v", err)
+		}
+		defer conn.Close()
+		assertEcho(t, conn)
+	})
+
+	t.Run("untrusted cert", func(t *testing.T) {
+		d := &TLSDialer{ServerName: "stunnel.example.com"}
+		_, err := d.DialContext(context.Background(), "tcp", addr)
+		if !errors.Is(err, ErrBadTLSHandshake) {
+			t.Errorf("DialContext(): want %v, got %v", ErrBadTLSHandshake, err)
+		}
+	})
+
+	t.Run("pinned cert needs no roots", func(t *testing.T) {
+		d := &TLSDialer{ServerName: "other.example.com", Pins: []string{tlsPinFor(cert)}}
+		conn, err := d.DialContext(context.Background(), "tcp", addr)
+		if err != nil {
+			t.Fatalf("DialContext() error = %v", err)
+		}
+		defer conn.Close()
+		assertEcho(t, conn)
+	})
+
+	t.Run("pin mismatch", func(t *testing.T) {
+		other := tlsPinPrefix + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+		d := &TLSDialer{Pins: []string{other}}
+		_, err := d.DialContext(context.Background(), "tcp", addr)
+		if !errors.Is(err, ErrBadTLSHandshake) || !strings.Contains(err.Error(), ErrPinMismatch.Error()) {
+			t.Errorf("DialContext(): want pin mismatch, got %v", err)
+		}
+	})
+
+	t.Run("pinned cert after another leaf", func(t *testing.T) {
+		mitm := startTLSServerWithChain(t, cert.Raw)
+		d := &TLSDialer{Pins: []string{tlsPinFor(cert)}}
+		_, err := d.DialContext(context.Background(), "tcp", mitm)
+		if !errors.Is(err, ErrBadTLSHandshake) || !strings.Contains(err.Error(), ErrPinMismatch.Error()) {
+			t.Errorf("DialContext(): want pin mismatch, got %v", err)
+		}
+	})
+
+	t.Run("bad pin", func(t *testing.T) {
+		d := &TLSDialer{Pins: []string{"sha1//AAAA"}}
+		_, err := d.DialContext(context.Background(), "tcp", addr)
+		if !errors.Is(err, errBadInput) {
+			t.Errorf("DialContext(): want %v, got %v", errBadInput, err)
+		}
+	})
+
+	t.Run("unknown fingerprint", func(t *testing.T) {
+		d := &TLSDialer{Fingerprint: "netscape"}
+		_, err := d.DialContext(context.Background(), "tcp", addr)
+		if !errors.Is(err, ErrBadFingerprint) {
+			t.Errorf("DialContext(): want %v, got %v", ErrBadFingerprint, err)
+		}
+	})
+
+	t.Run("udp is not supported", func(t *testing.T) {
+		d := &TLSDialer{}
+		_, err := d.DialContext(context.Background(), "udp", addr)
+		if !errors.Is(err, ErrProxyNetwork) {
+			t.Errorf("DialContext(): want %v, got %v", ErrProxyNetwork, err)
+		}
+	})
+}
+
+func Test_parseTLSPin(t *testing.T) {
+	good := tlsPinPrefix + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	if _, err := parseTLSPin(good); err != nil {
+		t.Errorf("parseTLSPin(%v): unexpected error %v", good, err)
+	}
+	for _, bad := range []string{"", "AAAA", "sha256//AAAA", "sha256//!!", "sha1//" + good[len(tlsPinPrefix):]} {
+		if _, err := parseTLSPin(bad); !errors.Is(err, errBadInput) {
+			t.Errorf("parseTLSPin(%v): want %v, got %v", bad, errBadInput, err)
+		}
+	}
+}
@@ -28,6 +28,23 @@ var (
 	ErrPacketTooShort = errors.New("packet too short")
 )
 
+const (
+	// defaultTLSMTU is the default tls-mtu: the largest control packet
+	// that we send, without the TCP size frame. minTLSMTU is the smallest
+	// one that we accept, like the reference implementation.
+	defaultTLSMTU = 1250
+	minTLSMTU     = 512
+
+	// controlPacketOverhead is what a P_CONTROL_V1 packet adds to the TLS
+	// data: the opcode, the session id, the tls-auth hmac, packet id and
+	// time, an empty ack array, and the message packet id.
+	controlPacketOverhead = 1 + 8 + 20 + 4 + 4 + 1 + 4
+
+	// resetACKOverhead is what the first control packet adds to it, to
+	// ack the server hard reset: a packet id and the remote session id.
+	resetACKOverhead = 4 + 8
+)
+
 // direct reads on the underlying conn
 
 func readPacket(conn net.Conn) ([]byte, error) {
@@ -144,13 +161,26 @@ func (t *tlsTransport) WritePacket(opcodeKeyID uint8, data []byte) error {
 	if err != nil {
 		return err
 	}
+	// every control packet is a reliable message of its own, with the
+	// next message packet id.
+	msgID, err := t.session.LocalMessageID()
+	if err != nil {
+		return err
+	}
 	p := newPacketFromPayload(opcodeKeyID, 0, data)
 	p.localSessionID = t.session.LocalSessionID
 	p.id = id
 
 	out := append([]byte{0x20}, t.session.LocalSessionID[:]...)
 
-	ackBytes := []byte{0, 0, 0, 0, 1}
+	ackBytes := []byte{0}
+	if resetID, ok := t.session.takeResetACK(); ok {
+		// the first control packet acks the server hard reset, and
+		// echoes its session id.
+		ackBytes = binary.BigEndian.AppendUint32([]byte{1}, uint32(resetID))
+		ackBytes = append(ackBytes, t.session.RemoteSessionID[:]...)
+	}
+	ackBytes = binary.BigEndian.AppendUint32(ackBytes, uint32(msgID))
 	timestamp := uint32(time.Now().Unix())
 	timeBytes := binary.BigEndian.AppendUint32(nil, timestamp)
 	packetIDBytes := binary.BigEndian.AppendUint32(nil, uint32(p.id))
@@ -190,6 +220,9 @@ type controlChannelTLSConn struct {
 	// we need to buffer reads because the tls records request less than
 	// the payload we receive.
 	bufReader *bytes.Buffer
+	// mtu is the tls-mtu: writes are split in control packets that are
+	// not larger than this. Zero means defaultTLSMTU.
+	mtu int
 
 	doReadFromConnFn  func(*controlChannelTLSConn, []byte) (bool, int, error)
 	doReadFromQueueFn func(*controlChannelTLSConn, []byte) (bool, int, error)
@@ -222,6 +255,11 @@ func (c *controlChannelTLSConn) Read(b []byte) (int, error) {
 	if c.session == nil || c.session.ackQueue == nil {
 		return 0, fmt.Errorf("%w: %s", errBadInput, "bad session in TLSConn.Read()")
 	}
+	// what is left of the last control packet comes first: the next
+	// packet might only arrive after we answer.
+	if c.bufReader != nil && c.bufReader.Len() > 0 {
+		return c.bufReader.Read(b)
+	}
 	for {
 		switch len(c.session.ackQueue) {
 		case 0:
@@ -302,14 +340,33 @@ func writeAndReadFromBuffer(bb *bytes.Buffer, b []byte, payload []byte) (int, er
 
 var writeAndReadFromBufferFn = writeAndReadFromBuffer
 
-// Write writes the given data to the tls connection.
+// Write writes the given data to the tls connection, split in control
+// packets that fit in the tls-mtu.
 func (c *controlChannelTLSConn) Write(b []byte) (int, error) {
-	err := c.transport.WritePacket(uint8(pControlV1), b)
-	if err != nil {
-		logger.Errorf("tls write: %s", err.Error())
-		return 0, err
+	size := c.maxPayload()
+	for off := 0; off < len(b); off += size {
+		end := off + size
+		if end > len(b) {
+			end = len(b)
+		}
+		if err := c.transport.WritePacket(uint8(pControlV1), b[off:end]); err != nil {
+			logger.Errorf("tls write: %s", err.Error())
+			return off, err
+		}
+	}
+	return len(b), nil
+}
+
+// maxPayload returns how much TLS data fits in a control packet.
+func (c *controlChannelTLSConn) maxPayload() int {
+	mtu := c.mtu
+	if mtu == 0 {
+		mtu = defaultTLSMTU
+	}
+	if c.session != nil && c.session.hasResetACK() {
+		mtu -= resetACKOverhead
 	}
-	return len(b), err
+	return mtu - controlPacketOverhead
 }
 
 // Close closes the tls connection.
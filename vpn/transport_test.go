@@ -645,3 +645,106 @@ func TestTLSConn_Write(t *testing.T) {
 		t.Errorf("TLSConn.Write(): written = %v, want = %v", c.written, want)
 	}
 }
+
+func TestTLSConn_Write_Fragments(t *testing.T) {
+	tr, conn := makeTestingTLSTransportWithDefaultPacketPayload()
+	var written [][]byte
+	conn.MockWrite = func(b []byte) (int, error) {
+		written = append(written, append([]byte(nil), b...))
+		return len(b), nil
+	}
+	tc := &controlChannelTLSConn{conn: conn, session: tr.session, transport: tr, mtu: minTLSMTU}
+
+	data := bytes.Repeat([]byte("0123456789"), 120)
+	n, err := tc.Write(data)
+	if err != nil || n != len(data) {
+		t.Fatalf("TLSConn.Write() = %d, %v, want %d", n, err, len(data))
+	}
+	// 470 + 470 + 260 bytes of tls data.
+	if len(written) != 3 {
+		t.Fatalf("TLSConn.Write(): got %d packets, want 3", len(written))
+	}
+	var got []byte
+	for i, p := range written {
+		if len(p) > minTLSMTU {
+			t.Errorf("packet %d: %d bytes, larger than the tls-mtu", i, len(p))
+		}
+		// the message packet ids follow each other, after the hard reset.
+		msgID := p[controlPacketOverhead-4 : controlPacketOverhead]
+		if want := []byte{0, 0, 0, byte(i + 1)}; !bytes.Equal(msgID, want) {
+			t.Errorf("packet %d: message id %x, want %x", i, msgID, want)
+		}
+		got = append(got, p[controlPacketOverhead:]...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("TLSConn.Write(): the packets do not add up to the data")
+	}
+}
+
+func TestTLSConn_Read_Buffered(t *testing.T) {
+	tc, _ := makeTestingTLSConn()
+	tc.session = makeTestingSession()
+	tc.session.ackQueue = make(chan *packet, 16)
+	tc.bufReader = bytes.NewBuffer(nil)
+	tc.doReadFromConnFn = func(*controlChannelTLSConn, []byte) (bool, int, error) {
+		t.Fatal("TLSConn.Read(): read from conn with buffered data")
+		return true, 0, nil
+	}
+	tc.bufReader.WriteString("leftover")
+	b := make([]byte, 4)
+	for _, want := range []string{"left", "over"} {
+		n, err := tc.Read(b)
+		if err != nil || string(b[:n]) != want {
+			t.Errorf("TLSConn.Read() = %q, %v, want %q", b[:n], err, want)
+		}
+	}
+}
+
+func Test_parseTLSMTU(t *testing.T) {
+	o := &Options{}
+	if err := parseTLSMTU([]string{"1400"}, o); err != nil || o.TLSMTU != 1400 {
+		t.Errorf("parseTLSMTU() = %d, %v, want 1400", o.TLSMTU, err)
+	}
+	for _, p := range [][]string{{}, {"small"}, {"511"}, {"70000"}, {"1400", "1"}} {
+		if err := parseTLSMTU(p, &Options{}); !errors.Is(err, errBadCfg) {
+			t.Errorf("parseTLSMTU(%v): want %v, got %v", p, errBadCfg, err)
+		}
+	}
+}
+
+func TestTLSConn_Write_ResetACK(t *testing.T) {
+	tr, conn := makeTestingTLSTransportWithDefaultPacketPayload()
+	var written [][]byte
+	conn.MockWrite = func(b []byte) (int, error) {
+		written = append(written, append([]byte(nil), b...))
+		return len(b), nil
+	}
+	tr.session.RemoteSessionID = sessionID{1, 2, 3, 4, 5, 6, 7, 8}
+	tr.session.setResetACK(0)
+	tc := &controlChannelTLSConn{conn: conn, session: tr.session, transport: tr, mtu: minTLSMTU}
+
+	data := bytes.Repeat([]byte("0123456789"), 60)
+	if _, err := tc.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if len(written) != 2 {
+		t.Fatalf("TLSConn.Write(): got %d packets, want 2", len(written))
+	}
+	// the first packet acks the server hard reset and echoes its session id.
+	first := written[0]
+	if len(first) != minTLSMTU {
+		t.Errorf("first packet: %d bytes, want %d", len(first), minTLSMTU)
+	}
+	acks := first[37 : 37+1+resetACKOverhead]
+	want := append([]byte{1, 0, 0, 0, 0}, tr.session.RemoteSessionID[:]...)
+	if !bytes.Equal(acks, want) {
+		t.Errorf("first packet: acks %x, want %x", acks, want)
+	}
+	if got := written[1][37]; got != 0 {
+		t.Errorf("second packet: %d acks, want none", got)
+	}
+	got := append(first[controlPacketOverhead+resetACKOverhead:], written[1][controlPacketOverhead:]...)
+	if !bytes.Equal(got, data) {
+		t.Error("TLSConn.Write(): the packets do not add up to the data")
+	}
+}
@@ -0,0 +1,253 @@
+package vpn
+
+//
+// WebSocket transport for the outer connection, and the matching bridge
+// handler.
+//
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	tls "github.com/refraction-networking/utls"
+)
+
+// WebSocketDialer is a DialerContext that connects to the remote through a
+// websocket relay. Each write on the returned conn is sent as a binary
+// websocket message. The relay is expected to forward the stream to the
+// OpenVPN gateway, so the address passed to DialContext is ignored. Only TCP
+// is supported.
+type WebSocketDialer struct {
+	// URL is the ws:// or wss:// url of the relay, including the path.
+	URL string
+	// Host, if set, is sent as the Host header instead of the url host. The
+	// TLS server name is still taken from the url (or from TLSConfig).
+	Host string
+	// Fingerprint is the uTLS preset used for wss:// (golang, chrome,
+	// firefox, safari, ios, edge or randomized). The Go TLS stack is used if
+	// empty.
+	Fingerprint string
+	// TLSConfig is the TLS configuration for wss://. If nil, the default
+	// configuration is used.
+	TLSConfig *tls.Config
+	// Dialer is used to connect to the relay. If nil, a net.Dialer is used.
+	Dialer DialerContext
+}
+
+// NewWebSocketDialerFromOptions returns a WebSocketDialer configured from the
+// proxy-websocket and proxy-websocket-host options, that uses the passed
+// dialer to reach the relay.
+func NewWebSocketDialerFromOptions(o *Options, dialer DialerContext) *WebSocketDialer {
+	return &WebSocketDialer{
+		URL:         o.ProxyWebSocket,
+		Host:        o.ProxyWebSocketHost,
+		Fingerprint: o.ProxyWebSocketFingerprint,
+		Dialer:      dialer,
+	}
+}
+
+// DialContext opens the websocket, and returns it as a net.Conn.
+func (d *WebSocketDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("%w: proxy-websocket cannot carry %s", ErrProxyNetwork, network)
+	}
+	u, err := url.Parse(d.URL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errBadInput, err)
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("%w: expected ws:// or wss:// url", errBadInput)
+	}
+	dialer := d.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	wsDialer := &websocket.Dialer{
+		NetDialContext: dialer.DialContext,
+		NetDialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return d.dialTLS(ctx, dialer, network, addr, u.Hostname())
+		},
+	}
+	header := http.Header{}
+	if d.Host != "" {
+		header.Set("Host", d.Host)
+	}
+	ws, resp, err := wsDialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		// errors from our own TLS dial are returned as they are.
+		for _, e := range []error{ErrBadFingerprint, ErrBadParrot, ErrBadTLSHandshake} {
+			if errors.Is(err, e) {
+				return nil, err
+			}
+		}
+		if resp != nil {
+			return nil, fmt.Errorf("%w: websocket relay says: %s", ErrProxy, resp.Status)
+		}
+		return nil, fmt.Errorf("%w: %s", ErrProxy, err)
+	}
+	return newWSConn(ws), nil
+}
+
+// dialTLS connects to the relay, and performs the TLS handshake with the
+// configured fingerprint. HTTP/1.1 is the only ALPN protocol offered, since
+// the websocket upgrade needs it.
+func (d *WebSocketDialer) dialTLS(ctx context.Context, dialer DialerContext, network, addr, serverName string) (net.Conn, error) {
+	config := d.TLSConfig
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = serverName
+	}
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	client, err := utlsClient(conn, config, d.Fingerprint, []string{"http/1.1"})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := client.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %s", ErrBadTLSHandshake, err)
+	}
+	return client, nil
+}
+
+// wsConn is a net.Conn over a websocket, where the stream is carried in
+// binary messages. LocalAddr returns the address of the underlying TCP conn,
+// so that the OpenVPN framing remains the one for TCP.
+type wsConn struct {
+	*websocket.Conn
+
+	// r is the reader for the current message, if any.
+	r io.Reader
+	// wmu serializes writes, since the websocket allows only one writer.
+	wmu sync.Mutex
+}
+
+// newWSConn returns a net.Conn for the given websocket.
+func newWSConn(ws *websocket.Conn) *wsConn {
+	return &wsConn{Conn: ws}
+}
+
+// Read reads from the current binary message, moving to the next one when
+// it is exhausted. Other message types are skipped.
+func (c *wsConn) Read(b []byte) (int, error) {
+	for {
+		if c.r == nil {
+			typ, r, err := c.Conn.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if typ != websocket.BinaryMessage {
+				continue
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(b)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Write sends the passed bytes as a binary message.
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.Conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// SetDeadline sets both the read and write deadlines.
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.Conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// Close sends a close message, and closes the underlying conn.
+func (c *wsConn) Close() error {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	c.Conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	return c.Conn.Close()
+}
+
+// WebSocketHandler is an http.Handler that accepts the websockets opened by
+// a WebSocketDialer, and forwards each of them to an OpenVPN endpoint. Since
+// websockets carry a stream, the endpoint must use proto tcp.
+type WebSocketHandler struct {
+	// Forward is the host:port of the OpenVPN endpoint.
+	Forward string
+	// Dialer is used to connect to Forward. If nil, a net.Dialer is used.
+	Dialer DialerContext
+	// Upgrader is used to accept the websockets. The zero value is fine
+	// for clients that do not send an Origin header.
+	Upgrader websocket.Upgrader
+}
+
+// ServeHTTP connects to the endpoint, upgrades the request, and copies data
+// in both directions until either side is done.
+func (h *WebSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dialer := h.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	upstream, err := dialer.DialContext(r.Context(), "tcp", h.Forward)
+	if err != nil {
+		log.Printf("websocket: cannot reach %s: %s", h.Forward, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	ws, err := h.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already replied with an error.
+		return
+	}
+	conn := newWSConn(ws)
+	defer conn.Close()
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// isWebSocketURL returns true if the passed string is a ws:// or wss:// url.
+func isWebSocketURL(s string) bool {
+	return strings.HasPrefix(s, "ws://") || strings.HasPrefix(s, "wss://")
+}
+
+var _ DialerContext = &WebSocketDialer{} // Ensure that we implement DialerContext
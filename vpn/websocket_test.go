@@ -0,0 +1,118 @@
+package vpn
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// startWebSocketRelay starts a relay that forwards to the given address, and
+// records the Host header of the last request.
+func startWebSocketRelay(t *testing.T, forward string, useTLS bool) (*httptest.Server, *string) {
+	host := new(string)
+	h := &WebSocketHandler{Forward: forward}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*host = r.Host
+		h.ServeHTTP(w, r)
+	}))
+	if useTLS {
+		srv.StartTLS()
+	} else {
+		srv.Start()
+	}
+	t.Cleanup(srv.Close)
+	return srv, host
+}
+
+func TestWebSocketDialer_DialContext(t *testing.T) {
+	echo := startEchoServer(t)
+
+	t.Run("ws with host header", func(t *testing.T) {
+		srv, host := startWebSocketRelay(t, echo, false)
+		d := &WebSocketDialer{
+			URL:  "ws://" + srv.Listener.Addr().String() + "/vpn",
+			Host: "cdn.example.com",
+		}
+		conn, err := d.DialContext(context.Background(), "tcp", "10.0.0.1:1194")
+		if err != nil {
+			t.Fatalf("DialContext() error = %v", err)
+		}
+		defer conn.Close()
+		if conn.LocalAddr().Network() != "tcp" {
+			t.Errorf("LocalAddr(): network = %v, want tcp", conn.LocalAddr().Network())
+		}
+		assertEcho(t, conn)
+		assertEcho(t, conn)
+		if *host != "cdn.example.com" {
+			t.Errorf("relay got Host %v, want cdn.example.com", *host)
+		}
+	})
+
+	for _, fp := range []string{"", "golang", "chrome", "firefox"} {
+		t.Run("wss with fingerprint "+fp, func(t *testing.T) {
+			srv, _ := startWebSocketRelay(t, echo, true)
+			pool := x509.NewCertPool()
+			pool.AddCert(srv.Certificate())
+			d := &WebSocketDialer{
+				URL:         "wss://" + srv.Listener.Addr().String() + "/vpn",
+				Fingerprint: fp,
+				TLSConfig:   &tls.Config{RootCAs: pool},
+			}
+			conn, err := d.DialContext(context.Background(), "tcp", "10.0.0.1:1194")
+			if err != nil {
+				t.Fatalf("DialContext() error = %v", err)
+			}
+			defer conn.Close()
+			assertEcho(t, conn)
+		})
+	}
+
+	t.Run("wss with an untrusted cert", func(t *testing.T) {
+		srv, _ := startWebSocketRelay(t, echo, true)
+		d := &WebSocketDialer{URL: "wss://" + srv.Listener.Addr().String() + "/vpn"}
+		_, err := d.DialContext(context.Background(), "tcp", "10.0.0.1:1194")
+		if !errors.Is(err, ErrBadTLSHandshake) {
+			t.Errorf("DialContext(): want %v, got %v", ErrBadTLSHandshake, err)
+		}
+	})
+
+	t.Run("unknown fingerprint", func(t *testing.T) {
+		srv, _ := startWebSocketRelay(t, echo, true)
+		d := &WebSocketDialer{URL: "wss://" + srv.Listener.Addr().String(), Fingerprint: "netscape"}
+		_, err := d.DialContext(context.Background(), "tcp", "10.0.0.1:1194")
+		if !errors.Is(err, ErrBadFingerprint) {
+			t.Errorf("DialContext(): want %v, got %v", ErrBadFingerprint, err)
+		}
+	})
+
+	t.Run("relay cannot reach the endpoint", func(t *testing.T) {
+		srv, _ := startWebSocketRelay(t, "127.0.0.1:1", false)
+		d := &WebSocketDialer{URL: "ws://" + srv.Listener.Addr().String()}
+		_, err := d.DialContext(context.Background(), "tcp", "10.0.0.1:1194")
+		if !errors.Is(err, ErrProxy) || !strings.Contains(err.Error(), "502") {
+			t.Errorf("DialContext(): want %v with 502, got %v", ErrProxy, err)
+		}
+	})
+
+	t.Run("bad url", func(t *testing.T) {
+		d := &WebSocketDialer{URL: "http://127.0.0.1:1"}
+		_, err := d.DialContext(context.Background(), "tcp", "10.0.0.1:1194")
+		if !errors.Is(err, errBadInput) {
+			t.Errorf("DialContext(): want %v, got %v", errBadInput, err)
+		}
+	})
+
+	t.Run("udp is not supported", func(t *testing.T) {
+		d := &WebSocketDialer{URL: "ws://127.0.0.1:1"}
+		_, err := d.DialContext(context.Background(), "udp", "10.0.0.1:1194")
+		if !errors.Is(err, ErrProxyNetwork) {
+			t.Errorf("DialContext(): want %v, got %v", ErrProxyNetwork, err)
+		}
+	})
+}